@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin guards admin endpoints with the ADMIN_TOKEN bearer token.
+// Admin endpoints are disabled when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg().adminToken == "" {
+			http.Error(w, "Admin endpoints are disabled", http.StatusNotFound)
+			return
+		}
+
+		if !adminAuthorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminAuthorized reports whether r carries the ADMIN_TOKEN bearer token
+func adminAuthorized(r *http.Request) bool {
+	if cfg().adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg().adminToken)) == 1
+}
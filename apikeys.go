@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Routes that don't need an API key: probes and scrapes, and the admin
+// endpoints, which have ADMIN_TOKEN
+var authExempt = map[string]bool{"/health": true, "/readyz": true, "/metrics": true}
+
+// Errors from managing keys
+var (
+	errKeyExists   = errors.New("an API key with this name exists")
+	errKeyNotFound = errors.New("no such API key")
+	errKeyStatic   = errors.New("keys from API_KEYS are revoked by removing them from the configuration")
+)
+
+// APIKey describes a client key. The key itself is only known to the
+// client; the bridge keeps its SHA-256 hash.
+type APIKey struct {
+	Name               string    `json:"name"`
+	Hash               string    `json:"sha256"`
+	CreatedAt          time.Time `json:"created_at"`
+	RateLimitPerMinute int       `json:"rate_limit_per_minute,omitempty"` // 0 = RATE_LIMIT_PER_MINUTE
+	DefaultModel       string    `json:"default_model,omitempty"`         // model or alias when the request names none
+	Static             bool      `json:"-"`                               // from API_KEYS
+}
+
+// keyStore holds the keys from API_KEYS and those created through
+// /admin/keys. Created keys are saved to API_KEYS_FILE when it is set.
+type keyStore struct {
+	mu      sync.RWMutex
+	byHash  map[string]*APIKey
+	created []*APIKey // in creation order, as saved
+	static  []*APIKey
+	path    string
+}
+
+// API keys, set up by apply and main
+var apiKeys = &keyStore{byHash: make(map[string]*APIKey)}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// enabled reports whether requests need a key. A key file turns
+// authentication on even while it is empty, so no request gets through
+// until the first key is created.
+func (s *keyStore) enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.path != "" || len(s.byHash) > 0
+}
+
+// lookup returns the key whose hash matches key
+func (s *keyStore) lookup(key string) (*APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.byHash[hashAPIKey(key)]
+	return k, ok
+}
+
+// setStatic replaces the keys from API_KEYS
+func (s *keyStore) setStatic(keys []*APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.static = keys
+	s.reindex()
+}
+
+// reindex rebuilds byHash. Called with mu held.
+func (s *keyStore) reindex() {
+	s.byHash = make(map[string]*APIKey, len(s.static)+len(s.created))
+	for _, k := range s.created {
+		s.byHash[k.Hash] = k
+	}
+	for _, k := range s.static {
+		s.byHash[k.Hash] = k
+	}
+}
+
+// load reads the keys saved at path and saves created keys there from now
+// on. A missing file is an empty one.
+func (s *keyStore) load(path string) error {
+	var keys []*APIKey
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &keys)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("API_KEYS_FILE: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	s.created = keys
+	s.reindex()
+	return nil
+}
+
+// list returns all keys, sorted by name
+func (s *keyStore) list() []*APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]*APIKey, 0, len(s.byHash))
+	for _, k := range s.byHash {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b *APIKey) int { return strings.Compare(a.Name, b.Name) })
+	return keys
+}
+
+// create makes a key named name and returns it with its secret, which
+// isn't stored
+func (s *keyStore) create(name string, rateLimit int, defaultModel string) (*APIKey, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	key := "sk-" + hex.EncodeToString(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.byHash {
+		if k.Name == name {
+			return nil, "", errKeyExists
+		}
+	}
+	k := &APIKey{Name: name, Hash: hashAPIKey(key), CreatedAt: time.Now().UTC(), RateLimitPerMinute: rateLimit, DefaultModel: defaultModel}
+	created := append(slices.Clip(s.created), k)
+	if err := s.save(created); err != nil {
+		return nil, "", err
+	}
+	s.created = created
+	s.reindex()
+	return k, key, nil
+}
+
+// revoke deletes the created key named name
+func (s *keyStore) revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.ContainsFunc(s.static, func(k *APIKey) bool { return k.Name == name }) {
+		return errKeyStatic
+	}
+	i := slices.IndexFunc(s.created, func(k *APIKey) bool { return k.Name == name })
+	if i < 0 {
+		return errKeyNotFound
+	}
+	created := slices.Delete(slices.Clone(s.created), i, i+1)
+	if err := s.save(created); err != nil {
+		return err
+	}
+	s.created = created
+	s.reindex()
+	return nil
+}
+
+// save writes keys to the key file, if there is one, through a temp file
+// so a crash can't leave it half written. Called with mu held.
+func (s *keyStore) save(keys []*APIKey) error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".apikeys-*")
+	if err != nil {
+		return fmt.Errorf("failed to save API keys: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save API keys: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save API keys: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to save API keys: %w", err)
+	}
+	return nil
+}
+
+// parseAPIKeys parses API_KEYS, e.g. "team-a=sk-123,team-b=sk-456", the
+// per-key limits of API_KEY_RATE_LIMITS and the per-key default models of
+// API_KEY_MODELS
+func parseAPIKeys(value, limits, models string) ([]*APIKey, error) {
+	rateLimits, err := parseWeights(limits)
+	if err != nil {
+		return nil, fmt.Errorf("API_KEY_RATE_LIMITS: %w", err)
+	}
+	defaultModels, err := parseKeyModels(models)
+	if err != nil {
+		return nil, fmt.Errorf("API_KEY_MODELS: %w", err)
+	}
+	var keys []*APIKey
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(entry, "=")
+		name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("API_KEYS: invalid entry (expected name=key)")
+		}
+		if names[name] {
+			return nil, fmt.Errorf("API_KEYS: %q is given twice", name)
+		}
+		names[name] = true
+		keys = append(keys, &APIKey{Name: name, Hash: hashAPIKey(key), RateLimitPerMinute: rateLimits[name], DefaultModel: defaultModels[name], Static: true})
+	}
+	for name := range rateLimits {
+		if !names[name] {
+			return nil, fmt.Errorf("API_KEY_RATE_LIMITS: %q is not in API_KEYS", name)
+		}
+	}
+	for name := range defaultModels {
+		if !names[name] {
+			return nil, fmt.Errorf("API_KEY_MODELS: %q is not in API_KEYS", name)
+		}
+	}
+	return keys, nil
+}
+
+// parseKeyModels parses API_KEY_MODELS, e.g. "team-a=fast,team-b=mistral"
+func parseKeyModels(value string) (map[string]string, error) {
+	models := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, model, ok := strings.Cut(entry, "=")
+		name, model = strings.TrimSpace(name), strings.TrimSpace(model)
+		if !ok || name == "" || model == "" {
+			return nil, fmt.Errorf("invalid entry %q (expected name=model)", entry)
+		}
+		models[name] = model
+	}
+	return models, nil
+}
+
+// requestCredential returns the API key or JWT a request presents in
+// X-API-Key or as a bearer token. WebSocket clients in browsers can't set
+// headers, so /ws/stream also takes an api_key query parameter.
+func requestCredential(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if r.URL.Path == "/ws/stream" {
+		return r.URL.Query().Get("api_key")
+	}
+	return ""
+}
+
+// redactedURI is the request URI with the value of an api_key query
+// parameter hidden, for logging
+func redactedURI(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has("api_key") {
+		return r.RequestURI
+	}
+	query.Set("api_key", "REDACTED")
+	return r.URL.Path + "?" + query.Encode()
+}
+
+func keyName(k *APIKey) string {
+	if k == nil {
+		return ""
+	}
+	return k.Name
+}
+
+// authMiddleware requires a valid API key or JWT on the data endpoints of
+// mux once either is configured. The key or the token's claims are kept in
+// the request trace, where rate limiting, fair queuing and the access log
+// find them.
+func authMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if !(apiKeys.enabled() || cfg().jwtEnabled()) || authExempt[route] || strings.HasPrefix(route, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		credential := requestCredential(r)
+		if cfg().jwtEnabled() && looksLikeJWT(credential) {
+			claims, err := verifyJWT(r.Context(), credential)
+			if errors.Is(err, errJWKSUnavailable) {
+				log.Printf("Can't verify bearer token: %v request_id=%s", err, requestIDFromContext(r.Context()))
+				writeAuthError(w, r, http.StatusServiceUnavailable, "bearer tokens can't be verified right now")
+				return
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="whisper-llm-bridge", error="invalid_token"`)
+				writeAuthError(w, r, http.StatusUnauthorized, "invalid bearer token: "+err.Error())
+				return
+			}
+			traceFromContext(r.Context()).claims = claims
+			tokenRequests.add(1, claims.Tenant)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := apiKeys.lookup(credential)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="whisper-llm-bridge"`)
+			message := "a valid API key is required in the X-API-Key header"
+			if cfg().jwtEnabled() {
+				message = "a valid bearer token is required in the Authorization header"
+			}
+			writeAuthError(w, r, http.StatusUnauthorized, message)
+			return
+		}
+		traceFromContext(r.Context()).apiKey = key
+		apiKeyRequests.add(1, key.Name)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAuthError refuses a request, with an OpenAI-style error on /v1/
+// routes
+func writeAuthError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		errType := "invalid_request_error"
+		if status >= 500 {
+			errType = "server_error"
+		}
+		writeOpenAIError(w, status, errType, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// APIKeyRequest is the body of POST /admin/keys
+type APIKeyRequest struct {
+	Name               string `json:"name"`
+	RateLimitPerMinute int    `json:"rate_limit_per_minute"`
+	DefaultModel       string `json:"default_model"`
+}
+
+// APIKeyResponse describes a key. Key is only set when it is created.
+type APIKeyResponse struct {
+	Name               string     `json:"name"`
+	Key                string     `json:"key,omitempty"`
+	CreatedAt          *time.Time `json:"created_at,omitempty"`
+	RateLimitPerMinute int        `json:"rate_limit_per_minute,omitempty"`
+	DefaultModel       string     `json:"default_model,omitempty"`
+	Static             bool       `json:"static,omitempty"`
+}
+
+func newAPIKeyResponse(k *APIKey) APIKeyResponse {
+	resp := APIKeyResponse{Name: k.Name, RateLimitPerMinute: k.RateLimitPerMinute, DefaultModel: k.DefaultModel, Static: k.Static}
+	if !k.CreatedAt.IsZero() {
+		resp.CreatedAt = &k.CreatedAt
+	}
+	return resp
+}
+
+// keysHandler lists keys on GET and creates one on POST
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		keys := []APIKeyResponse{}
+		for _, k := range apiKeys.list() {
+			keys = append(keys, newAPIKeyResponse(k))
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+	case http.MethodPost:
+		var req APIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to parse JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || strings.ContainsAny(req.Name, ",=") {
+			http.Error(w, "name is required and may not contain commas or equals signs", http.StatusBadRequest)
+			return
+		}
+		if req.RateLimitPerMinute < 0 {
+			http.Error(w, "rate_limit_per_minute must not be negative", http.StatusBadRequest)
+			return
+		}
+		req.DefaultModel = strings.TrimSpace(req.DefaultModel)
+		if req.DefaultModel != "" {
+			if _, err := resolveModel(req.DefaultModel); err != nil {
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		k, key, err := apiKeys.create(req.Name, req.RateLimitPerMinute, req.DefaultModel)
+		if errors.Is(err, errKeyExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		resp := newAPIKeyResponse(k)
+		resp.Key = key
+		writeJSON(w, http.StatusCreated, resp)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// keyHandler revokes a created key on DELETE
+func keyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := apiKeys.revoke(r.PathValue("name"))
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errKeyStatic):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		writeError(w, err, http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authedHandler serves a few routes behind authMiddleware, answering 200
+// to the requests it lets through
+func authedHandler() http.Handler {
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, route := range []string{"/health", "/readyz", "/metrics", "/process", "/v1/audio/transcriptions", "/admin/keys", "/admin/keys/{name}"} {
+		mux.HandleFunc(route, ok)
+	}
+	return authMiddleware(mux, mux)
+}
+
+// authRequest sends a request for path with the given headers and returns
+// the response
+func authRequest(handler http.Handler, method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r = r.WithContext(context.WithValue(r.Context(), requestTraceKey, &requestTrace{}))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	useAPIKeys(t, "team-a=sk-a")
+	useJWT(t, newJWKSServer(t, map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey}))
+	handler := authedHandler()
+	token := signJWT(t, "RS256", "rsa", rsaKey, validClaims(nil))
+	expired := signJWT(t, "RS256", "rsa", rsaKey, validClaims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}))
+
+	tests := []struct {
+		name          string
+		method, path  string
+		headers       map[string]string
+		want          int
+		wantChallenge string
+		wantBody      string
+	}{
+		{"health", "GET", "/health", nil, http.StatusOK, "", ""},
+		{"readyz", "GET", "/readyz", nil, http.StatusOK, "", ""},
+		{"metrics", "GET", "/metrics", nil, http.StatusOK, "", ""},
+		{"admin keys", "GET", "/admin/keys", nil, http.StatusOK, "", ""},
+		{"admin key", "DELETE", "/admin/keys/team-b", nil, http.StatusOK, "", ""},
+		{"API key", "POST", "/process", map[string]string{"X-API-Key": "sk-a"}, http.StatusOK, "", ""},
+		{"API key as bearer", "POST", "/process", map[string]string{"Authorization": "Bearer sk-a"}, http.StatusOK, "", ""},
+		{"token", "POST", "/process", map[string]string{"Authorization": "Bearer " + token}, http.StatusOK, "", ""},
+		{"no credential", "POST", "/process", nil, http.StatusUnauthorized, `Bearer realm="whisper-llm-bridge"`, "a valid bearer token is required"},
+		{"unknown key", "POST", "/process", map[string]string{"X-API-Key": "sk-b"}, http.StatusUnauthorized, `Bearer realm="whisper-llm-bridge"`, "a valid bearer token is required"},
+		{"expired token", "POST", "/process", map[string]string{"Authorization": "Bearer " + expired}, http.StatusUnauthorized, `error="invalid_token"`, "invalid bearer token: token expired"},
+		{"tampered token", "POST", "/process", map[string]string{"Authorization": "Bearer " + token + "x"}, http.StatusUnauthorized, `error="invalid_token"`, "invalid bearer token"},
+		{"OpenAI route", "POST", "/v1/audio/transcriptions", nil, http.StatusUnauthorized, `Bearer realm="whisper-llm-bridge"`, `"type":"invalid_request_error"`},
+		{"not an exempt prefix", "GET", "/healthz", nil, http.StatusUnauthorized, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := authRequest(handler, tt.method, tt.path, tt.headers)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if challenge := rec.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, tt.wantChallenge) {
+				t.Errorf("WWW-Authenticate = %q, want %q", challenge, tt.wantChallenge)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareSetsIdentity(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	useAPIKeys(t, "team-a=sk-a")
+	useJWT(t, newJWKSServer(t, map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey}))
+	var trace *requestTrace
+	mux := http.NewServeMux()
+	mux.HandleFunc("/process", func(w http.ResponseWriter, r *http.Request) { trace = traceFromContext(r.Context()) })
+	handler := authMiddleware(mux, mux)
+
+	authRequest(handler, "POST", "/process", map[string]string{"X-API-Key": "sk-a"})
+	if trace == nil || trace.apiKey == nil || trace.apiKey.Name != "team-a" {
+		t.Errorf("API key request traced %+v, want the key team-a", trace)
+	}
+	authRequest(handler, "POST", "/process", map[string]string{"Authorization": "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, validClaims(nil))})
+	if trace == nil || trace.claims.subject() != "user-1" || trace.claims.tenant() != "acme" {
+		t.Errorf("token request traced %+v, want user-1 of acme", trace)
+	}
+}
+
+func TestAuthMiddlewareJWKSUnavailable(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	useAPIKeys(t, "team-a=sk-a")
+	useJWT(t, newJWKSServer(t, nil))
+	handler := authedHandler()
+	token := signJWT(t, "RS256", "rsa", rsaKey, validClaims(nil))
+
+	rec := authRequest(handler, "POST", "/process", map[string]string{"Authorization": "Bearer " + token})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("token status = %d, want 503", rec.Code)
+	}
+	if challenge := rec.Header().Get("WWW-Authenticate"); challenge != "" {
+		t.Errorf("WWW-Authenticate = %q on a 503, want none", challenge)
+	}
+	rec = authRequest(handler, "POST", "/v1/audio/transcriptions", map[string]string{"Authorization": "Bearer " + token})
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"type":"server_error"`) {
+		t.Errorf("OpenAI route = %d %s, want 503 with a server_error", rec.Code, rec.Body)
+	}
+	// API keys don't depend on the issuer
+	if rec := authRequest(handler, "POST", "/process", map[string]string{"X-API-Key": "sk-a"}); rec.Code != http.StatusOK {
+		t.Errorf("API key status = %d, want 200", rec.Code)
+	}
+}
+
+func TestAuthMiddlewareDisabled(t *testing.T) {
+	setForTest(t, &apiKeys, &keyStore{byHash: make(map[string]*APIKey)})
+	setConfigForTest(t, func(c *config) {
+		c.oidcIssuer = ""
+		c.jwksURL = ""
+	})
+	handler := authedHandler()
+	for _, headers := range []map[string]string{nil, {"X-API-Key": "anything"}, {"Authorization": "Bearer a.b.c"}} {
+		if rec := authRequest(handler, "POST", "/process", headers); rec.Code != http.StatusOK {
+			t.Errorf("status with %v = %d, want 200", headers, rec.Code)
+		}
+	}
+}
+
+func TestAuthMiddlewareAPIKeysOnly(t *testing.T) {
+	useAPIKeys(t, "team-a=sk-a")
+	setConfigForTest(t, func(c *config) {
+		c.oidcIssuer = ""
+		c.jwksURL = ""
+	})
+	handler := authedHandler()
+	// Without JWT authentication a token-shaped credential is just an
+	// unknown key
+	for _, headers := range []map[string]string{nil, {"Authorization": "Bearer a.b.c"}} {
+		rec := authRequest(handler, "POST", "/process", headers)
+		if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), "X-API-Key header") {
+			t.Errorf("status with %v = %d %q, want 401 asking for an API key", headers, rec.Code, rec.Body)
+		}
+	}
+	if rec := authRequest(handler, "POST", "/process", map[string]string{"X-API-Key": "sk-a"}); rec.Code != http.StatusOK {
+		t.Errorf("API key status = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ASR backend names, used in ASR_BACKEND
+const (
+	asrWhisperASR    = "whisper-asr"
+	asrWhisperCpp    = "whisper-cpp"
+	asrFasterWhisper = "faster-whisper"
+	asrDeepgram      = "deepgram"
+)
+
+// Transcriber runs the transcription step. Results are reported in the
+// Whisper ASR webservice's shape, which the rest of the bridge
+// understands: the text, the detected language and segments with start,
+// end, text and, when requested, words.
+type Transcriber interface {
+	// name is the backend's name in the configuration
+	name() string
+	// transcribe converts the audio read from r, named filename
+	transcribe(ctx context.Context, filename string, r io.Reader, opts whisperOptions) (*WhisperResponse, error)
+	// ping checks that the backend answers, for the keepalive pinger
+	ping(ctx context.Context) error
+}
+
+// Values of the task field
+const (
+	taskTranscribe = "transcribe"
+	taskTranslate  = "translate"
+)
+
+// canTranslate reports whether a backend has Whisper's translate task.
+// Deepgram only transcribes.
+func canTranslate(t Transcriber) bool {
+	return t.name() != asrDeepgram
+}
+
+// newTranscriber returns the backend with the given name
+func (c *config) newTranscriber(name string) (Transcriber, error) {
+	switch name {
+	case asrWhisperASR:
+		return whisperASRTranscriber{}, nil
+	case asrWhisperCpp:
+		return whisperCppTranscriber{}, nil
+	case asrFasterWhisper:
+		model := c.asrModel
+		if model == "" {
+			model = defaultFasterWhisperModel
+		}
+		return fasterWhisperTranscriber{model: model}, nil
+	case asrDeepgram:
+		if c.deepgramAPIKey == "" {
+			return nil, fmt.Errorf("ASR_BACKEND %q needs DEEPGRAM_API_KEY", name)
+		}
+		model := c.asrModel
+		if model == "" {
+			model = defaultDeepgramModel
+		}
+		return &deepgramTranscriber{baseURL: c.deepgramURL, apiKey: c.deepgramAPIKey, model: model}, nil
+	}
+	return nil, fmt.Errorf("unknown ASR_BACKEND %q (want %s, %s, %s or %s)", name, asrWhisperASR, asrWhisperCpp, asrFasterWhisper, asrDeepgram)
+}
+
+// guardedTranscribe runs the transcription behind the ASR backend's
+// circuit breaker, on the WHISPER_URL backends. Requests routed to an
+// override URL bypass both, so a canary can't open the breaker for
+// everyone.
+func guardedTranscribe(ctx context.Context, filename string, r io.Reader, opts whisperOptions) (*WhisperResponse, error) {
+	if overridesFromContext(ctx).whisper != "" {
+		return cfg().transcriber.transcribe(ctx, filename, r, opts)
+	}
+	if err := whisperBreaker.allow(); err != nil {
+		return nil, err
+	}
+	var resp *WhisperResponse
+	var err error
+	if cfg().transcriber.name() == asrDeepgram {
+		resp, err = cfg().transcriber.transcribe(ctx, filename, r, opts)
+	} else {
+		resp, err = whisperBackends.transcribe(ctx, filename, r, opts)
+	}
+	whisperBreaker.record(err)
+	return resp, err
+}
+
+// whisperASRTranscriber calls the /asr endpoint of the Whisper ASR
+// webservice (onerahmet/openai-whisper-asr-webservice)
+type whisperASRTranscriber struct{}
+
+func (whisperASRTranscriber) name() string { return asrWhisperASR }
+
+func (whisperASRTranscriber) ping(ctx context.Context) error {
+	return probe(ctx, http.MethodGet, whisperBaseURL(ctx)+"/", nil)
+}
+
+func (whisperASRTranscriber) transcribe(ctx context.Context, filename string, r io.Reader, opts whisperOptions) (*WhisperResponse, error) {
+	query := url.Values{"output": {"json"}}
+	if opts.Language != "" {
+		query.Set("language", opts.Language)
+	}
+	if opts.InitialPrompt != "" {
+		query.Set("initial_prompt", opts.InitialPrompt)
+	}
+	if opts.WordTimestamps {
+		query.Set("word_timestamps", "true")
+	}
+	if opts.Translate {
+		query.Set("task", taskTranslate)
+	}
+	if opts.Diarize {
+		// Only the whisperx engine honours these
+		query.Set("diarize", "true")
+		if opts.NumSpeakers > 0 {
+			query.Set("min_speakers", strconv.Itoa(opts.NumSpeakers))
+			query.Set("max_speakers", strconv.Itoa(opts.NumSpeakers))
+		}
+	}
+	body, contentType := multipartAudio("audio_file", filename, r, nil)
+	defer body.Close()
+
+	var whisperResp WhisperResponse
+	header, err := postASR(ctx, asrWhisperASR, whisperBaseURL(ctx)+"/asr?"+query.Encode(), contentType, body, nil, &whisperResp)
+	if err != nil {
+		return nil, err
+	}
+	asrVersionFromHeaders(&whisperResp, header)
+	return &whisperResp, nil
+}
+
+// multipartAudio returns a multipart body with the audio read from r in
+// field and the given form fields. The body is produced through a pipe
+// while it is sent, so the audio is never buffered in full; close it to
+// unblock the writer if the request fails before the body is consumed.
+func multipartAudio(field, filename string, r io.Reader, fields url.Values) (io.ReadCloser, string) {
+	body, bodyWriter := io.Pipe()
+	writer := multipart.NewWriter(bodyWriter)
+	go func() {
+		var err error
+		for name, values := range fields {
+			for _, value := range values {
+				if err == nil {
+					err = writer.WriteField(name, value)
+				}
+			}
+		}
+		if err == nil {
+			var part io.Writer
+			part, err = writer.CreateFormFile(field, filename)
+			if err == nil {
+				_, err = io.Copy(part, r)
+			}
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+	return body, writer.FormDataContentType()
+}
+
+// postASR sends audio to an ASR backend and decodes its JSON answer into
+// v. A non-200 answer is returned as an upstreamError named after the
+// backend.
+func postASR(ctx context.Context, backend, url, contentType string, body io.Reader, header http.Header, v any) (http.Header, error) {
+	client := upstreamClient(time.Duration(cfg().requestTimeout) * time.Second)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	setUpstreamRequestID(req)
+	setTraceParent(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError(backend, resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return resp.Header, nil
+}
+
+// asrVersionFromHeaders fills in the model and version some ASR backends
+// report in headers rather than in the body
+func asrVersionFromHeaders(resp *WhisperResponse, header http.Header) {
+	if resp.Model == "" {
+		resp.Model = firstHeader(header, "X-Whisper-Model", "X-ASR-Model")
+	}
+	if resp.Version == "" {
+		resp.Version = firstHeader(header, "X-Whisper-Version", "X-ASR-Version")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Model used for Deepgram when ASR_MODEL is empty
+const defaultDeepgramModel = "nova-2"
+
+// deepgramTranscriber calls Deepgram's pre-recorded audio API. Its
+// utterances become the segments. Deepgram has no equivalent of Whisper's
+// initial prompt, so the prompt is ignored.
+type deepgramTranscriber struct {
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+func (t *deepgramTranscriber) name() string { return asrDeepgram }
+
+// ping treats any answer of the API as alive; the listen endpoint refuses
+// a GET without transcribing anything
+func (t *deepgramTranscriber) ping(ctx context.Context) error {
+	return probe(ctx, http.MethodGet, strings.TrimSuffix(t.baseURL, "/")+"/v1/listen", nil)
+}
+
+// deepgramWord is a word with its timing and confidence
+type deepgramWord struct {
+	Word           string  `json:"word"`
+	PunctuatedWord string  `json:"punctuated_word"`
+	Start          float64 `json:"start"`
+	End            float64 `json:"end"`
+	Confidence     float64 `json:"confidence"`
+}
+
+// deepgramResponse is the part of Deepgram's answer the bridge uses
+type deepgramResponse struct {
+	Metadata struct {
+		ModelInfo map[string]struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"model_info"`
+	} `json:"metadata"`
+	Results struct {
+		Channels []struct {
+			DetectedLanguage   string   `json:"detected_language"`
+			LanguageConfidence *float64 `json:"language_confidence"`
+			Alternatives       []struct {
+				Transcript string `json:"transcript"`
+			} `json:"alternatives"`
+		} `json:"channels"`
+		Utterances []struct {
+			Start      float64        `json:"start"`
+			End        float64        `json:"end"`
+			Confidence *float64       `json:"confidence"`
+			Speaker    *int           `json:"speaker"`
+			Transcript string         `json:"transcript"`
+			Words      []deepgramWord `json:"words"`
+		} `json:"utterances"`
+	} `json:"results"`
+}
+
+func (t *deepgramTranscriber) transcribe(ctx context.Context, filename string, r io.Reader, opts whisperOptions) (*WhisperResponse, error) {
+	query := url.Values{
+		"model":        {t.model},
+		"smart_format": {"true"},
+		"utterances":   {"true"},
+	}
+	if opts.Language != "" {
+		query.Set("language", opts.Language)
+	} else {
+		query.Set("detect_language", "true")
+	}
+	if opts.Diarize {
+		query.Set("diarize", "true")
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := http.Header{"Authorization": {"Token " + t.apiKey}}
+
+	var resp deepgramResponse
+	endpoint := strings.TrimSuffix(t.baseURL, "/") + "/v1/listen?" + query.Encode()
+	if _, err := postASR(ctx, asrDeepgram, endpoint, contentType, r, header, &resp); err != nil {
+		return nil, err
+	}
+
+	whisperResp := &WhisperResponse{Language: opts.Language}
+	if channels := resp.Results.Channels; len(channels) > 0 {
+		if whisperResp.Language == "" {
+			whisperResp.Language = channels[0].DetectedLanguage
+			whisperResp.LanguageProbability = channels[0].LanguageConfidence
+		}
+		if alternatives := channels[0].Alternatives; len(alternatives) > 0 {
+			whisperResp.Text = alternatives[0].Transcript
+		}
+	}
+	for _, info := range resp.Metadata.ModelInfo {
+		whisperResp.Model, whisperResp.Version = info.Name, info.Version
+		break
+	}
+	for i, utterance := range resp.Results.Utterances {
+		segment := Segment{
+			ID:         i,
+			Start:      utterance.Start,
+			End:        utterance.End,
+			Text:       utterance.Transcript,
+			Confidence: utterance.Confidence,
+		}
+		if opts.Diarize && utterance.Speaker != nil {
+			segment.Speaker = speakerLabel(*utterance.Speaker)
+		}
+		if opts.WordTimestamps {
+			segment.Words = make([]Word, 0, len(utterance.Words))
+			for _, word := range utterance.Words {
+				text := word.PunctuatedWord
+				if text == "" {
+					text = word.Word
+				}
+				segment.Words = append(segment.Words, Word{Word: text, Start: word.Start, End: word.End, Probability: &word.Confidence})
+			}
+		}
+		whisperResp.Segments = append(whisperResp.Segments, segment)
+	}
+	return whisperResp, nil
+}
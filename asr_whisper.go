@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Model requested from faster-whisper when ASR_MODEL is empty
+const defaultFasterWhisperModel = "Systran/faster-whisper-small"
+
+// whisperCppTranscriber calls the /inference endpoint of the whisper.cpp
+// server, which transcribes with the model it was started with. Its
+// verbose_json output has Whisper's segments, including word timings.
+type whisperCppTranscriber struct{}
+
+// whisperCppResponse is the verbose_json transcription, which names the
+// language probability differently
+type whisperCppResponse struct {
+	WhisperResponse
+	DetectedLanguageProbability *float64 `json:"detected_language_probability"`
+}
+
+func (whisperCppTranscriber) name() string { return asrWhisperCpp }
+
+func (whisperCppTranscriber) ping(ctx context.Context) error {
+	return probe(ctx, http.MethodGet, whisperBaseURL(ctx)+"/", nil)
+}
+
+func (whisperCppTranscriber) transcribe(ctx context.Context, filename string, r io.Reader, opts whisperOptions) (*WhisperResponse, error) {
+	// The server falls back to its own -l flag, English by default, so
+	// detection has to be asked for
+	language := opts.Language
+	if language == "" {
+		language = "auto"
+	}
+	fields := url.Values{
+		"response_format": {"verbose_json"},
+		"language":        {language},
+	}
+	if opts.InitialPrompt != "" {
+		fields.Set("prompt", opts.InitialPrompt)
+	}
+	if opts.Translate {
+		fields.Set("translate", "true")
+	}
+	body, contentType := multipartAudio("file", filename, r, fields)
+	defer body.Close()
+
+	var resp whisperCppResponse
+	header, err := postASR(ctx, asrWhisperCpp, whisperBaseURL(ctx)+"/inference", contentType, body, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.LanguageProbability == nil && opts.Language == "" {
+		resp.LanguageProbability = resp.DetectedLanguageProbability
+	}
+	asrVersionFromHeaders(&resp.WhisperResponse, header)
+	return &resp.WhisperResponse, nil
+}
+
+// fasterWhisperTranscriber calls a faster-whisper server with the OpenAI
+// transcription API, such as speaches (formerly faster-whisper-server)
+type fasterWhisperTranscriber struct {
+	model string
+}
+
+func (fasterWhisperTranscriber) name() string { return asrFasterWhisper }
+
+func (fasterWhisperTranscriber) ping(ctx context.Context) error {
+	return probe(ctx, http.MethodGet, whisperBaseURL(ctx)+"/health", nil)
+}
+
+// fasterWhisperResponse is the verbose_json transcription, which lists
+// word timings separately from the segments
+type fasterWhisperResponse struct {
+	WhisperResponse
+	Words []Word `json:"words"`
+}
+
+func (t fasterWhisperTranscriber) transcribe(ctx context.Context, filename string, r io.Reader, opts whisperOptions) (*WhisperResponse, error) {
+	fields := url.Values{
+		"model":                     {t.model},
+		"response_format":           {"verbose_json"},
+		"timestamp_granularities[]": {"segment"},
+	}
+	if opts.Language != "" {
+		fields.Set("language", opts.Language)
+	}
+	if opts.InitialPrompt != "" {
+		fields.Set("prompt", opts.InitialPrompt)
+	}
+	if opts.WordTimestamps {
+		fields.Add("timestamp_granularities[]", "word")
+	}
+	// Translation has an endpoint of its own, which detects the language
+	endpoint := "/v1/audio/transcriptions"
+	if opts.Translate {
+		endpoint = "/v1/audio/translations"
+		fields.Del("language")
+	}
+	body, contentType := multipartAudio("file", filename, r, fields)
+	defer body.Close()
+
+	var resp fasterWhisperResponse
+	header, err := postASR(ctx, asrFasterWhisper, whisperBaseURL(ctx)+endpoint, contentType, body, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Model == "" {
+		resp.Model = t.model
+	}
+	asrVersionFromHeaders(&resp.WhisperResponse, header)
+	if opts.WordTimestamps {
+		attachWords(resp.Segments, resp.Words)
+	}
+	return &resp.WhisperResponse, nil
+}
+
+// attachWords moves word timings into the segment they start in, where
+// Whisper reports them
+func attachWords(segments []Segment, words []Word) {
+	for i := range segments {
+		segment := &segments[i]
+		segment.Words = []Word{}
+		for _, word := range words {
+			if word.Start >= segment.Start && word.Start < segment.End {
+				segment.Words = append(segment.Words, word)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Audio formats recognised by sniffAudioFormat
+const (
+	formatWAV  = "wav"
+	formatMP3  = "mp3"
+	formatOGG  = "ogg"
+	formatFLAC = "flac"
+	formatM4A  = "m4a"
+	formatWebM = "webm"
+)
+
+// knownAudioFormats lists every format name sniffAudioFormat can return
+var knownAudioFormats = []string{formatWAV, formatMP3, formatOGG, formatFLAC, formatM4A, formatWebM}
+
+// sniffLength is the number of leading bytes sniffAudioFormat needs
+const sniffLength = 12
+
+// mimeFormats maps audio MIME types to format names
+var mimeFormats = map[string]string{
+	"audio/wav":       formatWAV,
+	"audio/wave":      formatWAV,
+	"audio/x-wav":     formatWAV,
+	"audio/vnd.wave":  formatWAV,
+	"audio/mpeg":      formatMP3,
+	"audio/mp3":       formatMP3,
+	"audio/ogg":       formatOGG,
+	"audio/opus":      formatOGG,
+	"audio/flac":      formatFLAC,
+	"audio/x-flac":    formatFLAC,
+	"audio/mp4":       formatM4A,
+	"audio/m4a":       formatM4A,
+	"audio/x-m4a":     formatM4A,
+	"audio/webm":      formatWebM,
+	"video/webm":      formatWebM,
+	"application/ogg": formatOGG,
+}
+
+// sniffAudioFormat detects the audio container from its magic bytes. It
+// returns an empty string for unrecognised data.
+func sniffAudioFormat(header []byte) string {
+	switch {
+	case len(header) >= 12 && bytes.Equal(header[0:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return formatWAV
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return formatMP3
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		// MPEG audio frame sync
+		return formatMP3
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return formatOGG
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return formatFLAC
+	case len(header) >= 8 && bytes.Equal(header[4:8], []byte("ftyp")):
+		return formatM4A
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// EBML header used by WebM/Matroska
+		return formatWebM
+	default:
+		return ""
+	}
+}
+
+// formatForMIME returns the format name of an audio MIME type, ignoring
+// parameters such as "codecs=opus". Unknown types return an empty string.
+func formatForMIME(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return ""
+	}
+	return mimeFormats[mediaType]
+}
+
+// audioFormatAllowed reports whether format is in ALLOWED_AUDIO_FORMATS
+func audioFormatAllowed(format string) bool {
+	for _, allowed := range strings.Split(cfg().allowedAudioFormats, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), format) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedAudioFormatList returns ALLOWED_AUDIO_FORMATS as a list
+func allowedAudioFormatList() []string {
+	var formats []string
+	for _, format := range strings.Split(cfg().allowedAudioFormats, ",") {
+		if format = strings.ToLower(strings.TrimSpace(format)); format != "" {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// UnsupportedAudioError is the 415 answer to audio in a format that isn't
+// on ALLOWED_AUDIO_FORMATS
+type UnsupportedAudioError struct {
+	Error          string   `json:"error"`
+	Filename       string   `json:"filename,omitempty"`
+	DetectedFormat string   `json:"detected_format,omitempty"`
+	AllowedFormats []string `json:"allowed_formats"`
+}
+
+// checkAudioFormat detects the format of audio from its magic bytes,
+// whatever its file name claims, and rejects formats that aren't on
+// ALLOWED_AUDIO_FORMATS with 415. Containers the bridge doesn't recognise
+// pass while TRANSCODE_AUDIO is on, as ffmpeg converts them or answers
+// 415 itself. The returned reader reads the audio from the start, and
+// errors are httpErrors.
+func checkAudioFormat(audio io.ReadCloser, filename string) (io.ReadCloser, error) {
+	header, peeked, err := peekAudio(audio)
+	if err != nil {
+		var he *httpError
+		if errors.As(err, &he) {
+			return nil, err
+		}
+		return nil, newHTTPError(http.StatusBadRequest, "Failed to read audio file: %v", err)
+	}
+
+	format := sniffAudioFormat(header)
+	switch {
+	case format == "" && cfg().transcodeMode != transcodeOff:
+		return peeked, nil
+	case format == "":
+		return nil, unsupportedAudio(filename, "", "%s is not audio in a format the bridge recognises", cmp.Or(filename, "the upload"))
+	case !audioFormatAllowed(format):
+		return nil, unsupportedAudio(filename, format, "audio format %s is not allowed", format)
+	}
+	return peeked, nil
+}
+
+// unsupportedAudio returns the 415 error for audio of filename in format,
+// "" when it wasn't recognised
+func unsupportedAudio(filename, format, msg string, args ...any) *httpError {
+	he := newHTTPError(http.StatusUnsupportedMediaType, msg, args...)
+	he.body = UnsupportedAudioError{Error: he.msg, Filename: filename, DetectedFormat: format, AllowedFormats: allowedAudioFormatList()}
+	return he
+}
+
+// peekAudio reads the first sniffLength bytes of audio and returns them
+// with a reader of the whole audio: audio itself, rewound, when it can
+// seek, so temp files and replayable readers keep their type
+func peekAudio(audio io.ReadCloser) ([]byte, io.ReadCloser, error) {
+	header := make([]byte, sniffLength)
+	if seeker, ok := audio.(io.ReadSeeker); ok {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, err
+		}
+		n, err := io.ReadFull(seeker, header)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		_, err = seeker.Seek(offset, io.SeekStart)
+		return header[:n], audio, err
+	}
+	n, err := io.ReadFull(audio, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+	return header[:n], peekedAudio{Reader: io.MultiReader(bytes.NewReader(header[:n]), audio), Closer: audio}, nil
+}
+
+// peekedAudio is audio whose first bytes were read already
+type peekedAudio struct {
+	io.Reader
+	io.Closer
+}
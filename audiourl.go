@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// checkAudioURL accepts http(s) URLs whose host is on AUDIO_URL_HOSTS. An
+// entry without a port allows every port of that host, and an entry such
+// as *.example.com allows its subdomains.
+func checkAudioURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return newHTTPError(http.StatusBadRequest, "audio_url must be an http(s) URL")
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range strings.Split(cfg().audioURLHosts, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		switch {
+		case allowed == "":
+		case strings.EqualFold(u.Host, allowed) || host == allowed:
+			return nil
+		case strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]):
+			return nil
+		}
+	}
+	return newHTTPError(http.StatusForbidden, "audio_url host %q is not allowed", u.Host)
+}
+
+// fetchAudioURL starts downloading the audio at raw and returns its body,
+// which the caller reads and closes, and a file name for it. The host and
+// every redirect must be on AUDIO_URL_HOSTS, at most
+// AUDIO_URL_MAX_REDIRECTS redirects are followed, and the download fails
+// once it exceeds AUDIO_URL_MAX_MB or AUDIO_URL_TIMEOUT. Reading the body
+// fails with an httpError carrying the status to answer.
+func fetchAudioURL(ctx context.Context, raw string) (io.ReadCloser, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "", newHTTPError(http.StatusBadRequest, "invalid audio_url: %v", err)
+	}
+	if u.Scheme == "s3" {
+		return fetchS3Audio(ctx, u)
+	}
+	if cfg().audioURLHosts == "" {
+		return nil, "", newHTTPError(http.StatusBadRequest, "audio_url is disabled (AUDIO_URL_HOSTS)")
+	}
+	if err := checkAudioURL(u); err != nil {
+		return nil, "", err
+	}
+
+	// The timeout covers reading the body too, which happens after this
+	// returns
+	client := &http.Client{
+		Timeout: time.Duration(cfg().audioURLTimeout) * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg().audioURLMaxRedirects {
+				return newHTTPError(http.StatusBadGateway, "audio_url redirected more than %d times (AUDIO_URL_MAX_REDIRECTS)", cfg().audioURLMaxRedirects)
+			}
+			return checkAudioURL(req.URL)
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", newHTTPError(http.StatusBadRequest, "invalid audio_url: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var httpErr *httpError
+		if errors.As(err, &httpErr) {
+			return nil, "", httpErr
+		}
+		return nil, "", downloadError(err)
+	}
+	return audioDownload(resp, resp.Request.URL.Path)
+}
+
+// audioDownload checks the answer to an audio download and returns its
+// body, limited to AUDIO_URL_MAX_MB, and a file name for the audio at
+// urlPath
+func audioDownload(resp *http.Response, urlPath string) (io.ReadCloser, string, error) {
+	maxBytes := int64(cfg().audioURLMaxMB) << 20
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, "", newHTTPError(http.StatusBadGateway, "audio_url returned status %d", resp.StatusCode)
+	case resp.ContentLength > maxBytes:
+		resp.Body.Close()
+		return nil, "", newHTTPError(http.StatusRequestEntityTooLarge, "audio at audio_url is larger than %d MB (AUDIO_URL_MAX_MB)", cfg().audioURLMaxMB)
+	}
+
+	// Name the file after the URL, or its content type when the path has
+	// no extension, so the ASR backend can tell the format
+	filename := path.Base(urlPath)
+	if path.Ext(filename) == "" {
+		filename = "audio"
+		if format := formatForMIME(resp.Header.Get("Content-Type")); format != "" {
+			filename += "." + format
+		}
+	}
+	return &downloadBody{body: resp.Body, remaining: maxBytes}, filename, nil
+}
+
+// downloadBody reads the body of an audio_url download, failing with an
+// httpError once more than the allowed bytes arrive or the download fails
+type downloadBody struct {
+	body      io.ReadCloser
+	remaining int64
+}
+
+func (d *downloadBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > d.remaining+1 {
+		p = p[:d.remaining+1]
+	}
+	n, err := d.body.Read(p)
+	d.remaining -= int64(n)
+	if d.remaining < 0 {
+		return 0, newHTTPError(http.StatusRequestEntityTooLarge, "audio at audio_url is larger than %d MB (AUDIO_URL_MAX_MB)", cfg().audioURLMaxMB)
+	}
+	if err != nil && err != io.EOF {
+		return n, downloadError(err)
+	}
+	return n, err
+}
+
+func (d *downloadBody) Close() error { return d.body.Close() }
+
+// downloadError reports a failed audio_url download as a gateway error
+func downloadError(err error) error {
+	if isTimeout(err) {
+		return newHTTPError(http.StatusGatewayTimeout, "downloading audio_url took longer than %d seconds (AUDIO_URL_TIMEOUT)", cfg().audioURLTimeout)
+	}
+	return newHTTPError(http.StatusBadGateway, "downloading audio_url failed: %v", err)
+}
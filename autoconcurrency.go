@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// autoConcurrencyLimit sizes the slot pool from the memory and CPU available
+// to the process:
+//
+//	byMemory = available memory / REQUEST_MEMORY_MB
+//	byCPU    = CPUs * CONCURRENCY_PER_CPU
+//	limit    = max(1, min(byMemory, byCPU))
+//
+// Container limits from cgroups take precedence over host totals so the
+// same image behaves sensibly on small and large nodes.
+func (c *config) autoConcurrencyLimit() int {
+	memory := c.availableMemory()
+	cpus := availableCPUs()
+
+	byMemory := int(memory / (int64(c.requestMemoryMB) << 20))
+	byCPU := int(math.Ceil(cpus * float64(c.concurrencyPerCPU)))
+	limit := max(1, min(byMemory, byCPU))
+
+	log.Printf("Auto concurrency: %d MB memory, %.2f CPUs -> %d by memory, %d by CPU, using %d",
+		memory>>20, cpus, byMemory, byCPU, limit)
+	return limit
+}
+
+// availableMemory returns the memory available to the process in bytes:
+// MemAvailable from /proc/meminfo, capped by the cgroup memory limit
+func (c *config) availableMemory() int64 {
+	memory := readMemAvailable()
+	if limit, ok := cgroupMemoryLimit(); ok && (memory == 0 || limit < memory) {
+		memory = limit
+	}
+	if memory == 0 {
+		// Unknown, assume enough for the configured maximum
+		memory = int64(c.maxConcurrent) * int64(c.requestMemoryMB) << 20
+	}
+	return memory
+}
+
+func readMemAvailable() int64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+// cgroupMemoryLimit reads the cgroup v2 or v1 memory limit
+func cgroupMemoryLimit() (int64, bool) {
+	if value, err := readTrimmed("/sys/fs/cgroup/memory.max"); err == nil {
+		if value == "max" {
+			return 0, false
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		return limit, err == nil
+	}
+	if value, err := readTrimmed("/sys/fs/cgroup/memory/memory.limit_in_bytes"); err == nil {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		// v1 reports a huge number when unlimited
+		if err != nil || limit >= 1<<60 {
+			return 0, false
+		}
+		return limit, true
+	}
+	return 0, false
+}
+
+// availableCPUs returns the cgroup CPU quota, or the number of CPUs when
+// there is none
+func availableCPUs() float64 {
+	cpus := float64(runtime.NumCPU())
+
+	var quota, period float64
+	if value, err := readTrimmed("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(value)
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, _ = strconv.ParseFloat(fields[0], 64)
+			period, _ = strconv.ParseFloat(fields[1], 64)
+		}
+	} else if value, err := readTrimmed("/sys/fs/cgroup/cpu/cpu.cfs_quota_us"); err == nil {
+		quota, _ = strconv.ParseFloat(value, 64)
+		if value, err := readTrimmed("/sys/fs/cgroup/cpu/cpu.cfs_period_us"); err == nil {
+			period, _ = strconv.ParseFloat(value, 64)
+		}
+	}
+
+	if quota > 0 && period > 0 && quota/period < cpus {
+		return quota / period
+	}
+	return cpus
+}
+
+func readTrimmed(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
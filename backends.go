@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Routing policies of WHISPER_ROUTING and OLLAMA_ROUTING
+const (
+	routingRoundRobin  = "round_robin"
+	routingLeastLoaded = "least_loaded"
+)
+
+// How long a backend that failed is skipped, unless a health check finds
+// it answering again first
+const backendCooldown = 30 * time.Second
+
+// poolBackend is one of the servers of a WHISPER_URL or OLLAMA_URL list
+type poolBackend struct {
+	kind     string // "Whisper backend" or "Ollama host", for the logs
+	url      string
+	inFlight atomic.Int64 // requests being sent to it
+
+	mu        sync.Mutex
+	downUntil time.Time // skipped until then after failing
+}
+
+// available reports whether the backend is not being skipped
+func (b *poolBackend) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.downUntil)
+}
+
+// load returns the number of requests being sent to the backend
+func (b *poolBackend) load() int64 {
+	return b.inFlight.Load()
+}
+
+// markDown skips the backend for backendCooldown after err
+func (b *poolBackend) markDown(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !time.Now().Before(b.downUntil) {
+		log.Printf("%s %s is down, failing over for %s: %v", b.kind, b.url, backendCooldown, err)
+	}
+	b.downUntil = time.Now().Add(backendCooldown)
+}
+
+// markUp routes to the backend again
+func (b *poolBackend) markUp() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.downUntil.IsZero() {
+		log.Printf("%s %s is back", b.kind, b.url)
+	}
+	b.downUntil = time.Time{}
+}
+
+// routable is a backend that can be ordered by routeBackends
+type routable interface {
+	available() bool
+	load() int64
+}
+
+// routeBackends orders candidate backends for a request: those that are
+// up, or all of them when none is, rotated by next so ties take turns,
+// then by fewest requests in flight for least_loaded
+func routeBackends[B routable](candidates []B, next *atomic.Uint64, routing string) []B {
+	var up []B
+	for _, b := range candidates {
+		if b.available() {
+			up = append(up, b)
+		}
+	}
+	if len(up) == 0 {
+		up = append(up, candidates...)
+	}
+	if len(up) < 2 {
+		return up
+	}
+
+	start := int(next.Add(1) % uint64(len(up)))
+	up = append(up[start:], up[:start]...)
+	if routing == routingLeastLoaded {
+		slices.SortStableFunc(up, func(a, b B) int {
+			return int(a.load() - b.load())
+		})
+	}
+	return up
+}
+
+// splitBackendURLs returns the URLs of a WHISPER_URL or OLLAMA_URL list
+func splitBackendURLs(value string) []string {
+	urls := splitList(value)
+	for i, url := range urls {
+		urls[i] = strings.TrimRight(url, "/")
+	}
+	return urls
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Endpoint batch results are recorded for
+const resultEndpointBatch = "batch"
+
+// BatchItem is the outcome of one file of a batch: the /process response,
+// or why the file failed
+type BatchItem struct {
+	ID       string            `json:"id"`
+	Filename string            `json:"filename"`
+	Result   *CombinedResponse `json:"result,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// BatchResponse is the response of a synchronous /process/batch request
+type BatchResponse struct {
+	Results []BatchItem `json:"results"`
+}
+
+// batch is a set of spooled files processed with the same parameters
+type batch struct {
+	input *processInput // parameters shared by the files, without audio
+	files []batchFile
+}
+
+// batchFile is a file of a batch, spooled to a temp file
+type batchFile struct {
+	name string
+	path string
+}
+
+// run processes the files with up to concurrency at once and returns their
+// outcomes in upload order. Progress is logged as each file finishes.
+func (b *batch) run(ctx context.Context, concurrency int) []BatchItem {
+	items := make([]BatchItem, len(b.files))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var done atomic.Int32
+	for i, file := range b.files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(item *BatchItem, file batchFile) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			*item = b.process(ctx, file)
+			outcome := "done"
+			if item.Error != "" {
+				outcome = "failed"
+			}
+			log.Printf("Batch file %d/%d %s: %s request_id=%s", done.Add(1), len(b.files), outcome, file.name, requestIDFromContext(ctx))
+		}(&items[i], file)
+	}
+	wg.Wait()
+	return items
+}
+
+// process runs the pipeline on one file
+func (b *batch) process(ctx context.Context, file batchFile) BatchItem {
+	item := BatchItem{ID: newRequestID(), Filename: file.name}
+	if ctx.Err() != nil {
+		item.Error = ctx.Err().Error()
+		return item
+	}
+	input := *b.input
+	input.Filename = file.name
+	input.Audio = http.NoBody
+
+	audioPath, tempFiles, err := prepareAudio(ctx, &input, file.path)
+	defer func() {
+		for _, path := range tempFiles {
+			os.Remove(path)
+		}
+	}()
+	var result *pipelineResult
+	if err == nil {
+		result, err = processSpooled(ctx, resultEndpointBatch, item.ID, &input, audioPath, nil)
+	}
+	if err != nil {
+		log.Printf("Batch file %s failed: %v request_id=%s", file.name, err, requestIDFromContext(ctx))
+		item.Error = err.Error()
+		return item
+	}
+	item.Result = &result.Response
+	return item
+}
+
+// remove deletes the spooled files
+func (b *batch) remove() {
+	for _, file := range b.files {
+		os.Remove(file.path)
+	}
+}
+
+// batchHandler processes several audio files with the parameters of
+// /process: every file part, and the audio in zip archives, up to
+// MAX_BATCH_SIZE. The files run BATCH_CONCURRENCY at a time and the
+// response lists their results in upload order. With async=true the batch
+// runs as an async job instead.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	trace := traceFromContext(r.Context())
+	trace.traced = true
+	if rejectLargeUpload(w, r) {
+		return
+	}
+
+	prio, err := parsePriority(r.URL.Query().Get("priority"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, err := admit(r, prio)
+	if err != nil {
+		http.Error(w, "Server is at capacity, please try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfg().requestTimeout)*time.Second)
+	defer cancel()
+	ctx, err = withURLOverrides(ctx, r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	upload := newUploadReader(ctx, w, r.Body, time.Duration(cfg().uploadIdleTimeout)*time.Second, int64(cfg().maxUploadBytes))
+	defer upload.stop()
+	r.Body = upload
+
+	b, async, err := readBatch(r)
+	if b != nil {
+		defer func() {
+			if b != nil {
+				b.remove()
+			}
+		}()
+	}
+	if err != nil {
+		if writeUploadFailure(w, upload) {
+			return
+		}
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if async {
+		// The job outlives the request, but keeps its ID and upstream overrides
+		jobCtx, jobCancel := context.WithTimeout(context.WithValue(context.Background(), requestIDKey, requestIDFromContext(r.Context())), time.Duration(cfg().jobTimeout)*time.Second)
+		jobCtx = withSpanContext(jobCtx, r.Context())
+		jobCtx, _ = withURLOverrides(jobCtx, r)
+		j := &job{
+			Job:    Job{ID: newRequestID(), Status: jobQueued, CreatedAt: time.Now()},
+			batch:  b,
+			caller: callerName(r),
+			ctx:    jobCtx,
+			cancel: jobCancel,
+		}
+		for _, file := range b.files {
+			j.tempFiles = append(j.tempFiles, file.path)
+		}
+		if err := jobs.submit(j); err != nil {
+			jobCancel()
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		// The job removes the files when it is done
+		b = nil
+		log.Printf("Batch job %s queued with %d files request_id=%s", j.ID, len(j.batch.files), requestIDFromContext(r.Context()))
+		w.Header().Set("Location", "/jobs/"+j.ID)
+		writeJSON(w, http.StatusAccepted, j.Job)
+		return
+	}
+
+	// Run the files on as many slots as are free, up to BATCH_CONCURRENCY
+	concurrency := 1
+	for concurrency < cfg().batchConcurrency {
+		releaseExtra, ok := slots.tryAcquire(prio)
+		if !ok {
+			break
+		}
+		defer releaseExtra()
+		concurrency++
+	}
+	writeJSON(w, http.StatusOK, BatchResponse{Results: b.run(ctx, concurrency)})
+}
+
+// readBatch reads the parameters of a batch and spools its files. The
+// batch is returned whenever files were spooled, so they can be removed.
+func readBatch(r *http.Request) (*batch, bool, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return nil, false, newHTTPError(http.StatusBadRequest, "Failed to parse form: %v", err)
+	}
+	async, err := parseOptionalBool(r.FormValue("async"))
+	if err != nil {
+		return nil, false, newHTTPError(http.StatusBadRequest, "invalid async: %v", err)
+	}
+	switch {
+	case r.FormValue("audio_url") != "":
+		return nil, false, newHTTPError(http.StatusBadRequest, "batches take files instead of audio_url")
+	case r.FormValue("mode") == modeLLMOnly:
+		return nil, false, newHTTPError(http.StatusBadRequest, "batches can't use mode %s", modeLLMOnly)
+	}
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		return nil, false, newHTTPError(http.StatusBadRequest, "send the audio files as file parts")
+	}
+
+	// Read the shared parameters as /process would with the first file
+	r.MultipartForm.File["file"] = headers[:1]
+	input, err := readProcessInput(r)
+	r.MultipartForm.File["file"] = headers
+	if err != nil {
+		return nil, false, err
+	}
+	input.Audio.Close()
+	input.Audio, input.Filename = http.NoBody, ""
+	switch {
+	case input.Stream || input.RawStream:
+		return nil, false, newHTTPError(http.StatusBadRequest, "batches can't be streamed")
+	case input.ResponseFormat != responseFormatJSON || input.Download || (input.TTS && input.TTSDelivery != speechDeliveryURL):
+		return nil, false, newHTTPError(http.StatusBadRequest, "batch results are always JSON")
+	case input.SessionID != "":
+		return nil, false, newHTTPError(http.StatusBadRequest, "batches can't continue a session")
+	}
+
+	b := &batch{input: input}
+	extracted := int64(0)
+	for _, header := range headers {
+		if err := b.add(header, &extracted); err != nil {
+			return b, false, err
+		}
+	}
+	if len(b.files) == 0 {
+		return b, false, newHTTPError(http.StatusBadRequest, "the zip archives hold no files")
+	}
+	return b, async, nil
+}
+
+// add spools an uploaded file, or the files of a zip archive, adding up
+// the bytes extracted from archives in extracted
+func (b *batch) add(header *multipart.FileHeader, extracted *int64) error {
+	file, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if !isZip(header) {
+		return b.spool(header.Filename, file)
+	}
+
+	archive, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "invalid zip archive %s: %v", header.Filename, err)
+	}
+	limit := int64(cfg().batchMaxZipMB) << 20
+	for _, entry := range archive.File {
+		name := entry.Name
+		if entry.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, "invalid zip entry %s: %v", name, err)
+		}
+		// Sizes in the archive can lie, so the limit is enforced on the
+		// bytes read
+		err = b.spool(path.Base(name), &limitedZipReader{r: rc, left: limit - *extracted})
+		*extracted += int64(entry.UncompressedSize64)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spool copies a file of the batch to a temp file, once its content was
+// found to be audio in an allowed format
+func (b *batch) spool(name string, audio io.Reader) error {
+	if len(b.files) == cfg().maxBatchSize {
+		return newHTTPError(http.StatusBadRequest, "a batch holds at most %d files (MAX_BATCH_SIZE)", cfg().maxBatchSize)
+	}
+	checked, err := checkAudioFormat(io.NopCloser(audio), name)
+	if err != nil {
+		return err
+	}
+	path, err := spoolAudio(checked, name)
+	if path != "" {
+		b.files = append(b.files, batchFile{name: name, path: path})
+	}
+	var limitErr *httpError
+	if errors.As(err, &limitErr) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", name, err)
+	}
+	return nil
+}
+
+// isZip reports whether an uploaded file is a zip archive, by its name or
+// content type
+func isZip(header *multipart.FileHeader) bool {
+	switch header.Header.Get("Content-Type") {
+	case "application/zip", "application/x-zip-compressed":
+		return true
+	}
+	return strings.EqualFold(path.Ext(header.Filename), ".zip")
+}
+
+// limitedZipReader fails once more than left bytes were read, so a zip
+// bomb can't fill the disk
+type limitedZipReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitedZipReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, newHTTPError(http.StatusRequestEntityTooLarge, "the zip archives hold more than %d MB of audio (BATCH_MAX_ZIP_MB)", cfg().batchMaxZipMB)
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
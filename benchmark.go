@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits for a single benchmark run
+const maxBenchmarkRequests = 1000
+
+// BenchmarkRequest is the optional JSON body of POST /admin/benchmark
+type BenchmarkRequest struct {
+	Requests    int    `json:"requests"`
+	Concurrency int    `json:"concurrency"`
+	Model       string `json:"model"`
+}
+
+// BenchmarkResponse reports latencies of each pipeline stage
+type BenchmarkResponse struct {
+	Requests    int        `json:"requests"`
+	Concurrency int        `json:"concurrency"`
+	Model       string     `json:"model"`
+	Whisper     StageStats `json:"whisper"`
+	Ollama      StageStats `json:"ollama"`
+}
+
+// StageStats summarises the synthetic requests sent to one upstream
+type StageStats struct {
+	Completed  int     `json:"completed"`
+	Errors     int     `json:"errors"`
+	P50        float64 `json:"p50_ms"`
+	P95        float64 `json:"p95_ms"`
+	P99        float64 `json:"p99_ms"`
+	Throughput float64 `json:"throughput_rps"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+// benchmarkHandler runs synthetic requests against Whisper and then Ollama
+// and reports latency percentiles and throughput for each stage. The run
+// holds one concurrency slot per worker, so it can't push the server past
+// MAX_CONCURRENT_REQUESTS.
+func benchmarkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := BenchmarkRequest{Requests: 10, Concurrency: 1, Model: "llama3"}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to parse JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Requests < 1 || req.Requests > maxBenchmarkRequests {
+		http.Error(w, fmt.Sprintf("requests must be between 1 and %d", maxBenchmarkRequests), http.StatusBadRequest)
+		return
+	}
+	if req.Concurrency < 1 || req.Concurrency > req.Requests {
+		http.Error(w, "concurrency must be between 1 and requests", http.StatusBadRequest)
+		return
+	}
+
+	// Reserve a slot per worker up front
+	for i := 0; i < req.Concurrency; i++ {
+		release, ok := slots.tryAcquire(priorityNormal)
+		if !ok {
+			http.Error(w, "Server is at capacity, please try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+
+	// Write the bundled sample clip once for all Whisper requests
+	sample, err := os.CreateTemp("", "benchmark-*.wav")
+	if err != nil {
+		http.Error(w, "Failed to create temp file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(sample.Name())
+	_, err = sample.Write(benchmarkClip())
+	sample.Close()
+	if err != nil {
+		http.Error(w, "Failed to write temp file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	whisperStats := runBenchmarkStage(ctx, req.Requests, req.Concurrency, func(ctx context.Context) error {
+		_, err := transcribeWithWhisper(ctx, sample.Name(), whisperOptions{})
+		return err
+	})
+	ollamaStats := runBenchmarkStage(ctx, req.Requests, req.Concurrency, func(ctx context.Context) error {
+		_, err := generateWithOllama(ctx, req.Model, buildPrompt("Reply with a single word.", "benchmark"), nil, nil)
+		return err
+	})
+
+	writeJSON(w, http.StatusOK, BenchmarkResponse{
+		Requests:    req.Requests,
+		Concurrency: req.Concurrency,
+		Model:       req.Model,
+		Whisper:     whisperStats,
+		Ollama:      ollamaStats,
+	})
+}
+
+// runBenchmarkStage calls fn total times from concurrency workers
+func runBenchmarkStage(ctx context.Context, total, concurrency int, fn func(context.Context) error) StageStats {
+	jobs := make(chan struct{}, total)
+	for i := 0; i < total; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	var mu sync.Mutex
+	var stats StageStats
+	var latencies []float64
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				callCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg().requestTimeout)*time.Second)
+				callStart := time.Now()
+				err := fn(callCtx)
+				elapsed := time.Since(callStart)
+				cancel()
+
+				mu.Lock()
+				if err != nil {
+					stats.Errors++
+					stats.LastError = err.Error()
+				} else {
+					stats.Completed++
+					latencies = append(latencies, float64(elapsed.Microseconds())/1000)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Float64s(latencies)
+	stats.P50 = percentile(latencies, 50)
+	stats.P95 = percentile(latencies, 95)
+	stats.P99 = percentile(latencies, 99)
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		stats.Throughput = float64(stats.Completed) / elapsed
+	}
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// benchmarkClip returns the bundled sample: three seconds of a 440 Hz tone
+// as 16 kHz mono 16-bit PCM WAV
+func benchmarkClip() []byte {
+	const sampleRate = 16000
+	const samples = 3 * sampleRate
+
+	data := append(monoWAVHeader(wavFormatPCM, sampleRate, 16, samples*2), make([]byte, samples*2)...)
+
+	for i := 0; i < samples; i++ {
+		v := int16(8000 * math.Sin(2*math.Pi*440*float64(i)/sampleRate))
+		binary.LittleEndian.PutUint16(data[44+i*2:], uint16(v))
+	}
+	return data
+}
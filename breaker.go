@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of calling an upstream whose circuit
+// breaker is open
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitOpenError is errCircuitOpen from a particular breaker, so the
+// Retry-After sent to the client matches it
+type circuitOpenError struct {
+	breaker *circuitBreaker
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%s %v", e.breaker.name, errCircuitOpen)
+}
+
+func (e *circuitOpenError) Unwrap() error { return errCircuitOpen }
+
+// circuitBreaker stops calling an upstream after threshold consecutive
+// failures. While open, calls fail fast until the cooldown has elapsed;
+// then calls are let through again and a single failure re-opens it.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns errCircuitOpen while the breaker is open
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.openUntil) {
+		return &circuitOpenError{breaker: b}
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a call. Client errors and
+// cancellations say nothing about upstream health and are ignored.
+func (b *circuitBreaker) record(err error) {
+	if err != nil && !isUpstreamFailure(err) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.failures >= b.threshold {
+			log.Printf("Circuit breaker for %s closed", b.name)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if !time.Now().Before(b.openUntil) {
+			log.Printf("Circuit breaker for %s opened after %d failures", b.name, b.failures)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// retryAfter returns the remaining open time in whole seconds, at least 1
+func (b *circuitBreaker) retryAfter() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	secs := int(time.Until(b.openUntil).Seconds() + 0.999)
+	return strconv.Itoa(max(secs, 1))
+}
+
+// isUpstreamFailure reports whether err indicates an unhealthy upstream:
+// transport errors and 5xx answers
+func isUpstreamFailure(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		return ue.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// writeCircuitOpen rejects the request with 503 when b is open. It returns
+// false, writing nothing, when calls are allowed.
+func writeCircuitOpen(w http.ResponseWriter, b *circuitBreaker) bool {
+	return writeCircuitOpenError(w, b.allow())
+}
+
+// writeCircuitOpenError reports a call refused by an open breaker as 503
+// with a Retry-After header for the breaker's remaining cooldown. It
+// returns false, writing nothing, for other errors.
+func writeCircuitOpenError(w http.ResponseWriter, err error) bool {
+	var open *circuitOpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	w.Header().Set("Retry-After", open.breaker.retryAfter())
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Values of TRANSCRIPTION_CACHE and LLM_CACHE
+const (
+	cacheOff    = "off"
+	cacheMemory = "memory"
+	cacheRedis  = "redis"
+)
+
+// Values of the cache field
+const cacheBypass = "bypass"
+
+// Lookups in the cache request metrics
+const (
+	cacheHit      = "hit"
+	cacheMiss     = "miss"
+	cacheBypassed = "bypass"
+)
+
+// byteCache keeps entries by key for a while. The transcription and LLM
+// response caches keep JSON in one.
+type byteCache interface {
+	// get returns the entry, or nil for an unknown or expired one
+	get(ctx context.Context, key string) ([]byte, error)
+	// set stores the entry for ttl
+	set(ctx context.Context, key string, entry []byte, ttl time.Duration) error
+}
+
+// newCache returns the cache kind names, nil for off: one in memory that
+// keeps up to maxEntries, or one in Redis at REDIS_URL under keyPrefix.
+// setting names the setting that chose kind in errors.
+func newCache(setting, kind string, maxEntries int, keyPrefix string) (byteCache, error) {
+	switch kind {
+	case cacheOff:
+		return nil, nil
+	case cacheMemory:
+		return newMemoryCache(maxEntries), nil
+	case cacheRedis:
+		client, err := newRedisClient(cfg().redisURL)
+		if err != nil {
+			return nil, fmt.Errorf("REDIS_URL: %w", err)
+		}
+		return redisCache{client: client, prefix: keyPrefix}, nil
+	}
+	return nil, fmt.Errorf("%s must be %s, %s or %s, got %q", setting, cacheOff, cacheMemory, cacheRedis, kind)
+}
+
+// checkCacheConfig reports what is wrong with a cache's settings
+func (c *config) checkCacheConfig(setting, kind string) error {
+	switch kind {
+	case cacheOff, cacheMemory:
+		return nil
+	case cacheRedis:
+		if _, err := newRedisClient(c.redisURL); err != nil {
+			return fmt.Errorf("REDIS_URL: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s must be %s, %s or %s, got %q", setting, cacheOff, cacheMemory, cacheRedis, kind)
+}
+
+// parseCacheMode checks the cache field: empty, or bypass to skip the
+// caches
+func parseCacheMode(value string) (string, error) {
+	if value != "" && value != cacheBypass {
+		return "", newHTTPError(http.StatusBadRequest, "cache must be %s, got %q", cacheBypass, value)
+	}
+	return value, nil
+}
+
+// memoryCache keeps entries in memory, evicting the least recently used
+// one when it is full. Expired entries are dropped when they are looked up.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *memoryCacheEntry, front is most recently used
+	max     int
+}
+
+type memoryCacheEntry struct {
+	key     string
+	entry   []byte
+	expires time.Time
+}
+
+func newMemoryCache(maxEntries int) *memoryCache {
+	return &memoryCache{entries: make(map[string]*list.Element), lru: list.New(), max: maxEntries}
+}
+
+func (c *memoryCache) get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e := elem.Value.(*memoryCacheEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, nil
+	}
+	c.lru.MoveToFront(elem)
+	return e.entry, nil
+}
+
+func (c *memoryCache) set(ctx context.Context, key string, entry []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(ttl)
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*memoryCacheEntry)
+		e.entry, e.expires = entry, expires
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+	for len(c.entries) >= c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&memoryCacheEntry{key: key, entry: entry, expires: expires})
+	return nil
+}
+
+// size returns the number of entries kept, including expired ones not
+// looked up since
+func (c *memoryCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// redisCache keeps entries in Redis under a key prefix, expiring them with
+// Redis's own TTL, so several bridges can share them
+type redisCache struct {
+	client *redisClient
+	prefix string
+}
+
+func (c redisCache) get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.client.do(ctx, "GET", c.prefix+key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	data, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to GET: %v", value)
+	}
+	return []byte(data), nil
+}
+
+func (c redisCache) set(ctx context.Context, key string, entry []byte, ttl time.Duration) error {
+	_, err := c.client.do(ctx, "SET", c.prefix+key, string(entry), "EX", fmt.Sprint(int(ttl.Seconds())))
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Candidate is a single LLM generation when several are requested
+type Candidate struct {
+	Response    string `json:"response"`
+	ProcessTime int64  `json:"process_time_ms"`
+	DoneReason  string `json:"done_reason,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	ollamaResp *OllamaResponse
+}
+
+// parseCandidateCount validates the optional n form field. An empty value
+// means a single generation.
+func parseCandidateCount(value string) (int, error) {
+	if value == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("n must be between 1 and %d", cfg().maxCandidates)
+	}
+	return n, validateCandidateCount(n)
+}
+
+func validateCandidateCount(n int) error {
+	if n < 1 || n > cfg().maxCandidates {
+		return fmt.Errorf("n must be between 1 and %d", cfg().maxCandidates)
+	}
+	return nil
+}
+
+// checkCandidateOptions refuses n > 1 with options that make every
+// generation the same, a temperature of 0 or a fixed seed, which would pay
+// n times for one answer
+func checkCandidateOptions(n int, options map[string]any) error {
+	if n <= 1 {
+		return nil
+	}
+	if _, ok := options["seed"]; ok {
+		return newHTTPError(http.StatusBadRequest, "seed can't be combined with n > 1, the candidates would be identical")
+	}
+	switch temperature := options["temperature"].(type) {
+	case int:
+		if temperature == 0 {
+			return newHTTPError(http.StatusBadRequest, "temperature 0 can't be combined with n > 1, the candidates would be identical")
+		}
+	case float64:
+		if temperature == 0 {
+			return newHTTPError(http.StatusBadRequest, "temperature 0 can't be combined with n > 1, the candidates would be identical")
+		}
+	}
+	return nil
+}
+
+// generateCandidates runs the LLM step n times concurrently. Sampling uses
+// candidateTemperature, unless the request sets a temperature, so the
+// generations actually differ. Results are returned in start order;
+// failed generations carry an error instead of a response.
+func generateCandidates(ctx context.Context, model, prompt string, options map[string]any, n int) []Candidate {
+	options = mergeLLMOptions(options, map[string]any{"temperature": cfg().candidateTemperature})
+	// Identical generations would be answered from the cache
+	ctx = withLLMCacheMode(ctx, llmCacheSkip)
+	candidates := make([]Candidate, n)
+
+	var wg sync.WaitGroup
+	for i := range candidates {
+		wg.Add(1)
+		go func(c *Candidate) {
+			defer wg.Done()
+			start := time.Now()
+			resp, err := processWithLLM(ctx, model, prompt, options)
+			c.ProcessTime = time.Since(start).Milliseconds()
+			if err != nil {
+				c.Error = err.Error()
+				return
+			}
+			c.Response = resp.Response
+			c.DoneReason = resp.DoneReason
+			c.ollamaResp = resp
+		}(&candidates[i])
+	}
+	wg.Wait()
+
+	return candidates
+}
+
+// firstSuccessful returns the first candidate that produced a response
+func firstSuccessful(candidates []Candidate) (Candidate, bool) {
+	for _, c := range candidates {
+		if c.Error == "" {
+			return c, true
+		}
+	}
+	return Candidate{}, false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckCandidateOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		options map[string]any
+		wantErr bool
+	}{
+		{"one candidate with temperature 0", 1, map[string]any{"temperature": 0.0}, false},
+		{"one candidate with a seed", 1, map[string]any{"seed": 42}, false},
+		{"no options", 3, nil, false},
+		{"temperature set", 3, map[string]any{"temperature": 0.7}, false},
+		{"temperature 0", 3, map[string]any{"temperature": 0.0}, true},
+		{"integer temperature 0", 3, map[string]any{"temperature": 0}, true},
+		{"seed", 3, map[string]any{"seed": 42}, true},
+		{"seed 0", 2, map[string]any{"seed": 0, "temperature": 0.7}, true},
+	}
+	for _, tt := range tests {
+		err := checkCandidateOptions(tt.n, tt.options)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkCandidateOptions = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIdenticalCandidatesRejected(t *testing.T) {
+	for _, body := range []string{
+		`{"mode": "llm_only", "text": "hi", "n": 2, "temperature": 0}`,
+		`{"mode": "llm_only", "text": "hi", "n": 2, "options": {"seed": 7}}`,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/process", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		_, err := readProcessInput(r)
+		var httpErr *httpError
+		if !errors.As(err, &httpErr) || httpErr.status != http.StatusBadRequest || !strings.Contains(httpErr.msg, "n > 1") {
+			t.Errorf("%s: readProcessInput = %v, want a 400 about n > 1", body, err)
+		}
+	}
+}
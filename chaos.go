@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// chaosConfirmation must be the value of CHAOS_CONFIRM for CHAOS_MODE to
+// start, so the mode can't be switched on by a stray boolean
+const chaosConfirmation = "inject-failures"
+
+// withChaos wraps a handler with random fault injection for resilience
+// testing: failing with 503, delaying, or corrupting the response body.
+// Every injected fault is logged and marked with an X-Chaos-Fault header.
+func withChaos(next http.HandlerFunc) http.HandlerFunc {
+	if !cfg().chaosMode {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := cfg()
+		requestID := requestIDFromContext(r.Context())
+
+		if rand.Float64() < c.chaosLatencyRate {
+			delay := time.Duration(rand.Int64N(int64(c.chaosMaxLatency)*int64(time.Millisecond) + 1))
+			log.Printf("Chaos: delaying by %s request_id=%s", delay.Round(time.Millisecond), requestID)
+			w.Header().Add("X-Chaos-Fault", "latency")
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if rand.Float64() < c.chaosErrorRate {
+			log.Printf("Chaos: failing with 503 request_id=%s", requestID)
+			w.Header().Add("X-Chaos-Fault", "error")
+			w.Header().Set("Retry-After", strconv.Itoa(c.defaultRetryAfter))
+			http.Error(w, "chaos: injected failure", http.StatusServiceUnavailable)
+			return
+		}
+
+		if rand.Float64() < c.chaosCorruptRate {
+			log.Printf("Chaos: corrupting response request_id=%s", requestID)
+			w.Header().Add("X-Chaos-Fault", "corrupt")
+			rec := &chaosRecorder{ResponseWriter: w, status: http.StatusOK}
+			next(rec, r)
+			body := rec.body.Bytes()
+			w.Header().Del("Content-Length")
+			w.WriteHeader(rec.status)
+			w.Write(body[:len(body)/2])
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// chaosRecorder buffers a response so it can be corrupted before sending
+type chaosRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *chaosRecorder) WriteHeader(status int) { c.status = status }
+
+func (c *chaosRecorder) Write(p []byte) (int, error) { return c.body.Write(p) }
+
+// Unwrap keeps upload read deadlines working on the underlying connection
+func (c *chaosRecorder) Unwrap() http.ResponseWriter { return c.ResponseWriter }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+// audioChunk is a stretch of a long recording transcribed on its own
+type audioChunk struct {
+	Start, End float64 // seconds
+}
+
+// ChunkProgress reports a transcribed chunk of a long recording, as sent in
+// SSE chunk_transcribed events. Percent is the share of the chunks
+// reported so far.
+type ChunkProgress struct {
+	Index   int     `json:"index"`
+	Chunks  int     `json:"chunks"`
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Text    string  `json:"text"`
+	Percent float64 `json:"percent"`
+}
+
+// transcribeAudioFile transcribes the audio file at path, in overlapping
+// chunks when it is a WAV file longer than AUDIO_CHUNK_SECONDS. Other
+// formats can't be cut without a decoder and are sent whole. So is audio
+// the ASR backend diarizes, whose speaker labels wouldn't match across
+// chunks.
+func transcribeAudioFile(ctx context.Context, path string, opts whisperOptions) (*WhisperResponse, error) {
+	if cfg().audioChunkSeconds == 0 || opts.Diarize {
+		return transcribeWithWhisper(ctx, path, opts)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	wav, err := readWAVHeader(file)
+	if err != nil {
+		return transcribeWithWhisper(ctx, path, opts)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Streaming encoders may leave the data size unset
+	frameSize := int64(wav.Channels * wav.BitsPerSample / 8)
+	if frameSize == 0 || wav.SampleRate == 0 {
+		return transcribeWithWhisper(ctx, path, opts)
+	}
+	frames := min(wav.DataSize, stat.Size()-wav.DataOffset) / frameSize
+	duration := float64(frames) / float64(wav.SampleRate)
+	if duration <= float64(cfg().audioChunkSeconds) {
+		return transcribeWithWhisper(ctx, path, opts)
+	}
+
+	chunks := planChunks(duration)
+	results, err := transcribeChunks(ctx, file, wav, frames, chunks, opts)
+	if err != nil {
+		return nil, err
+	}
+	return stitchChunks(chunks, results), nil
+}
+
+// planChunks cuts duration seconds into chunks of AUDIO_CHUNK_SECONDS that
+// overlap by AUDIO_CHUNK_OVERLAP_SECONDS, so words cut at a chunk's end
+// are heard whole in the next one. The last chunk is stretched by up to a
+// quarter rather than leave a short one.
+func planChunks(duration float64) []audioChunk {
+	length, overlap := float64(cfg().audioChunkSeconds), float64(cfg().audioChunkOverlap)
+	var chunks []audioChunk
+	for start := 0.0; ; start += length - overlap {
+		end := start + length
+		if end+length/4 >= duration {
+			return append(chunks, audioChunk{Start: start, End: duration})
+		}
+		chunks = append(chunks, audioChunk{Start: start, End: end})
+	}
+}
+
+// transcribeChunks transcribes the chunks of the WAV file concurrently.
+// One worker runs on the request's own slot; up to AUDIO_CHUNK_CONCURRENCY
+// - 1 more take free slots of the shared pool, never the ones reserved for
+// high priority, so chunked requests don't push the server past
+// MAX_CONCURRENT_REQUESTS. The first failure cancels the other chunks.
+// Chunks are passed to the reporter of ctx, if any, in order: one that
+// finishes early waits for those before it.
+func transcribeChunks(ctx context.Context, file *os.File, wav *wavInfo, frames int64, chunks []audioChunk, opts whisperOptions) ([]*WhisperResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indexes := make(chan int, len(chunks))
+	for i := range chunks {
+		indexes <- i
+	}
+	close(indexes)
+
+	report, _ := ctx.Value(chunkProgressKey).(func(ChunkProgress))
+	results := make([]*WhisperResponse, len(chunks))
+	var mu sync.Mutex // guards results and reported
+	reported := 0
+	var firstErr error
+	var once sync.Once
+	var wg sync.WaitGroup
+	work := func() {
+		defer wg.Done()
+		for i := range indexes {
+			if ctx.Err() != nil {
+				return
+			}
+			result, err := transcribeChunk(ctx, file, wav, frames, chunks[i], opts)
+			if err != nil {
+				once.Do(func() {
+					firstErr = fmt.Errorf("chunk %d of %d: %w", i+1, len(chunks), err)
+					cancel()
+				})
+				return
+			}
+			mu.Lock()
+			results[i] = result
+			for ; report != nil && reported < len(chunks) && results[reported] != nil; reported++ {
+				chunk := chunks[reported]
+				report(ChunkProgress{
+					Index:   reported,
+					Chunks:  len(chunks),
+					Start:   chunk.Start,
+					End:     chunk.End,
+					Text:    results[reported].Text,
+					Percent: math.Round(float64(reported+1)*1000/float64(len(chunks))) / 10,
+				})
+			}
+			mu.Unlock()
+		}
+	}
+
+	wg.Add(1)
+	go work()
+	for n := 1; n < min(cfg().audioChunkConcurrency, len(chunks)); n++ {
+		release, ok := slots.tryAcquire(priorityNormal)
+		if !ok {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer release()
+			work()
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
+
+// transcribeChunk copies the chunk's frames to a WAV file of their own and
+// transcribes it
+func transcribeChunk(ctx context.Context, file *os.File, wav *wavInfo, frames int64, chunk audioChunk, opts whisperOptions) (*WhisperResponse, error) {
+	frameSize := int64(wav.Channels * wav.BitsPerSample / 8)
+	first := int64(chunk.Start * float64(wav.SampleRate))
+	last := min(int64(math.Ceil(chunk.End*float64(wav.SampleRate))), frames)
+	size := (last - first) * frameSize
+
+	out, err := os.CreateTemp("", "chunk-*.wav")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out.Name())
+	_, err = out.Write(wavHeader(wav.Format, wav.Channels, wav.SampleRate, wav.BitsPerSample, size))
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(file, wav.DataOffset+first*frameSize, size))
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write chunk: %w", err)
+	}
+	return transcribeWithWhisper(ctx, out.Name(), opts)
+}
+
+// stitchChunks joins the transcriptions of overlapping chunks. Segment and
+// word times are shifted to the whole recording's, and within each overlap
+// the earlier chunk's segments are kept up to its middle and the later
+// chunk's after it, so speech in the overlap appears once. Chunks whose
+// backend returned no timed segments contribute their text whole.
+func stitchChunks(chunks []audioChunk, results []*WhisperResponse) *WhisperResponse {
+	first := results[0]
+	stitched := &WhisperResponse{
+		Language:            first.Language,
+		LanguageProbability: first.LanguageProbability,
+		Model:               first.Model,
+		Version:             first.Version,
+		Chunks:              len(chunks),
+	}
+	var texts []string
+	for i, result := range results {
+		offset := chunks[i].Start
+		from, to := math.Inf(-1), math.Inf(1)
+		if i > 0 {
+			from = (chunks[i-1].End + chunks[i].Start) / 2
+		}
+		if i < len(chunks)-1 {
+			to = (chunks[i].End + chunks[i+1].Start) / 2
+		}
+
+		if len(result.Segments) == 0 || !result.Segments[0].timed() {
+			if text := strings.TrimSpace(result.Text); text != "" {
+				texts = append(texts, text)
+			}
+			continue
+		}
+		var kept []Segment
+		for _, segment := range result.Segments {
+			segment.Start += offset
+			segment.End += offset
+			if middle := (segment.Start + segment.End) / 2; middle < from || middle >= to {
+				continue
+			}
+			for j := range segment.Words {
+				segment.Words[j].Start += offset
+				segment.Words[j].End += offset
+			}
+			segment.ID = len(stitched.Segments)
+			stitched.Segments = append(stitched.Segments, segment)
+			kept = append(kept, segment)
+		}
+		if text := textFromSegments(kept); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	stitched.Text = strings.Join(texts, " ")
+	return stitched
+}
+
+// withChunkProgress makes a chunked transcription report each chunk to the
+// client, when stream can show it
+func withChunkProgress(ctx context.Context, stream tokenStream) context.Context {
+	reporter, ok := stream.(interface{ chunk(ChunkProgress) })
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, chunkProgressKey, reporter.chunk)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"whisper-ollama-go/pkg/client"
+)
+
+func newJobsCommand(opts *options) *cobra.Command {
+	jobs := &cobra.Command{
+		Use:   "jobs",
+		Short: "List, inspect and cancel async jobs",
+	}
+
+	var status string
+	var limit int
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the jobs, newest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel := opts.client(cmd)
+			defer cancel()
+			list, err := c.ListJobs(ctx, status, limit)
+			if err != nil {
+				return explain(err)
+			}
+			if opts.json {
+				return printJSON(list)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tSTATUS\tCREATED\tDURATION\tERROR")
+			for _, job := range list {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", job.ID, job.Status, job.CreatedAt.Local().Format(time.DateTime), duration(job), job.Error)
+			}
+			return w.Flush()
+		},
+	}
+	list.Flags().StringVar(&status, "status", "", "only jobs with this status: queued, running, completed, failed or cancelled")
+	list.Flags().IntVar(&limit, "limit", 0, "at most this many jobs (the bridge's default of 100 when 0)")
+
+	get := &cobra.Command{
+		Use:   "get ID",
+		Short: "Show a job and its result",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel := opts.client(cmd)
+			defer cancel()
+			job, err := c.Job(ctx, args[0])
+			if err != nil {
+				return explain(err)
+			}
+			return printJSON(job)
+		},
+	}
+
+	var interval time.Duration
+	wait := &cobra.Command{
+		Use:   "wait ID",
+		Short: "Wait for a job to finish and show it",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel := opts.client(cmd)
+			defer cancel()
+			job, err := c.WaitJob(ctx, args[0], interval)
+			if err != nil {
+				return explain(err)
+			}
+			return printJSON(job)
+		},
+	}
+	wait.Flags().DurationVar(&interval, "interval", client.DefaultPollInterval, "how often to poll the job")
+
+	cancelJob := &cobra.Command{
+		Use:   "cancel ID",
+		Short: "Cancel a queued or running job",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel := opts.client(cmd)
+			defer cancel()
+			job, err := c.CancelJob(ctx, args[0])
+			if err != nil {
+				return explain(err)
+			}
+			fmt.Printf("Job %s %s\n", job.ID, job.Status)
+			return nil
+		},
+	}
+
+	jobs.AddCommand(list, get, wait, cancelJob)
+	return jobs
+}
+
+// duration is how long the job ran, or has been running, blank when it
+// hasn't started
+func duration(job client.Job) string {
+	if job.StartedAt == nil {
+		return ""
+	}
+	end := time.Now()
+	if job.FinishedAt != nil {
+		end = *job.FinishedAt
+	}
+	return end.Sub(*job.StartedAt).Round(100 * time.Millisecond).String()
+}
@@ -0,0 +1,99 @@
+// Command bridgectl calls a whisper-llm-bridge from the command line, for
+// scripts and for checking on a deployment:
+//
+//	bridgectl transcribe call.wav
+//	bridgectl process --model llama3 --template summary call.mp3
+//	bridgectl jobs list --status running
+//
+// The bridge is given with --server or BRIDGE_SERVER, and an API key or
+// JWT with --token or BRIDGE_TOKEN.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"whisper-ollama-go/pkg/client"
+)
+
+// options are the flags every command takes
+type options struct {
+	server  string
+	token   string
+	timeout time.Duration
+	retries int
+	json    bool
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := newRootCommand().ExecuteContext(ctx); err != nil {
+		stop()
+		os.Exit(1)
+	}
+}
+
+func newRootCommand() *cobra.Command {
+	opts := &options{}
+	root := &cobra.Command{
+		Use:          "bridgectl",
+		Short:        "Call a whisper-llm-bridge from the command line",
+		SilenceUsage: true,
+	}
+	flags := root.PersistentFlags()
+	flags.StringVar(&opts.server, "server", envOr("BRIDGE_SERVER", "http://localhost:8080"), "URL of the bridge (env BRIDGE_SERVER)")
+	flags.StringVar(&opts.token, "token", os.Getenv("BRIDGE_TOKEN"), "API key or JWT (env BRIDGE_TOKEN)")
+	flags.DurationVar(&opts.timeout, "timeout", 0, "give up after this long, e.g. 5m (0 waits as long as it takes)")
+	flags.IntVar(&opts.retries, "retries", client.DefaultMaxRetries, "retries while the bridge is overloaded")
+	flags.BoolVar(&opts.json, "json", false, "print the bridge's full JSON response")
+
+	root.AddCommand(newTranscribeCommand(opts), newProcessCommand(opts), newJobsCommand(opts), newModelsCommand(opts))
+	return root
+}
+
+// client returns the client of the bridge and the context for a command,
+// bounded by --timeout
+func (o *options) client(cmd *cobra.Command) (*client.Client, context.Context, context.CancelFunc) {
+	c := client.New(o.server)
+	c.Token = o.token
+	c.MaxRetries = o.retries
+	ctx, cancel := cmd.Context(), context.CancelFunc(func() {})
+	if o.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+	}
+	return c, ctx, cancel
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// explain adds what an error of the bridge means for the user
+func explain(err error) error {
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.RequestID != "" {
+		return fmt.Errorf("%w (request ID %s)", err, apiErr.RequestID)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.New("timed out; raise --timeout")
+	}
+	return err
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
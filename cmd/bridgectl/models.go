@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func newModelsCommand(opts *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "models",
+		Short: "List the models the bridge can run",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel := opts.client(cmd)
+			defer cancel()
+			models, err := c.Models(ctx)
+			if err != nil {
+				return explain(err)
+			}
+			if opts.json {
+				return printJSON(models)
+			}
+
+			asr := models.ASR.Backend
+			if models.ASR.Model != "" {
+				asr += " " + models.ASR.Model
+			}
+			fmt.Printf("ASR: %s\n", asr)
+			fmt.Printf("Default LLM: %s %s\n\n", models.LLM.DefaultProvider, models.LLM.DefaultModel)
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tPARAMETERS\tQUANTIZATION\tCONTEXT\tSIZE")
+			for _, model := range models.LLM.Models {
+				contextLength := ""
+				if model.ContextLength > 0 {
+					contextLength = strconv.Itoa(model.ContextLength)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", model.Name, model.ParameterSize, model.QuantizationLevel, contextLength, size(model.SizeBytes))
+			}
+			for _, alias := range slices.Sorted(maps.Keys(models.LLM.Aliases)) {
+				fmt.Fprintf(w, "%s\t→ %s\t\t\t\n", alias, models.LLM.Aliases[alias])
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			for _, message := range models.Errors {
+				fmt.Fprintf(os.Stderr, "Could not list %s\n", message)
+			}
+			return nil
+		},
+	}
+}
+
+// size formats a byte count in GB or MB
+func size(bytes int64) string {
+	switch {
+	case bytes <= 0:
+		return ""
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(bytes)/(1<<30))
+	}
+	return fmt.Sprintf("%.0f MB", float64(bytes)/(1<<20))
+}
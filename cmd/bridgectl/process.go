@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"whisper-ollama-go/pkg/client"
+)
+
+// processFlags are the /process fields the process command sets
+type processFlags struct {
+	model    string
+	template string
+	prompt   string
+	system   string
+	provider string
+	pipeline string
+	language string
+	task     string
+	priority string
+	fields   []string
+	stream   bool
+	async    bool
+}
+
+func newTranscribeCommand(opts *options) *cobra.Command {
+	var language, task string
+	cmd := &cobra.Command{
+		Use:   "transcribe FILE|URL",
+		Short: "Transcribe a recording without the LLM step",
+		Long: "Transcribe a recording without the LLM step and print the transcription.\n" +
+			"FILE may be - for stdin, or an http(s) or s3:// URL the bridge downloads.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := client.ProcessRequest{Mode: "transcribe_only", Language: language, Task: task}
+			closeAudio, err := setAudio(&req, args[0])
+			if err != nil {
+				return err
+			}
+			defer closeAudio()
+
+			c, ctx, cancel := opts.client(cmd)
+			defer cancel()
+			resp, err := c.Process(ctx, req)
+			if err != nil {
+				return explain(err)
+			}
+			if opts.json {
+				return printJSON(resp)
+			}
+			fmt.Println(strings.TrimSpace(resp.Transcription))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&language, "language", "", "language of the audio, e.g. de (detected when empty)")
+	cmd.Flags().StringVar(&task, "task", "", "transcribe, or translate to English")
+	return cmd
+}
+
+func newProcessCommand(opts *options) *cobra.Command {
+	var f processFlags
+	cmd := &cobra.Command{
+		Use:   "process FILE|URL",
+		Short: "Transcribe a recording and run the LLM step on it",
+		Long: "Transcribe a recording, run the LLM step on it and print the LLM's answer.\n" +
+			"FILE may be - for stdin, or an http(s) or s3:// URL the bridge downloads.\n" +
+			"Other /process fields are set with --field name=value.",
+		Example: "  bridgectl process --model llama3 --template summary call.mp3\n" +
+			"  bridgectl process --stream --prompt 'List the action items' meeting.wav\n" +
+			"  bridgectl process --async --field diarize=true https://recordings.example.com/call-42.mp3",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if f.stream && f.async {
+				return fmt.Errorf("--stream and --async can't be combined")
+			}
+			req := client.ProcessRequest{
+				Model:    f.model,
+				Template: f.template,
+				Prompt:   f.prompt,
+				System:   f.system,
+				Provider: f.provider,
+				Pipeline: f.pipeline,
+				Language: f.language,
+				Task:     f.task,
+				Priority: f.priority,
+				Fields:   map[string]string{},
+			}
+			for _, field := range f.fields {
+				name, value, ok := strings.Cut(field, "=")
+				if !ok || name == "" {
+					return fmt.Errorf("invalid --field %q (expected name=value)", field)
+				}
+				req.Fields[name] = value
+			}
+			closeAudio, err := setAudio(&req, args[0])
+			if err != nil {
+				return err
+			}
+			defer closeAudio()
+
+			c, ctx, cancel := opts.client(cmd)
+			defer cancel()
+			var resp *client.ProcessResponse
+			switch {
+			case f.async:
+				job, err := c.SubmitJob(ctx, req)
+				if err != nil {
+					return explain(err)
+				}
+				fmt.Fprintf(os.Stderr, "Job %s queued, waiting for it\n", job.ID)
+				if job, err = c.WaitJob(ctx, job.ID, 0); err != nil {
+					return explain(err)
+				}
+				if job.Status != client.JobCompleted {
+					return fmt.Errorf("job %s %s: %s", job.ID, job.Status, job.Error)
+				}
+				resp = job.Result
+			case f.stream && !opts.json:
+				resp, err = c.StreamTokens(ctx, req, func(token string) { fmt.Print(token) })
+				if err != nil {
+					return explain(err)
+				}
+				fmt.Println()
+				return nil
+			default:
+				if resp, err = c.Process(ctx, req); err != nil {
+					return explain(err)
+				}
+			}
+			if opts.json {
+				return printJSON(resp)
+			}
+			fmt.Println(strings.TrimSpace(resp.Response))
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&f.model, "model", "", "LLM model (the provider's default when empty)")
+	flags.StringVar(&f.template, "template", "", "prompt template")
+	flags.StringVar(&f.prompt, "prompt", "", "prompt for the LLM")
+	flags.StringVar(&f.system, "system", "", "system prompt for the LLM")
+	flags.StringVar(&f.provider, "provider", "", "LLM provider: ollama, openai, anthropic or vllm")
+	flags.StringVar(&f.pipeline, "pipeline", "", "pipeline to run instead of the single LLM step")
+	flags.StringVar(&f.language, "language", "", "language of the audio, e.g. de (detected when empty)")
+	flags.StringVar(&f.task, "task", "", "transcribe, or translate to English")
+	flags.StringVar(&f.priority, "priority", "", "high or normal")
+	flags.StringArrayVarP(&f.fields, "field", "F", nil, "further /process field as name=value, repeatable")
+	flags.BoolVar(&f.stream, "stream", false, "print the answer as it is generated")
+	flags.BoolVar(&f.async, "async", false, "run the recording as a job and wait for it")
+	return cmd
+}
+
+// setAudio sets the recording of req: the file at source, stdin for -,
+// or a URL for the bridge to download. The returned function closes the
+// file.
+func setAudio(req *client.ProcessRequest, source string) (func(), error) {
+	switch {
+	case source == "-":
+		req.Audio = os.Stdin
+		return func() {}, nil
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"), strings.HasPrefix(source, "s3://"):
+		req.AudioURL = source
+		return func() {}, nil
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	req.Audio = f
+	req.Filename = filepath.Base(source)
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Bounds for numeric settings
+const (
+	maxConcurrentLimit  = 10000
+	requestTimeoutLimit = 24 * 60 * 60 // seconds
+	maxCandidatesLimit  = 5
+)
+
+// configErrors collects the settings the last loadConfig failed to parse
+var configErrors []error
+
+// validate rejects nonsensical settings before c is put in use, so
+// misconfiguration fails loudly instead of silently misbehaving, e.g. a
+// zero-capacity slot pool rejecting every request
+func (c *config) validate() error {
+	errs := append([]error(nil), configErrors...)
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if _, err := c.serverTLSConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := c.upstreamTLSConfig(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, url := range splitBackendURLs(c.whisperURL) {
+		check(validHTTPURL(url), "WHISPER_URL must be a comma-separated list of http(s) URLs, got %q", url)
+	}
+	check(len(splitBackendURLs(c.whisperURL)) > 0 || strings.EqualFold(c.asrBackend, asrDeepgram), "WHISPER_URL can't be empty")
+	check(c.whisperRouting == routingRoundRobin || c.whisperRouting == routingLeastLoaded,
+		"WHISPER_ROUTING must be %s or %s, got %q", routingRoundRobin, routingLeastLoaded, c.whisperRouting)
+	for _, url := range splitBackendURLs(c.ollamaURL) {
+		check(validHTTPURL(url), "OLLAMA_URL must be a comma-separated list of http(s) URLs, got %q", url)
+	}
+	check(c.ollamaRouting == routingRoundRobin || c.ollamaRouting == routingLeastLoaded,
+		"OLLAMA_ROUTING must be %s or %s, got %q", routingRoundRobin, routingLeastLoaded, c.ollamaRouting)
+
+	port, err := strconv.Atoi(c.serverPort)
+	check(err == nil && port >= 1 && port <= 65535, "SERVER_PORT must be a port number, got %q", c.serverPort)
+	if c.grpcPort != "" {
+		port, err := strconv.Atoi(c.grpcPort)
+		check(err == nil && port >= 1 && port <= 65535 && c.grpcPort != c.serverPort, "GRPC_PORT must be a port number other than SERVER_PORT, got %q", c.grpcPort)
+	}
+	check(c.autoConcurrency || (c.maxConcurrent >= 1 && c.maxConcurrent <= maxConcurrentLimit),
+		"MAX_CONCURRENT_REQUESTS must be between 1 and %d, got %d", maxConcurrentLimit, c.maxConcurrent)
+	check(c.requestTimeout >= 1 && c.requestTimeout <= requestTimeoutLimit,
+		"REQUEST_TIMEOUT must be between 1 and %d seconds, got %d", requestTimeoutLimit, c.requestTimeout)
+	check(c.priorityReservedFraction >= 0 && c.priorityReservedFraction < 1,
+		"PRIORITY_RESERVED_FRACTION must be at least 0 and below 1, got %g", c.priorityReservedFraction)
+	check(c.maxCandidates >= 1 && c.maxCandidates <= maxCandidatesLimit,
+		"MAX_CANDIDATES must be between 1 and %d, got %d", maxCandidatesLimit, c.maxCandidates)
+	check(c.candidateTemperature > 0, "CANDIDATE_TEMPERATURE must be positive, got %g", c.candidateTemperature)
+	check(c.silenceThreshold <= 0, "SILENCE_THRESHOLD_DBFS must not be positive, got %g", c.silenceThreshold)
+	check(c.vadThreshold <= 0, "VAD_THRESHOLD_DBFS must not be positive, got %g", c.vadThreshold)
+	check(c.vadMinSpeechMs >= vadFrameMs, "VAD_MIN_SPEECH_MS must be at least %d, got %d", vadFrameMs, c.vadMinSpeechMs)
+	check(c.vadPaddingMs >= 0, "VAD_PADDING_MS must not be negative, got %d", c.vadPaddingMs)
+	for _, format := range strings.Split(c.allowedAudioFormats, ",") {
+		format = strings.TrimSpace(format)
+		check(slices.Contains(knownAudioFormats, format), "ALLOWED_AUDIO_FORMATS contains unknown format %q", format)
+	}
+	check(c.keepaliveInterval >= 0, "KEEPALIVE_INTERVAL must not be negative, got %d", c.keepaliveInterval)
+	check(c.defaultRetryAfter >= 0, "DEFAULT_RETRY_AFTER must not be negative, got %d", c.defaultRetryAfter)
+	check(c.requestMemoryMB >= 1, "REQUEST_MEMORY_MB must be at least 1, got %d", c.requestMemoryMB)
+	check(c.concurrencyPerCPU >= 1, "CONCURRENCY_PER_CPU must be at least 1, got %d", c.concurrencyPerCPU)
+	check(validHeaderName(c.requestIDHeader), "REQUEST_ID_HEADER must be a valid header name, got %q", c.requestIDHeader)
+	check(c.breakerThreshold >= 1, "BREAKER_FAILURE_THRESHOLD must be at least 1, got %d", c.breakerThreshold)
+	check(c.breakerCooldown >= 1, "BREAKER_COOLDOWN must be at least 1 second, got %d", c.breakerCooldown)
+	check(c.whisperSecondsPerAudioSecond >= 0, "WHISPER_SECONDS_PER_AUDIO_SECOND must not be negative, got %g", c.whisperSecondsPerAudioSecond)
+	check(c.costPerAudioMinute >= 0, "COST_PER_AUDIO_MINUTE must not be negative, got %g", c.costPerAudioMinute)
+	check(c.pipelineRetries >= 0, "PIPELINE_RETRIES must not be negative, got %d", c.pipelineRetries)
+	check(c.ollamaMaxConcurrent >= 0, "OLLAMA_MAX_CONCURRENT must not be negative, got %d", c.ollamaMaxConcurrent)
+	check(c.spilloverOllamaURL == "" || c.ollamaMaxConcurrent > 0, "SPILLOVER_OLLAMA_URL requires OLLAMA_MAX_CONCURRENT")
+	check(!c.allowURLOverride || c.adminToken != "", "ALLOW_URL_OVERRIDE requires ADMIN_TOKEN")
+	if _, err := parseAPIKeys(c.apiKeysConfig, c.apiKeyRateLimits, c.apiKeyModels); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.apiKeysFile == "" || c.adminToken != "", "API_KEYS_FILE requires ADMIN_TOKEN to manage the keys")
+	check(c.oidcIssuer == "" || validHTTPURL(c.oidcIssuer), "OIDC_ISSUER must be an http(s) URL, got %q", c.oidcIssuer)
+	check(c.jwksURL == "" || validHTTPURL(c.jwksURL), "JWKS_URL must be an http(s) URL, got %q", c.jwksURL)
+	check(!c.jwtEnabled() || c.jwtAudience != "", "JWT authentication requires JWT_AUDIENCE, the aud tokens must be issued for")
+	check(c.jwksURL == "" || c.oidcIssuer != "", "JWKS_URL requires OIDC_ISSUER, the iss tokens must carry")
+	check(c.jwtLeeway >= 0, "JWT_LEEWAY must not be negative, got %d", c.jwtLeeway)
+	check(c.jwksRefresh >= 60, "JWKS_REFRESH must be at least 60 seconds, got %d", c.jwksRefresh)
+	check(!c.allowURLOverride || strings.TrimSpace(c.urlOverrideHosts) != "", "ALLOW_URL_OVERRIDE requires URL_OVERRIDE_HOSTS")
+	check(c.readyzTimeout >= 1, "READYZ_TIMEOUT must be at least 1 second, got %d", c.readyzTimeout)
+	check(c.readyzCacheSeconds >= 0, "READYZ_CACHE_SECONDS must not be negative, got %d", c.readyzCacheSeconds)
+	check(c.shutdownTimeout >= 0 && c.shutdownTimeout <= requestTimeoutLimit,
+		"SHUTDOWN_TIMEOUT must be between 0 and %d seconds, got %d", requestTimeoutLimit, c.shutdownTimeout)
+	check(c.queueTimeout >= 1, "QUEUE_TIMEOUT must be at least 1 second, got %d", c.queueTimeout)
+	check(c.queueMaxWaiting >= 1, "QUEUE_MAX_WAITING must be at least 1, got %d", c.queueMaxWaiting)
+	check(c.maxQueueDepth >= 0, "MAX_QUEUE_DEPTH must not be negative, got %d", c.maxQueueDepth)
+	check(c.rateLimitPerMinute >= 0, "RATE_LIMIT_PER_MINUTE must not be negative, got %d", c.rateLimitPerMinute)
+	check(c.rateLimitBurst >= 0, "RATE_LIMIT_BURST must not be negative, got %d", c.rateLimitBurst)
+	if _, err := parseRouteLimits(c.rateLimitRoutes); err != nil {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_ROUTES: %w", err))
+	}
+	check(c.maxQueueWait >= 1, "MAX_QUEUE_WAIT must be at least 1 second, got %d", c.maxQueueWait)
+	if _, err := parsePIIPatterns(c.piiPatternsConfig); err != nil {
+		errs = append(errs, fmt.Errorf("REDACT_PII_PATTERNS: %w", err))
+	}
+	if templates, err := loadPromptTemplates(c.promptTemplatesDir); err != nil {
+		errs = append(errs, fmt.Errorf("PROMPT_TEMPLATES_DIR: %w", err))
+	} else if _, err := loadPipelines(c.pipelinesFile, templates); err != nil {
+		errs = append(errs, fmt.Errorf("PIPELINES_FILE: %w", err))
+	}
+	if _, err := parseLanguageModels(c.languageModelsConfig); err != nil {
+		errs = append(errs, fmt.Errorf("LANGUAGE_MODELS: %w", err))
+	}
+	if policy, err := parseModelPolicy(c.modelAliasesConfig, c.allowedModelsConfig); err != nil {
+		errs = append(errs, err)
+	} else {
+		// The models the bridge picks by itself must be allowed too
+		if provider, ok := c.newLLMProviders()[strings.ToLower(c.llmProvider)]; ok && provider.defaultModel() != "" {
+			if _, err := policy.resolve(provider.defaultModel()); err != nil {
+				errs = append(errs, fmt.Errorf("default model of LLM_PROVIDER %s: %w", provider.name(), err))
+			}
+		}
+		languages, _ := parseLanguageModels(c.languageModelsConfig)
+		for language, model := range languages {
+			if _, err := policy.resolve(model); err != nil {
+				errs = append(errs, fmt.Errorf("LANGUAGE_MODELS: %s: %w", language, err))
+			}
+		}
+		keys, _ := parseAPIKeys(c.apiKeysConfig, c.apiKeyRateLimits, c.apiKeyModels)
+		for _, k := range keys {
+			if _, err := policy.resolve(k.DefaultModel); k.DefaultModel != "" && err != nil {
+				errs = append(errs, fmt.Errorf("API_KEY_MODELS: %s: %w", k.Name, err))
+			}
+		}
+	}
+	if _, err := parseWeights(c.clientWeightsConfig); err != nil {
+		errs = append(errs, fmt.Errorf("CLIENT_WEIGHTS: %w", err))
+	}
+	check(c.schemaMaxRetries >= 0, "SCHEMA_MAX_RETRIES must not be negative, got %d", c.schemaMaxRetries)
+	check(c.whisperRetries >= 0, "WHISPER_RETRIES must not be negative, got %d", c.whisperRetries)
+	check(c.llmRetries >= 0, "LLM_RETRIES must not be negative, got %d", c.llmRetries)
+	check(c.retryBackoffMS >= 1, "RETRY_BACKOFF_MS must be at least 1, got %d", c.retryBackoffMS)
+	check(c.retryMaxBackoffMS >= c.retryBackoffMS,
+		"RETRY_MAX_BACKOFF_MS must be at least RETRY_BACKOFF_MS (%d), got %d", c.retryBackoffMS, c.retryMaxBackoffMS)
+	check(c.retryJitter >= 0 && c.retryJitter <= 1, "RETRY_JITTER must be between 0 and 1, got %g", c.retryJitter)
+	if _, err := parseRetryStatuses(c.retryOnStatus); err != nil {
+		errs = append(errs, fmt.Errorf("RETRY_ON_STATUS: %w", err))
+	}
+	check(!c.chaosMode || c.chaosConfirm == chaosConfirmation,
+		"CHAOS_MODE breaks requests on purpose and requires CHAOS_CONFIRM=%s", chaosConfirmation)
+	check(c.chaosErrorRate >= 0 && c.chaosErrorRate <= 1, "CHAOS_ERROR_RATE must be between 0 and 1, got %g", c.chaosErrorRate)
+	check(c.chaosLatencyRate >= 0 && c.chaosLatencyRate <= 1, "CHAOS_LATENCY_RATE must be between 0 and 1, got %g", c.chaosLatencyRate)
+	check(c.chaosCorruptRate >= 0 && c.chaosCorruptRate <= 1, "CHAOS_CORRUPT_RATE must be between 0 and 1, got %g", c.chaosCorruptRate)
+	check(c.chaosMaxLatency >= 0, "CHAOS_MAX_LATENCY_MS must not be negative, got %d", c.chaosMaxLatency)
+	check(c.liveWindowSeconds >= 2, "LIVE_WINDOW_SECONDS must be at least 2, got %d", c.liveWindowSeconds)
+	check(c.liveMaxPending >= 1, "LIVE_MAX_PENDING must be at least 1, got %d", c.liveMaxPending)
+	check(c.liveMaxDuration >= 1, "LIVE_MAX_DURATION must be at least 1 second, got %d", c.liveMaxDuration)
+	check(c.summarizeChunkTokens >= 100, "SUMMARIZE_CHUNK_TOKENS must be at least 100, got %d", c.summarizeChunkTokens)
+	if _, err := c.newTranscriber(strings.ToLower(c.asrBackend)); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := c.newSynthesizer(strings.ToLower(c.ttsBackend), c.ttsURL); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseTranscodeMode(c.transcodeMode); err != nil {
+		errs = append(errs, err)
+	} else if c.transcodeMode != transcodeOff {
+		if _, err := exec.LookPath(c.ffmpegPath); err != nil {
+			errs = append(errs, fmt.Errorf("TRANSCODE_AUDIO requires ffmpeg: %w", err))
+		}
+	}
+	check(c.audioChunkSeconds == 0 || c.audioChunkSeconds >= 30, "AUDIO_CHUNK_SECONDS must be 0 or at least 30, got %d", c.audioChunkSeconds)
+	check(c.audioChunkOverlap >= 0 && (c.audioChunkSeconds == 0 || 2*c.audioChunkOverlap < c.audioChunkSeconds),
+		"AUDIO_CHUNK_OVERLAP_SECONDS must be between 0 and half of AUDIO_CHUNK_SECONDS, got %d", c.audioChunkOverlap)
+	check(c.audioChunkConcurrency >= 1, "AUDIO_CHUNK_CONCURRENCY must be at least 1, got %d", c.audioChunkConcurrency)
+	check(c.audioURLMaxMB >= 1, "AUDIO_URL_MAX_MB must be at least 1, got %d", c.audioURLMaxMB)
+	check(c.audioURLTimeout >= 1, "AUDIO_URL_TIMEOUT must be at least 1 second, got %d", c.audioURLTimeout)
+	check(c.audioURLMaxRedirects >= 0, "AUDIO_URL_MAX_REDIRECTS must not be negative, got %d", c.audioURLMaxRedirects)
+	check(c.s3EndpointURL == "" || validHTTPURL(c.s3EndpointURL), "S3_ENDPOINT must be an http(s) URL, got %q", c.s3EndpointURL)
+	check(c.s3Region != "", "S3_REGION must not be empty")
+	check((c.s3AccessKeyID == "") == (c.s3SecretAccessKey == ""), "S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set together")
+	if c.s3OutputBucket != "" {
+		if _, err := c.renderS3OutputPrefix(s3OutputData{ID: "id", RequestID: "id", Date: "2006-01-02", Time: "150405", Name: "audio"}); err != nil {
+			errs = append(errs, fmt.Errorf("S3_OUTPUT_PREFIX: %w", err))
+		}
+	}
+	check(c.transcodeTimeout >= 1, "TRANSCODE_TIMEOUT must be at least 1 second, got %d", c.transcodeTimeout)
+	check(c.diarizationURL == "" || validHTTPURL(c.diarizationURL), "DIARIZATION_URL must be an http(s) URL, got %q", c.diarizationURL)
+	check(c.ttsMaxChars >= 1, "TTS_MAX_CHARS must be at least 1, got %d", c.ttsMaxChars)
+	check(c.speechTTL >= 1, "SPEECH_TTL must be at least 1 second, got %d", c.speechTTL)
+	check(c.speechMaxStored >= 1, "SPEECH_MAX_STORED must be at least 1, got %d", c.speechMaxStored)
+	if _, ok := c.newLLMProviders()[strings.ToLower(c.llmProvider)]; !ok {
+		errs = append(errs, fmt.Errorf("LLM_PROVIDER %q is unknown or missing its API key or URL", c.llmProvider))
+	}
+	check(c.traceSampleRatio >= 0 && c.traceSampleRatio <= 1, "OTEL_TRACES_SAMPLER_ARG must be between 0 and 1, got %g", c.traceSampleRatio)
+	if _, err := parseOTLPHeaders(c.otlpHeaders); err != nil {
+		errs = append(errs, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: %w", err))
+	}
+	check(c.anthropicMaxTokens >= 1, "ANTHROPIC_MAX_TOKENS must be at least 1, got %d", c.anthropicMaxTokens)
+	check(c.jobWorkers >= 1, "JOB_WORKERS must be at least 1, got %d", c.jobWorkers)
+	check(c.jobQueueSize >= 1, "JOB_QUEUE_SIZE must be at least 1, got %d", c.jobQueueSize)
+	check(c.jobTimeout >= 1, "JOB_TIMEOUT must be at least 1 second, got %d", c.jobTimeout)
+	check(c.jobMaxStored >= 1, "JOB_MAX_STORED must be at least 1, got %d", c.jobMaxStored)
+	check(c.jobTTLCompleted >= 1, "JOB_TTL_COMPLETED must be at least 1 second, got %d", c.jobTTLCompleted)
+	check(c.jobTTLFailed >= 1, "JOB_TTL_FAILED must be at least 1 second, got %d", c.jobTTLFailed)
+	check(c.jobTTLQueued >= 1, "JOB_TTL_QUEUED must be at least 1 second, got %d", c.jobTTLQueued)
+	check(c.maxBatchSize >= 1, "MAX_BATCH_SIZE must be at least 1, got %d", c.maxBatchSize)
+	check(c.batchConcurrency >= 1, "BATCH_CONCURRENCY must be at least 1, got %d", c.batchConcurrency)
+	check(c.batchMaxZipMB >= 1, "BATCH_MAX_ZIP_MB must be at least 1, got %d", c.batchMaxZipMB)
+	if err := c.checkWatchConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.checkKafkaConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.checkNATSConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.sessionStoreKind != sessionStoreMemory && c.sessionStoreKind != sessionStoreRedis {
+		errs = append(errs, fmt.Errorf("SESSION_STORE must be %s or %s, got %q", sessionStoreMemory, sessionStoreRedis, c.sessionStoreKind))
+	} else if _, err := newRedisClient(c.redisURL); c.sessionStoreKind == sessionStoreRedis && err != nil {
+		errs = append(errs, fmt.Errorf("REDIS_URL: %w", err))
+	}
+	if err := c.checkCacheConfig("TRANSCRIPTION_CACHE", c.transcriptionCacheKind); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.transcriptionCacheTTL >= 1, "TRANSCRIPTION_CACHE_TTL must be at least 1 second, got %d", c.transcriptionCacheTTL)
+	check(c.transcriptionCacheMaxEntries >= 1, "TRANSCRIPTION_CACHE_MAX_ENTRIES must be at least 1, got %d", c.transcriptionCacheMaxEntries)
+	if err := c.checkCacheConfig("LLM_CACHE", c.llmCacheKind); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.llmCacheTTL >= 1, "LLM_CACHE_TTL must be at least 1 second, got %d", c.llmCacheTTL)
+	check(c.llmCacheMaxEntries >= 1, "LLM_CACHE_MAX_ENTRIES must be at least 1, got %d", c.llmCacheMaxEntries)
+	switch c.resultsStoreKind {
+	case resultsStoreOff:
+	case resultsStoreFile:
+		check(c.resultsFile != "", "RESULTS_FILE must not be empty with RESULTS_STORE=file")
+	case resultsStorePostgres:
+		if _, err := newPostgresClient(c.resultsDatabaseURL); err != nil {
+			errs = append(errs, fmt.Errorf("RESULTS_DATABASE_URL: %w", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("RESULTS_STORE must be %s, %s or %s, got %q", resultsStoreOff, resultsStoreFile, resultsStorePostgres, c.resultsStoreKind))
+	}
+	check(c.sessionTTL >= 1, "SESSION_TTL must be at least 1 second, got %d", c.sessionTTL)
+	check(c.sessionMaxTurns >= 1, "SESSION_MAX_TURNS must be at least 1, got %d", c.sessionMaxTurns)
+	check(c.sessionMaxStored >= 1, "SESSION_MAX_STORED must be at least 1, got %d", c.sessionMaxStored)
+	check(c.uploadIdleTimeout >= 0, "UPLOAD_IDLE_TIMEOUT must not be negative, got %d", c.uploadIdleTimeout)
+	check(c.maxUploadBytes >= 0, "MAX_UPLOAD_BYTES must not be negative, got %d", c.maxUploadBytes)
+	check(c.traceMaxSizeMB >= 0, "TRACE_FILE_MAX_MB must not be negative, got %d", c.traceMaxSizeMB)
+	check(c.traceMaxBackups >= 0, "TRACE_FILE_BACKUPS must not be negative, got %d", c.traceMaxBackups)
+	if _, err := parseCIDRs(c.trustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("TRUSTED_PROXIES: %w", err))
+	}
+	if _, err := parseWeights(c.modelWeights); err != nil {
+		errs = append(errs, fmt.Errorf("OLLAMA_MODEL_WEIGHTS: %w", err))
+	}
+	check(c.modelWeights == "" || c.ollamaMaxConcurrent > 0, "OLLAMA_MODEL_WEIGHTS requires OLLAMA_MAX_CONCURRENT")
+	check(c.responseKeyStyle == keyStyleSnake || c.responseKeyStyle == keyStyleCamel,
+		"RESPONSE_KEY_STYLE must be %q or %q, got %q", keyStyleSnake, keyStyleCamel, c.responseKeyStyle)
+
+	return errors.Join(errs...)
+}
+
+// validHeaderName reports whether name is a non-empty HTTP header token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validHTTPURL reports whether s is an absolute http or https URL
+func validHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetEnvAsInt(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		want      int
+		wantError bool
+	}{
+		{"positive", "42", 42, false},
+		{"zero", "0", 0, false},
+		{"negative", "-5", -5, false},
+		{"max int64", "9223372036854775807", 9223372036854775807, false},
+		{"overflow", "9223372036854775808", 300, true},
+		{"negative overflow", "-9223372036854775809", 300, true},
+		{"not a number", "ten", 300, true},
+		{"decimal", "1.5", 300, true},
+		{"empty", "", 300, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &configErrors, nil)
+			t.Setenv("TEST_INT_SETTING", tt.value)
+			if got := getEnvAsInt("TEST_INT_SETTING", 300); got != tt.want {
+				t.Errorf("getEnvAsInt(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+			if gotError := len(configErrors) > 0; gotError != tt.wantError {
+				t.Errorf("getEnvAsInt(%q) recorded errors %v, want an error: %v", tt.value, configErrors, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestGetEnvAsIntUnset(t *testing.T) {
+	setForTest(t, &configErrors, nil)
+	if got := getEnvAsInt("TEST_INT_SETTING_UNSET", 7); got != 7 || len(configErrors) > 0 {
+		t.Errorf("getEnvAsInt of an unset variable = %d with errors %v, want 7 without", got, configErrors)
+	}
+}
+
+func TestValidateConfigLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(t *testing.T, c *config)
+		wantErr string
+	}{
+		{"defaults", func(t *testing.T, c *config) {}, ""},
+		{"zero concurrency", func(t *testing.T, c *config) { c.maxConcurrent = 0 }, "MAX_CONCURRENT_REQUESTS"},
+		{"negative concurrency", func(t *testing.T, c *config) { c.maxConcurrent = -1 }, "MAX_CONCURRENT_REQUESTS"},
+		{"huge concurrency", func(t *testing.T, c *config) { c.maxConcurrent = maxConcurrentLimit + 1 }, "MAX_CONCURRENT_REQUESTS"},
+		{"zero timeout", func(t *testing.T, c *config) { c.requestTimeout = 0 }, "REQUEST_TIMEOUT"},
+		{"negative timeout", func(t *testing.T, c *config) { c.requestTimeout = -30 }, "REQUEST_TIMEOUT"},
+		{"huge timeout", func(t *testing.T, c *config) { c.requestTimeout = requestTimeoutLimit + 1 }, "REQUEST_TIMEOUT"},
+		{"unparsable setting", func(t *testing.T, c *config) {
+			t.Setenv("REQUEST_TIMEOUT", "9223372036854775808")
+			getEnvAsInt("REQUEST_TIMEOUT", c.requestTimeout)
+		}, "REQUEST_TIMEOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &configErrors, nil)
+			c := *cfg()
+			tt.set(t, &c)
+			err := c.validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validate() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validate() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
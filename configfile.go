@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Types of settings, as declared by the getEnv functions
+const (
+	settingString = "string"
+	settingInt    = "int"
+	settingBool   = "bool"
+	settingFloat  = "float"
+)
+
+var (
+	// Settings from the config file, by environment variable name
+	fileSettings map[string]string
+
+	// Type of every setting loadConfig reads, by environment variable name
+	settingKinds = make(map[string]string)
+)
+
+// lookupSetting returns a setting from the environment, or else from the
+// config file, and records its type
+func lookupSetting(key, kind string) (string, bool) {
+	settingKinds[key] = kind
+	if value, ok := os.LookupEnv(key); ok {
+		return value, true
+	}
+	value, ok := fileSettings[key]
+	return value, ok
+}
+
+// initConfig loads the settings, including the config file at path if it
+// is set. The first pass learns which settings exist and their types, so
+// the file can be checked against them.
+func initConfig(path string) (*config, error) {
+	c := loadConfig()
+	if path == "" {
+		return c, nil
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fileSettings = settings
+	configErrors = nil
+	return loadConfig(), nil
+}
+
+// readConfigFile parses a YAML config file. Keys are the environment
+// variable names in any case, and may be nested: whisper_url,
+// WHISPER_URL and whisper: {url: ...} all set WHISPER_URL. Lists and maps
+// give the comma-separated values of list settings such as
+// LOG_EXCLUDE_PATHS and LANGUAGE_MODELS. Unknown keys and values of the
+// wrong type are errors.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	settings := make(map[string]string)
+	var errs []error
+	if len(doc.Content) > 0 {
+		root := doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("config file %s: line %d: want a mapping of settings", path, root.Line)
+		}
+		flattenConfig(root, "", "", settings, &errs)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("config file %s: %w", path, errors.Join(errs...))
+	}
+	return settings, nil
+}
+
+// flattenConfig collects the settings of a mapping whose keys are
+// prefixed with name (an environment variable name) and display (the key
+// path as written)
+func flattenConfig(node *yaml.Node, name, display string, settings map[string]string, errs *[]error) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		keyName := strings.ToUpper(strings.ReplaceAll(key.Value, "-", "_"))
+		keyDisplay := key.Value
+		if name != "" {
+			keyName = name + "_" + keyName
+			keyDisplay = display + "." + keyDisplay
+		}
+
+		kind, known := settingKinds[keyName]
+		switch {
+		case known && !(value.Kind == yaml.MappingNode && hasChildSetting(value, keyName)):
+			if _, seen := settings[keyName]; seen {
+				*errs = append(*errs, fmt.Errorf("line %d: %s sets %s again", key.Line, keyDisplay, keyName))
+				continue
+			}
+			setting, err := configValue(value, kind)
+			if err != nil {
+				*errs = append(*errs, fmt.Errorf("line %d: %s: %w", value.Line, keyDisplay, err))
+				continue
+			}
+			settings[keyName] = setting
+		case value.Kind == yaml.MappingNode:
+			flattenConfig(value, keyName, keyDisplay, settings, errs)
+		default:
+			*errs = append(*errs, fmt.Errorf("line %d: unknown setting %q", key.Line, keyDisplay))
+		}
+	}
+}
+
+// hasChildSetting reports whether a mapping under a setting's key holds
+// further settings, as in trace_file: {max_mb: 100}, rather than the
+// pairs of a map setting such as language_models: {de: mistral}
+func hasChildSetting(node *yaml.Node, name string) bool {
+	for i := 0; i < len(node.Content); i += 2 {
+		child := name + "_" + strings.ToUpper(strings.ReplaceAll(node.Content[i].Value, "-", "_"))
+		if _, ok := settingKinds[child]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// configValue converts a YAML value to the string form of a setting,
+// checking that it has the setting's type
+func configValue(node *yaml.Node, kind string) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		switch {
+		case node.Tag == "!!null":
+			if kind == settingString {
+				return "", nil
+			}
+		case kind == settingInt && node.Tag == "!!int",
+			kind == settingFloat && (node.Tag == "!!int" || node.Tag == "!!float"),
+			kind == settingBool && node.Tag == "!!bool",
+			kind == settingString:
+			return node.Value, nil
+		}
+		return "", fmt.Errorf("want %s, got %q", describeKind(kind), node.Value)
+	case yaml.SequenceNode:
+		if kind != settingString {
+			break
+		}
+		items := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("want a list of values")
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	case yaml.MappingNode:
+		if kind != settingString {
+			break
+		}
+		pairs := make([]string, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("want a mapping of values")
+			}
+			pairs = append(pairs, node.Content[i].Value+"="+node.Content[i+1].Value)
+		}
+		return strings.Join(pairs, ","), nil
+	}
+	return "", fmt.Errorf("want %s", describeKind(kind))
+}
+
+func describeKind(kind string) string {
+	switch kind {
+	case settingInt:
+		return "an integer"
+	case settingBool:
+		return "true or false"
+	case settingFloat:
+		return "a number"
+	}
+	return "a string"
+}
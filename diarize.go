@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Largest num_speakers accepted
+const maxSpeakers = 20
+
+// speakerTurn is a stretch of audio the diarization sidecar attributes to
+// one speaker
+type speakerTurn struct {
+	Start   float64 `json:"start"` // seconds
+	End     float64 `json:"end"`
+	Speaker string  `json:"speaker"`
+}
+
+// diarizationResponse is the answer of the diarization sidecar
+type diarizationResponse struct {
+	Segments []speakerTurn `json:"segments"`
+}
+
+// canDiarize reports whether requests can ask for speaker labels: through
+// the sidecar at DIARIZATION_URL, else natively by the ASR backend
+func canDiarize() bool {
+	if cfg().diarizationURL != "" {
+		return true
+	}
+	switch cfg().transcriber.name() {
+	case asrWhisperASR, asrDeepgram:
+		return true
+	}
+	return false
+}
+
+// parseNumSpeakers parses the num_speakers field; 0 lets the backend tell
+func parseNumSpeakers(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, newHTTPError(http.StatusBadRequest, "invalid num_speakers: %v", err)
+	}
+	return n, nil
+}
+
+// checkDiarize rejects diarize requests no backend can serve
+func checkDiarize(input *processInput) error {
+	switch {
+	case input.NumSpeakers < 0 || input.NumSpeakers > maxSpeakers:
+		return newHTTPError(http.StatusBadRequest, "num_speakers must be between 1 and %d", maxSpeakers)
+	case !input.Diarize:
+		if input.NumSpeakers != 0 {
+			return newHTTPError(http.StatusBadRequest, "num_speakers requires diarize")
+		}
+		return nil
+	case input.Mode == modeLLMOnly:
+		return newHTTPError(http.StatusBadRequest, "diarize can't be combined with mode %s", modeLLMOnly)
+	case !canDiarize():
+		return newHTTPError(http.StatusBadRequest, "the %s ASR backend can't diarize; set DIARIZATION_URL", cfg().transcriber.name())
+	}
+	// The sidecar is sent the audio after the transcription
+	if cfg().diarizationURL != "" {
+		input.Streamed = false
+	}
+	return nil
+}
+
+// diarizeAudio sends the audio file to the diarization sidecar and labels
+// each segment with the speaker it overlaps most
+func diarizeAudio(ctx context.Context, audioPath string, numSpeakers int, segments []Segment) error {
+	ctx, span := startSpan(ctx, "diarization", spanKindClient)
+	file, err := os.Open(audioPath)
+	if err != nil {
+		span.end(err)
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	var fields url.Values
+	if numSpeakers > 0 {
+		fields = url.Values{"num_speakers": {strconv.Itoa(numSpeakers)}}
+	}
+	body, contentType := multipartAudio("file", filepath.Base(audioPath), file, fields)
+	defer body.Close()
+
+	var diarization diarizationResponse
+	endpoint := strings.TrimSuffix(cfg().diarizationURL, "/") + "/diarize"
+	if _, err := postASR(ctx, upstreamDiarization, endpoint, contentType, body, nil, &diarization); err != nil {
+		countUpstreamError(ctx, upstreamDiarization, err)
+		span.end(err)
+		return err
+	}
+	span.setAttributes("diarization.turns", len(diarization.Segments))
+	span.end(nil)
+
+	assignSpeakers(segments, diarization.Segments)
+	return nil
+}
+
+// assignSpeakers labels each segment with the speaker of the turns it
+// overlaps longest, leaving segments no turn overlaps unlabeled
+func assignSpeakers(segments []Segment, turns []speakerTurn) {
+	for i := range segments {
+		overlaps := make(map[string]float64)
+		best, bestOverlap := "", 0.0
+		for _, turn := range turns {
+			overlap := min(segments[i].End, turn.End) - max(segments[i].Start, turn.Start)
+			if overlap <= 0 || turn.Speaker == "" {
+				continue
+			}
+			overlaps[turn.Speaker] += overlap
+			if overlaps[turn.Speaker] > bestOverlap {
+				best, bestOverlap = turn.Speaker, overlaps[turn.Speaker]
+			}
+		}
+		segments[i].Speaker = best
+	}
+}
+
+// speakerLabel names the speaker numbered n by a backend, the way
+// pyannote does
+func speakerLabel(n int) string {
+	return fmt.Sprintf("SPEAKER_%02d", n)
+}
+
+// speakerTranscript renders the segments as one "SPEAKER: text" line per
+// turn, merging consecutive segments of the same speaker, and counts the
+// speakers. It returns no text when no segment has a speaker.
+func speakerTranscript(segments []Segment, clean bool) (string, int) {
+	type turn struct {
+		speaker string
+		text    []string
+	}
+	var turns []turn
+	speakers := make(map[string]bool)
+	for _, segment := range segments {
+		text := strings.TrimSpace(segment.Text)
+		if text == "" {
+			continue
+		}
+		speaker := segment.Speaker
+		if speaker == "" {
+			speaker = "UNKNOWN"
+		} else {
+			speakers[speaker] = true
+		}
+		if n := len(turns); n > 0 && turns[n-1].speaker == speaker {
+			turns[n-1].text = append(turns[n-1].text, text)
+		} else {
+			turns = append(turns, turn{speaker: speaker, text: []string{text}})
+		}
+	}
+	if len(speakers) == 0 {
+		return "", 0
+	}
+
+	lines := make([]string, len(turns))
+	for i, turn := range turns {
+		text := strings.Join(strings.Fields(strings.Join(turn.text, " ")), " ")
+		if clean {
+			text = cleanTranscription(text)
+		}
+		lines[i] = turn.speaker + ": " + text
+	}
+	return strings.Join(lines, "\n"), len(speakers)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Errors returned when a queued request gives up
+var (
+	errQueueFull    = errors.New("admission queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a free slot")
+)
+
+// Admission queue, nil unless FAIR_QUEUING or MAX_QUEUE_DEPTH is set
+var admission *fairQueue
+
+// admit takes a concurrency slot for r. Without a queue a full server
+// rejects the request at once. With FAIR_QUEUING the request queues for up
+// to QUEUE_TIMEOUT seconds, sharing slots fairly between clients; with
+// MAX_QUEUE_DEPTH it queues in arrival order for up to MAX_QUEUE_WAIT.
+func admit(r *http.Request, prio priority) (func(), error) {
+	if admission == nil {
+		if release, ok := slots.tryAcquire(prio); ok {
+			return release, nil
+		}
+		return nil, errQueueFull
+	}
+
+	// All requests count as one client outside fair queuing, which keeps
+	// the queue in arrival order
+	client, timeout := "", cfg().maxQueueWait
+	if cfg().fairQueuing {
+		client, timeout = clientID(r), cfg().queueTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	start := time.Now()
+	release, err := admission.acquire(ctx, client, prio)
+	if err == nil {
+		queueWait.observe(time.Since(start).Seconds())
+	}
+	return release, err
+}
+
+// clientID identifies the client a request is queued and rate limited
+// for: the name of the key it authenticated with, else the tenant or
+// subject of its JWT, else its address. A key that wasn't verified isn't
+// used, or a client could send a fresh one for a fresh bucket, or another
+// client's to get its weight.
+func clientID(r *http.Request) string {
+	trace := traceFromContext(r.Context())
+	if trace.apiKey != nil {
+		return trace.apiKey.Name
+	}
+	if claims := trace.claims; claims != nil && (claims.Tenant != "" || claims.Subject != "") {
+		return cmp.Or(claims.Tenant, claims.Subject)
+	}
+	return clientIP(r)
+}
+
+func clientWeight(id string) int {
+	if weight, ok := cfg().clientWeights[id]; ok {
+		return weight
+	}
+	return 1
+}
+
+// fairQueue hands out free slots of a slotPool to waiting requests using
+// start-time fair queuing. Each waiter is tagged with a virtual finish
+// time of max(now, the client's last finish) + 1/weight, and the waiter
+// with the smallest tag is served next. A client with weight 2 therefore
+// gets twice the slots of a weight-1 client while both are waiting, and a
+// client that sends a burst can't push out the others.
+type fairQueue struct {
+	mu         sync.Mutex
+	pool       *slotPool
+	maxWaiting int
+	waiters    waiterHeap
+	virtual    float64
+	lastFinish map[string]float64
+	seq        uint64
+}
+
+type queueWaiter struct {
+	prio    priority
+	tag     float64
+	seq     uint64
+	index   int
+	granted chan func()
+}
+
+func newFairQueue(pool *slotPool, maxWaiting int) *fairQueue {
+	q := &fairQueue{pool: pool, maxWaiting: maxWaiting, lastFinish: make(map[string]float64)}
+	pool.onRelease = q.dispatch
+	return q
+}
+
+// waiting returns the number of queued requests
+func (q *fairQueue) waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiters.Len()
+}
+
+// acquire takes a slot for client, queuing fairly until one is free or
+// ctx is done. High-priority requests still get reserved slots at once.
+func (q *fairQueue) acquire(ctx context.Context, client string, prio priority) (func(), error) {
+	q.mu.Lock()
+	if q.waiters.Len() == 0 || prio == priorityHigh {
+		if release, ok := q.pool.tryAcquire(prio); ok {
+			q.mu.Unlock()
+			return release, nil
+		}
+	}
+	if q.waiters.Len() >= q.maxWaiting {
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	start := max(q.virtual, q.lastFinish[client])
+	tag := start + 1/float64(clientWeight(client))
+	q.lastFinish[client] = tag
+	q.seq++
+	w := &queueWaiter{prio: prio, tag: tag, seq: q.seq, granted: make(chan func(), 1)}
+	heap.Push(&q.waiters, w)
+	q.mu.Unlock()
+
+	select {
+	case release := <-w.granted:
+		return release, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if w.index < 0 {
+			// Granted just as the wait ended, pass the slot on
+			release := <-w.granted
+			go release()
+		} else {
+			heap.Remove(&q.waiters, w.index)
+		}
+		return nil, errQueueTimeout
+	}
+}
+
+// dispatch grants freed slots to the waiters with the smallest tags
+func (q *fairQueue) dispatch() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.waiters.Len() > 0 {
+		next := q.waiters[0]
+		release, ok := q.pool.tryAcquire(next.prio)
+		if !ok {
+			// Only a reserved slot may be free, which the first
+			// high-priority waiter can still use
+			if next = q.waiters.firstHigh(); next == nil {
+				return
+			}
+			if release, ok = q.pool.tryAcquire(next.prio); !ok {
+				return
+			}
+		}
+		heap.Remove(&q.waiters, next.index)
+		q.virtual = max(q.virtual, next.tag)
+		next.granted <- release
+	}
+	q.prune()
+}
+
+// prune forgets clients whose last finish time has passed, as they would
+// start from the current virtual time anyway. Must be called with q.mu
+// held.
+func (q *fairQueue) prune() {
+	for client, finish := range q.lastFinish {
+		if finish <= q.virtual {
+			delete(q.lastFinish, client)
+		}
+	}
+}
+
+// waiterHeap orders waiters by tag, then arrival
+type waiterHeap []*queueWaiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool { return h.less(h[i], h[j]) }
+
+func (waiterHeap) less(a, b *queueWaiter) bool {
+	if a.tag != b.tag {
+		return a.tag < b.tag
+	}
+	return a.seq < b.seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+// firstHigh returns the high-priority waiter with the smallest tag
+func (h waiterHeap) firstHigh() *queueWaiter {
+	var first *queueWaiter
+	for _, w := range h {
+		if w.prio == priorityHigh && (first == nil || h.less(w, first)) {
+			first = w
+		}
+	}
+	return first
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*queueWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
@@ -1,3 +1,15 @@
 module whisper-ollama-go
 
-go 1.23
+go 1.24
+
+require github.com/gorilla/websocket v1.5.3
+
+require (
+	github.com/spf13/cobra v1.9.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.6 // indirect
+)
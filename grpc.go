@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Methods of the gRPC API, defined in proto/bridge.proto
+const (
+	grpcProcess       = "/whisperbridge.v1.Bridge/Process"
+	grpcProcessStream = "/whisperbridge.v1.Bridge/ProcessStream"
+	grpcStreamTokens  = "/whisperbridge.v1.Bridge/StreamTokens"
+)
+
+// Endpoint gRPC results are recorded for
+const resultEndpointGRPC = "grpc"
+
+// Largest gRPC message accepted, compressed or not
+const grpcMaxMessageSize = 64 << 20
+
+// gRPC status codes the bridge answers with
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// grpcError is a failed call's status
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func newGRPCError(code int, format string, args ...any) *grpcError {
+	return &grpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// grpcStatus returns the status code of err: its own, the one matching
+// the HTTP status of an httpError, or internal
+func grpcStatus(err error) int {
+	var grpcErr *grpcError
+	var httpErr *httpError
+	switch {
+	case errors.As(err, &grpcErr):
+		return grpcErr.code
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return grpcCanceled
+	case errors.As(err, &httpErr):
+		switch httpErr.status {
+		case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusUnsupportedMediaType:
+			return grpcInvalidArgument
+		case http.StatusUnauthorized:
+			return grpcUnauthenticated
+		case http.StatusForbidden:
+			return grpcPermissionDenied
+		case http.StatusNotFound:
+			return grpcNotFound
+		case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+			return grpcResourceExhausted
+		case http.StatusServiceUnavailable, http.StatusBadGateway:
+			return grpcUnavailable
+		case http.StatusGatewayTimeout:
+			return grpcDeadlineExceeded
+		}
+	}
+	return grpcInternal
+}
+
+// setupGRPCRoutes returns the handler of the gRPC port, behind the same
+// middleware as the HTTP API: gRPC metadata are HTTP/2 headers, so API
+// keys, JWTs, rate limits and request IDs work the same
+func setupGRPCRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(grpcProcess, grpcHandler(grpcProcessMethod(false)))
+	mux.HandleFunc(grpcProcessStream, grpcHandler(grpcProcessMethod(true)))
+	mux.HandleFunc(grpcStreamTokens, grpcHandler(grpcStreamTokensMethod))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		newGRPCCall(w, r).finish(newGRPCError(grpcUnimplemented, "unknown method %s", r.URL.Path))
+	})
+	handler := requestIDMiddleware(logMiddleware(tracingMiddleware(authMiddleware(mux, rateLimitMiddleware(mux)))))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &grpcErrorWriter{ResponseWriter: w}
+		handler.ServeHTTP(ew, r)
+		if ew.status != 0 {
+			newGRPCCall(w, r).finish(newHTTPError(ew.status, "%s", strings.TrimSpace(ew.msg.String())))
+		}
+	})
+}
+
+// grpcErrorWriter holds back the plain HTTP errors the middleware answers
+// with, such as a missing API key or a rate limit, so they can be sent as
+// gRPC statuses instead
+type grpcErrorWriter struct {
+	http.ResponseWriter
+	status int
+	msg    bytes.Buffer
+}
+
+func (w *grpcErrorWriter) WriteHeader(status int) {
+	if status != http.StatusOK && !strings.HasPrefix(w.Header().Get("Content-Type"), "application/grpc") {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *grpcErrorWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return w.msg.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *grpcErrorWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// newGRPCServer returns the server of the gRPC port: HTTP/2 over TLS when
+// the HTTP API uses TLS, else HTTP/2 without TLS (h2c), which gRPC clients
+// speak with prior knowledge
+func newGRPCServer(tlsConfig *tls.Config) *http.Server {
+	server := &http.Server{
+		Addr:      ":" + cfg().grpcPort,
+		Handler:   setupGRPCRoutes(),
+		TLSConfig: tlsConfig,
+		Protocols: new(http.Protocols),
+	}
+	if tlsConfig != nil {
+		server.Protocols.SetHTTP2(true)
+	} else {
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server
+}
+
+// grpcCall is a call of the gRPC API: length-prefixed protobuf messages
+// read from the request body and written to the response, and a status
+// sent in the trailers
+type grpcCall struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	rc   *http.ResponseController
+	gzip bool // request messages may be gzip-compressed
+	sent bool // the headers were sent
+}
+
+func newGRPCCall(w http.ResponseWriter, r *http.Request) *grpcCall {
+	return &grpcCall{w: w, r: r, rc: http.NewResponseController(w)}
+}
+
+// grpcHandler serves a gRPC method: it checks the call, admits it like a
+// /process request, bounds it by grpc-timeout and REQUEST_TIMEOUT, and
+// ends it with the status of the error method returns
+func grpcHandler(method func(ctx context.Context, call *grpcCall) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trace := traceFromContext(r.Context())
+		trace.traced = true
+		call := newGRPCCall(w, r)
+		if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC calls are HTTP/2 POST requests with Content-Type application/grpc", http.StatusUnsupportedMediaType)
+			return
+		}
+		switch encoding := r.Header.Get("Grpc-Encoding"); encoding {
+		case "", "identity":
+		case "gzip":
+			call.gzip = true
+		default:
+			call.finish(newGRPCError(grpcUnimplemented, "unsupported grpc-encoding %s", encoding))
+			return
+		}
+
+		prio, err := parsePriority(r.Header.Get("Priority"))
+		if err != nil {
+			call.finish(newGRPCError(grpcInvalidArgument, "%v", err))
+			return
+		}
+		release, err := admit(r, prio)
+		if err != nil {
+			call.finish(newGRPCError(grpcResourceExhausted, "Server is at capacity, please try again later"))
+			return
+		}
+		defer release()
+
+		timeout := time.Duration(cfg().requestTimeout) * time.Second
+		if value := r.Header.Get("Grpc-Timeout"); value != "" {
+			callTimeout, err := parseGRPCTimeout(value)
+			if err != nil {
+				call.finish(newGRPCError(grpcInvalidArgument, "%v", err))
+				return
+			}
+			timeout = min(timeout, callTimeout)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		deadline, _ := ctx.Deadline()
+		call.rc.SetReadDeadline(deadline)
+		if ctx, err = withURLOverrides(ctx, r); err != nil {
+			call.finish(err)
+			return
+		}
+		call.finish(method(ctx, call))
+	}
+}
+
+// grpcProcessMethod serves Process, or ProcessStream with stream set
+func grpcProcessMethod(stream bool) func(ctx context.Context, call *grpcCall) error {
+	return func(ctx context.Context, call *grpcCall) error {
+		input, err := call.readInput(ctx, stream)
+		if err != nil {
+			return err
+		}
+		defer input.Audio.Close()
+		id := requestIDFromContext(ctx)
+		result, err := processUpload(ctx, resultEndpointGRPC, id, input, nil)
+		if err != nil {
+			return err
+		}
+		return call.send(encodeProcessResponse(id, result))
+	}
+}
+
+// grpcStreamTokensMethod serves StreamTokens. A failed generation ends the
+// call with an unavailable status once tokens were sent.
+func grpcStreamTokensMethod(ctx context.Context, call *grpcCall) error {
+	input, err := call.readInput(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer input.Audio.Close()
+	id := requestIDFromContext(ctx)
+	stream := &grpcTokenStream{call: call}
+	result, err := processUpload(ctx, resultEndpointGRPC, id, input, stream)
+	if err != nil {
+		return err
+	}
+	if stream.started() && result.LLMErr != nil {
+		return newGRPCError(grpcUnavailable, "generation failed: %v", result.LLMErr)
+	}
+	// Answers that weren't generated token by token, such as transcribe_only
+	// and cached ones, still open with the transcription
+	if !stream.started() {
+		stream.begin(&result.Response)
+	}
+	var e protoEncoder
+	e.message(3, func(m *protoEncoder) { m.buf = encodeProcessResponse(id, result) })
+	return call.send(e.buf)
+}
+
+// readInput reads the parameters and audio of a call as a /process
+// upload. With stream set the audio continues in the messages after the
+// first, which are read while the pipeline consumes them.
+func (c *grpcCall) readInput(ctx context.Context, stream bool) (*processInput, error) {
+	msg, err := c.recv()
+	if errors.Is(err, io.EOF) {
+		return nil, newGRPCError(grpcInvalidArgument, "send a ProcessRequest")
+	}
+	if err != nil {
+		return nil, err
+	}
+	req, err := decodeProcessRequest(msg)
+	if err != nil {
+		return nil, newGRPCError(grpcInvalidArgument, "%v", err)
+	}
+	for _, key := range []string{"stream", "raw_stream", "response_format", "download", "async"} {
+		if req.params.Has(key) {
+			return nil, newGRPCError(grpcInvalidArgument, "%s doesn't apply to gRPC calls", key)
+		}
+	}
+
+	var audio io.Reader = &grpcAudioReader{call: c, chunk: req.audio, stream: stream}
+	if len(req.audio) == 0 && (req.params.Get("audio_url") != "" || req.params.Get("mode") == modeLLMOnly) {
+		audio = nil
+	}
+	filename := req.filename
+	if filename == "" {
+		filename = "audio"
+		if format := sniffAudioFormat(req.audio[:min(len(req.audio), sniffLength)]); format != "" {
+			filename += "." + format
+		}
+	}
+	input, err := readUpload(ctx, req.params, filename, audio)
+	if err != nil {
+		return nil, err
+	}
+	if input.TTS && input.TTSDelivery != speechDeliveryURL {
+		input.Audio.Close()
+		return nil, newGRPCError(grpcInvalidArgument, "gRPC calls get speech with tts_delivery=%s", speechDeliveryURL)
+	}
+	input.Caller = callerName(c.r)
+	return input, nil
+}
+
+// recv reads the next request message, returning io.EOF at the end of the
+// stream
+func (c *grpcCall) recv() ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(c.r.Body, prefix[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, newGRPCError(grpcInvalidArgument, "truncated message")
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessageSize {
+		return nil, newGRPCError(grpcResourceExhausted, "message of %d bytes is larger than %d bytes", size, grpcMaxMessageSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(c.r.Body, msg); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, newGRPCError(grpcInvalidArgument, "truncated message")
+		}
+		return nil, err
+	}
+	if prefix[0]&1 == 0 {
+		return msg, nil
+	}
+	if !c.gzip {
+		return nil, newGRPCError(grpcInternal, "compressed message without grpc-encoding")
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, newGRPCError(grpcInternal, "invalid gzip message: %v", err)
+	}
+	msg, err = io.ReadAll(io.LimitReader(reader, grpcMaxMessageSize+1))
+	if err != nil {
+		return nil, newGRPCError(grpcInternal, "invalid gzip message: %v", err)
+	}
+	if len(msg) > grpcMaxMessageSize {
+		return nil, newGRPCError(grpcResourceExhausted, "message is larger than %d bytes", grpcMaxMessageSize)
+	}
+	return msg, nil
+}
+
+// send writes a response message, sending the headers first
+func (c *grpcCall) send(msg []byte) error {
+	if !c.sent {
+		c.writeHeader()
+	}
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := c.w.Write(append(prefix[:], msg...)); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+func (c *grpcCall) writeHeader() {
+	header := c.w.Header()
+	header.Set("Content-Type", "application/grpc+proto")
+	header.Set("Grpc-Accept-Encoding", "identity,gzip")
+	c.w.WriteHeader(http.StatusOK)
+	c.sent = true
+}
+
+// finish ends the call with the status of err, in the headers when
+// nothing was sent (a trailers-only response), else in the trailers
+func (c *grpcCall) finish(err error) {
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcStatus(err), err.Error()
+		if code == grpcInternal || code == grpcUnavailable {
+			log.Printf("gRPC %s failed: %v request_id=%s", c.r.URL.Path, err, requestIDFromContext(c.r.Context()))
+		}
+	}
+	prefix := http.TrailerPrefix
+	if !c.sent {
+		prefix = ""
+		c.w.Header().Set("Content-Type", "application/grpc+proto")
+	}
+	c.w.Header().Set(prefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		c.w.Header().Set(prefix+"Grpc-Message", encodeGRPCMessage(msg))
+	}
+	if !c.sent {
+		c.w.WriteHeader(http.StatusOK)
+		c.sent = true
+	}
+}
+
+// encodeGRPCMessage percent-encodes a status message as grpc-message
+// requires
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout parses a grpc-timeout header: up to 8 digits and a unit
+func parseGRPCTimeout(value string) (time.Duration, error) {
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	unit, ok := units[value[len(value)-1]]
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// grpcAudioReader reads the audio of a call: the first message's chunk,
+// then with stream set the chunks of the messages that follow
+type grpcAudioReader struct {
+	call   *grpcCall
+	chunk  []byte
+	stream bool
+}
+
+func (a *grpcAudioReader) Read(p []byte) (int, error) {
+	for len(a.chunk) == 0 {
+		if !a.stream {
+			return 0, io.EOF
+		}
+		msg, err := a.call.recv()
+		if err != nil {
+			return 0, err
+		}
+		req, err := decodeProcessRequest(msg)
+		if err != nil {
+			return 0, newGRPCError(grpcInvalidArgument, "%v", err)
+		}
+		a.chunk = req.audio
+	}
+	n := copy(p, a.chunk)
+	a.chunk = a.chunk[n:]
+	return n, nil
+}
+
+// grpcTokenStream sends the generation of StreamTokens as ProcessEvent
+// messages: the transcription, then a token per generated chunk.
+// grpcStreamTokensMethod sends the final response itself.
+type grpcTokenStream struct {
+	call  *grpcCall
+	sent  bool
+	start time.Time
+	count int
+}
+
+func (s *grpcTokenStream) begin(resp *CombinedResponse) {
+	s.sent = true
+	s.start = time.Now()
+	var e protoEncoder
+	e.message(1, func(m *protoEncoder) {
+		m.string(1, resp.Transcription)
+		m.string(2, resp.Model)
+	})
+	s.call.send(e.buf)
+}
+
+func (s *grpcTokenStream) write(token string) error {
+	s.count++
+	var e protoEncoder
+	e.message(2, func(m *protoEncoder) {
+		m.string(1, token)
+		m.int64(2, int64(s.count))
+		m.int64(3, time.Since(s.start).Milliseconds())
+	})
+	return s.call.send(e.buf)
+}
+
+func (s *grpcTokenStream) started() bool {
+	return s.sent
+}
+
+func (s *grpcTokenStream) finish(CombinedResponse, ProcessStats, error) {}
+
+// grpcProcessRequest is a decoded ProcessRequest
+type grpcProcessRequest struct {
+	audio    []byte
+	filename string
+	params   url.Values
+}
+
+func decodeProcessRequest(msg []byte) (grpcProcessRequest, error) {
+	req := grpcProcessRequest{params: url.Values{}}
+	d := protoDecoder{buf: msg}
+	for {
+		field, wireType, ok, err := d.next()
+		if err != nil || !ok {
+			return req, err
+		}
+		if wireType != protoBytes || field > 3 {
+			if err := d.skip(wireType); err != nil {
+				return req, err
+			}
+			continue
+		}
+		value, err := d.bytes()
+		if err != nil {
+			return req, err
+		}
+		switch field {
+		case 1:
+			req.audio = value
+		case 2:
+			req.filename = string(value)
+		case 3:
+			key, val, err := decodeMapEntry(value)
+			if err != nil {
+				return req, err
+			}
+			req.params.Set(key, val)
+		}
+	}
+}
+
+// decodeMapEntry decodes an entry of a map<string, string>
+func decodeMapEntry(msg []byte) (key, value string, err error) {
+	d := protoDecoder{buf: msg}
+	for {
+		field, wireType, ok, err := d.next()
+		if err != nil || !ok {
+			return key, value, err
+		}
+		if wireType != protoBytes || field > 2 {
+			if err := d.skip(wireType); err != nil {
+				return key, value, err
+			}
+			continue
+		}
+		data, err := d.bytes()
+		if err != nil {
+			return key, value, err
+		}
+		if field == 1 {
+			key = string(data)
+		} else {
+			value = string(data)
+		}
+	}
+}
+
+// encodeProcessResponse encodes the ProcessResponse of a result recorded
+// under id
+func encodeProcessResponse(id string, result *pipelineResult) []byte {
+	resp := result.Response
+	var e protoEncoder
+	e.string(1, id)
+	e.string(2, resp.Transcription)
+	e.string(3, resp.Response)
+	e.string(4, resp.Model)
+	e.string(5, resp.Language)
+	e.int64(6, resp.ProcessTime)
+	e.double(7, resp.AudioDuration)
+	e.message(8, func(m *protoEncoder) {
+		m.int64(1, result.Stats.TranscriptionTime)
+		m.int64(2, result.Stats.LLMTime)
+		m.int64(3, int64(result.Stats.PromptTokens))
+		m.int64(4, int64(result.Stats.CompletionTokens))
+		m.double(5, result.Stats.TokensPerSecond)
+	})
+	if result.WhisperResp != nil {
+		for _, segment := range result.WhisperResp.Segments {
+			e.message(9, func(m *protoEncoder) {
+				m.double(1, segment.Start)
+				m.double(2, segment.End)
+				m.string(3, segment.Text)
+				m.string(4, segment.Speaker)
+				if segment.Confidence != nil {
+					m.double(5, *segment.Confidence)
+				}
+			})
+		}
+	}
+	if data, err := marshalResponse(resp); err == nil {
+		e.string(10, string(data))
+	}
+	return e.buf
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Protobuf fixtures written by hand from the encoding guide and
+// proto/bridge.proto, not produced by the encoder under test
+const (
+	// ProcessRequest{audio: a 12-byte WAV header, filename: "a.wav",
+	// params: {mode: transcribe_only, language: en}}, with a varint field
+	// 15 and a fixed32 field 16 the bridge doesn't know in between
+	processRequestFixture = "0a0c524946462400000057415645" + "1205612e776176" +
+		"1a170a046d6f6465120f7472616e7363726962655f6f6e6c79" +
+		"7801" + "850101020304" +
+		"1a0e0a086c616e67756167651202656e"
+
+	// ProcessResponse{id: "req-1", transcription: "hello", language: "en",
+	// process_time_ms: 1234, audio_duration_seconds: 1.5,
+	// stats: {transcription_time_ms: 1200, prompt_tokens: 7,
+	// tokens_per_second: 12.5}, segments: [{start: 0, end: 1.5,
+	// text: "hello", confidence: 0.875}]}, before its json field
+	processResponseFixture = "0a057265712d31" + "120568656c6c6f" + "2a02656e" + "30d209" +
+		"39000000000000f83f" +
+		"420e08b009180729" + "0000000000002940" +
+		"4a19" + "11000000000000f83f" + "1a0568656c6c6f" + "29000000000000ec3f"
+
+	// A gRPC frame of ProcessRequest{filename: "a.wav",
+	// params: {mode: llm_only}}: uncompressed, 25 bytes
+	grpcFrameFixture = "0000000019" + "1205612e776176" + "1a100a046d6f646512086c6c6d5f6f6e6c79"
+
+	// ProcessEvent{transcription: {text: "hello", model: "llama3"}} and
+	// ProcessEvent{token: {text: "Hi", eval_count: 1, elapsed_ms: 5}}
+	transcriptionEventFixture = "0a0f0a0568656c6c6f12066c6c616d6133"
+	tokenEventFixture         = "12080a02486910011805"
+)
+
+// wavMagic starts a RIFF WAVE file, enough for the bridge to take it as
+// WAV audio
+const wavMagic = "RIFF\x24\x00\x00\x00WAVE"
+
+func TestDecodeProcessRequest(t *testing.T) {
+	req, err := decodeProcessRequest(fixture(t, processRequestFixture))
+	if err != nil {
+		t.Fatalf("decodeProcessRequest: %v", err)
+	}
+	if string(req.audio) != wavMagic {
+		t.Errorf("audio = %q, want %q", req.audio, wavMagic)
+	}
+	if req.filename != "a.wav" {
+		t.Errorf("filename = %q, want a.wav", req.filename)
+	}
+	if got := req.params.Get("mode"); got != modeTranscribeOnly {
+		t.Errorf("mode = %q, want %s", got, modeTranscribeOnly)
+	}
+	if got := req.params.Get("language"); got != "en" {
+		t.Errorf("language = %q, want en", got)
+	}
+	if len(req.params) != 2 {
+		t.Errorf("params = %v, want mode and language only", req.params)
+	}
+}
+
+func TestDecodeProcessRequestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+	}{
+		{"truncated tag", "80"},
+		{"truncated length", "0a"},
+		{"length past the end", "0a0552494646"},
+		{"truncated map entry", "1a040a046d6f"},
+		{"truncated fixed32", "85010102"},
+		{"field 0", "0200"},
+		{"group wire type", "0b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeProcessRequest(fixture(t, tt.msg)); err == nil {
+				t.Errorf("decodeProcessRequest(%s) succeeded, want an error", tt.msg)
+			}
+		})
+	}
+}
+
+func TestEncodeProcessResponse(t *testing.T) {
+	confidence := 0.875
+	result := &pipelineResult{
+		Response: CombinedResponse{
+			Transcription: "hello",
+			ProcessTime:   1234,
+			Language:      "en",
+			AudioDuration: 1.5,
+		},
+		WhisperResp: &WhisperResponse{
+			Text:     "hello",
+			Segments: []Segment{{Start: 0, End: 1.5, Text: "hello", Confidence: &confidence}},
+		},
+		Stats: ProcessStats{TranscriptionTime: 1200, PromptTokens: 7, TokensPerSecond: 12.5},
+	}
+	msg := encodeProcessResponse("req-1", result)
+	want := fixture(t, processResponseFixture)
+	if !bytes.HasPrefix(msg, want) {
+		t.Fatalf("ProcessResponse = %x, want it to start with %x", msg, want)
+	}
+
+	// The json field is last: the /process response as JSON
+	d := protoDecoder{buf: msg[len(want):]}
+	field, wireType, ok, err := d.next()
+	if err != nil || !ok || field != 10 || wireType != protoBytes {
+		t.Fatalf("field after segments = %d (wire type %d, %v, %v), want json (10)", field, wireType, ok, err)
+	}
+	data, err := d.bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp CombinedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("json field %q: %v", data, err)
+	}
+	if resp.Transcription != "hello" || resp.ProcessTime != 1234 {
+		t.Errorf("json field = %s, want the response", data)
+	}
+	if len(d.buf) != 0 {
+		t.Errorf("%d bytes after the json field", len(d.buf))
+	}
+}
+
+func TestTokenStreamEvents(t *testing.T) {
+	rec := httptest.NewRecorder()
+	call := newGRPCCall(rec, httptest.NewRequest(http.MethodPost, grpcStreamTokens, nil))
+	stream := &grpcTokenStream{call: call}
+	stream.begin(&CombinedResponse{Transcription: "hello", Model: "llama3"})
+	stream.start = time.Now().Add(-5 * time.Millisecond)
+	if err := stream.write("Hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := readFrames(t, rec.Body)
+	if len(frames) != 2 {
+		t.Fatalf("%d messages, want 2", len(frames))
+	}
+	if want := fixture(t, transcriptionEventFixture); !bytes.Equal(frames[0], want) {
+		t.Errorf("transcription event = %x, want %x", frames[0], want)
+	}
+	// elapsed_ms is the one field that depends on timing
+	if want := fixture(t, tokenEventFixture); !bytes.Equal(frames[1][:len(want)-1], want[:len(want)-1]) || frames[1][len(want)-1] < 5 {
+		t.Errorf("token event = %x, want %x with elapsed_ms of 5 or more", frames[1], want)
+	}
+}
+
+// grpcBody returns a request body of hex-encoded frames
+func grpcBody(t *testing.T, frames ...string) io.Reader {
+	t.Helper()
+	var body []byte
+	for _, frame := range frames {
+		body = append(body, fixture(t, frame)...)
+	}
+	return bytes.NewReader(body)
+}
+
+func TestGRPCRecv(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(fixture(t, grpcFrameFixture)[5:])
+	zw.Close()
+	gzipFrame := "01" + hex.EncodeToString(binary.BigEndian.AppendUint32(nil, uint32(compressed.Len()))) + hex.EncodeToString(compressed.Bytes())
+
+	tests := []struct {
+		name     string
+		body     []string
+		gzip     bool
+		wantCode int // 0 when the message is read
+	}{
+		{"frame", []string{grpcFrameFixture}, false, 0},
+		{"gzip frame", []string{gzipFrame}, true, 0},
+		{"compressed without grpc-encoding", []string{gzipFrame}, false, grpcInternal},
+		{"invalid gzip", []string{"0100000002abcd"}, true, grpcInternal},
+		{"truncated prefix", []string{"000000"}, false, grpcInvalidArgument},
+		{"truncated message", []string{grpcFrameFixture[:20]}, false, grpcInvalidArgument},
+		{"message too large", []string{"0004000001"}, false, grpcResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, grpcProcess, grpcBody(t, tt.body...))
+			call := newGRPCCall(httptest.NewRecorder(), r)
+			call.gzip = tt.gzip
+			msg, err := call.recv()
+			if tt.wantCode != 0 {
+				if code := grpcStatus(err); err == nil || code != tt.wantCode {
+					t.Fatalf("recv = %v (code %d), want code %d", err, code, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("recv: %v", err)
+			}
+			if want := fixture(t, grpcFrameFixture)[5:]; !bytes.Equal(msg, want) {
+				t.Errorf("message = %x, want %x", msg, want)
+			}
+			if _, err := call.recv(); err != io.EOF {
+				t.Errorf("recv at the end of the stream = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestGRPCAudioReader(t *testing.T) {
+	// Chunks after the first message: "FF" then "xy", then the end
+	r := httptest.NewRequest(http.MethodPost, grpcProcessStream, grpcBody(t, "00000000040a024646", "00000000040a027879"))
+	audio := &grpcAudioReader{call: newGRPCCall(httptest.NewRecorder(), r), chunk: []byte("RI"), stream: true}
+	data, err := io.ReadAll(audio)
+	if err != nil {
+		t.Fatalf("reading the audio: %v", err)
+	}
+	if string(data) != "RIFFxy" {
+		t.Errorf("audio = %q, want RIFFxy", data)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, grpcProcess, grpcBody(t, "00000000040a024646"))
+	audio = &grpcAudioReader{call: newGRPCCall(httptest.NewRecorder(), r), chunk: []byte("RI")}
+	if data, _ := io.ReadAll(audio); string(data) != "RI" {
+		t.Errorf("unary audio = %q, want the first message's chunk only", data)
+	}
+}
+
+func TestGRPCFinish(t *testing.T) {
+	t.Run("trailers", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		call := newGRPCCall(rec, httptest.NewRequest(http.MethodPost, grpcProcess, nil))
+		if err := call.send([]byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+		call.finish(nil)
+		resp := rec.Result()
+		if got := rec.Body.String(); got != "\x00\x00\x00\x00\x03abc" {
+			t.Errorf("body = %q, want a 5-byte prefix and the message", got)
+		}
+		if got := resp.Header.Get("Content-Type"); got != "application/grpc+proto" {
+			t.Errorf("Content-Type = %q, want application/grpc+proto", got)
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Errorf("grpc-status trailer = %q, want 0", got)
+		}
+		if resp.Header.Get("Grpc-Status") != "" {
+			t.Error("grpc-status sent in the headers of a response with messages")
+		}
+	})
+
+	t.Run("trailers-only", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		call := newGRPCCall(rec, httptest.NewRequest(http.MethodPost, grpcProcess, nil))
+		call.finish(newGRPCError(grpcNotFound, "no result 100%% ✓\n"))
+		resp := rec.Result()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("HTTP status = %d, want 200", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Grpc-Status"); got != "5" {
+			t.Errorf("grpc-status = %q, want 5", got)
+		}
+		if got := resp.Header.Get("Grpc-Message"); got != "no result 100%25 %E2%9C%93%0A" {
+			t.Errorf("grpc-message = %q, want it percent-encoded", got)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("body = %q, want none", rec.Body.String())
+		}
+	})
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"1H", time.Hour, false},
+		{"2M", 2 * time.Minute, false},
+		{"30S", 30 * time.Second, false},
+		{"100m", 100 * time.Millisecond, false},
+		{"5u", 5 * time.Microsecond, false},
+		{"99999999n", 99999999 * time.Nanosecond, false},
+		{"0S", 0, false},
+		{"", 0, true},
+		{"S", 0, true},
+		{"10", 0, true},
+		{"10s", 0, true},
+		{"-1S", 0, true},
+		{"123456789S", 0, true},
+		{"1.5S", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseGRPCTimeout(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseGRPCTimeout(%q) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"gRPC error", newGRPCError(grpcUnimplemented, "no"), grpcUnimplemented},
+		{"wrapped gRPC error", errors.Join(errors.New("x"), newGRPCError(grpcNotFound, "no")), grpcNotFound},
+		{"deadline", context.DeadlineExceeded, grpcDeadlineExceeded},
+		{"canceled", context.Canceled, grpcCanceled},
+		{"400", newHTTPError(http.StatusBadRequest, "bad"), grpcInvalidArgument},
+		{"415", newHTTPError(http.StatusUnsupportedMediaType, "bad"), grpcInvalidArgument},
+		{"401", newHTTPError(http.StatusUnauthorized, "who"), grpcUnauthenticated},
+		{"403", newHTTPError(http.StatusForbidden, "no"), grpcPermissionDenied},
+		{"404", newHTTPError(http.StatusNotFound, "gone"), grpcNotFound},
+		{"429", newHTTPError(http.StatusTooManyRequests, "slow down"), grpcResourceExhausted},
+		{"502", newHTTPError(http.StatusBadGateway, "down"), grpcUnavailable},
+		{"504", newHTTPError(http.StatusGatewayTimeout, "slow"), grpcDeadlineExceeded},
+		{"500", newHTTPError(http.StatusInternalServerError, "oops"), grpcInternal},
+		{"other", errors.New("oops"), grpcInternal},
+	}
+	for _, tt := range tests {
+		if got := grpcStatus(tt.err); got != tt.want {
+			t.Errorf("grpcStatus(%s) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// readFrames splits a response body into its messages
+func readFrames(t *testing.T, body io.Reader) [][]byte {
+	t.Helper()
+	var frames [][]byte
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(body, prefix[:]); err == io.EOF {
+			return frames
+		} else if err != nil {
+			t.Fatalf("reading a message prefix: %v", err)
+		}
+		if prefix[0] != 0 {
+			t.Fatalf("message compressed (flag %d), want it sent uncompressed", prefix[0])
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		if _, err := io.ReadFull(body, msg); err != nil {
+			t.Fatalf("reading a message: %v", err)
+		}
+		frames = append(frames, msg)
+	}
+}
+
+// grpcFrame frames an uncompressed message
+func grpcFrame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...)
+}
+
+// fakeWhisper is a Whisper server that transcribes every upload as text
+// and records the audio it got
+type fakeWhisper struct {
+	*httptest.Server
+	mu    sync.Mutex
+	audio []string
+}
+
+func serveWhisper(t *testing.T, text string) *fakeWhisper {
+	t.Helper()
+	whisper := &fakeWhisper{}
+	whisper.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, files := range r.MultipartForm.File {
+			file, err := files[0].Open()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := io.ReadAll(file)
+			file.Close()
+			whisper.mu.Lock()
+			whisper.audio = append(whisper.audio, string(data))
+			whisper.mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"text": text})
+	}))
+	t.Cleanup(whisper.Close)
+	return whisper
+}
+
+func (w *fakeWhisper) uploads() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.audio...)
+}
+
+// grpcClient calls a bridge serving the gRPC port's handler over h2c, as
+// gRPC clients without TLS do, sending the upstream overrides of a test
+type grpcClient struct {
+	t       *testing.T
+	server  *httptest.Server
+	client  *http.Client
+	whisper string
+	ollama  string
+}
+
+func newGRPCClient(t *testing.T) *grpcClient {
+	t.Helper()
+	setConfigForTest(t, func(c *config) {
+		c.allowURLOverride = true
+		c.urlOverrideHosts = "127.0.0.1"
+		c.adminToken = "admin-token"
+		c.transcodeMode = transcodeOff
+	})
+
+	server := httptest.NewUnstartedServer(setupGRPCRoutes())
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(transport.CloseIdleConnections)
+	return &grpcClient{t: t, server: server, client: &http.Client{Transport: transport}}
+}
+
+// grpcReply is the answer to a call: its messages and status
+type grpcReply struct {
+	header  http.Header
+	frames  [][]byte
+	code    int
+	message string
+}
+
+// call sends the messages read from body to method and reads the reply,
+// taking the status from the trailers, or the headers of a trailers-only
+// response
+func (c *grpcClient) call(method string, header http.Header, body io.Reader) grpcReply {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(c.t.Context(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server.URL+method, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	if c.whisper != "" || c.ollama != "" {
+		req.Header.Set("Authorization", "Bearer admin-token")
+		req.Header.Set("X-Whisper-URL", c.whisper)
+		req.Header.Set("X-Ollama-URL", c.ollama)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatalf("calling %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		c.t.Fatalf("answered over HTTP/%d, want HTTP/2", resp.ProtoMajor)
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("HTTP status = %d, want 200 with a gRPC status", resp.StatusCode)
+	}
+	reply := grpcReply{header: resp.Header, frames: readFrames(c.t, resp.Body)}
+	status := resp.Trailer
+	if resp.Header.Get("Grpc-Status") != "" {
+		status = resp.Header
+	}
+	if reply.code, err = strconv.Atoi(status.Get("Grpc-Status")); err != nil {
+		c.t.Fatalf("grpc-status = %q, want a status code", status.Get("Grpc-Status"))
+	}
+	reply.message = status.Get("Grpc-Message")
+	return reply
+}
+
+// protoFields decodes the length-delimited fields of a message, the last
+// one of each number
+func protoFields(t *testing.T, msg []byte) map[int][]byte {
+	t.Helper()
+	fields := map[int][]byte{}
+	d := protoDecoder{buf: msg}
+	for {
+		field, wireType, ok, err := d.next()
+		if err != nil {
+			t.Fatalf("decoding %x: %v", msg, err)
+		}
+		if !ok {
+			return fields
+		}
+		if wireType != protoBytes {
+			if err := d.skip(wireType); err != nil {
+				t.Fatalf("decoding %x: %v", msg, err)
+			}
+			continue
+		}
+		if fields[field], err = d.bytes(); err != nil {
+			t.Fatalf("decoding %x: %v", msg, err)
+		}
+	}
+}
+
+// protoVarintField returns the value of a varint field of a message, 0
+// when it's missing
+func protoVarintField(t *testing.T, msg []byte, want int) uint64 {
+	t.Helper()
+	var value uint64
+	d := protoDecoder{buf: msg}
+	for {
+		field, wireType, ok, err := d.next()
+		if err != nil {
+			t.Fatalf("decoding %x: %v", msg, err)
+		}
+		if !ok {
+			return value
+		}
+		if field == want && wireType == protoVarint {
+			if value, err = d.varint(); err != nil {
+				t.Fatalf("decoding %x: %v", msg, err)
+			}
+		} else if err := d.skip(wireType); err != nil {
+			t.Fatalf("decoding %x: %v", msg, err)
+		}
+	}
+}
+
+func TestGRPCProcess(t *testing.T) {
+	whisper := serveWhisper(t, "hello world")
+	c := newGRPCClient(t)
+	c.whisper = whisper.URL
+
+	reply := c.call(grpcProcess, http.Header{"X-Request-Id": {"grpc-test-1"}}, bytes.NewReader(grpcFrame(fixture(t, processRequestFixture))))
+	if reply.code != grpcOK {
+		t.Fatalf("status = %d (%s), want OK", reply.code, reply.message)
+	}
+	if got := reply.header.Get("Content-Type"); got != "application/grpc+proto" {
+		t.Errorf("Content-Type = %q, want application/grpc+proto", got)
+	}
+	if len(reply.frames) != 1 {
+		t.Fatalf("%d messages, want a ProcessResponse", len(reply.frames))
+	}
+	fields := protoFields(t, reply.frames[0])
+	if got := string(fields[1]); got != "grpc-test-1" {
+		t.Errorf("id = %q, want the request ID", got)
+	}
+	if got := string(fields[2]); got != "hello world" {
+		t.Errorf("transcription = %q, want hello world", got)
+	}
+	if got := string(fields[5]); got != "en" {
+		t.Errorf("language = %q, want en", got)
+	}
+	if got := whisper.uploads(); len(got) != 1 || got[0] != wavMagic {
+		t.Errorf("Whisper got %q, want the audio of the request", got)
+	}
+}
+
+func TestGRPCProcessStream(t *testing.T) {
+	whisper := serveWhisper(t, "streamed")
+	c := newGRPCClient(t)
+	c.whisper = whisper.URL
+
+	// The first message carries the parameters, the others audio only,
+	// sent while the bridge reads them
+	body, bodyWriter := io.Pipe()
+	go func() {
+		var first protoEncoder
+		first.bytes(1, []byte(wavMagic))
+		first.string(2, "a.wav")
+		first.message(3, func(m *protoEncoder) {
+			m.string(1, "mode")
+			m.string(2, modeTranscribeOnly)
+		})
+		bodyWriter.Write(grpcFrame(first.buf))
+		for _, chunk := range []string{"0001", "0203"} {
+			var e protoEncoder
+			e.bytes(1, []byte(chunk))
+			bodyWriter.Write(grpcFrame(e.buf))
+		}
+		bodyWriter.Close()
+	}()
+	reply := c.call(grpcProcessStream, nil, body)
+	if reply.code != grpcOK {
+		t.Fatalf("status = %d (%s), want OK", reply.code, reply.message)
+	}
+	if len(reply.frames) != 1 {
+		t.Fatalf("%d messages, want a ProcessResponse", len(reply.frames))
+	}
+	if got := string(protoFields(t, reply.frames[0])[2]); got != "streamed" {
+		t.Errorf("transcription = %q, want streamed", got)
+	}
+	if got := whisper.uploads(); len(got) != 1 || got[0] != wavMagic+"00010203" {
+		t.Errorf("Whisper got %q, want the chunks in order", got)
+	}
+}
+
+func TestGRPCStreamTokensTranscribeOnly(t *testing.T) {
+	whisper := serveWhisper(t, "hello")
+	c := newGRPCClient(t)
+	c.whisper = whisper.URL
+
+	reply := c.call(grpcStreamTokens, nil, bytes.NewReader(grpcFrame(fixture(t, processRequestFixture))))
+	if reply.code != grpcOK {
+		t.Fatalf("status = %d (%s), want OK", reply.code, reply.message)
+	}
+	// Without generation the stream is the transcription, then the response
+	if len(reply.frames) != 2 {
+		t.Fatalf("%d events, want the transcription and the response", len(reply.frames))
+	}
+	if got := string(protoFields(t, protoFields(t, reply.frames[0])[1])[1]); got != "hello" {
+		t.Errorf("transcription event text = %q, want hello", got)
+	}
+	done, ok := protoFields(t, reply.frames[1])[3]
+	if !ok {
+		t.Fatalf("last event = %x, want done", reply.frames[1])
+	}
+	if got := string(protoFields(t, done)[2]); got != "hello" {
+		t.Errorf("done transcription = %q, want hello", got)
+	}
+}
+
+func TestGRPCCallErrors(t *testing.T) {
+	c := newGRPCClient(t)
+	request := func(params ...string) []byte {
+		var e protoEncoder
+		e.string(2, "a.wav")
+		for i := 0; i+1 < len(params); i += 2 {
+			e.message(3, func(m *protoEncoder) {
+				m.string(1, params[i])
+				m.string(2, params[i+1])
+			})
+		}
+		return grpcFrame(e.buf)
+	}
+	tests := []struct {
+		name     string
+		method   string
+		header   http.Header
+		body     []byte
+		wantCode int
+		wantMsg  string
+	}{
+		{"unknown method", "/whisperbridge.v1.Bridge/Nope", nil, nil, grpcUnimplemented, "unknown method"},
+		{"not gRPC", grpcProcess, http.Header{"Content-Type": {"application/json"}}, nil, grpcInvalidArgument, "application/grpc"},
+		{"unsupported encoding", grpcProcess, http.Header{"Grpc-Encoding": {"snappy"}}, nil, grpcUnimplemented, "grpc-encoding snappy"},
+		{"invalid grpc-timeout", grpcProcess, http.Header{"Grpc-Timeout": {"soon"}}, nil, grpcInvalidArgument, "grpc-timeout"},
+		{"no message", grpcProcess, nil, nil, grpcInvalidArgument, "send a ProcessRequest"},
+		{"truncated message", grpcProcess, nil, fixture(t, grpcFrameFixture)[:12], grpcInvalidArgument, "truncated"},
+		{"invalid message", grpcProcess, nil, grpcFrame([]byte{0x0a, 0x05}), grpcInvalidArgument, "truncated"},
+		{"HTTP-only parameter", grpcProcess, nil, request("stream", "true"), grpcInvalidArgument, "stream doesn't apply"},
+		{"override refused", grpcProcess, http.Header{"X-Whisper-Url": {"http://example.com"}}, request(), grpcUnauthenticated, "admin token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := c.call(tt.method, tt.header, bytes.NewReader(tt.body))
+			if reply.code != tt.wantCode {
+				t.Errorf("status = %d (%s), want %d", reply.code, reply.message, tt.wantCode)
+			}
+			if !strings.Contains(reply.message, tt.wantMsg) {
+				t.Errorf("grpc-message = %q, want it to mention %q", reply.message, tt.wantMsg)
+			}
+			if len(reply.frames) != 0 {
+				t.Errorf("%d messages, want a trailers-only response", len(reply.frames))
+			}
+		})
+	}
+}
+
+func TestGRPCStreamTokens(t *testing.T) {
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/generate" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, token := range []string{"Hi", " there"} {
+			json.NewEncoder(w).Encode(map[string]any{"model": "llama3", "response": token, "done": false})
+			w.(http.Flusher).Flush()
+		}
+		json.NewEncoder(w).Encode(map[string]any{"model": "llama3", "done": true, "prompt_eval_count": 3, "eval_count": 2})
+	}))
+	defer ollama.Close()
+	c := newGRPCClient(t)
+	c.ollama = ollama.URL
+
+	var e protoEncoder
+	for _, param := range [][2]string{{"mode", modeLLMOnly}, {"text", "hello"}, {"model", "llama3"}} {
+		e.message(3, func(m *protoEncoder) {
+			m.string(1, param[0])
+			m.string(2, param[1])
+		})
+	}
+	reply := c.call(grpcStreamTokens, nil, bytes.NewReader(grpcFrame(e.buf)))
+	if reply.code != grpcOK {
+		t.Fatalf("status = %d (%s), want OK", reply.code, reply.message)
+	}
+	if len(reply.frames) != 4 {
+		t.Fatalf("%d events, want the transcription, 2 tokens and the response", len(reply.frames))
+	}
+	if want := fixture(t, transcriptionEventFixture); !bytes.Equal(reply.frames[0], want) {
+		t.Errorf("first event = %x, want %x", reply.frames[0], want)
+	}
+	for i, want := range []string{"Hi", " there"} {
+		token := protoFields(t, reply.frames[i+1])[2]
+		if got := string(protoFields(t, token)[1]); got != want {
+			t.Errorf("token %d = %q, want %q", i+1, got, want)
+		}
+		if got := protoVarintField(t, token, 2); got != uint64(i+1) {
+			t.Errorf("token %d eval_count = %d, want %d", i+1, got, i+1)
+		}
+	}
+	done := protoFields(t, protoFields(t, reply.frames[3])[3])
+	if got := string(done[3]); got != "Hi there" {
+		t.Errorf("done response = %q, want the tokens joined", got)
+	}
+	if got := protoVarintField(t, done[8], 4); got != 2 {
+		t.Errorf("done completion_tokens = %d, want 2", got)
+	}
+}
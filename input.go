@@ -0,0 +1,911 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// httpError is an error that should be reported to the client with a
+// specific HTTP status
+type httpError struct {
+	status int
+	msg    string
+	body   any // sent as JSON instead of msg, if set
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func newHTTPError(status int, format string, args ...any) *httpError {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// JSONProcessRequest is the JSON body accepted by /process as an
+// alternative to a multipart upload. Audio is a data URI such as
+// "data:audio/wav;base64,UklGR...", or AudioURL the address to download
+// the audio from.
+type JSONProcessRequest struct {
+	Audio    string `json:"audio"`
+	AudioURL string `json:"audio_url"`
+	Prompt   string `json:"prompt"`
+	Model    string `json:"model"`
+	N        int    `json:"n"`
+
+	Provider           string          `json:"provider"`
+	CleanTranscription bool            `json:"clean_transcription"`
+	Channel            string          `json:"channel"`
+	EstimateTokens     bool            `json:"estimate_tokens"`
+	RawStream          bool            `json:"raw_stream"`
+	Stream             bool            `json:"stream"`
+	ResponseFormat     string          `json:"response_format"`
+	Download           bool            `json:"download"`
+	WordTimestamps     *bool           `json:"word_timestamps"`
+	Language           string          `json:"language"`
+	Task               string          `json:"task"`
+	TranslateTo        string          `json:"translate_to"`
+	Template           string          `json:"template"`
+	Pipeline           string          `json:"pipeline"`
+	Schema             json.RawMessage `json:"schema"`
+	Mode               string          `json:"mode"`
+	Text               string          `json:"text"`
+	SessionID          string          `json:"session_id"`
+	Cache              string          `json:"cache"`
+	TTS                bool            `json:"tts"`
+	TTSVoice           string          `json:"tts_voice"`
+	TTSFormat          string          `json:"tts_format"`
+	TTSDelivery        string          `json:"tts_delivery"`
+	Diarize            bool            `json:"diarize"`
+	NumSpeakers        int             `json:"num_speakers"`
+
+	// Generation options, see parseLLMOptions
+	System      string         `json:"system"`
+	Temperature *float64       `json:"temperature"`
+	TopP        *float64       `json:"top_p"`
+	TopK        *int           `json:"top_k"`
+	NumPredict  *int           `json:"num_predict"`
+	Seed        *int           `json:"seed"`
+	Options     map[string]any `json:"options"`
+}
+
+// processInput holds the parameters and audio of a /process request
+type processInput struct {
+	Model    string
+	Prompt   string
+	N        int
+	Filename string
+	Audio    io.ReadCloser
+
+	// AudioURL is the address the audio is downloaded from instead of
+	// being uploaded, if any
+	AudioURL string
+
+	// Mode is full, transcribe_only to skip the LLM step, or llm_only to
+	// run the LLM step on Text instead of a transcription. Audio is empty
+	// with llm_only.
+	Mode string
+	Text string
+
+	// LLM runs the LLM step, chosen with the provider field
+	LLM LLMProvider
+	// Provider is the provider name sent by the client
+	Provider string
+
+	CleanTranscription bool
+
+	// Channel is the stereo channel to transcribe: mix, left or right
+	Channel string
+
+	// ModelDefaulted is set when the client didn't choose a model, so one
+	// may be picked for the detected language
+	ModelDefaulted bool
+
+	// EstimateTokens skips generation and reports the prompt size instead
+	EstimateTokens bool
+
+	// RawStream streams the generated text as plain text
+	RawStream bool
+
+	// Stream sends the generated text as Server-Sent Events
+	Stream bool
+
+	// Streamed is set when the audio should go straight to Whisper instead
+	// of through a temp file
+	Streamed bool
+
+	// Caller names the client in the result history
+	Caller string
+
+	// Cache is bypass to transcribe the audio and generate the answer
+	// afresh instead of answering from the caches
+	Cache string
+
+	// ResponseFormat is json, text, srt or vtt, and Download asks for the
+	// response as an attachment
+	ResponseFormat string
+	Download       bool
+
+	// WordTimestamps asks the ASR backend for word timings
+	WordTimestamps bool
+
+	// Language is the code of the spoken language, detected when empty
+	Language string
+
+	// Translate has the ASR backend translate the speech to English
+	Translate bool
+
+	// TranslateTo is the language the LLM translates the transcription
+	// into before the LLM step
+	TranslateTo string
+
+	// TemplateName names the prompt template chosen with the template
+	// field, and Template is that template, nil for the default prompt
+	TemplateName string
+	Template     *template.Template
+
+	// PipelineName names the pipeline chosen with the pipeline field, run
+	// instead of the single LLM step, and Pipeline is that pipeline
+	PipelineName string
+	Pipeline     *llmPipeline
+
+	// Schema is the JSON Schema the LLM's reply must match, if any
+	Schema map[string]any
+
+	// SessionID names the conversation the request continues, if any
+	SessionID string
+
+	// TTS speaks the LLM's answer with TTSVoice (TTS_VOICE when empty) in
+	// TTSFormat, delivered as TTSDelivery: a download URL or a part of a
+	// multipart response
+	TTS         bool
+	TTSVoice    string
+	TTSFormat   string
+	TTSDelivery string
+
+	// Diarize labels the segments with their speakers and gives the LLM a
+	// speaker-attributed transcript. NumSpeakers is the number of
+	// speakers, detected when 0.
+	Diarize     bool
+	NumSpeakers int
+
+	// Speech maps the time of audio VAD cut silence from back to the
+	// upload's, nil when the audio is the upload
+	Speech *speechMap
+
+	// Options are the Ollama generation options of the LLM step, with the
+	// system prompt under "system"; nil for the providers' defaults
+	Options map[string]any
+}
+
+// readProcessInput extracts the request parameters and audio from either a
+// JSON body or a multipart form, applying defaults for omitted values. The
+// audio is closed when the request turns out to be invalid.
+func readProcessInput(r *http.Request) (_ *processInput, err error) {
+	// Batches parse their forms first and check each of their files
+	batch := r.MultipartForm != nil
+	var input *processInput
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		input, err = readJSONInput(r)
+	} else {
+		input, err = readMultipartInput(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil && input.Audio != nil {
+			input.Audio.Close()
+		}
+	}()
+
+	// stream may also be set in the query string
+	if value := r.URL.Query().Get("stream"); value != "" {
+		stream, err := parseOptionalBool(value)
+		if err != nil {
+			return nil, newHTTPError(http.StatusBadRequest, "invalid stream: %v", err)
+		}
+		input.Stream = input.Stream || stream
+	}
+
+	if input.RawStream && input.Stream {
+		return nil, newHTTPError(http.StatusBadRequest, "raw_stream and stream can't be combined")
+	}
+	if input.RawStream && input.N > 1 {
+		return nil, newHTTPError(http.StatusBadRequest, "raw_stream can't be combined with n > 1")
+	}
+	if input.Stream && input.N > 1 {
+		return nil, newHTTPError(http.StatusBadRequest, "stream can't be combined with n > 1")
+	}
+	if err := checkCandidateOptions(input.N, input.Options); err != nil {
+		return nil, err
+	}
+	if input.ResponseFormat, err = parseResponseFormat(input.ResponseFormat); err != nil {
+		return nil, err
+	}
+	if input.ResponseFormat != responseFormatJSON && (input.RawStream || input.Stream) {
+		return nil, newHTTPError(http.StatusBadRequest, "response_format %s can't be combined with streaming", input.ResponseFormat)
+	}
+	if input.ResponseFormat != responseFormatJSON && input.N > 1 {
+		return nil, newHTTPError(http.StatusBadRequest, "response_format %s can't be combined with n > 1", input.ResponseFormat)
+	}
+	if input.TranslateTo, err = parseTranslateTo(input.TranslateTo); err != nil {
+		return nil, err
+	}
+	if input.TranslateTo != "" && isSubtitleFormat(input.ResponseFormat) {
+		return nil, newHTTPError(http.StatusBadRequest, "translate_to can't be combined with response_format %s", input.ResponseFormat)
+	}
+	if input.Template, err = lookupPromptTemplate(input.TemplateName); err != nil {
+		return nil, err
+	}
+	if err := checkMode(input); err != nil {
+		return nil, err
+	}
+	if input.Mode == modeLLMOnly && input.AudioURL != "" {
+		return nil, newHTTPError(http.StatusBadRequest, "mode %s takes text instead of audio_url", modeLLMOnly)
+	}
+	if err := checkDiarize(input); err != nil {
+		return nil, err
+	}
+	if input.TTSFormat, err = parseSpeechFormat(input.TTSFormat); err != nil {
+		return nil, err
+	}
+	if input.TTSDelivery, err = parseSpeechDelivery(input.TTSDelivery); err != nil {
+		return nil, err
+	}
+	if err := checkTTS(input); err != nil {
+		return nil, err
+	}
+	if input.TTSVoice == "" {
+		input.TTSVoice = cfg().ttsVoice
+	}
+	if input.Pipeline, err = lookupPipeline(input.PipelineName); err != nil {
+		return nil, err
+	}
+	if input.SessionID != "" && input.Pipeline != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "session_id can't be combined with pipeline")
+	}
+	if input.Schema != nil {
+		switch {
+		case input.N > 1:
+			return nil, newHTTPError(http.StatusBadRequest, "schema can't be combined with n > 1")
+		case input.Stream || input.RawStream:
+			return nil, newHTTPError(http.StatusBadRequest, "schema can't be combined with streaming")
+		case input.Pipeline != nil:
+			return nil, newHTTPError(http.StatusBadRequest, "schema can't be combined with pipeline")
+		}
+	}
+	if input.Pipeline != nil {
+		switch {
+		case input.N > 1:
+			return nil, newHTTPError(http.StatusBadRequest, "pipeline can't be combined with n > 1")
+		case input.Stream || input.RawStream:
+			return nil, newHTTPError(http.StatusBadRequest, "pipeline can't be combined with streaming")
+		case input.Template != nil:
+			return nil, newHTTPError(http.StatusBadRequest, "pipeline and template can't be combined; pipeline steps have their own prompts")
+		case input.EstimateTokens:
+			return nil, newHTTPError(http.StatusBadRequest, "pipeline can't be combined with estimate_tokens")
+		}
+	}
+
+	if input.LLM, err = lookupLLM(input.Provider); err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "%v", err)
+	}
+	if input.Model, input.ModelDefaulted, err = requestModel(r, input.LLM, input.Model); err != nil {
+		return nil, err
+	}
+	if input.Prompt == "" {
+		input.Prompt = cfg().defaultPrompt
+	}
+	input.Caller = callerName(r)
+
+	// Download the audio last, once the request is known to be valid
+	if input.AudioURL != "" {
+		audio, filename, err := fetchAudioURL(r.Context(), input.AudioURL)
+		if err != nil {
+			return nil, err
+		}
+		input.Audio, input.Filename, input.Streamed = audio, filename, false
+	}
+
+	// Judge the audio by its content rather than its file name
+	if input.Mode != modeLLMOnly && !batch {
+		audio, err := checkAudioFormat(input.Audio, input.Filename)
+		if err != nil {
+			return nil, err
+		}
+		input.Audio = audio
+	}
+	return input, nil
+}
+
+func readMultipartInput(r *http.Request) (*processInput, error) {
+	// Forms are read part by part, except those parsed already, as
+	// /process/batch does
+	if r.MultipartForm == nil {
+		return readMultipartParts(r, streamingUploads())
+	}
+
+	// The query string is part of the form
+	input, err := parseFormInput(r.Form)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the audio file, which llm_only requests and requests with an
+	// audio_url go without
+	file, handler, err := r.FormFile("file")
+	switch {
+	case input.Mode == modeLLMOnly && err == nil:
+		file.Close()
+		return nil, newHTTPError(http.StatusBadRequest, "mode %s takes text instead of an audio file", modeLLMOnly)
+	case input.Mode == modeLLMOnly:
+	case input.AudioURL != "" && err == nil:
+		file.Close()
+		return nil, newHTTPError(http.StatusBadRequest, "send either an audio file or audio_url, not both")
+	case input.AudioURL != "":
+	case err != nil:
+		return nil, newHTTPError(http.StatusBadRequest, "Failed to get audio file: %v", err)
+	default:
+		input.Audio, input.Filename = file, handler.Filename
+	}
+	return input, nil
+}
+
+// parseFormInput parses the fields of a /process form, leaving the audio
+// to the caller
+func parseFormInput(values url.Values) (*processInput, error) {
+	n, err := parseCandidateCount(values.Get("n"))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "%v", err)
+	}
+	clean, err := parseOptionalBool(values.Get("clean_transcription"))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid clean_transcription: %v", err)
+	}
+	channel, err := parseChannel(values.Get("channel"))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "%v", err)
+	}
+	estimate, err := parseOptionalBool(values.Get("estimate_tokens"))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid estimate_tokens: %v", err)
+	}
+	rawStream, err := parseOptionalBool(values.Get("raw_stream"))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid raw_stream: %v", err)
+	}
+	stream, err := parseOptionalBool(values.Get("stream"))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid stream: %v", err)
+	}
+	download, err := parseOptionalBool(values.Get("download"))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid download: %v", err)
+	}
+	words, err := parseWordTimestamps(values.Get("word_timestamps"))
+	if err != nil {
+		return nil, err
+	}
+	language, err := parseLanguage(values.Get("language"))
+	if err != nil {
+		return nil, err
+	}
+	options, err := parseLLMOptions(values.Get)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := parseSchema([]byte(values.Get("schema")))
+	if err != nil {
+		return nil, err
+	}
+	translate, err := parseTask(values.Get("task"))
+	if err != nil {
+		return nil, err
+	}
+	session, err := parseSessionID(values.Get("session_id"))
+	if err != nil {
+		return nil, err
+	}
+	cache, err := parseCacheMode(values.Get("cache"))
+	if err != nil {
+		return nil, err
+	}
+	tts, err := parseOptionalBool(values.Get("tts"))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid tts: %v", err)
+	}
+	diarize, err := parseOptionalBool(values.Get("diarize"))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid diarize: %v", err)
+	}
+	speakers, err := parseNumSpeakers(values.Get("num_speakers"))
+	if err != nil {
+		return nil, err
+	}
+	mode, err := parseMode(values.Get("mode"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &processInput{
+		Model:    values.Get("model"),
+		Prompt:   values.Get("prompt"),
+		Provider: values.Get("provider"),
+		N:        n,
+		Audio:    http.NoBody,
+		AudioURL: values.Get("audio_url"),
+		Mode:     mode,
+		Text:     values.Get("text"),
+
+		CleanTranscription: clean,
+		Channel:            channel,
+		EstimateTokens:     estimate,
+		RawStream:          rawStream,
+		Stream:             stream,
+		ResponseFormat:     values.Get("response_format"),
+		Download:           download,
+		WordTimestamps:     words,
+		Language:           language,
+		Translate:          translate,
+		TranslateTo:        values.Get("translate_to"),
+		TemplateName:       values.Get("template"),
+		PipelineName:       values.Get("pipeline"),
+		Schema:             schema,
+		SessionID:          session,
+		Cache:              cache,
+		TTS:                tts,
+		TTSVoice:           values.Get("tts_voice"),
+		TTSFormat:          values.Get("tts_format"),
+		TTSDelivery:        values.Get("tts_delivery"),
+		Diarize:            diarize,
+		NumSpeakers:        speakers,
+		Options:            options,
+	}, nil
+}
+
+func readJSONInput(r *http.Request) (*processInput, error) {
+	var req JSONProcessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "Failed to parse JSON body: %v", err)
+	}
+
+	if req.N == 0 {
+		req.N = 1
+	}
+	if err := validateCandidateCount(req.N); err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "%v", err)
+	}
+
+	channel, err := parseChannel(req.Channel)
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "%v", err)
+	}
+
+	mode, err := parseMode(cmp.Or(req.Mode, queryMode(r)))
+	if err != nil {
+		return nil, err
+	}
+
+	// llm_only requests have text instead of audio
+	var audio io.ReadCloser = http.NoBody
+	var filename string
+	switch {
+	case mode == modeLLMOnly:
+		if req.Audio != "" {
+			return nil, newHTTPError(http.StatusBadRequest, "mode %s takes text instead of audio", modeLLMOnly)
+		}
+	case req.AudioURL != "":
+		if req.Audio != "" {
+			return nil, newHTTPError(http.StatusBadRequest, "send either audio or audio_url, not both")
+		}
+	default:
+		format, data, err := decodeAudioDataURI(req.Audio)
+		if err != nil {
+			return nil, err
+		}
+		audio, filename = io.NopCloser(bytes.NewReader(data)), "audio."+format
+	}
+
+	words := cfg().wordTimestamps
+	if req.WordTimestamps != nil {
+		words = *req.WordTimestamps
+	}
+
+	language, err := parseLanguage(req.Language)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := req.llmOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := parseSchema(req.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	translate, err := parseTask(req.Task)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := parseSessionID(req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := parseCacheMode(req.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return &processInput{
+		Model:    req.Model,
+		Prompt:   req.Prompt,
+		Provider: req.Provider,
+		N:        req.N,
+		Filename: filename,
+		Audio:    audio,
+		AudioURL: req.AudioURL,
+		Mode:     mode,
+		Text:     req.Text,
+
+		CleanTranscription: req.CleanTranscription,
+		Channel:            channel,
+		EstimateTokens:     req.EstimateTokens,
+		RawStream:          req.RawStream,
+		Stream:             req.Stream,
+		ResponseFormat:     req.ResponseFormat,
+		Download:           req.Download,
+		WordTimestamps:     words,
+		Language:           language,
+		Translate:          translate,
+		TranslateTo:        req.TranslateTo,
+		TemplateName:       req.Template,
+		PipelineName:       req.Pipeline,
+		Schema:             schema,
+		SessionID:          session,
+		Cache:              cache,
+		TTS:                req.TTS,
+		TTSVoice:           req.TTSVoice,
+		TTSFormat:          req.TTSFormat,
+		TTSDelivery:        req.TTSDelivery,
+		Diarize:            req.Diarize,
+		NumSpeakers:        req.NumSpeakers,
+		Options:            options,
+		Streamed:           streamingUploads() && channel == channelMix && mode != modeLLMOnly && req.AudioURL == "",
+	}, nil
+}
+
+// streamingUploads reports whether uploads can skip the temp file: it must
+// be enabled and no enabled feature may need the audio on disk. Silence
+// detection and VAD read the samples, pipeline retries replay the audio,
+// ffmpeg converts the file, long recordings are cut into chunks and the
+// transcription cache hashes the file.
+func streamingUploads() bool {
+	c := cfg()
+	return c.streamUploads && !c.detectSilence && !c.vadEnabled && c.pipelineRetries == 0 && c.transcodeMode == transcodeOff && c.audioChunkSeconds == 0 &&
+		c.transcriptionCacheKind == cacheOff
+}
+
+// readMultipartParts reads the form part by part. With streamAudio set it
+// reads the fields up to the file part and returns the file part itself
+// as the audio, leaving it unread in the request body; fields sent after
+// the file are ignored. Otherwise the file part is written to a temp file
+// as it arrives, the only copy of the upload the bridge makes, and the
+// rest of the form is read as well. llm_only requests and requests with an
+// audio_url have no file part and are read in full. As with
+// ParseMultipartForm, the query string adds to the form's fields.
+func readMultipartParts(r *http.Request, streamAudio bool) (input *processInput, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "Failed to parse form: %v", err)
+	}
+
+	values := url.Values{}
+	var file *multipart.Part
+	var spooled *spooledUpload
+	parts, formBytes := 0, 0
+	defer func() {
+		if err != nil && spooled != nil {
+			spooled.Close()
+		}
+	}()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, newHTTPError(http.StatusBadRequest, "Failed to parse form: %v", err)
+		}
+		if parts++; parts > maxFormParts {
+			return nil, newHTTPError(http.StatusBadRequest, "form has more than %d parts", maxFormParts)
+		}
+		if part.FormName() == "file" {
+			if file != nil {
+				// Only the first file is used, as with FormFile
+				continue
+			}
+			file = part
+			if streamAudio {
+				break
+			}
+			if spooled, err = spoolUpload(part); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFormValueBytes+1))
+		if err != nil {
+			return nil, newHTTPError(http.StatusBadRequest, "Failed to parse form: %v", err)
+		}
+		if len(value) > maxFormValueBytes {
+			return nil, newHTTPError(http.StatusBadRequest, "form field %s is larger than %d bytes", part.FormName(), maxFormValueBytes)
+		}
+		if formBytes += len(value); formBytes > maxFormBytes {
+			return nil, newHTTPError(http.StatusBadRequest, "form fields are larger than %d bytes in total", maxFormBytes)
+		}
+		values.Add(part.FormName(), string(value))
+	}
+	for name, query := range r.URL.Query() {
+		values[name] = append(values[name], query...)
+	}
+
+	if input, err = parseFormInput(values); err != nil {
+		return nil, err
+	}
+	switch {
+	case input.Mode == modeLLMOnly && file != nil:
+		return nil, newHTTPError(http.StatusBadRequest, "mode %s takes text instead of an audio file", modeLLMOnly)
+	case input.AudioURL != "" && file != nil:
+		return nil, newHTTPError(http.StatusBadRequest, "send either an audio file or audio_url, not both")
+	case input.Mode != modeLLMOnly && file == nil && input.AudioURL == "":
+		return nil, newHTTPError(http.StatusBadRequest, "Failed to get audio file: %v", http.ErrMissingFile)
+	}
+	switch {
+	case spooled != nil:
+		input.Filename, input.Audio = file.FileName(), spooled
+	case file != nil:
+		input.Filename, input.Audio = file.FileName(), file
+		// Splitting channels needs the whole file
+		input.Streamed = input.Channel == channelMix
+	}
+	return input, nil
+}
+
+// Limits of the form fields read part by part: each non-file field, all of
+// them together, and the parts of the form, as ParseMultipartForm limits
+// them, so a form of many small fields can't fill memory
+const (
+	maxFormValueBytes = 1 << 20
+	maxFormBytes      = 10 << 20
+	maxFormParts      = 1000
+)
+
+// spooledUpload is an uploaded file written to a temp file while the form
+// was read. Closing it removes the file unless it was kept.
+type spooledUpload struct {
+	*os.File
+	size int64
+	kept bool
+}
+
+// spoolUpload writes the file part of a form to a temp file named like
+// the upload and opens it for reading
+func spoolUpload(part *multipart.Part) (*spooledUpload, error) {
+	tempFile, err := os.CreateTemp("", "upload-*"+filepath.Ext(part.FileName()))
+	if err != nil {
+		return nil, newHTTPError(http.StatusInternalServerError, "Failed to create temp file: %v", err)
+	}
+	size, err := io.Copy(tempFile, part)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		tempFile, err = os.Open(tempFile.Name())
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		// Disk failures are ours, anything else is the upload breaking off
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return nil, newHTTPError(http.StatusInternalServerError, "Failed to write temp file: %v", err)
+		}
+		return nil, newHTTPError(http.StatusBadRequest, "Failed to read audio file: %v", err)
+	}
+	return &spooledUpload{File: tempFile, size: size}, nil
+}
+
+func (u *spooledUpload) Close() error {
+	err := u.File.Close()
+	if !u.kept {
+		os.Remove(u.Name())
+	}
+	return err
+}
+
+// keep hands the temp file over to the caller, who removes it
+func (u *spooledUpload) keep() string {
+	u.kept = true
+	return u.Name()
+}
+
+// spooledUploadPath returns the temp file and size of audio written to
+// disk while its form was read, or "" for other audio
+func spooledUploadPath(audio io.Reader) (string, int64) {
+	if u, ok := audio.(*spooledUpload); ok {
+		return u.Name(), u.size
+	}
+	return "", 0
+}
+
+// decodeAudioDataURI decodes a base64 data URI carrying audio. The declared
+// MIME type must be an allowed format and match the sniffed magic bytes.
+func decodeAudioDataURI(uri string) (format string, audio []byte, err error) {
+	if uri == "" {
+		return "", nil, newHTTPError(http.StatusBadRequest, "audio is required")
+	}
+	rest, ok := strings.CutPrefix(uri, "data:")
+	if !ok {
+		return "", nil, newHTTPError(http.StatusBadRequest, "audio must be a data URI")
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, newHTTPError(http.StatusBadRequest, "malformed data URI")
+	}
+	mimeType, ok := strings.CutSuffix(meta, ";base64")
+	if !ok {
+		return "", nil, newHTTPError(http.StatusBadRequest, "data URI must be base64 encoded")
+	}
+
+	format = formatForMIME(mimeType)
+	if format == "" || !audioFormatAllowed(format) {
+		return "", nil, unsupportedAudio("", format, "audio type %q is not allowed", mimeType)
+	}
+
+	audio, err = base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, newHTTPError(http.StatusBadRequest, "invalid base64 audio: %v", err)
+	}
+
+	if sniffed := sniffAudioFormat(audio[:min(len(audio), sniffLength)]); sniffed != format {
+		return "", nil, newHTTPError(http.StatusBadRequest, "declared type %q does not match audio content", mimeType)
+	}
+	return format, audio, nil
+}
+
+// parseWordTimestamps parses the word_timestamps field, which defaults to
+// WORD_TIMESTAMPS
+func parseWordTimestamps(value string) (bool, error) {
+	if value == "" {
+		return cfg().wordTimestamps, nil
+	}
+	words, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, newHTTPError(http.StatusBadRequest, "invalid word_timestamps: %v", err)
+	}
+	return words, nil
+}
+
+// parseOptionalBool parses a boolean form value, treating an empty value
+// as false
+func parseOptionalBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// writeError reports err to the client, using the status of an httpError
+// and fallback otherwise
+func writeError(w http.ResponseWriter, err error, fallback int) {
+	if he, ok := err.(*httpError); ok && he.body != nil {
+		writeJSON(w, he.status, he.body)
+		return
+	}
+	if he, ok := err.(*httpError); ok {
+		http.Error(w, he.msg, he.status)
+		return
+	}
+	http.Error(w, err.Error(), fallback)
+}
+
+// parseTask parses the task field: transcribe, the default, or translate
+// to have the ASR backend translate the speech to English
+func parseTask(value string) (translate bool, err error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", taskTranscribe:
+		return false, nil
+	case taskTranslate:
+		if !canTranslate(cfg().transcriber) {
+			return false, newHTTPError(http.StatusBadRequest, "the %s ASR backend can't translate", cfg().transcriber.name())
+		}
+		return true, nil
+	}
+	return false, newHTTPError(http.StatusBadRequest, "invalid task %q (expected %s or %s)", value, taskTranscribe, taskTranslate)
+}
+
+// Values of the mode field
+const (
+	modeFull           = "full"
+	modeTranscribeOnly = "transcribe_only"
+	modeLLMOnly        = "llm_only"
+)
+
+// parseMode parses the mode field: full, the default, transcribe_only or
+// llm_only
+func parseMode(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case "":
+		return modeFull, nil
+	case modeFull, modeTranscribeOnly, modeLLMOnly:
+		return mode, nil
+	}
+	return "", newHTTPError(http.StatusBadRequest, "invalid mode %q (expected %s, %s or %s)", value, modeFull, modeTranscribeOnly, modeLLMOnly)
+}
+
+// queryMode returns the mode in the query string. It is known before the
+// body is read, so handlers can tell llm_only requests apart early.
+func queryMode(r *http.Request) string {
+	return r.URL.Query().Get("mode")
+}
+
+// checkMode rejects the fields that don't apply to the input's mode:
+// audio-only settings with llm_only, and LLM settings with transcribe_only
+func checkMode(input *processInput) error {
+	switch input.Mode {
+	case modeLLMOnly:
+		switch {
+		case strings.TrimSpace(input.Text) == "":
+			return newHTTPError(http.StatusBadRequest, "mode %s requires text", modeLLMOnly)
+		case input.Translate:
+			return newHTTPError(http.StatusBadRequest, "task %s needs audio, mode %s takes text", taskTranslate, modeLLMOnly)
+		case isSubtitleFormat(input.ResponseFormat):
+			return newHTTPError(http.StatusBadRequest, "response_format %s needs audio, mode %s takes text", input.ResponseFormat, modeLLMOnly)
+		}
+	case modeTranscribeOnly:
+		var field string
+		switch {
+		case input.N > 1:
+			field = "n > 1"
+		case input.Stream || input.RawStream:
+			field = "streaming"
+		case input.EstimateTokens:
+			field = "estimate_tokens"
+		case input.TranslateTo != "":
+			field = "translate_to"
+		case input.Template != nil:
+			field = "template"
+		case input.PipelineName != "":
+			field = "pipeline"
+		case input.Schema != nil:
+			field = "schema"
+		case input.SessionID != "":
+			field = "session_id"
+		}
+		if field != "" {
+			return newHTTPError(http.StatusBadRequest, "mode %s can't be combined with %s", modeTranscribeOnly, field)
+		}
+	}
+	if input.Text != "" && input.Mode != modeLLMOnly {
+		return newHTTPError(http.StatusBadRequest, "text requires mode %s", modeLLMOnly)
+	}
+	return nil
+}
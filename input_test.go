@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// formRequest returns a /process request with the fields, the audio file
+// and the query string
+func formRequest(t *testing.T, fields map[string]string, audio, query string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if audio != "" {
+		part, _ := form.CreateFormFile("file", "a.wav")
+		part.Write([]byte(audio))
+	}
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/process?"+query, &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestFormPathsAgree(t *testing.T) {
+	fields := map[string]string{
+		"model": "llama3", "prompt": "Summarize", "n": "2", "temperature": "0.5",
+		"clean_transcription": "true", "channel": "left", "word_timestamps": "true",
+		"language": "de", "task": "translate", "session_id": "s1", "cache": "bypass",
+		"diarize": "true", "num_speakers": "2", "tts": "true", "tts_voice": "alloy",
+		"response_format": "json", "schema": `{"type": "object"}`, "options": `{"num_ctx": 4096}`,
+	}
+	parsed := formRequest(t, fields, wavMagic, "estimate_tokens=true")
+	if err := parsed.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	fromForm, err := readMultipartInput(parsed)
+	if err != nil {
+		t.Fatalf("parsed form: %v", err)
+	}
+	fromParts, err := readMultipartParts(formRequest(t, fields, wavMagic, "estimate_tokens=true"), false)
+	if err != nil {
+		t.Fatalf("form read part by part: %v", err)
+	}
+	defer fromParts.Audio.Close()
+
+	if fromForm.Filename != "a.wav" || fromParts.Filename != "a.wav" {
+		t.Errorf("filenames = %q and %q, want a.wav", fromForm.Filename, fromParts.Filename)
+	}
+	fromForm.Audio, fromParts.Audio = nil, nil
+	if !reflect.DeepEqual(fromForm, fromParts) {
+		t.Errorf("the form paths disagree:\n%+v\n%+v", fromForm, fromParts)
+	}
+	if !fromForm.EstimateTokens || fromForm.Channel != "left" || fromForm.N != 2 {
+		t.Errorf("input = %+v, want the fields and the query string", fromForm)
+	}
+}
+
+func TestFormPathsAgreeOnErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		audio  string
+	}{
+		{"invalid n", map[string]string{"n": "many"}, wavMagic},
+		{"invalid bool", map[string]string{"stream": "perhaps"}, wavMagic},
+		{"invalid mode", map[string]string{"mode": "fast"}, wavMagic},
+		{"llm_only with audio", map[string]string{"mode": modeLLMOnly, "text": "hi"}, wavMagic},
+		{"audio and audio_url", map[string]string{"audio_url": "https://example.com/a.wav"}, wavMagic},
+		{"no audio", map[string]string{"model": "llama3"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed := formRequest(t, tt.fields, tt.audio, "")
+			if err := parsed.ParseMultipartForm(1 << 20); err != nil {
+				t.Fatal(err)
+			}
+			_, formErr := readMultipartInput(parsed)
+			_, partsErr := readMultipartParts(formRequest(t, tt.fields, tt.audio, ""), false)
+			if formErr == nil || partsErr == nil || formErr.Error() != partsErr.Error() {
+				t.Errorf("errors = %v and %v, want the same error", formErr, partsErr)
+			}
+		})
+	}
+}
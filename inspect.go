@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// InspectResponse describes an upload without transcribing it
+type InspectResponse struct {
+	audioInfo
+	EstimatedTranscriptionTime int64   `json:"estimated_transcription_ms,omitempty"`
+	EstimatedCost              float64 `json:"estimated_cost,omitempty"`
+}
+
+// inspectHandler reports the detected format, duration, sample rate and
+// channels of an upload together with estimated transcription time and
+// cost, without calling Whisper or Ollama
+func inspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectLargeUpload(w, r) {
+		return
+	}
+	upload := newUploadReader(r.Context(), w, r.Body, time.Duration(cfg().uploadIdleTimeout)*time.Second, int64(cfg().maxUploadBytes))
+	defer upload.stop()
+	r.Body = upload
+
+	input, err := readProcessInput(r)
+	if err != nil {
+		if writeUploadFailure(w, upload) {
+			return
+		}
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	defer input.Audio.Close()
+	if input.Mode == modeLLMOnly {
+		http.Error(w, "there is no audio to inspect with mode "+modeLLMOnly, http.StatusBadRequest)
+		return
+	}
+
+	// Multipart uploads were written to a temp file while the form was read
+	path, _ := spooledUploadPath(input.Audio)
+	if path == "" {
+		tempFile, err := os.CreateTemp("", "inspect-*"+filepath.Ext(input.Filename))
+		if err != nil {
+			http.Error(w, "Failed to create temp file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tempFile.Name())
+		defer tempFile.Close()
+
+		if _, err := io.Copy(tempFile, input.Audio); err != nil {
+			if _, ok := err.(*httpError); ok {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, "Failed to write temp file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tempFile.Close()
+		path = tempFile.Name()
+	}
+
+	info, err := probeAudioFile(path)
+	if err != nil {
+		http.Error(w, "Failed to inspect audio: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := InspectResponse{audioInfo: *info}
+	if info.Duration > 0 {
+		resp.EstimatedTranscriptionTime = int64(info.Duration * cfg().whisperSecondsPerAudioSecond * 1000)
+		resp.EstimatedCost = info.Duration / 60 * cfg().costPerAudioMinute
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
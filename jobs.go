@@ -0,0 +1,598 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Job statuses
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// How often expired jobs are evicted
+const jobJanitorInterval = 30 * time.Second
+
+// Jobs GET /jobs lists by default and at most
+const (
+	defaultJobsLimit = 100
+	maxJobsLimit     = 1000
+)
+
+var (
+	errJobQueueFull = errors.New("job queue is full")
+	errJobStoreFull = errors.New("job store is full of unfinished jobs")
+)
+
+// Job is the state of an async job as returned by the /jobs endpoints
+type Job struct {
+	ID         string            `json:"id"`
+	Status     string            `json:"status"`
+	CreatedAt  time.Time         `json:"created_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Result     *CombinedResponse `json:"result,omitempty"`
+
+	// Results of the files of a batch job, in upload order
+	Results []BatchItem `json:"results,omitempty"`
+}
+
+// job is a stored job with what the worker needs to run it
+type job struct {
+	Job
+	input     *processInput
+	audioPath string
+	batch     *batch // set instead of input for batch jobs
+	caller    string // client that submitted the job, see callerName
+	tempFiles []string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	elem      *list.Element // position in the store's LRU list
+}
+
+// finished reports whether the job has reached a final status
+func (j *job) finished() bool {
+	return j.Status != jobQueued && j.Status != jobRunning
+}
+
+// jobStore holds async jobs and runs them on a fixed pool of workers.
+// Finished jobs are evicted JOB_TTL_* seconds after they finish, queued
+// ones after waiting that long, and the store keeps at most
+// JOB_MAX_STORED jobs by evicting the least recently used finished job.
+// Unfinished jobs are never evicted for space; new jobs are refused
+// instead. All state is guarded by mu, so eviction can't race with polls.
+type jobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*job
+	lru   *list.List // front is most recently used
+	queue chan *job
+	max   int
+
+	// Workers that haven't stopped yet
+	workers sync.WaitGroup
+}
+
+// Async job store, nil until main starts it
+var jobs *jobStore
+
+func newJobStore(maxStored, queueSize int) *jobStore {
+	return &jobStore{
+		jobs:  make(map[string]*job),
+		lru:   list.New(),
+		queue: make(chan *job, queueSize),
+		max:   maxStored,
+	}
+}
+
+// start runs the workers and the janitor until ctx is done
+func (s *jobStore) start(ctx context.Context, workers int) {
+	s.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work(ctx)
+	}
+	go func() {
+		ticker := time.NewTicker(jobJanitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.evictExpired(time.Now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// submit stores j and queues it for a worker. A finished job is evicted
+// to make room only once j is queued, so a refused job costs no result.
+func (s *jobStore) submit(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var evict *job
+	if len(s.jobs) >= s.max {
+		if evict = s.oldestFinished(); evict == nil {
+			return errJobStoreFull
+		}
+	}
+	select {
+	case s.queue <- j:
+	default:
+		return errJobQueueFull
+	}
+	if evict != nil {
+		s.remove(evict.ID, evict)
+	}
+	j.elem = s.lru.PushFront(j)
+	s.jobs[j.ID] = j
+	return nil
+}
+
+// wait waits until the workers have finished their running jobs and
+// stopped, or ctx is done. It reports whether they stopped.
+func (s *jobStore) wait(ctx context.Context) bool {
+	stopped := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// size returns the number of stored jobs
+func (s *jobStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs)
+}
+
+// get returns a snapshot of the job of caller, any when empty, marking it
+// as recently used
+func (s *jobStore) get(id, caller string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || (caller != "" && j.caller != caller) {
+		return Job{}, false
+	}
+	s.lru.MoveToFront(j.elem)
+	return j.Job, true
+}
+
+// list returns snapshots of the jobs with the status and of the caller,
+// any when empty, newest first, up to limit of them
+func (s *jobStore) list(status, caller string, limit int) []Job {
+	s.mu.Lock()
+	var matched []Job
+	for _, j := range s.jobs {
+		if (status == "" || j.Status == status) && (caller == "" || j.caller == caller) {
+			matched = append(matched, j.Job)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(matched, func(a, b int) bool { return matched[a].CreatedAt.After(matched[b].CreatedAt) })
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched
+}
+
+// cancel stops a queued or running job of caller, any when empty.
+// cancelled is false if the job had already completed or failed.
+func (s *jobStore) cancel(id, caller string) (j Job, found, cancelled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.jobs[id]
+	if !ok || (caller != "" && stored.caller != caller) {
+		return Job{}, false, false
+	}
+	if stored.Status == jobCompleted || stored.Status == jobFailed {
+		return stored.Job, true, false
+	}
+	if stored.Status != jobCancelled {
+		now := time.Now()
+		stored.Status = jobCancelled
+		stored.FinishedAt = &now
+		stored.cancel()
+	}
+	return stored.Job, true, true
+}
+
+func (s *jobStore) work(ctx context.Context) {
+	defer s.workers.Done()
+	for {
+		select {
+		case j := <-s.queue:
+			s.run(j)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run processes one job unless it was cancelled or evicted while queued
+func (s *jobStore) run(j *job) {
+	defer func() {
+		for _, path := range j.tempFiles {
+			os.Remove(path)
+		}
+		j.cancel()
+	}()
+
+	s.mu.Lock()
+	if j.Status != jobQueued || j.ctx.Err() != nil {
+		s.mu.Unlock()
+		return
+	}
+	started := time.Now()
+	j.Status = jobRunning
+	j.StartedAt = &started
+	s.mu.Unlock()
+
+	ctx, span := startSpan(j.ctx, "job", spanKindInternal)
+	span.setAttributes("job.id", j.ID)
+	var result *pipelineResult
+	var batch []BatchItem
+	var err error
+	if j.batch != nil {
+		batch = j.batch.run(ctx, cfg().batchConcurrency)
+	} else {
+		result, err = processSpooled(ctx, resultEndpointJobs, j.ID, j.input, j.audioPath, nil)
+	}
+	span.end(err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A cancelled job keeps its status
+	if j.Status != jobRunning {
+		return
+	}
+	finished := time.Now()
+	j.FinishedAt = &finished
+	if err != nil {
+		log.Printf("Job %s failed: %v request_id=%s", j.ID, err, requestIDFromContext(j.ctx))
+		j.Status = jobFailed
+		j.Error = err.Error()
+		return
+	}
+	j.Status = jobCompleted
+	if j.batch != nil {
+		j.Results = batch
+		return
+	}
+	j.Result = &result.Response
+}
+
+// processSpooled runs the pipeline on audio spooled to audioPath, saves
+// the outputs and records the result under id. With stream set, the
+// generated text is sent to it as it comes.
+func processSpooled(ctx context.Context, endpoint, id string, input *processInput, audioPath string, stream tokenStream) (*pipelineResult, error) {
+	started := time.Now()
+	result, err := runPipelineWithRetries(ctx, input, audioPath, stream)
+	if err == nil {
+		elapsed := time.Since(started)
+		result.Response.ProcessTime = elapsed.Milliseconds()
+		if info, err := probeAudioFile(audioPath); err == nil && info.Duration > 0 {
+			result.Response.AudioDuration = info.Duration
+			audioSeconds.add(info.Duration)
+			result.Response.RealtimeFactor = realtimeFactor(info.Duration, elapsed)
+		}
+		if err = saveOutputs(ctx, input, &result.Response, id); err != nil {
+			err = fmt.Errorf("failed to save outputs: %w", err)
+		}
+	}
+	recordResult(ctx, endpoint, id, input, result, err)
+	return result, err
+}
+
+// evictExpired removes jobs whose TTL has passed. A queued job that
+// expires is cancelled, and its worker discards it.
+func (s *jobStore) evictExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		var since time.Time
+		var ttl int
+		switch j.Status {
+		case jobQueued:
+			since, ttl = j.CreatedAt, cfg().jobTTLQueued
+		case jobCompleted:
+			since, ttl = *j.FinishedAt, cfg().jobTTLCompleted
+		case jobFailed, jobCancelled:
+			since, ttl = *j.FinishedAt, cfg().jobTTLFailed
+		default:
+			continue
+		}
+		if now.Sub(since) >= time.Duration(ttl)*time.Second {
+			j.cancel()
+			s.remove(id, j)
+		}
+	}
+}
+
+// oldestFinished returns the least recently used finished job, the one
+// evicted to make room, or nil. Called with mu held.
+func (s *jobStore) oldestFinished() *job {
+	for e := s.lru.Back(); e != nil; e = e.Prev() {
+		if j := e.Value.(*job); j.finished() {
+			return j
+		}
+	}
+	return nil
+}
+
+func (s *jobStore) remove(id string, j *job) {
+	s.lru.Remove(j.elem)
+	delete(s.jobs, id)
+}
+
+// jobsHandler accepts an async job. It takes the same parameters as
+// /process, stores the audio and returns 202 with the job ID at once; the
+// result is polled with GET /jobs/{id}. GET lists the jobs.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		listJobsHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectLargeUpload(w, r) {
+		return
+	}
+
+	// Only the upload is bound to the request
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfg().requestTimeout)*time.Second)
+	defer cancel()
+
+	upload := newUploadReader(ctx, w, r.Body, time.Duration(cfg().uploadIdleTimeout)*time.Second, int64(cfg().maxUploadBytes))
+	defer upload.stop()
+	r.Body = upload
+
+	input, err := readProcessInput(r)
+	if err != nil {
+		if writeUploadFailure(w, upload) {
+			return
+		}
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	defer input.Audio.Close()
+	if input.RawStream || input.Stream {
+		http.Error(w, "streaming can't be used with async jobs", http.StatusBadRequest)
+		return
+	}
+	if input.ResponseFormat != responseFormatJSON || input.Download || (input.TTS && input.TTSDelivery != speechDeliveryURL) {
+		http.Error(w, "async job results are always JSON", http.StatusBadRequest)
+		return
+	}
+
+	// The job outlives the request, but keeps its ID and upstream overrides
+	jobCtx, jobCancel := context.WithTimeout(context.WithValue(context.Background(), requestIDKey, requestIDFromContext(r.Context())), time.Duration(cfg().jobTimeout)*time.Second)
+	jobCtx = withSpanContext(jobCtx, r.Context())
+	jobCtx, err = withURLOverrides(jobCtx, r)
+	if err != nil {
+		jobCancel()
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	j := &job{
+		Job:    Job{ID: newRequestID(), Status: jobQueued, CreatedAt: time.Now()},
+		input:  input,
+		caller: input.Caller,
+		ctx:    jobCtx,
+		cancel: jobCancel,
+	}
+	if err := spoolJobAudio(j); err != nil {
+		jobCancel()
+		for _, path := range j.tempFiles {
+			os.Remove(path)
+		}
+		if writeUploadFailure(w, upload) {
+			return
+		}
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := jobs.submit(j); err != nil {
+		jobCancel()
+		for _, path := range j.tempFiles {
+			os.Remove(path)
+		}
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Job %s queued request_id=%s", j.ID, requestIDFromContext(r.Context()))
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, j.Job)
+}
+
+// spoolJobAudio saves the job's upload to a temp file, which every
+// pipeline attempt reads, and prepares it with prepareAudio. llm_only jobs
+// have no audio to save.
+func spoolJobAudio(j *job) error {
+	if j.input.Mode == modeLLMOnly {
+		return nil
+	}
+	path, err := spoolAudio(j.input.Audio, j.input.Filename)
+	if path != "" {
+		j.tempFiles = append(j.tempFiles, path)
+	}
+	if err != nil {
+		return err
+	}
+	j.input.Streamed = false
+	var tempFiles []string
+	j.audioPath, tempFiles, err = prepareAudio(j.ctx, j.input, path)
+	j.tempFiles = append(j.tempFiles, tempFiles...)
+	return err
+}
+
+// processUpload spools the input's audio, prepares it and runs the
+// pipeline on it with processSpooled, removing the temp files afterwards
+func processUpload(ctx context.Context, endpoint, id string, input *processInput, stream tokenStream) (*pipelineResult, error) {
+	if input.Mode == modeLLMOnly {
+		return processSpooled(ctx, endpoint, id, input, "", stream)
+	}
+	var tempFiles []string
+	defer func() {
+		for _, path := range tempFiles {
+			os.Remove(path)
+		}
+	}()
+	path, err := spoolAudio(input.Audio, input.Filename)
+	if path != "" {
+		tempFiles = append(tempFiles, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	input.Streamed = false
+	audioPath, prepared, err := prepareAudio(ctx, input, path)
+	tempFiles = append(tempFiles, prepared...)
+	if err != nil {
+		return nil, err
+	}
+	return processSpooled(ctx, endpoint, id, input, audioPath, stream)
+}
+
+// spoolAudio copies audio to a temp file named like filename and returns
+// its path, which is set whenever the file was created. A multipart upload
+// written to disk while its form was read is taken over instead.
+func spoolAudio(audio io.Reader, filename string) (string, error) {
+	if u, ok := audio.(*spooledUpload); ok {
+		return u.keep(), nil
+	}
+	tempFile, err := os.CreateTemp("", "job-*"+filepath.Ext(filename))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tempFile, audio)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	return tempFile.Name(), err
+}
+
+// prepareAudio converts the spooled audio at path when TRANSCODE_AUDIO asks
+// for it, extracts the requested channel and cuts out silence, setting the
+// input's speech. It returns the path to transcribe and the temp files it
+// created, also on failure.
+func prepareAudio(ctx context.Context, input *processInput, path string) (string, []string, error) {
+	var tempFiles []string
+	transcodedPath, err := transcodeUpload(ctx, path, input.Channel)
+	if err != nil {
+		return "", tempFiles, err
+	}
+	if transcodedPath != path {
+		tempFiles = append(tempFiles, transcodedPath)
+		path = transcodedPath
+	}
+
+	if input.Channel != channelMix {
+		channelPath, err := selectChannel(path, input.Channel)
+		if err != nil {
+			return "", tempFiles, err
+		}
+		tempFiles = append(tempFiles, channelPath)
+		path = channelPath
+	}
+
+	speechPath, speech, err := stripSilence(path)
+	if err != nil {
+		return "", tempFiles, err
+	}
+	if speech != nil {
+		tempFiles = append(tempFiles, speechPath)
+		path, input.Speech = speechPath, speech
+	}
+	return path, tempFiles, nil
+}
+
+// JobsResponse is the list of GET /jobs
+type JobsResponse struct {
+	Jobs []Job `json:"jobs"`
+}
+
+// listJobsHandler lists the stored jobs, newest first, optionally those
+// with the status query parameter. With authentication on, callers only
+// see their own jobs.
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := query.Get("status")
+	switch status {
+	case "", jobQueued, jobRunning, jobCompleted, jobFailed, jobCancelled:
+	default:
+		http.Error(w, fmt.Sprintf("status must be %s, %s, %s, %s or %s, got %q", jobQueued, jobRunning, jobCompleted, jobFailed, jobCancelled, status), http.StatusBadRequest)
+		return
+	}
+	limit := defaultJobsLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxJobsLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxJobsLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	resp := JobsResponse{Jobs: jobs.list(status, scopedCaller(r), limit)}
+	if resp.Jobs == nil {
+		resp.Jobs = []Job{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// jobHandler returns a job's state with GET and cancels it with DELETE.
+// Cancelling a finished job is a conflict. With authentication on, the
+// jobs of other callers aren't found.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch r.Method {
+	case http.MethodGet:
+		j, ok := jobs.get(id, scopedCaller(r))
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, j)
+	case http.MethodDelete:
+		j, ok, cancelled := jobs.cancel(id, scopedCaller(r))
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		if !cancelled {
+			writeJSON(w, http.StatusConflict, j)
+			return
+		}
+		log.Printf("Job %s cancelled request_id=%s", id, requestIDFromContext(r.Context()))
+		writeJSON(w, http.StatusOK, j)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
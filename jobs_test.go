@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSubmitRefusedKeepsFinishedJob(t *testing.T) {
+	store := newJobStore(2, 1)
+	finished := &job{Job: Job{ID: "finished", Status: jobQueued}}
+	if err := store.submit(finished); err != nil {
+		t.Fatal(err)
+	}
+	<-store.queue
+	finished.Status = jobCompleted
+	if err := store.submit(&job{Job: Job{ID: "queued", Status: jobQueued}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store is full and so is the queue: the new job is refused and
+	// the finished one keeps its result
+	if err := store.submit(&job{Job: Job{ID: "refused", Status: jobQueued}}); !errors.Is(err, errJobQueueFull) {
+		t.Fatalf("submit to a full queue = %v, want %v", err, errJobQueueFull)
+	}
+	if _, ok := store.get("finished", ""); !ok {
+		t.Error("finished job evicted for a job that was refused")
+	}
+
+	<-store.queue
+	if err := store.submit(&job{Job: Job{ID: "accepted", Status: jobQueued}}); err != nil {
+		t.Fatalf("submit with room in the queue = %v", err)
+	}
+	if _, ok := store.get("finished", ""); ok {
+		t.Error("finished job kept, want it evicted for the accepted job")
+	}
+	if n := store.size(); n != 2 {
+		t.Errorf("%d jobs stored, want 2", n)
+	}
+}
+
+func TestSubmitStoreFullOfUnfinishedJobs(t *testing.T) {
+	store := newJobStore(1, 2)
+	if err := store.submit(&job{Job: Job{ID: "queued", Status: jobQueued}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.submit(&job{Job: Job{ID: "refused", Status: jobQueued}}); !errors.Is(err, errJobStoreFull) {
+		t.Fatalf("submit = %v, want %v", err, errJobStoreFull)
+	}
+	if n := len(store.queue); n != 1 {
+		t.Errorf("%d jobs queued, want the refused one left out", n)
+	}
+}
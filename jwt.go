@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Timeout for fetching the OIDC discovery document and the JWKS
+	jwksFetchTimeout = 10 * time.Second
+	// A token signed with an unknown key ID refetches the keys, at most
+	// this often, to pick up rotated keys
+	jwksRefetchInterval = 30 * time.Second
+)
+
+// errJWKSUnavailable means tokens can't be verified because the signing
+// keys couldn't be fetched, which is the bridge's problem, not the client's
+var errJWKSUnavailable = errors.New("signing keys are unavailable")
+
+// tokenClaims are the claims of a verified JWT that the bridge uses
+type tokenClaims struct {
+	Subject string
+	Tenant  string // from JWT_TENANT_CLAIM
+}
+
+func (c *tokenClaims) subject() string {
+	if c == nil {
+		return ""
+	}
+	return c.Subject
+}
+
+func (c *tokenClaims) tenant() string {
+	if c == nil {
+		return ""
+	}
+	return c.Tenant
+}
+
+// jwtEnabled reports whether bearer JWTs are accepted
+func (c *config) jwtEnabled() bool {
+	return c.oidcIssuer != "" || c.jwksURL != ""
+}
+
+// looksLikeJWT tells a compact JWT (three dot-separated parts) from an
+// API key
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Signature algorithms accepted in the JWT header. Symmetric algorithms
+// and "none" are refused, since the keys come from a public JWKS.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verifyJWT checks a compact JWT's signature against the issuer's keys and
+// its exp, nbf, iss and aud claims, and returns its claims
+func verifyJWT(ctx context.Context, token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	key, err := jwks.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, hash, h.Sum(nil), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	if err := checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	return &tokenClaims{Subject: sub, Tenant: claimString(claims[cfg().jwtTenantClaim])}, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// verifySignature checks a signature made with alg over digest
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) error {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return fmt.Errorf("%s token signed with an RSA key", alg)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return fmt.Errorf("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// checkClaims checks the registered claims: the token must not have
+// expired or be used before nbf, allowing JWT_LEEWAY seconds of clock
+// skew, and iss and aud must match OIDC_ISSUER and JWT_AUDIENCE, which
+// validate requires with JWT authentication on
+func checkClaims(claims map[string]any, now time.Time) error {
+	c := cfg()
+	leeway := time.Duration(c.jwtLeeway) * time.Second
+	exp, ok := claimTime(claims["exp"])
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(exp.Add(leeway)) {
+		return fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	if nbf, ok := claimTime(claims["nbf"]); ok && now.Add(leeway).Before(nbf) {
+		return fmt.Errorf("token is not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+	if claims["iss"] != strings.TrimSuffix(c.oidcIssuer, "/") && claims["iss"] != c.oidcIssuer {
+		return fmt.Errorf("token issuer %v is not %s", claims["iss"], c.oidcIssuer)
+	}
+	if !hasAudience(claims["aud"], c.jwtAudience) {
+		return fmt.Errorf("token audience doesn't include %s", c.jwtAudience)
+	}
+	return nil
+}
+
+func claimTime(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// hasAudience reports whether an aud claim, a string or a list of them,
+// includes audience
+func hasAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString returns a string or numeric claim as a string
+func claimString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// jwksCache holds the issuer's signing keys by key ID. Keys are fetched
+// on first use and refetched every JWKS_REFRESH seconds, or sooner when a
+// token names a key ID that isn't known yet. Fetches are at least
+// jwksRefetchInterval apart, so tokens can't flood the issuer. The lock
+// isn't held during a fetch: requests whose key is known go on with it,
+// and only those that need the fetched keys wait for it.
+type jwksCache struct {
+	mu          sync.Mutex
+	issuer      string
+	url         string
+	keys        map[string]crypto.PublicKey
+	fetched     time.Time
+	lastAttempt time.Time
+	err         error         // of the last fetch
+	fetching    chan struct{} // closed when the fetch in progress ends
+}
+
+var jwks = &jwksCache{}
+
+// configure sets where keys come from, dropping the cached keys when that
+// changes
+func (c *jwksCache) configure(issuer, url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.issuer != issuer || c.url != url {
+		c.issuer, c.url = issuer, url
+		c.keys, c.fetched, c.lastAttempt, c.err, c.fetching = nil, time.Time{}, time.Time{}, nil, nil
+	}
+}
+
+// key returns the signing key with ID kid. A token without a kid is
+// accepted when the issuer has a single key.
+func (c *jwksCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	now := time.Now()
+	_, known := c.keys[kid]
+	stale := now.Sub(c.fetched) >= time.Duration(cfg().jwksRefresh)*time.Second
+	if c.fetching == nil && (stale || (!known && kid != "")) && now.Sub(c.lastAttempt) >= jwksRefetchInterval {
+		c.lastAttempt = now
+		c.fetching = make(chan struct{})
+		go c.fetch(c.issuer, c.url, c.fetching)
+	}
+	fetching := c.fetching
+	c.mu.Unlock()
+
+	if fetching != nil && !known {
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		return nil, fmt.Errorf("%w: %v", errJWKSUnavailable, c.err)
+	}
+
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("token signed with unknown key %q", kid)
+}
+
+// fetch fetches the keys for key, which the requests waiting for it share,
+// and closes done. Its result is dropped when configure changed where keys
+// come from in the meantime.
+func (c *jwksCache) fetch(issuer, url string, done chan struct{}) {
+	defer close(done)
+	keys, source, err := fetchJWKS(context.Background(), issuer, url)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fetching != done {
+		return
+	}
+	c.fetching = nil
+	switch {
+	case err != nil:
+		c.err = err
+		if c.keys != nil {
+			log.Printf("Failed to refresh JWT signing keys, keeping the current ones: %v", err)
+		}
+	default:
+		if !sameKeyIDs(c.keys, keys) {
+			log.Printf("Loaded %d JWT signing keys from %s", len(keys), source)
+		}
+		c.keys, c.fetched, c.err = keys, time.Now(), nil
+	}
+}
+
+func sameKeyIDs(a, b map[string]crypto.PublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for kid := range a {
+		if _, ok := b[kid]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchJWKS fetches the key set at url, or at the jwks_uri of the
+// issuer's OIDC discovery document when url is empty, and returns the
+// usable signing keys and where they came from
+func fetchJWKS(ctx context.Context, issuer, url string) (map[string]crypto.PublicKey, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+
+	if url == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		configURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+		if err := getJSON(ctx, configURL, &discovery); err != nil {
+			return nil, "", err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, "", fmt.Errorf("%s has no jwks_uri", configURL)
+		}
+		url = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, url, &set); err != nil {
+		return nil, "", err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWT signing key %q from %s: %v", jwk.Kid, url, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("%s has no usable signing keys", url)
+	}
+	return keys, url, nil
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", url, err)
+	}
+	return nil
+}
+
+// jsonWebKey is an RSA or EC public key of a JWKS (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var check ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, check = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, check = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, check = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		size := (curve.Params().BitSize + 7) / 8
+		if errX != nil || errY != nil || len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("invalid point")
+		}
+		// crypto/ecdh rejects points that aren't on the curve
+		if _, err := check.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, fmt.Errorf("invalid point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
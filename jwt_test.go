@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example"
+	testAudience = "whisper-llm-bridge"
+)
+
+// Signing keys shared by the tests, since RSA key generation is slow
+var (
+	testKeysOnce sync.Once
+	testRSAKey   *rsa.PrivateKey
+	testECKey    *ecdsa.PrivateKey
+)
+
+func testKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		var err error
+		if testRSAKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+		if testECKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			panic(err)
+		}
+	})
+	return testRSAKey, testECKey
+}
+
+// jwksServer serves a JWKS with keys, which the test may replace, and
+// counts the fetches. With keys nil it fails.
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetches atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, keys map[string]crypto.PublicKey) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.keys == nil {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var set struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		for kid, key := range s.keys {
+			set.Keys = append(set.Keys, toJSONWebKey(kid, key))
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) setKeys(keys map[string]crypto.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func toJSONWebKey(kid string, key crypto.PublicKey) jsonWebKey {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jsonWebKey{Kty: "RSA", Kid: kid, Use: "sig", N: encode(key.N.Bytes()), E: encode(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		point, _ := key.ECDH()
+		xy := point.Bytes()[1:]
+		return jsonWebKey{Kty: "EC", Kid: kid, Use: "sig", Crv: key.Curve.Params().Name, X: encode(xy[:len(xy)/2]), Y: encode(xy[len(xy)/2:])}
+	}
+	panic("unsupported key type")
+}
+
+// useJWT turns JWT authentication on with the keys served by server for
+// the rest of the test
+func useJWT(t *testing.T, server *jwksServer) {
+	t.Helper()
+	setConfigForTest(t, func(c *config) {
+		c.oidcIssuer = testIssuer
+		c.jwksURL = server.URL
+		c.jwtAudience = testAudience
+		c.jwtTenantClaim = "tenant"
+		c.jwtLeeway = 60
+	})
+	setForTest(t, &jwks, &jwksCache{})
+	jwks.configure(cfg().oidcIssuer, cfg().jwksURL)
+}
+
+// validClaims returns claims that pass checkClaims, with overrides
+// applied; an override of nil deletes the claim
+func validClaims(overrides map[string]any) map[string]any {
+	now := time.Now()
+	claims := map[string]any{
+		"iss":    testIssuer,
+		"aud":    testAudience,
+		"sub":    "user-1",
+		"tenant": "acme",
+		"iat":    now.Unix(),
+		"exp":    now.Add(time.Hour).Unix(),
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+// signJWT returns a compact JWT with alg and kid in its header, signed
+// with key as alg's family does it for the key's type, or unsigned when
+// key is nil
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header := map[string]any{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	if key == nil {
+		return signed + "."
+	}
+
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		hash = crypto.SHA256
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, key, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	useJWT(t, newJWKSServer(t, map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey}))
+
+	valid := validClaims(nil)
+	esToken := signJWT(t, "ES256", "ec", ecKey, valid)
+	head, _, _ := strings.Cut(esToken, ".")
+	rsToken := signJWT(t, "RS256", "rsa", rsaKey, valid)
+	_, rsBody, _ := strings.Cut(rsToken, ".")
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"RS256", rsToken, ""},
+		{"PS256", signJWT(t, "PS256", "rsa", rsaKey, valid), ""},
+		{"ES256", esToken, ""},
+		{"alg none", signJWT(t, "none", "rsa", nil, valid), `unsupported signing algorithm "none"`},
+		{"HS256", signJWT(t, "HS256", "rsa", rsaKey, valid), `unsupported signing algorithm "HS256"`},
+		{"ES alg with an RSA key", signJWT(t, "ES256", "rsa", rsaKey, valid), "ES256 token signed with an RSA key"},
+		{"RS alg with an EC key", signJWT(t, "RS256", "ec", ecKey, valid), "invalid token signature"},
+		{"short ES signature", esToken[:len(esToken)-2], "invalid token signature"},
+		{"long ES signature", esToken + "AA", "invalid token signature"},
+		{"claims swapped", head + "." + rsBody, "invalid token signature"},
+		{"unknown kid", signJWT(t, "RS256", "other", rsaKey, valid), `unknown key "other"`},
+		{"expired", signJWT(t, "RS256", "rsa", rsaKey, validClaims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})), "token expired"},
+		{"wrong issuer", signJWT(t, "RS256", "rsa", rsaKey, validClaims(map[string]any{"iss": "https://evil.example"})), "token issuer"},
+		{"wrong audience", signJWT(t, "RS256", "rsa", rsaKey, validClaims(map[string]any{"aud": "other"})), "token audience"},
+		{"two parts", "a.b", "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyJWT(t.Context(), tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyJWT() error = %v", err)
+				}
+				if claims.Subject != "user-1" || claims.Tenant != "acme" {
+					t.Errorf("claims = %+v, want user-1 of acme", claims)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyJWT() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	digest := crypto.SHA256.New().Sum(nil)
+	r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esSignature := make([]byte, 64)
+	r.FillBytes(esSignature[:32])
+	s.FillBytes(esSignature[32:])
+	rsSignature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		alg       string
+		key       crypto.PublicKey
+		signature []byte
+		wantErr   string
+	}{
+		{"RS256", "RS256", &rsaKey.PublicKey, rsSignature, ""},
+		{"PS256 over a PKCS1 signature", "PS256", &rsaKey.PublicKey, rsSignature, "invalid token signature"},
+		{"ES256", "ES256", &ecKey.PublicKey, esSignature, ""},
+		{"ES256 with an RSA key", "ES256", &rsaKey.PublicKey, rsSignature, "ES256 token signed with an RSA key"},
+		{"RS256 with an EC key", "RS256", &ecKey.PublicKey, esSignature, "invalid token signature"},
+		{"ES256 signature too short", "ES256", &ecKey.PublicKey, esSignature[:63], "invalid token signature"},
+		{"ES256 signature too long", "ES256", &ecKey.PublicKey, append(esSignature[:64:64], 0), "invalid token signature"},
+		{"ES256 signature empty", "ES256", &ecKey.PublicKey, nil, "invalid token signature"},
+		{"unsupported key", "RS256", "secret", rsSignature, "unsupported key type string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySignature(tt.alg, tt.key, crypto.SHA256, digest, tt.signature)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifySignature() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifySignature() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckClaims(t *testing.T) {
+	setConfigForTest(t, func(c *config) {
+		c.oidcIssuer = testIssuer + "/"
+		c.jwtAudience = testAudience
+	})
+	now := time.Unix(1_700_000_000, 0)
+	at := func(offset time.Duration) json.Number {
+		return json.Number(strconv.FormatInt(now.Add(offset).Unix(), 10))
+	}
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{"iss": testIssuer, "aud": testAudience, "exp": at(time.Hour)}
+		for name, value := range overrides {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		leeway  int
+		wantErr string
+	}{
+		{"valid", claims(nil), 60, ""},
+		{"no expiry", claims(map[string]any{"exp": nil}), 60, "token has no expiry"},
+		{"expiry not a number", claims(map[string]any{"exp": "tomorrow"}), 60, "token has no expiry"},
+		{"expired", claims(map[string]any{"exp": at(-2 * time.Minute)}), 60, "token expired at 2023-11-14T22:11:20Z"},
+		{"expired within leeway", claims(map[string]any{"exp": at(-30 * time.Second)}), 60, ""},
+		{"expired without leeway", claims(map[string]any{"exp": at(-time.Second)}), 0, "token expired"},
+		{"not yet valid", claims(map[string]any{"nbf": at(2 * time.Minute)}), 60, "token is not valid before 2023-11-14T22:15:20Z"},
+		{"not yet valid within leeway", claims(map[string]any{"nbf": at(30 * time.Second)}), 60, ""},
+		{"not yet valid without leeway", claims(map[string]any{"nbf": at(time.Second)}), 0, "token is not valid before"},
+		{"valid since nbf", claims(map[string]any{"nbf": at(-time.Minute)}), 0, ""},
+		{"issuer with trailing slash", claims(map[string]any{"iss": testIssuer + "/"}), 60, ""},
+		{"wrong issuer", claims(map[string]any{"iss": "https://evil.example"}), 60, "token issuer https://evil.example"},
+		{"no issuer", claims(map[string]any{"iss": nil}), 60, "token issuer"},
+		{"audience list", claims(map[string]any{"aud": []any{"other", testAudience}}), 60, ""},
+		{"wrong audience", claims(map[string]any{"aud": "other"}), 60, "token audience"},
+		{"audience list without ours", claims(map[string]any{"aud": []any{"other", "another"}}), 60, "token audience"},
+		{"no audience", claims(map[string]any{"aud": nil}), 60, "token audience"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfigForTest(t, func(c *config) { c.jwtLeeway = tt.leeway })
+			err := checkClaims(tt.claims, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkClaims() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkClaims() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWKSRefetchesUnknownKeyID(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	server := newJWKSServer(t, map[string]crypto.PublicKey{"old": &rsaKey.PublicKey})
+	useJWT(t, server)
+	ctx := t.Context()
+
+	if _, err := jwks.key(ctx, "old"); err != nil {
+		t.Fatalf("key(old) error = %v", err)
+	}
+	if got := server.fetches.Load(); got != 1 {
+		t.Fatalf("fetches = %d, want 1", got)
+	}
+
+	// The issuer rotates in a new key. A token naming it right after the
+	// last fetch doesn't refetch, so unknown key IDs can't flood the issuer.
+	server.setKeys(map[string]crypto.PublicKey{"old": &rsaKey.PublicKey, "new": &ecKey.PublicKey})
+	for range 3 {
+		if _, err := jwks.key(ctx, "new"); err == nil || !strings.Contains(err.Error(), `unknown key "new"`) {
+			t.Fatalf("key(new) error = %v, want unknown key", err)
+		}
+	}
+	if got := server.fetches.Load(); got != 1 {
+		t.Fatalf("fetches within the refetch interval = %d, want 1", got)
+	}
+
+	// Once the interval has passed, an unknown key ID refetches
+	jwks.mu.Lock()
+	jwks.lastAttempt = time.Now().Add(-jwksRefetchInterval)
+	jwks.mu.Unlock()
+	key, err := jwks.key(ctx, "new")
+	if err != nil {
+		t.Fatalf("key(new) after the interval error = %v", err)
+	}
+	if _, ok := key.(*ecdsa.PublicKey); !ok {
+		t.Errorf("key(new) = %T, want the rotated EC key", key)
+	}
+	if _, err := jwks.key(ctx, "missing"); err == nil {
+		t.Error("key(missing) succeeded")
+	}
+	if got := server.fetches.Load(); got != 2 {
+		t.Errorf("fetches = %d, want 2", got)
+	}
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	useJWT(t, newJWKSServer(t, nil))
+	_, err := verifyJWT(t.Context(), signJWT(t, "RS256", "rsa", rsaKey, validClaims(nil)))
+	if !errors.Is(err, errJWKSUnavailable) {
+		t.Errorf("verifyJWT() error = %v, want errJWKSUnavailable", err)
+	}
+}
+
+func TestJWKSKeyWithoutKid(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	server := newJWKSServer(t, map[string]crypto.PublicKey{"only": &rsaKey.PublicKey})
+	useJWT(t, server)
+	if _, err := verifyJWT(t.Context(), signJWT(t, "RS256", "", rsaKey, validClaims(nil))); err != nil {
+		t.Errorf("token without a kid, single key: error = %v", err)
+	}
+
+	server.setKeys(map[string]crypto.PublicKey{"a": &rsaKey.PublicKey, "b": &ecKey.PublicKey})
+	setForTest(t, &jwks, &jwksCache{})
+	jwks.configure(cfg().oidcIssuer, cfg().jwksURL)
+	if _, err := jwks.key(t.Context(), ""); err == nil {
+		t.Error("token without a kid, two keys: succeeded")
+	}
+}
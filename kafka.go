@@ -0,0 +1,958 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kafka API keys, used at versions every broker since Kafka 1.0 supports
+const (
+	kafkaProduce         = 0
+	kafkaFetch           = 1
+	kafkaListOffsets     = 2
+	kafkaMetadata        = 3
+	kafkaOffsetCommit    = 8
+	kafkaOffsetFetch     = 9
+	kafkaFindCoordinator = 10
+	kafkaJoinGroup       = 11
+	kafkaHeartbeat       = 12
+	kafkaLeaveGroup      = 13
+	kafkaSyncGroup       = 14
+)
+
+// Kafka error codes the bridge acts on
+const (
+	kafkaUnknownTopicOrPartition = 3
+	kafkaNotLeader               = 6
+	kafkaCoordinatorLoading      = 14
+	kafkaCoordinatorNotAvailable = 15
+	kafkaNotCoordinator          = 16
+	kafkaIllegalGeneration       = 22
+	kafkaUnknownMemberID         = 25
+	kafkaRebalanceInProgress     = 27
+)
+
+// Offsets ListOffsets resolves to the first and next offsets of a partition
+const (
+	kafkaEarliest = -2
+	kafkaLatest   = -1
+)
+
+// Idle connections kept open to each broker
+const kafkaMaxIdle = 4
+
+// Bound on a Kafka request when the context has no deadline
+const kafkaTimeout = 30 * time.Second
+
+// Largest response accepted from a broker
+const kafkaMaxResponse = 128 << 20
+
+// kafkaError is an error code returned by a broker
+type kafkaError int16
+
+var kafkaErrorNames = map[kafkaError]string{
+	kafkaUnknownTopicOrPartition: "unknown topic or partition",
+	kafkaNotLeader:               "not the leader for the partition",
+	kafkaCoordinatorLoading:      "coordinator loading",
+	kafkaCoordinatorNotAvailable: "coordinator not available",
+	kafkaNotCoordinator:          "not the coordinator",
+	kafkaIllegalGeneration:       "illegal generation",
+	kafkaUnknownMemberID:         "unknown member ID",
+	kafkaRebalanceInProgress:     "rebalance in progress",
+}
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return fmt.Sprintf("kafka: %s (error %d)", name, int16(e))
+	}
+	return fmt.Sprintf("kafka: error %d", int16(e))
+}
+
+// kafkaErr returns the error of a code, nil for 0
+func kafkaErr(code int16) error {
+	if code == 0 {
+		return nil
+	}
+	return kafkaError(code)
+}
+
+// kafkaRecord is a message of a partition
+type kafkaRecord struct {
+	Offset int64
+	Key    []byte
+	Value  []byte
+}
+
+// kafkaClient talks to a Kafka cluster over its binary protocol, the
+// little the bridge needs, without a client library: metadata, the consumer
+// group API of the group coordinator, fetching and producing. Connections
+// to each broker are reused. Plaintext only, without SASL.
+type kafkaClient struct {
+	seeds    []string
+	clientID string
+
+	mu      sync.Mutex
+	brokers map[int32]string // node ID to address
+	idle    map[string]chan *kafkaConn
+}
+
+type kafkaConn struct {
+	net.Conn
+	correlationID int32
+}
+
+func newKafkaClient(seeds []string, clientID string) *kafkaClient {
+	return &kafkaClient{seeds: seeds, clientID: clientID, brokers: make(map[int32]string), idle: make(map[string]chan *kafkaConn)}
+}
+
+// request sends a request to the broker at addr and returns its response
+// body. Connections that fail are dropped.
+func (c *kafkaClient) request(ctx context.Context, addr string, apiKey, version int16, body []byte) (*kafkaDecoder, error) {
+	conn, err := c.conn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(kafkaTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	resp, err := conn.roundTrip(apiKey, version, c.clientID, body)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.mu.Lock()
+	idle := c.idle[addr]
+	c.mu.Unlock()
+	select {
+	case idle <- conn:
+	default:
+		conn.Close()
+	}
+	return &kafkaDecoder{b: resp}, nil
+}
+
+// conn returns an idle connection to addr, or a new one
+func (c *kafkaClient) conn(ctx context.Context, addr string) (*kafkaConn, error) {
+	c.mu.Lock()
+	idle, ok := c.idle[addr]
+	if !ok {
+		idle = make(chan *kafkaConn, kafkaMaxIdle)
+		c.idle[addr] = idle
+	}
+	c.mu.Unlock()
+	select {
+	case conn := <-idle:
+		return conn, nil
+	default:
+	}
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{Conn: netConn}, nil
+}
+
+// roundTrip sends a request with a version 1 header and reads the
+// response, checking its correlation ID
+func (conn *kafkaConn) roundTrip(apiKey, version int16, clientID string, body []byte) ([]byte, error) {
+	conn.correlationID++
+	var e kafkaEncoder
+	e.int32(0) // size, set below
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(conn.correlationID)
+	e.string(clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	if _, err := conn.Write(e.b); err != nil {
+		return nil, err
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	if size < 4 || size > kafkaMaxResponse {
+		return nil, fmt.Errorf("kafka: invalid response size %d", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != conn.correlationID {
+		return nil, fmt.Errorf("kafka: response to request %d, expected %d", id, conn.correlationID)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// anyBroker sends a request to the first seed broker that answers
+func (c *kafkaClient) anyBroker(ctx context.Context, apiKey, version int16, body []byte) (*kafkaDecoder, error) {
+	var err error
+	for _, addr := range c.seeds {
+		var d *kafkaDecoder
+		if d, err = c.request(ctx, addr, apiKey, version, body); err == nil {
+			return d, nil
+		}
+	}
+	return nil, err
+}
+
+// broker returns the address of a broker by node ID, from the last
+// metadata
+func (c *kafkaClient) broker(node int32) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr, ok := c.brokers[node]
+	if !ok {
+		return "", fmt.Errorf("kafka: unknown broker %d", node)
+	}
+	return addr, nil
+}
+
+// partitionLeader returns the address of the leader of a partition, from
+// leaders as returned by leaders. A partition missing from them is an error
+// rather than a lookup of broker 0.
+func (c *kafkaClient) partitionLeader(leaders map[int32]int32, topic string, partition int32) (string, error) {
+	node, ok := leaders[partition]
+	if !ok {
+		return "", fmt.Errorf("topic %s partition %d: %w", topic, partition, kafkaError(kafkaUnknownTopicOrPartition))
+	}
+	return c.broker(node)
+}
+
+// leaders returns the leader of each partition of topic, remembering the
+// brokers' addresses
+func (c *kafkaClient) leaders(ctx context.Context, topic string) (map[int32]int32, error) {
+	var e kafkaEncoder
+	e.arrayLen(1)
+	e.string(topic)
+	d, err := c.anyBroker(ctx, kafkaMetadata, 1, e.b)
+	if err != nil {
+		return nil, err
+	}
+
+	brokers := make(map[int32]string)
+	for n := d.arrayLen(); n > 0; n-- {
+		node, host, port := d.int32(), d.string(), d.int32()
+		d.nullableString() // rack
+		brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // controller
+	leaders := make(map[int32]int32)
+	var topicErr error
+	for n := d.arrayLen(); n > 0; n-- {
+		code := d.int16()
+		name := d.string()
+		d.int8() // internal
+		if name == topic {
+			topicErr = kafkaErr(code)
+		}
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int16() // partition error
+			partition, leader := d.int32(), d.int32()
+			d.int32Array() // replicas
+			d.int32Array() // in-sync replicas
+			if name == topic {
+				leaders[partition] = leader
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if topicErr != nil {
+		return nil, fmt.Errorf("topic %s: %w", topic, topicErr)
+	}
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("topic %s has no partitions", topic)
+	}
+	c.mu.Lock()
+	for node, addr := range brokers {
+		c.brokers[node] = addr
+	}
+	c.mu.Unlock()
+	return leaders, nil
+}
+
+// coordinator returns the address of the coordinator of a consumer group
+func (c *kafkaClient) coordinator(ctx context.Context, group string) (string, error) {
+	var e kafkaEncoder
+	e.string(group)
+	e.int8(0) // group key
+	d, err := c.anyBroker(ctx, kafkaFindCoordinator, 1, e.b)
+	if err != nil {
+		return "", err
+	}
+	d.int32() // throttle
+	code := d.int16()
+	d.nullableString() // message
+	d.int32()          // node
+	host, port := d.string(), d.int32()
+	if d.err != nil {
+		return "", d.err
+	}
+	if err := kafkaErr(code); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// kafkaMember is a member of a consumer group as the leader sees it
+type kafkaMember struct {
+	ID     string
+	Topics []string
+}
+
+// kafkaJoin is the outcome of joining a consumer group
+type kafkaJoin struct {
+	Generation int32
+	MemberID   string
+	Leader     string
+	Members    []kafkaMember // only sent to the leader
+}
+
+// joinGroup joins a consumer group subscribed to topics with the range
+// assignor. memberID is empty for a new member.
+func (c *kafkaClient) joinGroup(ctx context.Context, coordinator, group, memberID string, topics []string, sessionTimeout, rebalanceTimeout time.Duration) (*kafkaJoin, error) {
+	var subscription kafkaEncoder
+	subscription.int16(0)
+	subscription.arrayLen(len(topics))
+	for _, topic := range topics {
+		subscription.string(topic)
+	}
+	subscription.int32(-1) // user data
+
+	var e kafkaEncoder
+	e.string(group)
+	e.int32(int32(sessionTimeout.Milliseconds()))
+	e.int32(int32(rebalanceTimeout.Milliseconds()))
+	e.string(memberID)
+	e.string("consumer")
+	e.arrayLen(1)
+	e.string("range")
+	e.bytes(subscription.b)
+	d, err := c.request(ctx, coordinator, kafkaJoinGroup, 2, e.b)
+	if err != nil {
+		return nil, err
+	}
+
+	d.int32() // throttle
+	code := d.int16()
+	join := &kafkaJoin{Generation: d.int32()}
+	d.string() // protocol
+	join.Leader, join.MemberID = d.string(), d.string()
+	for n := d.arrayLen(); n > 0; n-- {
+		member := kafkaMember{ID: d.string()}
+		meta := kafkaDecoder{b: d.bytes()}
+		meta.int16() // version
+		for t := meta.arrayLen(); t > 0; t-- {
+			member.Topics = append(member.Topics, meta.string())
+		}
+		join.Members = append(join.Members, member)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := kafkaErr(code); err != nil {
+		return nil, err
+	}
+	return join, nil
+}
+
+// syncGroup sends the leader's assignments, partitions of topic by member
+// ID, and returns the member's own partitions of topic
+func (c *kafkaClient) syncGroup(ctx context.Context, coordinator, group string, generation int32, memberID, topic string, assignments map[string][]int32) ([]int32, error) {
+	var e kafkaEncoder
+	e.string(group)
+	e.int32(generation)
+	e.string(memberID)
+	e.arrayLen(len(assignments))
+	for member, partitions := range assignments {
+		var assignment kafkaEncoder
+		assignment.int16(0)
+		assignment.arrayLen(1)
+		assignment.string(topic)
+		assignment.int32Array(partitions)
+		assignment.int32(-1) // user data
+		e.string(member)
+		e.bytes(assignment.b)
+	}
+	d, err := c.request(ctx, coordinator, kafkaSyncGroup, 1, e.b)
+	if err != nil {
+		return nil, err
+	}
+
+	d.int32() // throttle
+	code := d.int16()
+	assignment := kafkaDecoder{b: d.bytes()}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := kafkaErr(code); err != nil {
+		return nil, err
+	}
+	var partitions []int32
+	if len(assignment.b) == 0 {
+		return nil, nil
+	}
+	assignment.int16() // version
+	for n := assignment.arrayLen(); n > 0; n-- {
+		name := assignment.string()
+		assigned := assignment.int32Array()
+		if name == topic {
+			partitions = append(partitions, assigned...)
+		}
+	}
+	return partitions, assignment.err
+}
+
+// heartbeat tells the coordinator the member is alive. It fails with
+// kafkaRebalanceInProgress when the group is rebalancing.
+func (c *kafkaClient) heartbeat(ctx context.Context, coordinator, group string, generation int32, memberID string) error {
+	var e kafkaEncoder
+	e.string(group)
+	e.int32(generation)
+	e.string(memberID)
+	d, err := c.request(ctx, coordinator, kafkaHeartbeat, 1, e.b)
+	if err != nil {
+		return err
+	}
+	d.int32() // throttle
+	code := d.int16()
+	if d.err != nil {
+		return d.err
+	}
+	return kafkaErr(code)
+}
+
+// leaveGroup leaves a consumer group, so its partitions are reassigned at
+// once instead of after the session timeout
+func (c *kafkaClient) leaveGroup(ctx context.Context, coordinator, group, memberID string) error {
+	var e kafkaEncoder
+	e.string(group)
+	e.string(memberID)
+	d, err := c.request(ctx, coordinator, kafkaLeaveGroup, 1, e.b)
+	if err != nil {
+		return err
+	}
+	d.int32() // throttle
+	code := d.int16()
+	if d.err != nil {
+		return d.err
+	}
+	return kafkaErr(code)
+}
+
+// committedOffsets returns the offsets committed by a group for partitions
+// of topic, -1 for partitions without one
+func (c *kafkaClient) committedOffsets(ctx context.Context, coordinator, group, topic string, partitions []int32) (map[int32]int64, error) {
+	var e kafkaEncoder
+	e.string(group)
+	e.arrayLen(1)
+	e.string(topic)
+	e.int32Array(partitions)
+	d, err := c.request(ctx, coordinator, kafkaOffsetFetch, 1, e.b)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		offsets[partition] = -1
+	}
+	for n := d.arrayLen(); n > 0; n-- {
+		d.string() // topic
+		for p := d.arrayLen(); p > 0; p-- {
+			partition, offset := d.int32(), d.int64()
+			d.nullableString() // metadata
+			if err := kafkaErr(d.int16()); err != nil && d.err == nil {
+				return nil, fmt.Errorf("partition %d: %w", partition, err)
+			}
+			offsets[partition] = offset
+		}
+	}
+	return offsets, d.err
+}
+
+// commitOffset commits the offset of the next record of a partition to
+// process
+func (c *kafkaClient) commitOffset(ctx context.Context, coordinator, group string, generation int32, memberID, topic string, partition int32, offset int64) error {
+	var e kafkaEncoder
+	e.string(group)
+	e.int32(generation)
+	e.string(memberID)
+	e.int64(-1) // broker's retention
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(1)
+	e.int32(partition)
+	e.int64(offset)
+	e.int16(-1) // metadata
+	d, err := c.request(ctx, coordinator, kafkaOffsetCommit, 2, e.b)
+	if err != nil {
+		return err
+	}
+
+	for n := d.arrayLen(); n > 0; n-- {
+		d.string() // topic
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int32() // partition
+			if err := kafkaErr(d.int16()); err != nil && d.err == nil {
+				return err
+			}
+		}
+	}
+	return d.err
+}
+
+// listOffset resolves kafkaEarliest or kafkaLatest to an offset of a
+// partition, asking its leader at addr
+func (c *kafkaClient) listOffset(ctx context.Context, addr, topic string, partition int32, at int64) (int64, error) {
+	var e kafkaEncoder
+	e.int32(-1) // consumer
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(1)
+	e.int32(partition)
+	e.int64(at)
+	d, err := c.request(ctx, addr, kafkaListOffsets, 1, e.b)
+	if err != nil {
+		return 0, err
+	}
+
+	offset := int64(-1)
+	for n := d.arrayLen(); n > 0; n-- {
+		d.string() // topic
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int32() // partition
+			code := d.int16()
+			d.int64() // timestamp
+			offset = d.int64()
+			if err := kafkaErr(code); err != nil && d.err == nil {
+				return 0, err
+			}
+		}
+	}
+	if d.err == nil && offset < 0 {
+		return 0, fmt.Errorf("kafka: no offset for partition %d", partition)
+	}
+	return offset, d.err
+}
+
+// fetch reads the records of a partition from offset on, asking its leader
+// at addr and waiting up to maxWait for some to arrive. It also returns the
+// offset to fetch next, past batches it had to skip.
+func (c *kafkaClient) fetch(ctx context.Context, addr, topic string, partition int32, offset int64, maxWait time.Duration, maxBytes int32) ([]kafkaRecord, int64, error) {
+	var e kafkaEncoder
+	e.int32(-1) // consumer
+	e.int32(int32(maxWait.Milliseconds()))
+	e.int32(1) // min bytes
+	e.int32(maxBytes)
+	e.int8(0) // read uncommitted
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(1)
+	e.int32(partition)
+	e.int64(offset)
+	e.int32(maxBytes)
+	d, err := c.request(ctx, addr, kafkaFetch, 4, e.b)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	d.int32() // throttle
+	var records []kafkaRecord
+	next := offset
+	for n := d.arrayLen(); n > 0; n-- {
+		d.string() // topic
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int32() // partition
+			code := d.int16()
+			d.int64() // high watermark
+			d.int64() // last stable offset
+			for a := d.arrayLen(); a > 0; a-- {
+				d.int64() // producer
+				d.int64() // first offset
+			}
+			data := d.bytes()
+			if d.err != nil {
+				return nil, offset, d.err
+			}
+			if err := kafkaErr(code); err != nil {
+				return nil, offset, err
+			}
+			if records, next, err = decodeRecordBatches(data, offset); err != nil {
+				return records, next, err
+			}
+		}
+	}
+	return records, next, d.err
+}
+
+// produce appends a record to a partition, waiting for all in-sync
+// replicas to have it
+func (c *kafkaClient) produce(ctx context.Context, addr, topic string, partition int32, key, value []byte) error {
+	var e kafkaEncoder
+	e.int16(-1) // no transaction
+	e.int16(-1) // acks from all in-sync replicas
+	e.int32(int32(kafkaTimeout.Milliseconds()))
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(1)
+	e.int32(partition)
+	e.bytes(encodeRecordBatch(time.Now(), key, value))
+	d, err := c.request(ctx, addr, kafkaProduce, 3, e.b)
+	if err != nil {
+		return err
+	}
+
+	for n := d.arrayLen(); n > 0; n-- {
+		d.string() // topic
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int32() // partition
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if err := kafkaErr(code); err != nil && d.err == nil {
+				return err
+			}
+		}
+	}
+	return d.err
+}
+
+// Record batch attributes
+const (
+	kafkaCompressionMask = 0x07
+	kafkaCompressionGzip = 1
+	kafkaControlBatch    = 0x20
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeRecordBatch encodes a record in a version 2 record batch, without
+// compression
+func encodeRecordBatch(now time.Time, key, value []byte) []byte {
+	var record []byte
+	record = append(record, 0) // attributes
+	record = binary.AppendVarint(record, 0)
+	record = binary.AppendVarint(record, 0)
+	if key == nil {
+		record = binary.AppendVarint(record, -1)
+	} else {
+		record = binary.AppendVarint(record, int64(len(key)))
+		record = append(record, key...)
+	}
+	record = binary.AppendVarint(record, int64(len(value)))
+	record = append(record, value...)
+	record = binary.AppendVarint(record, 0) // headers
+
+	// Everything after the CRC, which covers it
+	var tail kafkaEncoder
+	tail.int16(0) // attributes
+	tail.int32(0) // last offset delta
+	tail.int64(now.UnixMilli())
+	tail.int64(now.UnixMilli())
+	tail.int64(-1) // producer ID
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(1)
+	tail.b = binary.AppendVarint(tail.b, int64(len(record)))
+	tail.b = append(tail.b, record...)
+
+	var e kafkaEncoder
+	e.int64(0)
+	e.int32(int32(4 + 1 + 4 + len(tail.b))) // leader epoch, magic, CRC and the rest
+	e.int32(-1)                             // partition leader epoch
+	e.int8(2)                               // magic
+	e.int32(int32(crc32.Checksum(tail.b, crc32c)))
+	e.b = append(e.b, tail.b...)
+	return e.b
+}
+
+// decodeRecordBatches decodes the records of version 2 record batches from
+// offset on. A batch cut off at the end of data is left for the next fetch.
+// Control batches are skipped, and so are batches the bridge can't read,
+// which return an error along with the offset past them.
+func decodeRecordBatches(data []byte, offset int64) ([]kafkaRecord, int64, error) {
+	var records []kafkaRecord
+	next := offset
+	for len(data) >= 17 {
+		base := int64(binary.BigEndian.Uint64(data))
+		length := int(int32(binary.BigEndian.Uint32(data[8:])))
+		if length < 49 || len(data) < 12+length {
+			break
+		}
+		batch := data[12 : 12+length]
+		data = data[12+length:]
+
+		d := kafkaDecoder{b: batch}
+		d.int32() // partition leader epoch
+		magic := d.int8()
+		crc := uint32(d.int32())
+		last := base + int64(d.int32At(2))
+		if magic != 2 {
+			return records, max(next, last+1), fmt.Errorf("kafka: batch at offset %d has message format %d, expected 2", base, magic)
+		}
+		if crc32.Checksum(d.b, crc32c) != crc {
+			return records, max(next, last+1), fmt.Errorf("kafka: batch at offset %d fails its CRC check", base)
+		}
+		attributes := d.int16()
+		d.int32() // last offset delta
+		d.int64() // first timestamp
+		d.int64() // max timestamp
+		d.int64() // producer ID
+		d.int16() // producer epoch
+		d.int32() // base sequence
+		count := d.int32()
+		if last < offset {
+			continue
+		}
+		next = max(next, last+1)
+		if attributes&kafkaControlBatch != 0 {
+			continue
+		}
+		body := d.b
+		switch attributes & kafkaCompressionMask {
+		case 0:
+		case kafkaCompressionGzip:
+			reader, err := gzip.NewReader(bytes.NewReader(body))
+			if err == nil {
+				body, err = io.ReadAll(reader)
+			}
+			if err != nil {
+				return records, next, fmt.Errorf("kafka: batch at offset %d: %w", base, err)
+			}
+		default:
+			return records, next, fmt.Errorf("kafka: batch at offset %d uses compression %d, only gzip is supported", base, attributes&kafkaCompressionMask)
+		}
+
+		r := kafkaDecoder{b: body}
+		for ; count > 0 && r.err == nil; count-- {
+			r.varint() // length
+			r.int8()   // attributes
+			r.varint() // timestamp delta
+			record := kafkaRecord{Offset: base + r.varint()}
+			record.Key = r.varbytes()
+			record.Value = r.varbytes()
+			for h := r.varint(); h > 0; h-- {
+				r.varbytes() // header key
+				r.varbytes() // header value
+			}
+			if r.err == nil && record.Offset >= offset {
+				records = append(records, record)
+			}
+		}
+		if r.err != nil {
+			return records, next, fmt.Errorf("kafka: batch at offset %d: %w", base, r.err)
+		}
+	}
+	return records, next, nil
+}
+
+// kafkaPartitionFor picks the partition of a key like Kafka's default
+// partitioner, with murmur2, so records with the same key stay in order
+func kafkaPartitionFor(key []byte, partitions int) int32 {
+	return int32((murmur2(key) & 0x7fffffff) % uint32(partitions))
+}
+
+// murmur2 is the hash of Kafka's default partitioner
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	h := seed ^ uint32(len(data))
+	for ; len(data) >= 4; data = data[4:] {
+		k := binary.LittleEndian.Uint32(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// kafkaEncoder appends the protocol's big-endian fields
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+
+func (e *kafkaEncoder) arrayLen(n int) { e.int32(int32(n)) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *kafkaEncoder) int32Array(values []int32) {
+	e.arrayLen(len(values))
+	for _, v := range values {
+		e.int32(v)
+	}
+}
+
+// kafkaDecoder reads the protocol's fields, remembering the first error so
+// a response can be read in one go and checked at the end
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+var errKafkaShort = errors.New("kafka: response too short")
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errKafkaShort
+		d.b = nil
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// int32At reads the int32 n bytes ahead without consuming anything
+func (d *kafkaDecoder) int32At(n int) int32 {
+	if d.err != nil || len(d.b) < n+4 {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(d.b[n:]))
+}
+
+// arrayLen reads an array's length, 0 for a null array
+func (d *kafkaDecoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	if int(n) > len(d.b) {
+		d.err = errKafkaShort
+		return 0
+	}
+	return int(n)
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.next(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// bytes reads a byte array, nil for a null one
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *kafkaDecoder) int32Array() []int32 {
+	var values []int32
+	for n := d.arrayLen(); n > 0; n-- {
+		values = append(values, d.int32())
+	}
+	return values
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errKafkaShort
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// varbytes reads a varint-prefixed byte array, nil for a null one
+func (d *kafkaDecoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return slices.Clone(d.next(int(n)))
+}
@@ -0,0 +1,860 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Responses and requests of the Kafka protocol, written out byte by byte
+// from the protocol guide rather than with the bridge's encoder
+
+// Metadata v1 response: brokers 1 (broker-1:9092) and 2 (broker-2:9093,
+// rack-a), controller 1, topic "other" with partition 0 on broker 1 and
+// topic "audio" with partition 1 on broker 2 and partition 0 on broker 1
+const kafkaMetadataFixture = "00000002" +
+	"00000001" + "000862726f6b65722d31" + "00002384" + "ffff" +
+	"00000002" + "000862726f6b65722d32" + "00002385" + "00067261636b2d61" +
+	"00000001" +
+	"00000002" +
+	"0000" + "00056f74686572" + "00" + "00000001" +
+	"0000" + "00000000" + "00000001" + "0000000100000001" + "0000000100000001" +
+	"0000" + "0005617564696f" + "00" + "00000002" +
+	"0000" + "00000001" + "00000002" + "000000020000000200000001" + "0000000100000002" +
+	"0000" + "00000000" + "00000001" + "000000020000000100000002" + "000000020000000100000002"
+
+// Metadata v1 response with error 3, unknown topic or partition, for topic
+// "missing"
+const kafkaMetadataUnknownFixture = "00000001" + "00000001" + "000862726f6b65722d31" + "00002384" + "ffff" +
+	"00000001" + "00000001" + "0003" + "00076d697373696e67" + "00" + "00000000"
+
+// FindCoordinator v1 responses: broker 2 at broker-2:9093, and error 15,
+// coordinator not available
+const (
+	kafkaCoordinatorFixture      = "00000000" + "0000" + "ffff" + "00000002" + "000862726f6b65722d32" + "00002385"
+	kafkaCoordinatorErrorFixture = "00000000" + "000f" + "000e6e6f20636f6f7264696e61746f72" + "ffffffff" + "0000" + "ffffffff"
+)
+
+// JoinGroup v2 request body of a new member of group "g" subscribed to
+// "audio" with the range assignor, session timeout 30s and rebalance
+// timeout 60s
+const kafkaJoinRequestFixture = "000167" + "00007530" + "0000ea60" + "0000" + "0008636f6e73756d6572" +
+	"00000001" + "000572616e6765" +
+	"00000011" + "0000" + "00000001" + "0005617564696f" + "ffffffff"
+
+// JoinGroup v2 response to the leader m-1 of generation 7, with members m-1
+// subscribed to "audio" and m-2 subscribed to "audio" and "video"
+const kafkaJoinFixture = "00000000" + "0000" + "00000007" + "000572616e6765" + "00036d2d31" + "00036d2d31" +
+	"00000002" +
+	"00036d2d31" + "00000011" + "0000" + "00000001" + "0005617564696f" + "ffffffff" +
+	"00036d2d32" + "00000018" + "0000" + "00000002" + "0005617564696f" + "0005766964656f" + "ffffffff"
+
+// SyncGroup v1 response assigning partitions 0 and 2 of "audio" and 1 of
+// "video"
+const kafkaSyncFixture = "00000000" + "0000" + "0000002c" + "0000" + "00000002" +
+	"0005617564696f" + "00000002" + "00000000" + "00000002" +
+	"0005766964656f" + "00000001" + "00000001" +
+	"ffffffff"
+
+// OffsetFetch v1 response: partition 0 of "audio" committed at 42,
+// partition 2 without a committed offset
+const kafkaOffsetFetchFixture = "00000001" + "0005617564696f" + "00000002" +
+	"00000000" + "000000000000002a" + "0000" + "0000" +
+	"00000002" + "ffffffffffffffff" + "ffff" + "0000"
+
+// Heartbeat v1 request of member m-1 of generation 7 of group "g", framed
+// with its size and the header of request 1 from client "test"
+const kafkaHeartbeatRequestFixture = "0000001a" + "000c" + "0001" + "00000001" + "000474657374" +
+	"000167" + "00000007" + "00036d2d31"
+
+// Version 2 record batches: the record k=v at offset 0 written at
+// 1700000000000 ms, the records a=one and two (without a key) at offsets 5
+// and 6, and the gzip-compressed record z=zipped at offset 9
+const (
+	kafkaBatchFixture = "0000000000000000" + "0000003a" + "ffffffff" + "02" + "e99b8dd8" +
+		"0000" + "00000000" + "0000018bcfe56800" + "0000018bcfe56800" + "ffffffffffffffff" + "ffff" + "ffffffff" + "00000001" +
+		"10" + "00" + "00" + "00" + "02" + "6b" + "02" + "76" + "00"
+	kafkaTwoRecordBatchFixture = "0000000000000005" + "00000046" + "ffffffff" + "02" + "2059a02d" +
+		"0000" + "00000001" + "0000018bcfe56800" + "0000018bcfe56800" + "ffffffffffffffff" + "ffff" + "ffffffff" + "00000002" +
+		"14" + "00" + "00" + "00" + "02" + "61" + "06" + "6f6e65" + "00" +
+		"12" + "00" + "00" + "02" + "01" + "06" + "74776f" + "00"
+	kafkaGzipBatchFixture = "0000000000000009" + "00000053" + "ffffffff" + "02" + "8ebefd33" +
+		"0001" + "00000000" + "0000018bcfe56800" + "0000018bcfe56800" + "ffffffffffffffff" + "ffff" + "ffffffff" + "00000001" +
+		"1f8b08000000000002039362606060aae2a9ca2c28484d610000c5256ae90e000000"
+)
+
+func fixture(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad fixture: %v", err)
+	}
+	return b
+}
+
+// fakeKafkaServer is a broker that answers every request with handle,
+// keeping the requests it received
+type fakeKafkaServer struct {
+	addr string
+
+	mu       sync.Mutex
+	requests [][]byte // framed, size included
+}
+
+// serveKafka starts a broker that answers each request, its header read,
+// with the response body handle returns. A nil response drops the
+// connection.
+func serveKafka(t *testing.T, handle func(apiKey, version int16, body *kafkaDecoder) []byte) *fakeKafkaServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeKafkaServer{addr: ln.Addr().String()}
+	var conns sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		conns.Wait()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				defer conn.Close()
+				stop := context.AfterFunc(t.Context(), func() { conn.Close() })
+				defer stop()
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					req := make([]byte, binary.BigEndian.Uint32(size[:]))
+					if _, err := io.ReadFull(conn, req); err != nil {
+						return
+					}
+					server.mu.Lock()
+					server.requests = append(server.requests, append(size[:], req...))
+					server.mu.Unlock()
+
+					d := &kafkaDecoder{b: req}
+					apiKey, version, correlationID := d.int16(), d.int16(), d.int32()
+					d.string() // client ID
+					resp := handle(apiKey, version, d)
+					if resp == nil {
+						return
+					}
+					var e kafkaEncoder
+					e.int32(int32(4 + len(resp)))
+					e.int32(correlationID)
+					e.b = append(e.b, resp...)
+					if _, err := conn.Write(e.b); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+// framed returns the requests received so far, framed
+func (s *fakeKafkaServer) framed() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// lastRequest returns the body of the last request, after its header
+func (s *fakeKafkaServer) lastRequest() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := kafkaDecoder{b: s.requests[len(s.requests)-1][4:]}
+	d.int16()
+	d.int16()
+	d.int32()
+	d.string()
+	return d.b
+}
+
+// serveFixture starts a broker answering requests with apiKey with a
+// fixture
+func serveFixture(t *testing.T, apiKey int16, response string) *fakeKafkaServer {
+	resp := fixture(t, response)
+	return serveKafka(t, func(key, version int16, body *kafkaDecoder) []byte {
+		if key != apiKey {
+			t.Errorf("unexpected request with API key %d", key)
+			return nil
+		}
+		return resp
+	})
+}
+
+func TestKafkaRequestFraming(t *testing.T) {
+	server := serveFixture(t, kafkaHeartbeat, "00000000"+"0000")
+	client := newKafkaClient([]string{server.addr}, "test")
+	if err := client.heartbeat(t.Context(), server.addr, "g", 7, "m-1"); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	if got, want := hex.EncodeToString(server.framed()[0]), kafkaHeartbeatRequestFixture; got != want {
+		t.Errorf("heartbeat request = %s, want %s", got, want)
+	}
+}
+
+func TestKafkaConnectionReused(t *testing.T) {
+	server := serveFixture(t, kafkaHeartbeat, "00000000"+"001b")
+	client := newKafkaClient([]string{server.addr}, "test")
+	for range 3 {
+		err := client.heartbeat(t.Context(), server.addr, "g", 7, "m-1")
+		if !errors.Is(err, kafkaError(kafkaRebalanceInProgress)) {
+			t.Fatalf("heartbeat = %v, want %v", err, kafkaError(kafkaRebalanceInProgress))
+		}
+	}
+	// Requests on the one connection carry consecutive correlation IDs
+	for i, req := range server.framed() {
+		if id := int32(binary.BigEndian.Uint32(req[8:])); id != int32(i+1) {
+			t.Errorf("request %d has correlation ID %d, want %d", i, id, i+1)
+		}
+	}
+}
+
+func TestKafkaCorrelationMismatch(t *testing.T) {
+	client, broker := net.Pipe()
+	defer client.Close()
+	defer broker.Close()
+	go func() {
+		var size [4]byte
+		io.ReadFull(broker, size[:])
+		io.CopyN(io.Discard, broker, int64(binary.BigEndian.Uint32(size[:])))
+		broker.Write(fixture(t, "00000006"+"00000063"+"0000"))
+	}()
+	conn := &kafkaConn{Conn: client}
+	_, err := conn.roundTrip(kafkaHeartbeat, 1, "test", nil)
+	if err == nil || !strings.Contains(err.Error(), "response to request 99, expected 1") {
+		t.Errorf("roundTrip = %v, want a correlation ID mismatch", err)
+	}
+}
+
+func TestKafkaMetadata(t *testing.T) {
+	server := serveFixture(t, kafkaMetadata, kafkaMetadataFixture)
+	client := newKafkaClient([]string{server.addr}, "test")
+	leaders, err := client.leaders(t.Context(), "audio")
+	if err != nil {
+		t.Fatalf("leaders: %v", err)
+	}
+	if want := map[int32]int32{0: 1, 1: 2}; !reflect.DeepEqual(leaders, want) {
+		t.Errorf("leaders = %v, want %v", leaders, want)
+	}
+	if got, want := hex.EncodeToString(server.lastRequest()), "00000001"+"0005617564696f"; got != want {
+		t.Errorf("metadata request = %s, want %s", got, want)
+	}
+
+	addr, err := client.partitionLeader(leaders, "audio", 1)
+	if err != nil || addr != "broker-2:9093" {
+		t.Errorf("leader of partition 1 = %q, %v; want broker-2:9093", addr, err)
+	}
+	// A partition missing from the metadata has no leader, not broker 0
+	if addr, err := client.partitionLeader(leaders, "audio", 2); !errors.Is(err, kafkaError(kafkaUnknownTopicOrPartition)) {
+		t.Errorf("leader of partition 2 = %q, %v; want unknown topic or partition", addr, err)
+	}
+	if addr, err := client.partitionLeader(map[int32]int32{0: -1}, "audio", 0); err == nil {
+		t.Errorf("leader of a partition without one = %q, want an error", addr)
+	}
+}
+
+func TestKafkaMetadataUnknownTopic(t *testing.T) {
+	server := serveFixture(t, kafkaMetadata, kafkaMetadataUnknownFixture)
+	client := newKafkaClient([]string{server.addr}, "test")
+	if _, err := client.leaders(t.Context(), "missing"); !errors.Is(err, kafkaError(kafkaUnknownTopicOrPartition)) {
+		t.Errorf("leaders = %v, want unknown topic or partition", err)
+	}
+}
+
+func TestKafkaMetadataTruncated(t *testing.T) {
+	server := serveFixture(t, kafkaMetadata, kafkaMetadataFixture[:len(kafkaMetadataFixture)-8])
+	client := newKafkaClient([]string{server.addr}, "test")
+	if _, err := client.leaders(t.Context(), "audio"); !errors.Is(err, errKafkaShort) {
+		t.Errorf("leaders = %v, want %v", err, errKafkaShort)
+	}
+}
+
+func TestKafkaSeedFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	server := serveFixture(t, kafkaMetadata, kafkaMetadataFixture)
+	client := newKafkaClient([]string{down, server.addr}, "test")
+	if _, err := client.leaders(t.Context(), "audio"); err != nil {
+		t.Errorf("leaders with the first seed down: %v", err)
+	}
+}
+
+func TestKafkaCoordinator(t *testing.T) {
+	server := serveFixture(t, kafkaFindCoordinator, kafkaCoordinatorFixture)
+	client := newKafkaClient([]string{server.addr}, "test")
+	addr, err := client.coordinator(t.Context(), "g")
+	if err != nil || addr != "broker-2:9093" {
+		t.Errorf("coordinator = %q, %v; want broker-2:9093", addr, err)
+	}
+	if got, want := hex.EncodeToString(server.lastRequest()), "000167"+"00"; got != want {
+		t.Errorf("FindCoordinator request = %s, want %s", got, want)
+	}
+
+	server = serveFixture(t, kafkaFindCoordinator, kafkaCoordinatorErrorFixture)
+	client = newKafkaClient([]string{server.addr}, "test")
+	if _, err := client.coordinator(t.Context(), "g"); !errors.Is(err, kafkaError(kafkaCoordinatorNotAvailable)) {
+		t.Errorf("coordinator = %v, want coordinator not available", err)
+	}
+}
+
+func TestKafkaJoinGroup(t *testing.T) {
+	server := serveFixture(t, kafkaJoinGroup, kafkaJoinFixture)
+	client := newKafkaClient([]string{server.addr}, "test")
+	join, err := client.joinGroup(t.Context(), server.addr, "g", "", []string{"audio"}, 30*time.Second, time.Minute)
+	if err != nil {
+		t.Fatalf("joinGroup: %v", err)
+	}
+	if got, want := hex.EncodeToString(server.lastRequest()), kafkaJoinRequestFixture; got != want {
+		t.Errorf("JoinGroup request = %s, want %s", got, want)
+	}
+	want := &kafkaJoin{
+		Generation: 7,
+		MemberID:   "m-1",
+		Leader:     "m-1",
+		Members:    []kafkaMember{{ID: "m-1", Topics: []string{"audio"}}, {ID: "m-2", Topics: []string{"audio", "video"}}},
+	}
+	if !reflect.DeepEqual(join, want) {
+		t.Errorf("join = %+v, want %+v", join, want)
+	}
+}
+
+func TestKafkaSyncGroup(t *testing.T) {
+	server := serveFixture(t, kafkaSyncGroup, kafkaSyncFixture)
+	client := newKafkaClient([]string{server.addr}, "test")
+	partitions, err := client.syncGroup(t.Context(), server.addr, "g", 7, "m-1", "audio", map[string][]int32{"m-1": {0, 2}})
+	if err != nil {
+		t.Fatalf("syncGroup: %v", err)
+	}
+	if want := []int32{0, 2}; !reflect.DeepEqual(partitions, want) {
+		t.Errorf("partitions = %v, want %v", partitions, want)
+	}
+	// The leader's assignment: member m-1 with partitions 0 and 2 of audio
+	wantRequest := "000167" + "00000007" + "00036d2d31" + "00000001" +
+		"00036d2d31" + "0000001d" + "0000" + "00000001" + "0005617564696f" + "00000002" + "00000000" + "00000002" + "ffffffff"
+	if got := hex.EncodeToString(server.lastRequest()); got != wantRequest {
+		t.Errorf("SyncGroup request = %s, want %s", got, wantRequest)
+	}
+}
+
+func TestKafkaCommittedOffsets(t *testing.T) {
+	server := serveFixture(t, kafkaOffsetFetch, kafkaOffsetFetchFixture)
+	client := newKafkaClient([]string{server.addr}, "test")
+	offsets, err := client.committedOffsets(t.Context(), server.addr, "g", "audio", []int32{0, 1, 2})
+	if err != nil {
+		t.Fatalf("committedOffsets: %v", err)
+	}
+	if want := map[int32]int64{0: 42, 1: -1, 2: -1}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("offsets = %v, want %v", offsets, want)
+	}
+}
+
+func TestEncodeRecordBatch(t *testing.T) {
+	got := encodeRecordBatch(time.UnixMilli(1700000000000), []byte("k"), []byte("v"))
+	if want := kafkaBatchFixture; hex.EncodeToString(got) != want {
+		t.Errorf("record batch = %x, want %s", got, want)
+	}
+}
+
+func TestDecodeRecordBatches(t *testing.T) {
+	one := fixture(t, kafkaBatchFixture)
+	two := fixture(t, kafkaTwoRecordBatchFixture)
+	zipped := fixture(t, kafkaGzipBatchFixture)
+	corrupt := bytes.Clone(two)
+	corrupt[len(corrupt)-2] ^= 0xff
+	oldFormat := bytes.Clone(two)
+	oldFormat[16] = 1
+
+	tests := []struct {
+		name     string
+		data     []byte
+		offset   int64
+		want     []kafkaRecord
+		wantNext int64
+		wantErr  string
+	}{
+		{"one record", one, 0, []kafkaRecord{{0, []byte("k"), []byte("v")}}, 1, ""},
+		{"two records", two, 0, []kafkaRecord{{5, []byte("a"), []byte("one")}, {6, nil, []byte("two")}}, 7, ""},
+		{"from inside a batch", two, 6, []kafkaRecord{{6, nil, []byte("two")}}, 7, ""},
+		{"past the batch", two, 7, nil, 7, ""},
+		{"several batches", append(bytes.Clone(one), two...), 0,
+			[]kafkaRecord{{0, []byte("k"), []byte("v")}, {5, []byte("a"), []byte("one")}, {6, nil, []byte("two")}}, 7, ""},
+		{"gzip", zipped, 9, []kafkaRecord{{9, []byte("z"), []byte("zipped")}}, 10, ""},
+		{"batch cut off", append(bytes.Clone(one), two[:len(two)-1]...), 0, []kafkaRecord{{0, []byte("k"), []byte("v")}}, 1, ""},
+		{"empty", nil, 3, nil, 3, ""},
+		{"CRC mismatch", corrupt, 0, nil, 7, "fails its CRC check"},
+		{"old message format", oldFormat, 0, nil, 7, "message format 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, next, err := decodeRecordBatches(tt.data, tt.offset)
+			if !reflect.DeepEqual(records, tt.want) {
+				t.Errorf("records = %v, want %v", records, tt.want)
+			}
+			if next != tt.wantNext {
+				t.Errorf("next offset = %d, want %d", next, tt.wantNext)
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// The values Kafka's own client tests its murmur2 with
+	tests := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, want := range tests {
+		if got := int32(murmur2([]byte(key))); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+	if got := kafkaPartitionFor([]byte("foobar"), 10); got != 6 {
+		t.Errorf("partition of foobar among 10 = %d, want 6", got)
+	}
+}
+
+func TestAssignRange(t *testing.T) {
+	members := []kafkaMember{
+		{ID: "m-b", Topics: []string{"audio"}},
+		{ID: "m-a", Topics: []string{"audio", "video"}},
+		{ID: "m-c", Topics: []string{"video"}},
+	}
+	leaders := map[int32]int32{0: 1, 1: 1, 2: 2, 3: 2, 4: 1}
+	want := map[string][]int32{"m-a": {0, 1, 2}, "m-b": {3, 4}, "m-c": nil}
+	if got := assignRange(members, "audio", leaders); !reflect.DeepEqual(got, want) {
+		t.Errorf("assignRange = %v, want %v", got, want)
+	}
+}
+
+// fakeKafkaCluster is a single broker holding topics in memory and
+// coordinating one consumer group with a single member
+type fakeKafkaCluster struct {
+	server *fakeKafkaServer
+	host   string
+	port   int32
+
+	mu         sync.Mutex
+	partitions map[string]int32                      // partition count of each topic
+	logs       map[string]map[int32][]fakeKafkaBatch // record batches of each partition
+	committed  map[int32]int64
+	assignment []byte
+	left       bool
+}
+
+type fakeKafkaBatch struct {
+	base, last int64
+	data       []byte
+}
+
+func newFakeKafkaCluster(t *testing.T, partitions map[string]int32) *fakeKafkaCluster {
+	c := &fakeKafkaCluster{
+		partitions: partitions,
+		logs:       make(map[string]map[int32][]fakeKafkaBatch),
+		committed:  make(map[int32]int64),
+	}
+	c.server = serveKafka(t, c.handle)
+	host, port, _ := net.SplitHostPort(c.server.addr)
+	portNum, _ := strconv.Atoi(port)
+	c.host, c.port = host, int32(portNum)
+	return c
+}
+
+// next returns the offset of the next record of a partition
+func (c *fakeKafkaCluster) next(topic string, partition int32) int64 {
+	batches := c.logs[topic][partition]
+	if len(batches) == 0 {
+		return 0
+	}
+	return batches[len(batches)-1].last + 1
+}
+
+// records returns the records of a partition
+func (c *fakeKafkaCluster) records(topic string, partition int32) []kafkaRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var records []kafkaRecord
+	for _, batch := range c.logs[topic][partition] {
+		batchRecords, _, _ := decodeRecordBatches(batch.data, 0)
+		records = append(records, batchRecords...)
+	}
+	return records
+}
+
+func (c *fakeKafkaCluster) handle(apiKey, version int16, d *kafkaDecoder) []byte {
+	var e kafkaEncoder
+	switch apiKey {
+	case kafkaMetadata:
+		e.arrayLen(1)
+		e.int32(1)
+		e.string(c.host)
+		e.int32(c.port)
+		e.int16(-1) // rack
+		e.int32(1)  // controller
+		topics := make([]string, d.arrayLen())
+		for i := range topics {
+			topics[i] = d.string()
+		}
+		e.arrayLen(len(topics))
+		for _, topic := range topics {
+			n, ok := c.partitions[topic]
+			if !ok {
+				e.int16(kafkaUnknownTopicOrPartition)
+			} else {
+				e.int16(0)
+			}
+			e.string(topic)
+			e.int8(0)
+			e.arrayLen(int(n))
+			for p := range n {
+				e.int16(0)
+				e.int32(p)
+				e.int32(1) // leader
+				e.int32Array([]int32{1})
+				e.int32Array([]int32{1})
+			}
+		}
+
+	case kafkaFindCoordinator:
+		e.int32(0)
+		e.int16(0)
+		e.int16(-1)
+		e.int32(1)
+		e.string(c.host)
+		e.int32(c.port)
+
+	case kafkaJoinGroup:
+		d.string() // group
+		d.int32()  // session timeout
+		d.int32()  // rebalance timeout
+		d.string() // member
+		d.string() // protocol type
+		var metadata []byte
+		for n := d.arrayLen(); n > 0; n-- {
+			d.string()
+			metadata = d.bytes()
+		}
+		e.int32(0)
+		e.int16(0)
+		e.int32(1)
+		e.string("range")
+		e.string("member-1")
+		e.string("member-1")
+		e.arrayLen(1)
+		e.string("member-1")
+		e.bytes(metadata)
+
+	case kafkaSyncGroup:
+		d.string() // group
+		d.int32()  // generation
+		d.string() // member
+		c.mu.Lock()
+		for n := d.arrayLen(); n > 0; n-- {
+			if d.string() == "member-1" {
+				c.assignment = d.bytes()
+			} else {
+				d.bytes()
+			}
+		}
+		e.int32(0)
+		e.int16(0)
+		e.bytes(c.assignment)
+		c.mu.Unlock()
+
+	case kafkaHeartbeat:
+		e.int32(0)
+		e.int16(0)
+
+	case kafkaLeaveGroup:
+		c.mu.Lock()
+		c.left = true
+		c.mu.Unlock()
+		e.int32(0)
+		e.int16(0)
+
+	case kafkaOffsetFetch:
+		d.string() // group
+		c.mu.Lock()
+		e.arrayLen(d.arrayLen())
+		topic := d.string()
+		partitions := d.int32Array()
+		e.string(topic)
+		e.arrayLen(len(partitions))
+		for _, p := range partitions {
+			offset, ok := c.committed[p]
+			if !ok {
+				offset = -1
+			}
+			e.int32(p)
+			e.int64(offset)
+			e.string("")
+			e.int16(0)
+		}
+		c.mu.Unlock()
+
+	case kafkaOffsetCommit:
+		d.string() // group
+		d.int32()  // generation
+		d.string() // member
+		d.int64()  // retention
+		d.arrayLen()
+		topic := d.string()
+		d.arrayLen()
+		partition, offset := d.int32(), d.int64()
+		d.nullableString()
+		c.mu.Lock()
+		c.committed[partition] = offset
+		c.mu.Unlock()
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		e.int16(0)
+
+	case kafkaListOffsets:
+		d.int32() // replica
+		d.arrayLen()
+		topic := d.string()
+		d.arrayLen()
+		partition, at := d.int32(), d.int64()
+		offset := int64(0)
+		if at == kafkaLatest {
+			c.mu.Lock()
+			offset = c.next(topic, partition)
+			c.mu.Unlock()
+		}
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		e.int16(0)
+		e.int64(-1)
+		e.int64(offset)
+
+	case kafkaFetch:
+		d.int32() // replica
+		d.int32() // max wait
+		d.int32() // min bytes
+		d.int32() // max bytes
+		d.int8()  // isolation
+		d.arrayLen()
+		topic := d.string()
+		d.arrayLen()
+		partition, offset := d.int32(), d.int64()
+		c.mu.Lock()
+		var data []byte
+		for _, batch := range c.logs[topic][partition] {
+			if batch.last >= offset {
+				data = append(data, batch.data...)
+			}
+		}
+		next := c.next(topic, partition)
+		c.mu.Unlock()
+		if data == nil {
+			// Stand in for the broker's wait for records
+			time.Sleep(20 * time.Millisecond)
+		}
+		e.int32(0)
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		e.int16(0)
+		e.int64(next)
+		e.int64(next)
+		e.arrayLen(0)
+		e.bytes(data)
+
+	case kafkaProduce:
+		d.nullableString() // transaction
+		d.int16()          // acks
+		d.int32()          // timeout
+		d.arrayLen()
+		topic := d.string()
+		d.arrayLen()
+		partition := d.int32()
+		data := bytes.Clone(d.bytes())
+		if d.err != nil || len(data) < 61 {
+			return nil
+		}
+		c.mu.Lock()
+		base := c.next(topic, partition)
+		binary.BigEndian.PutUint64(data, uint64(base))
+		count := int64(binary.BigEndian.Uint32(data[57:]))
+		if c.logs[topic] == nil {
+			c.logs[topic] = make(map[int32][]fakeKafkaBatch)
+		}
+		c.logs[topic][partition] = append(c.logs[topic][partition], fakeKafkaBatch{base: base, last: base + count - 1, data: data})
+		c.mu.Unlock()
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		e.int16(0)
+		e.int64(base)
+		e.int64(-1)
+		e.int32(0) // throttle
+
+	default:
+		return nil
+	}
+	if d.err != nil {
+		return nil
+	}
+	return e.b
+}
+
+func TestKafkaProduceFetch(t *testing.T) {
+	cluster := newFakeKafkaCluster(t, map[string]int32{"audio": 1})
+	client := newKafkaClient([]string{cluster.server.addr}, "test")
+	ctx := t.Context()
+	for _, value := range []string{"first", "second", "third"} {
+		if err := client.produce(ctx, cluster.server.addr, "audio", 0, []byte("key"), []byte(value)); err != nil {
+			t.Fatalf("produce: %v", err)
+		}
+	}
+
+	latest, err := client.listOffset(ctx, cluster.server.addr, "audio", 0, kafkaLatest)
+	if err != nil || latest != 3 {
+		t.Errorf("latest offset = %d, %v; want 3", latest, err)
+	}
+	records, next, err := client.fetch(ctx, cluster.server.addr, "audio", 0, 1, time.Second, 1<<20)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	want := []kafkaRecord{{1, []byte("key"), []byte("second")}, {2, []byte("key"), []byte("third")}}
+	if !reflect.DeepEqual(records, want) || next != 3 {
+		t.Errorf("fetch = %v, next %d; want %v, next 3", records, next, want)
+	}
+}
+
+func TestKafkaConsumer(t *testing.T) {
+	setConfigForTest(t, func(c *config) { c.kafkaStartOffset = kafkaStartEarliest })
+	cluster := newFakeKafkaCluster(t, map[string]int32{"audio": 2, "results": 3})
+	client := newKafkaClient([]string{cluster.server.addr}, "test")
+	key := []byte("message-1")
+	inputPartition := kafkaPartitionFor(key, 2)
+	if err := client.produce(t.Context(), cluster.server.addr, "audio", inputPartition, key, []byte("not audio")); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+
+	kc := &kafkaConsumer{
+		client: newKafkaClient([]string{cluster.server.addr}, "bridge"),
+		group:  "bridges",
+		input:  "audio",
+		output: "results",
+		done:   make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	go kc.run(ctx)
+
+	// The failed message gets a result holding its error, published on the
+	// partition of its key, and only then is its offset committed
+	outputPartition := kafkaPartitionFor(key, 3)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		cluster.mu.Lock()
+		committed, ok := cluster.committed[inputPartition]
+		cluster.mu.Unlock()
+		if ok && committed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatalf("offset of partition %d not committed, got %d", inputPartition, committed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	results := cluster.records("results", outputPartition)
+	if len(results) != 1 {
+		t.Fatalf("got %d results on partition %d, want 1", len(results), outputPartition)
+	}
+	var item BatchItem
+	if err := json.Unmarshal(results[0].Value, &item); err != nil {
+		t.Fatalf("result %s: %v", results[0].Value, err)
+	}
+	if !bytes.Equal(results[0].Key, key) || item.Error == "" || item.Result != nil {
+		t.Errorf("result key %q = %s, want key %q with an error", results[0].Key, results[0].Value, key)
+	}
+
+	cancel()
+	select {
+	case <-kc.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("consumer didn't stop")
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if !cluster.left {
+		t.Error("consumer didn't leave the group")
+	}
+}
+
+func TestKafkaPublishMissingPartition(t *testing.T) {
+	// Metadata listing partition 1 only: the round-robin partition 0 has no
+	// leader, which must fail rather than go to broker 0
+	server := serveKafka(t, func(apiKey, version int16, d *kafkaDecoder) []byte {
+		if apiKey != kafkaMetadata {
+			t.Errorf("unexpected request with API key %d", apiKey)
+			return nil
+		}
+		var e kafkaEncoder
+		e.arrayLen(1)
+		e.int32(0)
+		e.string("127.0.0.1")
+		e.int32(1)
+		e.int16(-1)
+		e.int32(0)
+		e.arrayLen(1)
+		e.int16(0)
+		e.string("results")
+		e.int8(0)
+		e.arrayLen(1)
+		e.int16(0)
+		e.int32(1)
+		e.int32(0)
+		e.int32Array([]int32{0})
+		e.int32Array([]int32{0})
+		return e.b
+	})
+	kc := &kafkaConsumer{client: newKafkaClient([]string{server.addr}, "bridge"), output: "results"}
+	kc.next.Store(uint32(1<<32 - 1)) // the next round-robin partition is 0
+	if err := kc.publish(t.Context(), nil, []byte("result")); !errors.Is(err, kafkaError(kafkaUnknownTopicOrPartition)) {
+		t.Errorf("publish = %v, want unknown topic or partition", err)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Endpoint Kafka results are recorded for, and the caller they are
+// recorded under
+const resultEndpointKafka = "kafka"
+
+// Values of KAFKA_START_OFFSET
+const (
+	kafkaStartEarliest = "earliest"
+	kafkaStartLatest   = "latest"
+)
+
+// Consumer timings and sizes: the session a member must heartbeat within
+// and how often it does, the first and longest waits before retrying after
+// a failure, and how long a fetch waits for records and how much it reads
+const (
+	kafkaSessionTimeout   = 30 * time.Second
+	kafkaHeartbeatPeriod  = 3 * time.Second
+	kafkaRetryBackoff     = 2 * time.Second
+	kafkaMaxRetryInterval = 30 * time.Second
+	kafkaFetchMaxWait     = time.Second
+	kafkaFetchMaxBytes    = 64 << 20
+)
+
+// kafkaConsumer consumes audio from KAFKA_INPUT_TOPIC as a member of the
+// KAFKA_GROUP_ID consumer group, runs the pipeline on each message and
+// publishes the result to KAFKA_OUTPUT_TOPIC. Each assigned partition is
+// processed one message at a time, and a message's offset is only
+// committed once its result is published, so every message gets a result
+// at least once; running more bridges in the group spreads the partitions.
+type kafkaConsumer struct {
+	client *kafkaClient
+	group  string
+	input  string
+	output string
+
+	memberID string
+	next     atomic.Uint32 // round-robin partition for results without a key
+
+	done chan struct{} // closed once run has left the group
+}
+
+func newKafkaConsumer() *kafkaConsumer {
+	return &kafkaConsumer{
+		client: newKafkaClient(splitList(cfg().kafkaBrokers), "whisper-llm-bridge"),
+		group:  cfg().kafkaGroupID,
+		input:  cfg().kafkaInputTopic,
+		output: cfg().kafkaOutputTopic,
+		done:   make(chan struct{}),
+	}
+}
+
+// run takes part in the group until ctx is done, rejoining after
+// rebalances and failures, and leaves the group on the way out
+func (kc *kafkaConsumer) run(ctx context.Context) {
+	defer close(kc.done)
+	backoff := kafkaRetryBackoff
+	for ctx.Err() == nil {
+		err := kc.session(ctx)
+		if err == nil || ctx.Err() != nil {
+			backoff = kafkaRetryBackoff
+			continue
+		}
+		var code kafkaError
+		if errors.As(err, &code) && (code == kafkaUnknownMemberID || code == kafkaIllegalGeneration) {
+			kc.memberID = ""
+		}
+		log.Printf("Kafka consumer: %v, rejoining in %s", err, backoff)
+		sleepContext(ctx, backoff)
+		backoff = min(backoff*2, kafkaMaxRetryInterval)
+	}
+
+	if kc.memberID != "" {
+		leaveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if coordinator, err := kc.client.coordinator(leaveCtx, kc.group); err == nil {
+			kc.client.leaveGroup(leaveCtx, coordinator, kc.group, kc.memberID)
+		}
+	}
+}
+
+// session joins the group and processes the partitions assigned to the
+// bridge until the group rebalances, which returns nil, or something
+// fails. In-flight messages are finished before it returns.
+func (kc *kafkaConsumer) session(ctx context.Context) error {
+	coordinator, err := kc.client.coordinator(ctx, kc.group)
+	if err != nil {
+		return fmt.Errorf("failed to find the group coordinator: %w", err)
+	}
+	// Members finish their current message before rejoining
+	join, err := kc.client.joinGroup(ctx, coordinator, kc.group, kc.memberID, []string{kc.input}, kafkaSessionTimeout, time.Duration(cfg().jobTimeout)*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to join group %s: %w", kc.group, err)
+	}
+	kc.memberID = join.MemberID
+
+	leaders, err := kc.client.leaders(ctx, kc.input)
+	if err != nil {
+		return err
+	}
+	var assignments map[string][]int32
+	if join.Leader == join.MemberID {
+		assignments = assignRange(join.Members, kc.input, leaders)
+	}
+	partitions, err := kc.client.syncGroup(ctx, coordinator, kc.group, join.Generation, join.MemberID, kc.input, assignments)
+	if err != nil {
+		return fmt.Errorf("failed to sync group %s: %w", kc.group, err)
+	}
+	slices.Sort(partitions)
+	log.Printf("Kafka consumer: joined group %s (generation %d), consuming %s partitions %v", kc.group, join.Generation, kc.input, partitions)
+	if len(partitions) == 0 {
+		return kc.heartbeat(ctx, coordinator, join, nil)
+	}
+
+	offsets, err := kc.client.committedOffsets(ctx, coordinator, kc.group, kc.input, partitions)
+	if err != nil {
+		return fmt.Errorf("failed to read committed offsets: %w", err)
+	}
+
+	// Workers stop between messages once the session ends, so a message
+	// isn't cut off by a rebalance. A worker that stops on its own, when
+	// its commit fails, ends the session so the group rebalances.
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	var stopOnce sync.Once
+	var workers sync.WaitGroup
+	for _, partition := range partitions {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			kc.consume(ctx, stop, coordinator, join, partition, offsets[partition])
+			stopOnce.Do(func() { close(stopped) })
+		}()
+	}
+	err = kc.heartbeat(ctx, coordinator, join, stopped)
+	close(stop)
+	workers.Wait()
+	return err
+}
+
+// heartbeat heartbeats until the group rebalances, which returns nil, the
+// coordinator fails, or a worker stops early by closing done
+func (kc *kafkaConsumer) heartbeat(ctx context.Context, coordinator string, join *kafkaJoin, done <-chan struct{}) error {
+	ticker := time.NewTicker(kafkaHeartbeatPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+		err := kc.client.heartbeat(ctx, coordinator, kc.group, join.Generation, join.MemberID)
+		var code kafkaError
+		if errors.As(err, &code) && code == kafkaRebalanceInProgress {
+			log.Printf("Kafka consumer: group %s is rebalancing", kc.group)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("heartbeat failed: %w", err)
+		}
+	}
+}
+
+// consume processes the records of a partition from the committed offset
+// until stop is closed or ctx is done
+func (kc *kafkaConsumer) consume(ctx context.Context, stop <-chan struct{}, coordinator string, join *kafkaJoin, partition int32, offset int64) {
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return ctx.Err() != nil
+		}
+	}
+	// Fetches are cut short when the session ends
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-fetchCtx.Done():
+		}
+	}()
+
+	var leader string
+	backoff := kafkaRetryBackoff
+	retry := func(format string, args ...any) {
+		log.Printf("Kafka consumer: partition %d: "+format+", retrying in %s", append([]any{partition}, append(args, backoff)...)...)
+		leader = ""
+		sleepContext(fetchCtx, backoff)
+		backoff = min(backoff*2, kafkaMaxRetryInterval)
+	}
+	for !stopped() {
+		if leader == "" {
+			leaders, err := kc.client.leaders(fetchCtx, kc.input)
+			if err == nil {
+				leader, err = kc.client.partitionLeader(leaders, kc.input, partition)
+			}
+			if err != nil {
+				retry("failed to find the leader: %v", err)
+				continue
+			}
+		}
+		if offset < 0 {
+			at := int64(kafkaEarliest)
+			if cfg().kafkaStartOffset == kafkaStartLatest {
+				at = kafkaLatest
+			}
+			var err error
+			if offset, err = kc.client.listOffset(fetchCtx, leader, kc.input, partition, at); err != nil {
+				offset = -1
+				retry("failed to find the %s offset: %v", cfg().kafkaStartOffset, err)
+				continue
+			}
+		}
+
+		records, next, err := kc.client.fetch(fetchCtx, leader, kc.input, partition, offset, kafkaFetchMaxWait, kafkaFetchMaxBytes)
+		if err != nil && next == offset {
+			if !stopped() {
+				retry("fetch failed: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Kafka consumer: partition %d: skipping to offset %d: %v", partition, next, err)
+		}
+		backoff = kafkaRetryBackoff
+		for _, record := range records {
+			if stopped() {
+				return
+			}
+			if !kc.handle(ctx, partition, record) {
+				return
+			}
+			offset = record.Offset + 1
+			if err := kc.client.commitOffset(ctx, coordinator, kc.group, join.Generation, join.MemberID, kc.input, partition, offset); err != nil {
+				// The next owner of the partition processes the record again
+				log.Printf("Kafka consumer: partition %d: failed to commit offset %d: %v", partition, offset, err)
+				return
+			}
+		}
+		offset = max(offset, next)
+	}
+}
+
+// handle processes a record and publishes its result, retrying the
+// publication until it succeeds. It returns false when ctx is done first,
+// leaving the record uncommitted.
+func (kc *kafkaConsumer) handle(ctx context.Context, partition int32, record kafkaRecord) bool {
+	id := newRequestID()
+	item, err := processMessage(ctx, resultEndpointKafka, id, record.Value)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		kafkaMessages.add(1, "failed")
+		log.Printf("Kafka message %s/%d@%d failed: %v request_id=%s", kc.input, partition, record.Offset, err, id)
+	} else {
+		kafkaMessages.add(1, "ok")
+		log.Printf("Kafka message %s/%d@%d processed request_id=%s", kc.input, partition, record.Offset, id)
+	}
+	value, err := json.Marshal(item)
+	if err != nil {
+		log.Printf("Failed to encode the result of Kafka message %s/%d@%d: %v request_id=%s", kc.input, partition, record.Offset, err, id)
+		return true
+	}
+
+	backoff := kafkaRetryBackoff
+	for {
+		err := kc.publish(ctx, record.Key, value)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Printf("Failed to publish the result of Kafka message %s/%d@%d: %v, retrying in %s request_id=%s", kc.input, partition, record.Offset, err, backoff, id)
+		sleepContext(ctx, backoff)
+		backoff = min(backoff*2, kafkaMaxRetryInterval)
+	}
+}
+
+// publish sends a result to the output topic, on the partition of its key
+// so results with the same key stay in order, or round-robin
+func (kc *kafkaConsumer) publish(ctx context.Context, key, value []byte) error {
+	leaders, err := kc.client.leaders(ctx, kc.output)
+	if err != nil {
+		return err
+	}
+	var partition int32
+	if key != nil {
+		partition = kafkaPartitionFor(key, len(leaders))
+	} else {
+		partition = int32(kc.next.Add(1) % uint32(len(leaders)))
+	}
+	addr, err := kc.client.partitionLeader(leaders, kc.output, partition)
+	if err != nil {
+		return err
+	}
+	return kc.client.produce(ctx, addr, kc.output, partition, key, value)
+}
+
+// assignRange assigns the partitions of topic to the members subscribed to
+// it like Kafka's range assignor: members sorted by ID get consecutive
+// partitions, the first ones one more when they don't divide evenly
+func assignRange(members []kafkaMember, topic string, leaders map[int32]int32) map[string][]int32 {
+	var subscribed []string
+	for _, member := range members {
+		if slices.Contains(member.Topics, topic) {
+			subscribed = append(subscribed, member.ID)
+		}
+	}
+	sort.Strings(subscribed)
+	partitions := make([]int32, 0, len(leaders))
+	for partition := range leaders {
+		partitions = append(partitions, partition)
+	}
+	slices.Sort(partitions)
+
+	assignments := make(map[string][]int32, len(members))
+	for _, member := range members {
+		assignments[member.ID] = nil
+	}
+	if len(subscribed) == 0 {
+		return assignments
+	}
+	per, extra := len(partitions)/len(subscribed), len(partitions)%len(subscribed)
+	start := 0
+	for i, member := range subscribed {
+		n := per
+		if i < extra {
+			n++
+		}
+		assignments[member] = partitions[start : start+n]
+		start += n
+	}
+	return assignments
+}
+
+// checkKafkaConfig reports what is wrong with the KAFKA_ settings
+func (c *config) checkKafkaConfig() error {
+	if c.kafkaBrokers == "" {
+		return nil
+	}
+	switch {
+	case c.kafkaInputTopic == "" || c.kafkaOutputTopic == "":
+		return errors.New("KAFKA_INPUT_TOPIC and KAFKA_OUTPUT_TOPIC are required with KAFKA_BROKERS")
+	case c.kafkaGroupID == "":
+		return errors.New("KAFKA_GROUP_ID can't be empty")
+	case c.kafkaStartOffset != kafkaStartEarliest && c.kafkaStartOffset != kafkaStartLatest:
+		return fmt.Errorf("KAFKA_START_OFFSET must be %s or %s, got %q", kafkaStartEarliest, kafkaStartLatest, c.kafkaStartOffset)
+	}
+	return nil
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
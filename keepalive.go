@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upstream names used in health records
+const (
+	upstreamWhisper     = "whisper"
+	upstreamOllama      = "ollama"
+	upstreamTTS         = "tts"
+	upstreamDiarization = "diarization"
+)
+
+// upstreamStatus is the outcome of the most recent probes of an upstream
+type upstreamStatus struct {
+	LastSuccess time.Time
+	LastCheck   time.Time
+	LastError   string
+	LastLatency time.Duration
+}
+
+// upstreamHealth caches probe results so readiness checks don't have to hit
+// the upstreams on every call
+type upstreamHealth struct {
+	mu       sync.RWMutex
+	statuses map[string]upstreamStatus
+}
+
+var upstreams = &upstreamHealth{statuses: make(map[string]upstreamStatus)}
+
+// record stores the outcome of a probe that took latency
+func (h *upstreamHealth) record(name string, err error, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := h.statuses[name]
+	status.LastCheck = time.Now()
+	status.LastLatency = latency
+	if err != nil {
+		if status.LastError == "" {
+			log.Printf("Health check: %s is unreachable: %v", name, err)
+		}
+		status.LastError = err.Error()
+	} else {
+		if status.LastError != "" {
+			log.Printf("Health check: %s recovered", name)
+		}
+		status.LastSuccess = status.LastCheck
+		status.LastError = ""
+	}
+	h.statuses[name] = status
+}
+
+// check runs ping and records its outcome and latency under name
+func (h *upstreamHealth) check(ctx context.Context, name string, ping func(context.Context) error) {
+	start := time.Now()
+	err := ping(ctx)
+	h.record(name, err, time.Since(start))
+}
+
+func (h *upstreamHealth) get(name string) upstreamStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.statuses[name]
+}
+
+// startKeepalive pings Whisper and Ollama every interval until ctx is
+// cancelled. When keepaliveModel is set Ollama is also asked to load that
+// model so it isn't unloaded between requests.
+func startKeepalive(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			probeCtx, cancel := context.WithTimeout(ctx, min(interval, 30*time.Second))
+			upstreams.check(probeCtx, upstreamWhisper, pingWhisper)
+			upstreams.check(probeCtx, upstreamOllama, pingOllama)
+			ollamaModels.refresh(probeCtx)
+			cancel()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// pingWhisper checks that the ASR backend answers HTTP requests, each of
+// the WHISPER_URL servers
+func pingWhisper(ctx context.Context) error {
+	if cfg().transcriber.name() == asrDeepgram {
+		return cfg().transcriber.ping(ctx)
+	}
+	return whisperBackends.ping(ctx)
+}
+
+// pingOllama checks the Ollama API of each OLLAMA_URL host and optionally
+// keeps a model loaded
+func pingOllama(ctx context.Context) error {
+	return ollamaHosts.ping(ctx, cfg().keepaliveModel)
+}
+
+// pingOllamaAPI checks that the Ollama API answers, without loading a model
+func pingOllamaAPI(ctx context.Context) error {
+	return ollamaHosts.ping(ctx, "")
+}
+
+// probe sends a request and treats any non-5xx answer as alive
+func probe(ctx context.Context, method, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := upstreamClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// JSON key styles selectable with RESPONSE_KEY_STYLE
+const (
+	keyStyleSnake = "snake"
+	keyStyleCamel = "camel"
+)
+
+// marshalResponse encodes v with its snake_case struct tags and, when the
+// camel style is configured, rewrites the keys of the /process response
+// to camelCase: those of a CombinedResponse, its v1 and v2 variants and
+// any struct embedding one, wherever it is in v. Only keys of the
+// bridge's own struct fields are rewritten; maps and raw JSON, such as
+// structured output or user metadata, are passed through as they are.
+// The rewrite walks the token stream, so key order is preserved.
+func marshalResponse(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || cfg().responseKeyStyle != keyStyleCamel || v == nil {
+		return data, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out bytes.Buffer
+	if err := writeCamelValue(dec, &out, reflect.TypeOf(v), false); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+var (
+	combinedResponseType   = reflect.TypeFor[CombinedResponse]()
+	combinedResponseV1Type = reflect.TypeFor[CombinedResponseV1]()
+	jsonMarshalerType      = reflect.TypeFor[json.Marshaler]()
+)
+
+// isResponseType reports whether the keys of t are camelCased: t is a
+// CombinedResponse or its v1 variant, or embeds a CombinedResponse
+func isResponseType(t reflect.Type) bool {
+	if t == combinedResponseType || t == combinedResponseV1Type {
+		return true
+	}
+	for i := range t.NumField() {
+		if field := t.Field(i); field.Anonymous && field.Type == combinedResponseType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCamelValue copies the next JSON value from dec to out. t is the Go
+// type it was encoded from, which tells struct fields from map keys; camel
+// is set inside a response, whose struct field keys are converted to
+// camelCase.
+func writeCamelValue(dec *json.Decoder, out *bytes.Buffer, t reflect.Type, camel bool) error {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	verbatim := t == nil || t.Kind() == reflect.Map || t.Kind() == reflect.Interface ||
+		t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType)
+	if verbatim {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		out.Write(raw)
+		return nil
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '[' {
+			out.WriteByte('[')
+			for first := true; dec.More(); first = false {
+				if !first {
+					out.WriteByte(',')
+				}
+				if err := writeCamelValue(dec, out, t.Elem(), camel); err != nil {
+					return err
+				}
+			}
+		} else {
+			camel = camel || isResponseType(t)
+			fields := jsonFieldTypes(t)
+			out.WriteByte('{')
+			for first := true; dec.More(); first = false {
+				if !first {
+					out.WriteByte(',')
+				}
+				keyTok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				name := keyTok.(string)
+				key := name
+				if camel {
+					key = snakeToCamel(name)
+				}
+				encoded, _ := json.Marshal(key)
+				out.Write(encoded)
+				out.WriteByte(':')
+				if err := writeCamelValue(dec, out, fields[name], camel); err != nil {
+					return err
+				}
+			}
+		}
+		end, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		out.WriteRune(rune(end.(json.Delim)))
+	case json.Number:
+		out.WriteString(tok.String())
+	default:
+		// Strings, booleans and null
+		encoded, err := json.Marshal(tok)
+		if err != nil {
+			return fmt.Errorf("failed to encode %v: %w", tok, err)
+		}
+		out.Write(encoded)
+	}
+	return nil
+}
+
+// Field types of the structs encoded so far, by JSON key
+var jsonFieldCache sync.Map // reflect.Type -> map[string]reflect.Type
+
+// jsonFieldTypes returns the types of the fields encoding/json writes for
+// struct t, by key, with the fields of embedded structs promoted unless a
+// shallower field has the key
+func jsonFieldTypes(t reflect.Type) map[string]reflect.Type {
+	if cached, ok := jsonFieldCache.Load(t); ok {
+		return cached.(map[string]reflect.Type)
+	}
+	fields := make(map[string]reflect.Type)
+	var embedded []reflect.Type
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			inner := field.Type
+			if inner.Kind() == reflect.Pointer {
+				inner = inner.Elem()
+			}
+			if inner.Kind() == reflect.Struct {
+				embedded = append(embedded, inner)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	for _, inner := range embedded {
+		for name, fieldType := range jsonFieldTypes(inner) {
+			if _, ok := fields[name]; !ok {
+				fields[name] = fieldType
+			}
+		}
+	}
+	jsonFieldCache.Store(t, fields)
+	return fields
+}
+
+// snakeToCamel converts "process_time_ms" to "processTimeMs"
+func snakeToCamel(key string) string {
+	parts := strings.Split(key, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMarshalResponseCamel(t *testing.T) {
+	setConfigForTest(t, func(c *config) { c.responseKeyStyle = keyStyleCamel })
+	resp := CombinedResponse{
+		Transcription: "hello",
+		ProcessTime:   1200,
+		Model:         "llama3",
+		Structured:    json.RawMessage(`{"order_id":"A1","line_items":[{"unit_price":2}]}`),
+		Candidates:    []Candidate{{Response: "hi", ProcessTime: 300, DoneReason: "stop"}},
+	}
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{
+			"v1 response",
+			v1Response(resp),
+			`{"transcription":"hello","response":"","processTimeMs":1200,"model":"llama3",` +
+				`"candidates":[{"response":"hi","processTimeMs":300,"doneReason":"stop"}],` +
+				`"structured":{"order_id":"A1","line_items":[{"unit_price":2}]}}`,
+		},
+		{
+			"v2 response",
+			CombinedResponseV2{
+				CombinedResponse: CombinedResponse{Transcription: "hello", LLMSkipped: true},
+				Segments:         []Segment{{End: 1.5, Text: "hello", NoSpeechProb: new(float64)}},
+				Stats:            ProcessStats{TranscriptionTime: 800},
+			},
+			`{"transcription":"hello","response":"","processTimeMs":0,"model":"","llmSkipped":true,` +
+				`"segments":[{"id":0,"start":0,"end":1.5,"text":"hello","noSpeechProb":0}],"language":"",` +
+				`"stats":{"transcriptionTimeMs":800,"llmTimeMs":0,"promptTokens":0,"completionTokens":0,"tokensPerSecond":0}}`,
+		},
+		{
+			"SSE done event",
+			SSEDoneEvent{CombinedResponse: CombinedResponse{ProcessTime: 5}},
+			`{"transcription":"","response":"","processTimeMs":5,"model":"","stats":{"transcriptionTimeMs":0,"llmTimeMs":0,"promptTokens":0,"completionTokens":0,"tokensPerSecond":0}}`,
+		},
+		{
+			"job around a result",
+			Job{ID: "j1", Status: jobCompleted, CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), Result: &CombinedResponse{ProcessTime: 5}},
+			`{"id":"j1","status":"completed","created_at":"2026-01-02T03:04:05Z",` +
+				`"result":{"transcription":"","response":"","processTimeMs":5,"model":""}}`,
+		},
+		{
+			"map",
+			map[string]any{"process_time_ms": 1, "nested": map[string]int{"llm_time_ms": 2}},
+			`{"nested":{"llm_time_ms":2},"process_time_ms":1}`,
+		},
+		{
+			"other endpoint",
+			ProcessStats{TranscriptionTime: 3},
+			`{"transcription_time_ms":3,"llm_time_ms":0,"prompt_tokens":0,"completion_tokens":0,"tokens_per_second":0}`,
+		},
+	}
+	for _, tt := range tests {
+		data, err := marshalResponse(tt.v)
+		if err != nil {
+			t.Errorf("%s: marshalResponse: %v", tt.name, err)
+			continue
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: marshalResponse =\n%s\nwant\n%s", tt.name, data, tt.want)
+		}
+	}
+}
+
+func TestMarshalResponseSnake(t *testing.T) {
+	resp := CombinedResponse{ProcessTime: 5, Structured: json.RawMessage(`{"a_b":1}`)}
+	data, err := marshalResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(resp)
+	if string(data) != string(want) {
+		t.Errorf("marshalResponse = %s, want %s as json.Marshal encodes it", data, want)
+	}
+}
+
+func TestSnakeToCamel(t *testing.T) {
+	for key, want := range map[string]string{
+		"process_time_ms": "processTimeMs",
+		"model":           "model",
+		"a__b":            "aB",
+		"_leading":        "Leading",
+	} {
+		if got := snakeToCamel(key); got != want {
+			t.Errorf("snakeToCamel(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseLanguageModels parses a comma-separated list of language=model
+// pairs, e.g. "de=mistral,ja=qwen2:7b". Languages are the codes Whisper
+// reports and are matched case-insensitively.
+func parseLanguageModels(value string) (map[string]string, error) {
+	models := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		language, model, ok := strings.Cut(entry, "=")
+		language = strings.ToLower(strings.TrimSpace(language))
+		model = strings.TrimSpace(model)
+		if !ok || language == "" || model == "" {
+			return nil, fmt.Errorf("invalid entry %q (expected language=model)", entry)
+		}
+		models[language] = model
+	}
+	return models, nil
+}
+
+// modelForLanguage returns the model configured for a detected language
+func modelForLanguage(language string) (string, bool) {
+	model, ok := cfg().languageModels[strings.ToLower(strings.TrimSpace(language))]
+	return model, ok
+}
+
+// parseLanguage parses the language field, a Whisper language code such as
+// "de" or "yue" that the audio is transcribed in. Empty or "auto" leaves
+// the language to detection.
+func parseLanguage(value string) (string, error) {
+	language := strings.ToLower(strings.TrimSpace(value))
+	if language == "" || language == "auto" {
+		return "", nil
+	}
+	if len(language) < 2 || len(language) > 3 || strings.Trim(language, "abcdefghijklmnopqrstuvwxyz") != "" {
+		return "", newHTTPError(http.StatusBadRequest, "invalid language %q (expected a language code such as en or de)", value)
+	}
+	return language, nil
+}
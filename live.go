@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bytes per sample of the 16-bit PCM accepted by /live
+const liveSampleBytes = 2
+
+// LiveEvent is one NDJSON line of the /live response
+type LiveEvent struct {
+	Type     string  `json:"type"`
+	Start    float64 `json:"start"`
+	End      float64 `json:"end,omitempty"`
+	Text     string  `json:"text,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Segments int     `json:"segments,omitempty"`
+
+	// LLM answer on the WebSocket stream
+	Response   string `json:"response,omitempty"`
+	Model      string `json:"model,omitempty"`
+	DoneReason string `json:"done_reason,omitempty"`
+}
+
+// Live event types
+const (
+	liveEventSegment = "segment"
+	liveEventError   = "error"
+	liveEventDone    = "done"
+)
+
+// liveWindow is a slice of the live audio sent to Whisper in one request
+type liveWindow struct {
+	pcm   []byte
+	start float64 // seconds from the start of the stream
+}
+
+// liveHandler transcribes audio while it is being uploaded. The request
+// body is raw 16-bit little-endian mono PCM sent with chunked transfer
+// encoding, in chunks of any size. The audio is cut into windows of about
+// LIVE_WINDOW_SECONDS, ending at the quietest moment near the window end
+// to avoid splitting words, and each window is transcribed as soon as it
+// is complete. Finished segments are streamed back as NDJSON events with
+// timestamps relative to the start of the stream.
+//
+// Backpressure: at most LIVE_MAX_PENDING windows wait for transcription.
+// When the client sends audio faster than Whisper transcribes it, the
+// bridge stops reading the body and TCP flow control slows the client down.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType := strings.ToLower(r.Header.Get("Content-Type")); mediaType != "" &&
+		!strings.HasPrefix(mediaType, "audio/l16") && !strings.HasPrefix(mediaType, "application/octet-stream") {
+		http.Error(w, "expected raw 16-bit PCM (audio/L16)", http.StatusUnsupportedMediaType)
+		return
+	}
+	sampleRate, err := parseSampleRate(r.URL.Query().Get("sample_rate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A live session holds one slot for its whole duration
+	release, err := admit(r, priorityNormal)
+	if err != nil {
+		http.Error(w, "Server is at capacity, please try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfg().liveMaxDuration)*time.Second)
+	defer cancel()
+
+	// Stream results while the body is still arriving, without the
+	// per-request write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rc.SetWriteDeadline(time.Time{})
+
+	// LIVE_MAX_DURATION bounds live streams instead of MAX_UPLOAD_BYTES
+	body := newUploadReader(ctx, w, r.Body, time.Duration(cfg().uploadIdleTimeout)*time.Second, 0)
+	defer body.stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	emit := func(event LiveEvent) bool {
+		data, err := marshalResponse(event)
+		if err != nil {
+			return false
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	result, err := transcribeLive(ctx, body, sampleRate, emit)
+	if err != nil {
+		if body.stalled.Load() {
+			err = errUploadStalled
+		}
+		emit(LiveEvent{Type: liveEventError, Start: result.end, Error: err.Error()})
+		return
+	}
+	emit(LiveEvent{Type: liveEventDone, Start: 0, End: result.end, Segments: result.segments})
+}
+
+// parseSampleRate parses the sample_rate of live PCM, 16000 by default
+func parseSampleRate(value string) (int, error) {
+	if value == "" {
+		return 16000, nil
+	}
+	rate, err := strconv.Atoi(value)
+	if err != nil || rate < 8000 || rate > 48000 {
+		return 0, errors.New("sample_rate must be between 8000 and 48000")
+	}
+	return rate, nil
+}
+
+// liveResult summarises a finished live transcription
+type liveResult struct {
+	text     string  // all segment texts joined
+	end      float64 // seconds of audio received
+	segments int
+}
+
+// errClientGone is returned when events can no longer be delivered
+var errClientGone = errors.New("client went away")
+
+// transcribeLive cuts the PCM read from body into windows, transcribes
+// them one at a time and passes the resulting segments to emit as they
+// finish. A failed window is reported as an error event and skipped.
+func transcribeLive(ctx context.Context, body io.Reader, sampleRate int, emit func(LiveEvent) bool) (liveResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	windows := make(chan liveWindow, cfg().liveMaxPending)
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- readLiveWindows(ctx, body, sampleRate, windows)
+		close(windows)
+	}()
+	// Don't return while the reader may still touch the body
+	defer func() {
+		cancel()
+		for range windows {
+		}
+	}()
+
+	var result liveResult
+	var texts []string
+	for window := range windows {
+		result.end = window.start + float64(len(window.pcm)/liveSampleBytes)/float64(sampleRate)
+		events, err := transcribeLiveWindow(ctx, window, sampleRate)
+		if err != nil {
+			log.Printf("Live transcription of %.1fs window failed: %v request_id=%s", window.start, err, requestIDFromContext(ctx))
+			events = []LiveEvent{{Type: liveEventError, Start: window.start, End: result.end, Error: err.Error()}}
+		}
+		for _, event := range events {
+			if !emit(event) {
+				return result, errClientGone
+			}
+			if event.Type == liveEventSegment {
+				result.segments++
+				texts = append(texts, event.Text)
+			}
+		}
+	}
+	result.text = strings.Join(texts, " ")
+	return result, <-readDone
+}
+
+// readLiveWindows reads PCM from body and sends it to windows in pieces of
+// about LIVE_WINDOW_SECONDS. The remainder is sent when the body ends.
+func readLiveWindows(ctx context.Context, body io.Reader, sampleRate int, windows chan<- liveWindow) error {
+	bytesPerSecond := sampleRate * liveSampleBytes
+	windowBytes := cfg().liveWindowSeconds * bytesPerSecond
+
+	var buf []byte
+	var offset int // bytes sent so far
+	chunk := make([]byte, 32<<10)
+	send := func(n int) bool {
+		window := liveWindow{
+			pcm:   bytes.Clone(buf[:n]),
+			start: float64(offset) / float64(bytesPerSecond),
+		}
+		select {
+		case windows <- window:
+		case <-ctx.Done():
+			return false
+		}
+		buf = buf[n:]
+		offset += n
+		return true
+	}
+
+	for {
+		n, err := body.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		for len(buf) >= windowBytes {
+			if !send(quietCut(buf[:windowBytes], sampleRate)) {
+				return ctx.Err()
+			}
+		}
+		if err == io.EOF {
+			// Skip trailing fragments too short to hold a word
+			if len(buf) >= bytesPerSecond/10 {
+				send(len(buf) - len(buf)%liveSampleBytes)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// quietCut returns where to end a window of PCM: the start of the
+// quietest 20ms frame in its last second, so a window rarely ends in the
+// middle of a word
+func quietCut(pcm []byte, sampleRate int) int {
+	frameBytes := sampleRate / 50 * liveSampleBytes
+	searchFrom := max(len(pcm)-sampleRate*liveSampleBytes, len(pcm)/2)
+	searchFrom -= searchFrom % liveSampleBytes
+
+	cut, quietest := len(pcm), math.MaxFloat64
+	for pos := searchFrom; pos+frameBytes <= len(pcm); pos += frameBytes {
+		var energy float64
+		for i := pos; i < pos+frameBytes; i += liveSampleBytes {
+			v := float64(int16(binary.LittleEndian.Uint16(pcm[i:])))
+			energy += v * v
+		}
+		if energy < quietest {
+			cut, quietest = pos+frameBytes, energy
+		}
+	}
+	return cut
+}
+
+// transcribeLiveWindow sends one window to Whisper and converts the
+// resulting segments to events on the stream's timeline
+func transcribeLiveWindow(ctx context.Context, window liveWindow, sampleRate int) ([]LiveEvent, error) {
+	wav := append(monoWAVHeader(wavFormatPCM, sampleRate, 16, int64(len(window.pcm))), window.pcm...)
+	resp, err := transcribeStreamWithWhisper(ctx, "live.wav", bytes.NewReader(wav))
+	if err != nil {
+		return nil, err
+	}
+	if cfg().redactPIIEnabled {
+		redactWhisperResponse(resp)
+	}
+
+	duration := float64(len(window.pcm)/liveSampleBytes) / float64(sampleRate)
+	var events []LiveEvent
+	for _, segment := range resp.Segments {
+		if strings.TrimSpace(segment.Text) == "" {
+			continue
+		}
+		end := segment.End
+		if !segment.timed() {
+			end = duration
+		}
+		events = append(events, LiveEvent{
+			Type:  liveEventSegment,
+			Start: window.start + segment.Start,
+			End:   window.start + end,
+			Text:  strings.TrimSpace(segment.Text),
+		})
+	}
+	if len(events) == 0 && strings.TrimSpace(resp.Text) != "" {
+		events = append(events, LiveEvent{
+			Type:  liveEventSegment,
+			Start: window.start,
+			End:   window.start + duration,
+			Text:  strings.TrimSpace(resp.Text),
+		})
+	}
+	return events, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LLM provider names, used in LLM_PROVIDER and the provider field
+const (
+	providerOllama    = "ollama"
+	providerOpenAI    = "openai"
+	providerAnthropic = "anthropic"
+	providerVLLM      = "vllm"
+)
+
+// LLMProvider runs the LLM step of the pipeline. Results are reported in
+// Ollama's response shape, which the rest of the pipeline understands:
+// token counts, done_reason ("stop" or "length") and the eval duration.
+type LLMProvider interface {
+	// name is the provider's name in the configuration
+	name() string
+	// defaultModel is used when the client doesn't pick a model
+	defaultModel() string
+	// allow reports whether calls may be made, e.g. with a closed breaker
+	allow(ctx context.Context) error
+	// generate completes prompt with model. With onToken set the text is
+	// streamed to it as it is produced.
+	generate(ctx context.Context, model, prompt string, options map[string]any, onToken func(string) error) (*OllamaResponse, error)
+}
+
+// newLLMProviders returns Ollama and every hosted provider that has its
+// credentials or URL configured
+func (c *config) newLLMProviders() map[string]LLMProvider {
+	providers := map[string]LLMProvider{providerOllama: ollamaProvider{model: c.defaultModel}}
+	if c.openAIAPIKey != "" {
+		providers[providerOpenAI] = &openAICompatibleProvider{
+			provider: providerOpenAI,
+			baseURL:  c.openAIBaseURL,
+			apiKey:   c.openAIAPIKey,
+			model:    c.openAIModel,
+		}
+	}
+	if c.anthropicAPIKey != "" {
+		providers[providerAnthropic] = &anthropicProvider{
+			baseURL:   c.anthropicBaseURL,
+			apiKey:    c.anthropicAPIKey,
+			model:     c.anthropicModel,
+			maxTokens: c.anthropicMaxTokens,
+		}
+	}
+	if c.vllmURL != "" {
+		providers[providerVLLM] = &openAICompatibleProvider{
+			provider: providerVLLM,
+			baseURL:  strings.TrimSuffix(c.vllmURL, "/") + "/v1",
+			apiKey:   c.vllmAPIKey,
+			model:    c.vllmModel,
+		}
+	}
+	return providers
+}
+
+// lookupLLM returns the named provider, or the default one for an empty
+// name
+func lookupLLM(name string) (LLMProvider, error) {
+	if name == "" {
+		return cfg().defaultLLM, nil
+	}
+	if provider, ok := cfg().llmProviders[strings.ToLower(name)]; ok {
+		return provider, nil
+	}
+	names := make([]string, 0, len(cfg().llmProviders))
+	for configured := range cfg().llmProviders {
+		names = append(names, configured)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown or unconfigured provider %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// withLLM selects the provider for the LLM calls made with ctx
+func withLLM(ctx context.Context, provider LLMProvider) context.Context {
+	return context.WithValue(ctx, llmProviderKey, provider)
+}
+
+// llmFromContext returns the provider selected with withLLM, or the
+// default provider
+func llmFromContext(ctx context.Context) LLMProvider {
+	if provider, ok := ctx.Value(llmProviderKey).(LLMProvider); ok {
+		return provider
+	}
+	return cfg().defaultLLM
+}
+
+// ollamaProvider runs generations on Ollama, with the spillover backend,
+// model weights and circuit breaker
+type ollamaProvider struct {
+	model string // OLLAMA_MODEL
+}
+
+func (ollamaProvider) name() string           { return providerOllama }
+func (p ollamaProvider) defaultModel() string { return p.model }
+
+func (ollamaProvider) allow(ctx context.Context) error {
+	return allowOllama(ctx)
+}
+
+func (ollamaProvider) generate(ctx context.Context, model, prompt string, options map[string]any, onToken func(string) error) (*OllamaResponse, error) {
+	return generateWithOllama(ctx, model, prompt, options, onToken)
+}
+
+// hostedParams are the parameters common to the hosted APIs
+type hostedParams struct {
+	system      string
+	temperature any
+	topP        any
+	maxTokens   int
+	stop        []string
+	schema      map[string]any      // JSON Schema the reply must match
+	history     []OllamaChatMessage // earlier messages of the session
+}
+
+// hostedOptions maps the Ollama options the bridge sets to the common
+// parameters of hosted APIs: the system prompt, temperature, top_p, the
+// token limit, stop sequences, the output schema and the history. Others
+// have no equivalent and are dropped.
+func hostedOptions(options map[string]any) hostedParams {
+	params := hostedParams{temperature: options["temperature"], topP: options["top_p"]}
+	params.system, _ = options[systemOption].(string)
+	params.schema, _ = options[formatOption].(map[string]any)
+	params.history, _ = options[historyOption].([]OllamaChatMessage)
+	switch n := options["num_predict"].(type) {
+	case int:
+		params.maxTokens = n
+	case float64:
+		params.maxTokens = int(n)
+	}
+	if words, ok := options["stop"].([]string); ok {
+		params.stop = words
+	}
+	return params
+}
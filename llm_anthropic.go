@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Version of the Anthropic Messages API the requests are written for
+const anthropicAPIVersion = "2023-06-01"
+
+// anthropicProvider calls the Anthropic Messages API with the prompt as a
+// single user message
+type anthropicProvider struct {
+	baseURL   string
+	apiKey    string
+	model     string
+	maxTokens int // required by the API, used unless num_predict is set
+}
+
+func (p *anthropicProvider) name() string                    { return providerAnthropic }
+func (p *anthropicProvider) defaultModel() string            { return p.model }
+func (p *anthropicProvider) allow(ctx context.Context) error { return nil }
+
+// anthropicMessage is a Messages API response, or the message carried by a
+// streamed message_start event
+type anthropicMessage struct {
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      anthropicUsage `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// anthropicEvent is one streamed event; only the fields of the event
+// types the bridge reads are declared
+type anthropicEvent struct {
+	Type    string           `json:"type"`
+	Message anthropicMessage `json:"message"` // message_start
+	Delta   struct {
+		Text       string `json:"text"`        // content_block_delta
+		StopReason string `json:"stop_reason"` // message_delta
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"` // message_delta
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *anthropicProvider) generate(ctx context.Context, model, prompt string, options map[string]any, onToken func(string) error) (*OllamaResponse, error) {
+	// Anthropic has no schema parameter; the prompt asks for the JSON
+	params := hostedOptions(options)
+	if params.maxTokens <= 0 {
+		params.maxTokens = p.maxTokens
+	}
+	body := map[string]any{
+		"model":      model,
+		"max_tokens": params.maxTokens,
+		"messages":   chatMessages("", params.history, prompt),
+		"stream":     onToken != nil,
+	}
+	if params.system != "" {
+		body["system"] = params.system
+	}
+	if params.temperature != nil {
+		body["temperature"] = params.temperature
+	}
+	if params.topP != nil {
+		body["top_p"] = params.topP
+	}
+	if len(params.stop) > 0 {
+		body["stop_sequences"] = params.stop
+	}
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/v1/messages", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", p.apiKey)
+	req.Header.Set("Anthropic-Version", anthropicAPIVersion)
+	setUpstreamRequestID(req)
+	setTraceParent(req)
+
+	client := upstreamClient(time.Duration(cfg().requestTimeout) * time.Second)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError(providerAnthropic, resp)
+	}
+
+	result := &OllamaResponse{Model: model, Finished: true}
+	if onToken == nil {
+		var message anthropicMessage
+		if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		var text strings.Builder
+		for _, block := range message.Content {
+			if block.Type == "text" {
+				text.WriteString(block.Text)
+			}
+		}
+		result.Response = text.String()
+		result.Model = message.Model
+		result.DoneReason = anthropicDoneReason(message.StopReason)
+		result.PromptEvalCount = message.Usage.InputTokens
+		result.EvalCount = message.Usage.OutputTokens
+	} else if err := p.readStream(resp.Body, result, onToken); err != nil {
+		return nil, err
+	}
+	result.EvalDuration = time.Since(start).Nanoseconds()
+	return result, nil
+}
+
+// readStream reads the SSE events of a streamed message into result
+func (p *anthropicProvider) readStream(body io.Reader, result *OllamaResponse, onToken func(string) error) error {
+	var text strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		switch event.Type {
+		case "message_start":
+			result.Model = event.Message.Model
+			result.PromptEvalCount = event.Message.Usage.InputTokens
+		case "content_block_delta":
+			if event.Delta.Text != "" {
+				text.WriteString(event.Delta.Text)
+				if err := onToken(event.Delta.Text); err != nil {
+					return err
+				}
+			}
+		case "message_delta":
+			result.DoneReason = anthropicDoneReason(event.Delta.StopReason)
+			result.EvalCount = event.Usage.OutputTokens
+		case "message_stop":
+			result.Response = text.String()
+			return nil
+		case "error":
+			return fmt.Errorf("anthropic stream failed: %s", event.Error.Message)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return fmt.Errorf("failed to decode response: %w", io.ErrUnexpectedEOF)
+}
+
+// anthropicDoneReason maps a stop_reason to Ollama's done_reason
+func anthropicDoneReason(stopReason string) string {
+	if stopReason == "max_tokens" {
+		return doneReasonLength
+	}
+	return "stop"
+}
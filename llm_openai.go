@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// openAICompatibleProvider calls a chat completions API: OpenAI itself or
+// a server that implements it, such as vLLM. The prompt is sent as a
+// user message after the session's earlier messages.
+type openAICompatibleProvider struct {
+	provider string
+	baseURL  string // up to and including /v1
+	apiKey   string // optional for self-hosted servers
+	model    string
+}
+
+func (p *openAICompatibleProvider) name() string                    { return p.provider }
+func (p *openAICompatibleProvider) defaultModel() string            { return p.model }
+func (p *openAICompatibleProvider) allow(ctx context.Context) error { return nil }
+
+// openAIUpstreamChunk is a chat completion or one streamed chunk of it
+type openAIUpstreamChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      OllamaChatMessage `json:"message"`
+		Delta        OllamaChatMessage `json:"delta"`
+		FinishReason string            `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *OpenAIUsage `json:"usage"`
+}
+
+func (p *openAICompatibleProvider) generate(ctx context.Context, model, prompt string, options map[string]any, onToken func(string) error) (*OllamaResponse, error) {
+	params := hostedOptions(options)
+	messages := chatMessages(params.system, params.history, prompt)
+	body := map[string]any{
+		"model":    model,
+		"messages": messages,
+		"stream":   onToken != nil,
+	}
+	if params.temperature != nil {
+		body["temperature"] = params.temperature
+	}
+	if params.topP != nil {
+		body["top_p"] = params.topP
+	}
+	if params.maxTokens > 0 {
+		body["max_tokens"] = params.maxTokens
+	}
+	if len(params.stop) > 0 {
+		body["stop"] = params.stop
+	}
+	if params.schema != nil {
+		body["response_format"] = map[string]any{
+			"type":        "json_schema",
+			"json_schema": map[string]any{"name": "output", "schema": params.schema},
+		}
+	}
+	if onToken != nil {
+		body["stream_options"] = map[string]any{"include_usage": true}
+	}
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/chat/completions", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	setUpstreamRequestID(req)
+	setTraceParent(req)
+
+	client := upstreamClient(time.Duration(cfg().requestTimeout) * time.Second)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError(p.provider, resp)
+	}
+
+	result := &OllamaResponse{Model: model, Finished: true}
+	if onToken == nil {
+		var completion openAIUpstreamChunk
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		p.merge(result, completion)
+	} else if err := p.readStream(resp.Body, result, onToken); err != nil {
+		return nil, err
+	}
+	result.EvalDuration = time.Since(start).Nanoseconds()
+	return result, nil
+}
+
+// readStream reads the SSE chunks of a streamed completion into result
+func (p *openAICompatibleProvider) readStream(body io.Reader, result *OllamaResponse, onToken func(string) error) error {
+	var text strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			result.Response = text.String()
+			return nil
+		}
+		var chunk openAIUpstreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				text.WriteString(choice.Delta.Content)
+				if err := onToken(choice.Delta.Content); err != nil {
+					return err
+				}
+			}
+		}
+		p.merge(result, chunk)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return fmt.Errorf("failed to decode response: %w", io.ErrUnexpectedEOF)
+}
+
+// merge copies the model, finish reason, usage and, for complete
+// responses, the text of a completion into result
+func (p *openAICompatibleProvider) merge(result *OllamaResponse, completion openAIUpstreamChunk) {
+	if completion.Model != "" {
+		result.Model = completion.Model
+	}
+	if len(completion.Choices) > 0 {
+		choice := completion.Choices[0]
+		if choice.Message.Content != "" {
+			result.Response = choice.Message.Content
+		}
+		if choice.FinishReason != "" {
+			result.DoneReason = "stop"
+			if choice.FinishReason == "length" {
+				result.DoneReason = doneReasonLength
+			}
+		}
+	}
+	if completion.Usage != nil {
+		result.PromptEvalCount = completion.Usage.PromptTokens
+		result.EvalCount = completion.Usage.CompletionTokens
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Prefix of the Redis keys of cached LLM responses
+const llmResponseKeyPrefix = "whisper-llm-bridge:llm:"
+
+// LLM response cache, set up by main from LLM_CACHE; nil when responses
+// aren't cached. Entries are OllamaResponses keyed by a hash of the
+// provider, model, prompt and options.
+var llmResponses byteCache
+
+// How a generation uses the LLM response cache
+type llmCacheMode int
+
+const (
+	llmCacheUse     llmCacheMode = iota
+	llmCacheRefresh              // generate afresh and replace the entry
+	llmCacheSkip                 // neither read nor write the cache
+)
+
+// withLLMCacheMode sets how the generations run with ctx use the cache
+func withLLMCacheMode(ctx context.Context, mode llmCacheMode) context.Context {
+	return context.WithValue(ctx, llmCacheModeKey, mode)
+}
+
+// llmCacheKey returns the cache key of a generation, or false when it
+// isn't cached: with the cache off, generations that skip it and requests
+// routed to another Ollama with an upstream override
+func llmCacheKey(ctx context.Context, provider, model, prompt string, options map[string]any) (string, bool) {
+	if llmResponses == nil || overridesFromContext(ctx).ollama != "" {
+		return "", false
+	}
+	if mode, _ := ctx.Value(llmCacheModeKey).(llmCacheMode); mode == llmCacheSkip {
+		return "", false
+	}
+	// Maps are marshalled with sorted keys, so equal options hash alike
+	params, err := json.Marshal(struct {
+		Provider, Model, Prompt string
+		Options                 map[string]any
+	}{provider, model, prompt, options})
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(params)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// cachedLLMResponse returns the cached response of the generation with key,
+// or nil when it must be generated
+func cachedLLMResponse(ctx context.Context, key string) *OllamaResponse {
+	if mode, _ := ctx.Value(llmCacheModeKey).(llmCacheMode); mode == llmCacheRefresh {
+		llmCacheRequests.add(1, cacheBypassed)
+		return nil
+	}
+	entry, err := llmResponses.get(ctx, key)
+	if err != nil {
+		log.Printf("Failed to read the LLM response cache: %v request_id=%s", err, requestIDFromContext(ctx))
+	}
+	var resp OllamaResponse
+	if entry == nil || json.Unmarshal(entry, &resp) != nil {
+		llmCacheRequests.add(1, cacheMiss)
+		return nil
+	}
+	llmCacheRequests.add(1, cacheHit)
+	resp.Cached = true
+	return &resp
+}
+
+// cacheLLMResponse keeps a generation's response for LLM_CACHE_TTL seconds
+func cacheLLMResponse(ctx context.Context, key string, resp *OllamaResponse) {
+	entry, err := json.Marshal(resp)
+	if err == nil {
+		err = llmResponses.set(ctx, key, entry, time.Duration(cfg().llmCacheTTL)*time.Second)
+	}
+	if err != nil {
+		log.Printf("Failed to write the LLM response cache: %v request_id=%s", err, requestIDFromContext(ctx))
+	}
+}
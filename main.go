@@ -1,76 +1,1168 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
-// Configuration variables
+// config holds the settings, read by loadConfig, and the state derived
+// from them by apply. A configuration in use is never changed: reloading
+// the config file validates a new one and replaces the current one, which
+// cfg returns, as a whole.
+type config struct {
+	whisperURL     string // comma-separated list of backends
+	whisperRouting string // round_robin or least_loaded
+	ollamaURL      string // comma-separated list of hosts
+	ollamaRouting  string // round_robin or least_loaded
+	maxConcurrent  int
+	serverPort     string
+	grpcPort       string // empty disables the gRPC API
+	requestTimeout int    // seconds
+
+	// Model and prompt used when the client doesn't send one
+	defaultModel  string
+	defaultPrompt string
+
+	// Serve HTTPS with this certificate and key, optionally verifying
+	// client certificates against TLS_CLIENT_CA_FILE
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCAFile string
+	tlsClientAuth   string
+
+	// Extra CAs trusted for upstream calls and the client certificate
+	// presented to upstreams that ask for one
+	upstreamCAFile   string
+	upstreamCertFile string
+	upstreamKeyFile  string
+
+	// Fraction of MAX_CONCURRENT_REQUESTS reserved for high-priority requests
+	priorityReservedFraction float64
+
+	// Upper bound for the n form field and sampling temperature used when
+	// generating multiple candidates
+	maxCandidates        int
+	candidateTemperature float64
+
+	// Opt-in RMS silence detection for WAV uploads
+	detectSilence    bool
+	silenceThreshold float64
+
+	// Voice activity detection that cuts silence out of WAV uploads: the
+	// level speech must reach, the shortest speech kept, and the silence
+	// kept around it
+	vadEnabled     bool
+	vadThreshold   float64 // dBFS
+	vadMinSpeechMs int
+	vadPaddingMs   int
+
+	// Comma-separated list of accepted audio formats
+	allowedAudioFormats string
+
+	// Background upstream pinger, disabled when the interval is 0
+	keepaliveInterval int // seconds
+	keepaliveModel    string
+
+	// Retry-After sent when an overloaded upstream doesn't provide one
+	defaultRetryAfter int // seconds
+
+	// Size MAX_CONCURRENT_REQUESTS from available memory and CPU at startup
+	autoConcurrency   bool
+	requestMemoryMB   int
+	concurrencyPerCPU int
+
+	// Header used to forward the request ID to Whisper and Ollama
+	requestIDHeader string
+
+	// Circuit breaker for Ollama and whether to return the transcription
+	// alone while it is open
+	breakerThreshold       int
+	breakerCooldown        int // seconds
+	degradeToTranscription bool
+
+	// JSON key naming of responses: snake (default) or camel
+	responseKeyStyle string
+
+	// Bearer token for /admin endpoints, which are disabled when empty
+	adminToken string
+
+	// Client API keys as name=key pairs, requests per minute and default
+	// model by key name, and the file keys created through /admin/keys are
+	// saved in. Any of the keys is required on the data endpoints once one
+	// is set.
+	apiKeysConfig    string
+	apiKeyRateLimits string
+	apiKeyModels     string
+	apiKeysFile      string
+
+	// Accept JWTs signed by the keys of an OIDC issuer (found through its
+	// discovery document) or of a JWKS URL, optionally for one audience.
+	// The tenant claim names the client for quotas and logs.
+	oidcIssuer     string
+	jwksURL        string
+	jwtAudience    string
+	jwtTenantClaim string
+	jwtLeeway      int // seconds of clock skew allowed
+	jwksRefresh    int // seconds
+
+	// Add a warning to responses whose generation hit the token limit
+	warnOnTruncation bool
+
+	// Ask the ASR backend for word timings on /process unless the request
+	// sets word_timestamps
+	wordTimestamps bool
+
+	// Estimates reported by /inspect
+	whisperSecondsPerAudioSecond float64
+	costPerAudioMinute           float64
+
+	// Pipe uploads straight into the Whisper request instead of buffering
+	// them to a temp file, when no enabled feature needs the file on disk
+	streamUploads bool
+
+	// Convert uploads with ffmpeg before transcription: off, auto for
+	// containers the ASR backends may not read, or always
+	transcodeMode    string
+	ffmpegPath       string
+	transcodeTimeout int // seconds
+
+	// Transcribe WAV recordings longer than this many seconds in chunks
+	// that overlap by AUDIO_CHUNK_OVERLAP_SECONDS, up to
+	// AUDIO_CHUNK_CONCURRENCY at a time; 0 sends them whole
+	audioChunkSeconds     int
+	audioChunkOverlap     int // seconds
+	audioChunkConcurrency int
+
+	// Let requests send an audio_url on these hosts instead of uploading
+	// the audio, downloading at most AUDIO_URL_MAX_MB within
+	// AUDIO_URL_TIMEOUT and following AUDIO_URL_MAX_REDIRECTS redirects
+	audioURLHosts        string
+	audioURLMaxMB        int
+	audioURLTimeout      int // seconds
+	audioURLMaxRedirects int
+
+	// S3 or MinIO: the endpoint, empty for AWS, and its credentials, empty
+	// for anonymous access. audio_url may name s3:// objects in
+	// S3_INPUT_BUCKETS, and results are written to S3_OUTPUT_BUCKET under
+	// the S3_OUTPUT_PREFIX template.
+	s3EndpointURL     string
+	s3Region          string
+	s3AccessKeyID     string
+	s3SecretAccessKey string
+	s3SessionToken    string
+	s3PathStyle       bool
+	s3InputBuckets    string
+	s3OutputBucket    string
+	s3OutputPrefix    string
+
+	// Comma-separated CIDRs of proxies whose forwarding headers are trusted
+	trustedProxies string
+
+	// Extra attempts of the whole pipeline after a retryable failure
+	pipelineRetries int
+
+	// Retries of single upstream calls after a retryable failure
+	whisperRetries    int
+	llmRetries        int
+	retryBackoffMS    int
+	retryMaxBackoffMS int
+	retryJitter       float64 // fraction of the backoff added or taken off at random
+	retryOnStatus     string
+
+	// Concurrent generations allowed on the primary Ollama (0 = unlimited)
+	// and the slower backend that takes the overflow
+	ollamaMaxConcurrent int
+	spilloverOllamaURL  string
+	modelWeights        string
+
+	// Summarize transcriptions longer than the chunk size piecewise
+	// before the LLM step instead of overflowing the context
+	autoSummarizeLong    bool
+	summarizeChunkTokens int
+
+	// Paths left out of the access log, e.g. health probes
+	logExcludePaths string
+
+	// Mask emails, phone numbers etc. in transcriptions
+	redactPIIEnabled  bool
+	piiPatternsConfig string
+	redactPIIDebug    bool
+
+	// Live transcription: window length, windows allowed to queue for
+	// Whisper, and the longest session in seconds
+	liveWindowSeconds int
+	liveMaxPending    int
+	liveMaxDuration   int
+
+	// Browser origins allowed to open /ws/stream besides the server's own
+	wsAllowedOriginsConfig string
+
+	// Model used per detected language when the client doesn't pick one
+	languageModelsConfig string
+
+	// Model aliases as alias=model pairs, and the models requests may use,
+	// any when empty
+	modelAliasesConfig  string
+	allowedModelsConfig string
+
+	// Pull models Ollama doesn't have on their first use
+	autoPullModels bool
+
+	// Directory of the named prompt templates selected with template
+	promptTemplatesDir string
+
+	// YAML file of the multi-step pipelines selected with pipeline
+	pipelinesFile string
+
+	// Times a reply that doesn't match the request's schema is sent back
+	// for repair
+	schemaMaxRetries int
+
+	// Queue requests for a free slot, sharing slots fairly between clients
+	fairQueuing         bool
+	queueTimeout        int
+	queueMaxWaiting     int
+	clientWeightsConfig string
+
+	// Queue requests in arrival order when the server is full, without
+	// FAIR_QUEUING: how many may wait (0 = reject at once) and for how
+	// many seconds
+	maxQueueDepth int
+	maxQueueWait  int
+
+	// Requests per minute each client may make (0 = unlimited), the
+	// bucket size for bursts (0 = the per-minute limit) and per-route
+	// limits
+	rateLimitPerMinute int
+	rateLimitBurst     int
+	rateLimitRoutes    string
+
+	// Inject random faults into /process for resilience testing. Needs
+	// CHAOS_CONFIRM=inject-failures to start.
+	chaosMode        bool
+	chaosConfirm     string
+	chaosErrorRate   float64
+	chaosLatencyRate float64
+	chaosMaxLatency  int
+	chaosCorruptRate float64
+
+	// Let admin-authenticated requests pick the upstreams with
+	// X-Whisper-URL / X-Ollama-URL, limited to these hosts
+	allowURLOverride bool
+	urlOverrideHosts string
+
+	// Returned by /process and /readyz while Ollama has no models pulled
+	noModelsMessage string
+
+	// Async jobs: workers, queued jobs, time limit per job, jobs kept,
+	// and seconds completed, failed and queued jobs are kept
+	jobWorkers      int
+	jobQueueSize    int
+	jobTimeout      int
+	jobMaxStored    int
+	jobTTLCompleted int
+	jobTTLFailed    int
+	jobTTLQueued    int
+
+	// Batches: files per batch, files processed at once, and MB of audio
+	// extracted from zip archives
+	maxBatchSize     int
+	batchConcurrency int
+	batchMaxZipMB    int
+
+	// Hot folders: directories watched for audio files, where their
+	// outputs go (next to them when empty), the outputs written, the
+	// /process fields they are processed with and seconds between scans
+	watchDirs          string
+	watchOutputDir     string
+	watchOutputFormats string
+	watchParams        string
+	watchInterval      int
+
+	// Kafka: brokers (empty disables the consumer), the topics audio is
+	// read from and results are published to, the consumer group, and
+	// where a group without committed offsets starts (earliest or latest)
+	kafkaBrokers     string
+	kafkaInputTopic  string
+	kafkaOutputTopic string
+	kafkaGroupID     string
+	kafkaStartOffset string
+
+	// NATS: server (empty disables the service), the subject requests are
+	// taken from, the queue group the bridges share, the JetStream stream
+	// and durable consumer messages are pulled from instead (empty for
+	// request/reply), the subject results go to when a message doesn't
+	// name one, and messages processed at once
+	natsURL           string
+	natsSubject       string
+	natsQueue         string
+	natsStream        string
+	natsConsumer      string
+	natsResultSubject string
+	natsWorkers       int
+
+	// Conversation sessions: where they are kept (memory or redis), the
+	// Redis server, seconds an idle session is kept, exchanges sent to the
+	// LLM as history and sessions kept in memory
+	sessionStoreKind string
+	redisURL         string
+	sessionTTL       int
+	sessionMaxTurns  int
+	sessionMaxStored int
+
+	// Transcription cache: where transcriptions are kept (off, memory or
+	// redis, at REDIS_URL), seconds they are kept, and entries kept in
+	// memory
+	transcriptionCacheKind       string
+	transcriptionCacheTTL        int
+	transcriptionCacheMaxEntries int
+
+	// LLM response cache: where responses are kept (off, memory or redis,
+	// at REDIS_URL), seconds they are kept, and entries kept in memory
+	llmCacheKind       string
+	llmCacheTTL        int
+	llmCacheMaxEntries int
+
+	// Result history: where the results of /process and /jobs requests
+	// are kept (off, file or postgres), the JSON Lines file and the
+	// Postgres database
+	resultsStoreKind   string
+	resultsFile        string
+	resultsDatabaseURL string
+
+	// Text-to-speech stage: backend (piper, coqui or openai) and its URL,
+	// empty to disable it, the default voice, the model and key of
+	// OpenAI-compatible APIs, the longest text spoken, and how long and
+	// how many synthesized files are kept for download
+	ttsBackend      string
+	ttsURL          string
+	ttsVoice        string
+	ttsModel        string
+	ttsAPIKey       string
+	ttsMaxChars     int
+	speechTTL       int
+	speechMaxStored int
+
+	// ASR backend: whisper-asr, whisper-cpp and faster-whisper servers
+	// run at WHISPER_URL, Deepgram is hosted. ASR_MODEL is the model asked
+	// of backends that serve several.
+	asrBackend     string
+	asrModel       string
+	deepgramAPIKey string
+	deepgramURL    string
+
+	// Speaker diarization sidecar (pyannote, diart or compatible), empty
+	// to leave diarization to ASR backends that support it
+	diarizationURL string
+
+	// LLM provider used unless a request picks another one, and the
+	// settings of the hosted providers, each enabled by its key or URL
+	llmProvider        string
+	openAIAPIKey       string
+	openAIBaseURL      string
+	openAIModel        string
+	anthropicAPIKey    string
+	anthropicBaseURL   string
+	anthropicModel     string
+	anthropicMaxTokens int
+	vllmURL            string
+	vllmAPIKey         string
+	vllmModel          string
+
+	// OpenTelemetry tracing, enabled by an OTLP/HTTP endpoint. Traces are
+	// sampled at OTEL_TRACES_SAMPLER_ARG unless the caller decided.
+	otlpEndpoint     string
+	otlpTracesURL    string
+	otlpHeaders      string
+	otelServiceName  string
+	traceSampleRatio float64
+
+	// Serve Prometheus metrics on /metrics
+	metricsEnabled bool
+
+	// Seconds an upload may go without receiving data (0 = no limit)
+	uploadIdleTimeout int
+
+	// Largest request body an upload endpoint accepts (0 = no limit)
+	maxUploadBytes int
+
+	// Readiness probes of the upstreams: timeout and how long a result is
+	// reused, in seconds
+	readyzTimeout      int
+	readyzCacheSeconds int
+
+	// Seconds to let requests in flight finish on SIGTERM or SIGINT
+	shutdownTimeout int
+
+	// Append a JSON event per completed /process request to this file
+	traceFile       string
+	traceMaxSizeMB  int
+	traceMaxBackups int
+
+	// State derived from the settings by apply
+
+	// Parsed TRUSTED_PROXIES
+	trustedProxyNets []netip.Prefix
+
+	// Per-model slot weights parsed from OLLAMA_MODEL_WEIGHTS
+	ollamaModelWeights map[string]int
+
+	// Per-client weights parsed from CLIENT_WEIGHTS
+	clientWeights map[string]int
+
+	// Statuses of RETRY_ON_STATUS
+	retryStatuses map[int]bool
+
+	// Per-route limits parsed from RATE_LIMIT_ROUTES
+	routeRateLimits map[string]int
+
+	// Preferred LLM per detected language, parsed from LANGUAGE_MODELS
+	languageModels map[string]string
+
+	// Model aliases and allowlist
+	modelRules *modelPolicy
+
+	// Prompt templates by name, loaded from PROMPT_TEMPLATES_DIR, and
+	// pipelines by name, loaded from PIPELINES_FILE
+	promptTemplates map[string]*template.Template
+	llmPipelines    map[string]*llmPipeline
+
+	// Patterns selected by REDACT_PII_PATTERNS
+	piiPatterns []piiPattern
+
+	// The paths from LOG_EXCLUDE_PATHS, whose requests aren't logged
+	logExcluded map[string]bool
+
+	// Origins allowed to open /ws/stream, parsed from WS_ALLOWED_ORIGINS
+	wsAllowedOrigins map[string]bool
+
+	// ASR backend chosen with ASR_BACKEND, and TTS backend chosen with
+	// TTS_BACKEND, nil unless TTS_URL is set
+	transcriber Transcriber
+	synthesizer Synthesizer
+
+	// Configured LLM providers by name, and the one used when a request
+	// doesn't choose
+	llmProviders map[string]LLMProvider
+	defaultLLM   LLMProvider
+}
+
+// The configuration in use, set by apply
+var currentConfig atomic.Pointer[config]
+
+// cfg returns the configuration in use. Code that reads several settings
+// which must agree should call it once and keep the result.
+func cfg() *config {
+	return currentConfig.Load()
+}
+
+// Slot pool for limiting concurrent requests
+var slots *slotPool
+
+// Circuit breakers guarding Ollama and the ASR backend
 var (
-	whisperURL     = getEnv("WHISPER_URL", "http://whisper:9000")
-	ollamaURL      = getEnv("OLLAMA_URL", "http://ollama:11434")
-	maxConcurrent  = getEnvAsInt("MAX_CONCURRENT_REQUESTS", 50)
-	serverPort     = getEnv("SERVER_PORT", "8080")
-	requestTimeout = getEnvAsInt("REQUEST_TIMEOUT", 300) // seconds
+	ollamaBreaker  *circuitBreaker
+	whisperBreaker *circuitBreaker
 )
 
-// Semaphore for limiting concurrent requests
-var semaphore chan struct{}
-
 // Response structures
 type WhisperResponse struct {
-	Text     string `json:"text"`
-	Segments []any  `json:"segments"`
-	Language string `json:"language"`
+	Text     string    `json:"text"`
+	Segments []Segment `json:"segments"`
+	Language string    `json:"language"`
+
+	// Probability of the detected language, for backends that report it
+	LanguageProbability *float64 `json:"language_probability"`
+
+	// Reported by some ASR backends, either in the body or in headers
+	Model   string `json:"model"`
+	Version string `json:"version"`
+
+	// Chunks is the number of pieces long audio was transcribed in
+	Chunks int `json:"-"`
 }
 
 type OllamaRequest struct {
-	Model  string `json:"model"`
-	Prompt string `json:"prompt"`
-	Stream bool   `json:"stream"`
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	System  string         `json:"system,omitempty"`
+	Format  any            `json:"format,omitempty"` // JSON Schema of the reply
+	Stream  bool           `json:"stream"`
+	Options map[string]any `json:"options,omitempty"`
 }
 
 type OllamaResponse struct {
-	Model    string `json:"model"`
-	Response string `json:"response"`
-	Finished bool   `json:"done"`
+	Model           string `json:"model"`
+	Response        string `json:"response"`
+	Finished        bool   `json:"done"`
+	DoneReason      string `json:"done_reason"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	EvalDuration    int64  `json:"eval_duration"` // nanoseconds
+
+	// Set when the generation ran on the spillover backend
+	Spillover bool `json:"-"`
+
+	// Set when the response came from the LLM response cache
+	Cached bool `json:"-"`
+}
+
+// OllamaChatMessage is one turn of an Ollama /api/chat conversation
+type OllamaChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type OllamaChatRequest struct {
+	Model    string              `json:"model"`
+	Messages []OllamaChatMessage `json:"messages"`
+	Format   any                 `json:"format,omitempty"`
+	Stream   bool                `json:"stream"`
+	Options  map[string]any      `json:"options,omitempty"`
+}
+
+type OllamaChatResponse struct {
+	Model           string            `json:"model"`
+	Message         OllamaChatMessage `json:"message"`
+	Finished        bool              `json:"done"`
+	DoneReason      string            `json:"done_reason"`
+	PromptEvalCount int               `json:"prompt_eval_count"`
+	EvalCount       int               `json:"eval_count"`
+	EvalDuration    int64             `json:"eval_duration"` // nanoseconds
 }
 
 type CombinedResponse struct {
-	Transcription string `json:"transcription"`
-	Response      string `json:"response"`
-	ProcessTime   int64  `json:"process_time_ms"`
-	Model         string `json:"model"`
+	Transcription string      `json:"transcription"`
+	Response      string      `json:"response"`
+	ProcessTime   int64       `json:"process_time_ms"`
+	Model         string      `json:"model"`
+	Candidates    []Candidate `json:"candidates,omitempty"`
+
+	// Number of PII matches masked by REDACT_PII, and the original text
+	// when REDACT_PII_DEBUG is on
+	PIIRedactions           int    `json:"pii_redactions,omitempty"`
+	UnredactedTranscription string `json:"unredacted_transcription,omitempty"`
+
+	// Chunks of a long transcription summarized before the LLM step
+	SummarizedChunks int `json:"summarized_chunks,omitempty"`
+
+	// Chunks a long recording was transcribed in
+	TranscriptionChunks int `json:"transcription_chunks,omitempty"`
+
+	// Set when the transcription came from the transcription cache, and
+	// the LLM's answer from the LLM response cache
+	TranscriptionCached bool `json:"transcription_cached,omitempty"`
+	LLMCached           bool `json:"llm_cached,omitempty"`
+
+	// Seconds of silence VAD cut from the audio before transcription
+	SilenceRemoved float64 `json:"silence_removed_seconds,omitempty"`
+
+	// Set when the model was chosen from LANGUAGE_MODELS
+	ModelAutoSelected bool `json:"model_auto_selected,omitempty"`
+
+	// Set when the speech was translated to English with task=translate
+	Translated bool `json:"translated,omitempty"`
+
+	// The reply as JSON when it matches the request's schema, the attempts
+	// it took, and what was wrong with the last attempt when none matched
+	Structured     json.RawMessage `json:"structured,omitempty"`
+	SchemaAttempts int             `json:"schema_attempts,omitempty"`
+	SchemaErrors   []string        `json:"schema_errors,omitempty"`
+
+	// The session the request continued, and the earlier exchanges the
+	// LLM got as history
+	SessionID    string `json:"session_id,omitempty"`
+	SessionTurns int    `json:"session_turns,omitempty"`
+
+	// The spoken answer of tts requests: where to download it, its format
+	// and synthesis time, or why it couldn't be synthesized
+	SpeechURL    string `json:"speech_url,omitempty"`
+	SpeechFormat string `json:"speech_format,omitempty"`
+	SpeechTime   int64  `json:"speech_time_ms,omitempty"`
+	SpeechError  string `json:"speech_error,omitempty"`
+
+	// Where S3_OUTPUT_BUCKET got the transcript and answer
+	OutputLocation string `json:"output_location,omitempty"`
+
+	// The transcription as "SPEAKER: text" lines, as the LLM got it, and
+	// the number of speakers, for diarize requests
+	SpeakerTranscription string `json:"speaker_transcription,omitempty"`
+	Speakers             int    `json:"speakers,omitempty"`
+
+	// Name and steps of the pipeline run instead of the single LLM step
+	Pipeline string       `json:"pipeline,omitempty"`
+	Steps    []StepResult `json:"steps,omitempty"`
+
+	// The LLM's translation of the transcription with translate_to, which
+	// the LLM step worked on
+	Translation  string `json:"translation,omitempty"`
+	TranslatedTo string `json:"translated_to,omitempty"`
+
+	// Language of the audio, as given by the client or detected with the
+	// backend's confidence in it
+	Language           string   `json:"language,omitempty"`
+	LanguageDetected   bool     `json:"language_detected,omitempty"`
+	LanguageConfidence *float64 `json:"language_confidence,omitempty"`
+
+	// Set when clean_transcription is applied
+	RawTranscription string `json:"raw_transcription,omitempty"`
+
+	// Set when the LLM step was skipped and only the transcription is
+	// returned
+	LLMSkipped       bool   `json:"llm_skipped,omitempty"`
+	LLMSkippedReason string `json:"llm_skipped_reason,omitempty"`
+
+	// ASR model and version, when the backend reports them
+	WhisperModel   string `json:"whisper_model,omitempty"`
+	WhisperVersion string `json:"whisper_version,omitempty"`
+
+	// Set when the LLM step overflowed to the spillover backend
+	Spillover bool `json:"spillover,omitempty"`
+
+	// Why generation ended (e.g. stop, length) and a hint when the output
+	// was cut off
+	DoneReason string `json:"done_reason,omitempty"`
+	Warning    string `json:"warning,omitempty"`
+
+	// Length of the uploaded audio and audio seconds processed per second
+	// of processing time, when the duration can be read from the file
+	AudioDuration  float64 `json:"audio_duration_seconds,omitempty"`
+	RealtimeFactor float64 `json:"realtime_factor,omitempty"`
+
+	// Heuristic token count of the assembled prompt, set instead of a
+	// response when estimate_tokens is requested
+	EstimatedPromptTokens int `json:"estimated_prompt_tokens,omitempty"`
+}
+
+// loadConfig reads the settings into a new configuration. Each comes from
+// its environment variable, else from the config file, else from its
+// default.
+func loadConfig() *config {
+	c := &config{}
+	c.whisperURL = getEnv("WHISPER_URL", "http://whisper:9000")
+	c.whisperRouting = getEnv("WHISPER_ROUTING", routingRoundRobin)
+	c.ollamaURL = getEnv("OLLAMA_URL", "http://ollama:11434")
+	c.ollamaRouting = getEnv("OLLAMA_ROUTING", routingRoundRobin)
+	c.maxConcurrent = getEnvAsInt("MAX_CONCURRENT_REQUESTS", 50)
+	c.serverPort = getEnv("SERVER_PORT", "8080")
+	c.grpcPort = getEnv("GRPC_PORT", "")
+	c.requestTimeout = getEnvAsInt("REQUEST_TIMEOUT", 300)
+
+	c.tlsCertFile = getEnv("TLS_CERT_FILE", "")
+	c.tlsKeyFile = getEnv("TLS_KEY_FILE", "")
+	c.tlsClientCAFile = getEnv("TLS_CLIENT_CA_FILE", "")
+	c.tlsClientAuth = getEnv("TLS_CLIENT_AUTH", clientAuthRequire)
+	c.upstreamCAFile = getEnv("UPSTREAM_TLS_CA_FILE", "")
+	c.upstreamCertFile = getEnv("UPSTREAM_TLS_CERT_FILE", "")
+	c.upstreamKeyFile = getEnv("UPSTREAM_TLS_KEY_FILE", "")
+
+	c.defaultModel = getEnv("OLLAMA_MODEL", "llama3")
+	c.defaultPrompt = getEnv("DEFAULT_PROMPT", "Process this transcription:")
+	c.promptTemplatesDir = getEnv("PROMPT_TEMPLATES_DIR", "")
+	c.pipelinesFile = getEnv("PIPELINES_FILE", "")
+	c.schemaMaxRetries = getEnvAsInt("SCHEMA_MAX_RETRIES", 2)
+
+	c.priorityReservedFraction = getEnvAsFloat("PRIORITY_RESERVED_FRACTION", 0)
+
+	c.maxCandidates = getEnvAsInt("MAX_CANDIDATES", 5)
+	c.candidateTemperature = getEnvAsFloat("CANDIDATE_TEMPERATURE", 0.8)
+
+	c.detectSilence = getEnvAsBool("DETECT_SILENCE", false)
+	c.silenceThreshold = getEnvAsFloat("SILENCE_THRESHOLD_DBFS", -60)
+	c.vadEnabled = getEnvAsBool("VAD_ENABLED", false)
+	c.vadThreshold = getEnvAsFloat("VAD_THRESHOLD_DBFS", -45)
+	c.vadMinSpeechMs = getEnvAsInt("VAD_MIN_SPEECH_MS", 250)
+	c.vadPaddingMs = getEnvAsInt("VAD_PADDING_MS", 200)
+
+	c.allowedAudioFormats = getEnv("ALLOWED_AUDIO_FORMATS", "wav,mp3,ogg,flac,m4a,webm")
+
+	c.keepaliveInterval = getEnvAsInt("KEEPALIVE_INTERVAL", 0)
+	c.keepaliveModel = getEnv("KEEPALIVE_MODEL", "")
+
+	c.defaultRetryAfter = getEnvAsInt("DEFAULT_RETRY_AFTER", 5)
+
+	c.autoConcurrency = getEnvAsBool("AUTO_CONCURRENCY", false)
+	c.requestMemoryMB = getEnvAsInt("REQUEST_MEMORY_MB", 64)
+	c.concurrencyPerCPU = getEnvAsInt("CONCURRENCY_PER_CPU", 8)
+
+	c.requestIDHeader = getEnv("REQUEST_ID_HEADER", "X-Request-ID")
+
+	c.breakerThreshold = getEnvAsInt("BREAKER_FAILURE_THRESHOLD", 5)
+	c.breakerCooldown = getEnvAsInt("BREAKER_COOLDOWN", 30)
+	c.degradeToTranscription = getEnvAsBool("DEGRADE_TO_TRANSCRIPTION", false)
+
+	c.responseKeyStyle = getEnv("RESPONSE_KEY_STYLE", keyStyleSnake)
+
+	c.adminToken = getEnv("ADMIN_TOKEN", "")
+	c.apiKeysConfig = getEnv("API_KEYS", "")
+	c.apiKeyRateLimits = getEnv("API_KEY_RATE_LIMITS", "")
+	c.apiKeyModels = getEnv("API_KEY_MODELS", "")
+	c.apiKeysFile = getEnv("API_KEYS_FILE", "")
+	c.oidcIssuer = getEnv("OIDC_ISSUER", "")
+	c.jwksURL = getEnv("JWKS_URL", "")
+	c.jwtAudience = getEnv("JWT_AUDIENCE", "")
+	c.jwtTenantClaim = getEnv("JWT_TENANT_CLAIM", "tenant")
+	c.jwtLeeway = getEnvAsInt("JWT_LEEWAY", 60)
+	c.jwksRefresh = getEnvAsInt("JWKS_REFRESH", 3600)
+
+	c.warnOnTruncation = getEnvAsBool("WARN_ON_TRUNCATION", true)
+	c.wordTimestamps = getEnvAsBool("WORD_TIMESTAMPS", false)
+
+	c.whisperSecondsPerAudioSecond = getEnvAsFloat("WHISPER_SECONDS_PER_AUDIO_SECOND", 0.1)
+	c.costPerAudioMinute = getEnvAsFloat("COST_PER_AUDIO_MINUTE", 0)
+
+	c.streamUploads = getEnvAsBool("STREAM_UPLOADS", false)
+
+	c.transcodeMode = strings.ToLower(getEnv("TRANSCODE_AUDIO", transcodeOff))
+	c.ffmpegPath = getEnv("FFMPEG_PATH", "ffmpeg")
+	c.transcodeTimeout = getEnvAsInt("TRANSCODE_TIMEOUT", 120)
+
+	c.audioChunkSeconds = getEnvAsInt("AUDIO_CHUNK_SECONDS", 0)
+	c.audioChunkOverlap = getEnvAsInt("AUDIO_CHUNK_OVERLAP_SECONDS", 5)
+	c.audioChunkConcurrency = getEnvAsInt("AUDIO_CHUNK_CONCURRENCY", 4)
+
+	c.audioURLHosts = getEnv("AUDIO_URL_HOSTS", "")
+	c.audioURLMaxMB = getEnvAsInt("AUDIO_URL_MAX_MB", 100)
+	c.audioURLTimeout = getEnvAsInt("AUDIO_URL_TIMEOUT", 60)
+	c.audioURLMaxRedirects = getEnvAsInt("AUDIO_URL_MAX_REDIRECTS", 3)
+
+	c.s3EndpointURL = getEnv("S3_ENDPOINT", "")
+	c.s3Region = getEnv("S3_REGION", "us-east-1")
+	c.s3AccessKeyID = getEnv("S3_ACCESS_KEY_ID", "")
+	c.s3SecretAccessKey = getEnv("S3_SECRET_ACCESS_KEY", "")
+	c.s3SessionToken = getEnv("S3_SESSION_TOKEN", "")
+	c.s3PathStyle = getEnvAsBool("S3_PATH_STYLE", false)
+	c.s3InputBuckets = getEnv("S3_INPUT_BUCKETS", "")
+	c.s3OutputBucket = getEnv("S3_OUTPUT_BUCKET", "")
+	c.s3OutputPrefix = getEnv("S3_OUTPUT_PREFIX", "{{.Date}}/{{.ID}}")
+
+	c.trustedProxies = getEnv("TRUSTED_PROXIES", "")
+
+	c.pipelineRetries = getEnvAsInt("PIPELINE_RETRIES", 0)
+
+	c.whisperRetries = getEnvAsInt("WHISPER_RETRIES", 2)
+	c.llmRetries = getEnvAsInt("LLM_RETRIES", 2)
+	c.retryBackoffMS = getEnvAsInt("RETRY_BACKOFF_MS", 500)
+	c.retryMaxBackoffMS = getEnvAsInt("RETRY_MAX_BACKOFF_MS", 10000)
+	c.retryJitter = getEnvAsFloat("RETRY_JITTER", 0.2)
+	c.retryOnStatus = getEnv("RETRY_ON_STATUS", "502,503,504")
+
+	c.ollamaMaxConcurrent = getEnvAsInt("OLLAMA_MAX_CONCURRENT", 0)
+	c.spilloverOllamaURL = getEnv("SPILLOVER_OLLAMA_URL", "")
+	c.modelWeights = getEnv("OLLAMA_MODEL_WEIGHTS", "")
+
+	c.autoSummarizeLong = getEnvAsBool("AUTO_SUMMARIZE_LONG", false)
+	c.summarizeChunkTokens = getEnvAsInt("SUMMARIZE_CHUNK_TOKENS", 3000)
+
+	c.logExcludePaths = getEnv("LOG_EXCLUDE_PATHS", "/health,/healthz,/livez")
+
+	c.redactPIIEnabled = getEnvAsBool("REDACT_PII", false)
+	c.piiPatternsConfig = getEnv("REDACT_PII_PATTERNS", "all")
+	c.redactPIIDebug = getEnvAsBool("REDACT_PII_DEBUG", false)
+
+	c.liveWindowSeconds = getEnvAsInt("LIVE_WINDOW_SECONDS", 5)
+	c.liveMaxPending = getEnvAsInt("LIVE_MAX_PENDING", 2)
+	c.liveMaxDuration = getEnvAsInt("LIVE_MAX_DURATION", 3600)
+
+	c.wsAllowedOriginsConfig = getEnv("WS_ALLOWED_ORIGINS", "")
+
+	c.languageModelsConfig = getEnv("LANGUAGE_MODELS", "")
+	c.modelAliasesConfig = getEnv("MODEL_ALIASES", "")
+	c.allowedModelsConfig = getEnv("ALLOWED_MODELS", "")
+	c.autoPullModels = getEnvAsBool("AUTO_PULL_MODELS", false)
+
+	c.fairQueuing = getEnvAsBool("FAIR_QUEUING", false)
+	c.queueTimeout = getEnvAsInt("QUEUE_TIMEOUT", 30)
+	c.queueMaxWaiting = getEnvAsInt("QUEUE_MAX_WAITING", 100)
+	c.maxQueueDepth = getEnvAsInt("MAX_QUEUE_DEPTH", 0)
+	c.maxQueueWait = getEnvAsInt("MAX_QUEUE_WAIT", 30)
+
+	c.rateLimitPerMinute = getEnvAsInt("RATE_LIMIT_PER_MINUTE", 0)
+	c.rateLimitBurst = getEnvAsInt("RATE_LIMIT_BURST", 0)
+	c.rateLimitRoutes = getEnv("RATE_LIMIT_ROUTES", "")
+	c.clientWeightsConfig = getEnv("CLIENT_WEIGHTS", "")
+
+	c.chaosMode = getEnvAsBool("CHAOS_MODE", false)
+	c.chaosConfirm = getEnv("CHAOS_CONFIRM", "")
+	c.chaosErrorRate = getEnvAsFloat("CHAOS_ERROR_RATE", 0.1)
+	c.chaosLatencyRate = getEnvAsFloat("CHAOS_LATENCY_RATE", 0.1)
+	c.chaosMaxLatency = getEnvAsInt("CHAOS_MAX_LATENCY_MS", 5000)
+	c.chaosCorruptRate = getEnvAsFloat("CHAOS_CORRUPT_RATE", 0.05)
+
+	c.allowURLOverride = getEnvAsBool("ALLOW_URL_OVERRIDE", false)
+	c.urlOverrideHosts = getEnv("URL_OVERRIDE_HOSTS", "")
+
+	c.noModelsMessage = getEnv("NO_MODELS_MESSAGE", "no models available, pull a model first")
+
+	c.jobWorkers = getEnvAsInt("JOB_WORKERS", 2)
+	c.jobQueueSize = getEnvAsInt("JOB_QUEUE_SIZE", 100)
+	c.jobTimeout = getEnvAsInt("JOB_TIMEOUT", 3600)
+	c.jobMaxStored = getEnvAsInt("JOB_MAX_STORED", 1000)
+	c.jobTTLCompleted = getEnvAsInt("JOB_TTL_COMPLETED", 3600)
+	c.jobTTLFailed = getEnvAsInt("JOB_TTL_FAILED", 3600)
+	c.jobTTLQueued = getEnvAsInt("JOB_TTL_QUEUED", 3600)
+
+	// BATCH_MAX_FILES is the setting's earlier name
+	c.maxBatchSize = getEnvAsInt("MAX_BATCH_SIZE", getEnvAsInt("BATCH_MAX_FILES", 50))
+	c.batchConcurrency = getEnvAsInt("BATCH_CONCURRENCY", 4)
+	c.batchMaxZipMB = getEnvAsInt("BATCH_MAX_ZIP_MB", 1024)
+
+	c.watchDirs = getEnv("WATCH_DIRS", "")
+	c.watchOutputDir = getEnv("WATCH_OUTPUT_DIR", "")
+	c.watchOutputFormats = getEnv("WATCH_OUTPUTS", watchOutputJSON)
+	c.watchParams = getEnv("WATCH_PARAMS", "")
+	c.watchInterval = getEnvAsInt("WATCH_INTERVAL", 5)
+
+	c.kafkaBrokers = getEnv("KAFKA_BROKERS", "")
+	c.kafkaInputTopic = getEnv("KAFKA_INPUT_TOPIC", "")
+	c.kafkaOutputTopic = getEnv("KAFKA_OUTPUT_TOPIC", "")
+	c.kafkaGroupID = getEnv("KAFKA_GROUP_ID", "whisper-llm-bridge")
+	c.kafkaStartOffset = getEnv("KAFKA_START_OFFSET", kafkaStartEarliest)
+
+	c.natsURL = getEnv("NATS_URL", "")
+	c.natsSubject = getEnv("NATS_SUBJECT", "whisper.process")
+	c.natsQueue = getEnv("NATS_QUEUE", "whisper-llm-bridge")
+	c.natsStream = getEnv("NATS_STREAM", "")
+	c.natsConsumer = getEnv("NATS_CONSUMER", "whisper-llm-bridge")
+	c.natsResultSubject = getEnv("NATS_RESULT_SUBJECT", "")
+	c.natsWorkers = getEnvAsInt("NATS_WORKERS", 4)
+
+	c.sessionStoreKind = getEnv("SESSION_STORE", sessionStoreMemory)
+	c.redisURL = getEnv("REDIS_URL", "redis://localhost:6379")
+	c.sessionTTL = getEnvAsInt("SESSION_TTL", 1800)
+	c.sessionMaxTurns = getEnvAsInt("SESSION_MAX_TURNS", 10)
+	c.sessionMaxStored = getEnvAsInt("SESSION_MAX_STORED", 10000)
+
+	c.transcriptionCacheKind = getEnv("TRANSCRIPTION_CACHE", cacheOff)
+	c.transcriptionCacheTTL = getEnvAsInt("TRANSCRIPTION_CACHE_TTL", 86400)
+	c.transcriptionCacheMaxEntries = getEnvAsInt("TRANSCRIPTION_CACHE_MAX_ENTRIES", 1000)
+
+	c.llmCacheKind = getEnv("LLM_CACHE", cacheOff)
+	c.llmCacheTTL = getEnvAsInt("LLM_CACHE_TTL", 3600)
+	c.llmCacheMaxEntries = getEnvAsInt("LLM_CACHE_MAX_ENTRIES", 1000)
+
+	c.resultsStoreKind = getEnv("RESULTS_STORE", resultsStoreOff)
+	c.resultsFile = getEnv("RESULTS_FILE", "results.jsonl")
+	c.resultsDatabaseURL = getEnv("RESULTS_DATABASE_URL", "")
+
+	c.ttsBackend = getEnv("TTS_BACKEND", ttsPiper)
+	c.ttsURL = getEnv("TTS_URL", "")
+	c.ttsVoice = getEnv("TTS_VOICE", "")
+	c.ttsModel = getEnv("TTS_MODEL", "")
+	c.ttsAPIKey = getEnv("TTS_API_KEY", "")
+	c.ttsMaxChars = getEnvAsInt("TTS_MAX_CHARS", 4000)
+	c.speechTTL = getEnvAsInt("SPEECH_TTL", 600)
+	c.speechMaxStored = getEnvAsInt("SPEECH_MAX_STORED", 100)
+
+	c.asrBackend = getEnv("ASR_BACKEND", asrWhisperASR)
+	c.asrModel = getEnv("ASR_MODEL", "")
+	c.deepgramAPIKey = getEnv("DEEPGRAM_API_KEY", "")
+	c.deepgramURL = getEnv("DEEPGRAM_URL", "https://api.deepgram.com")
+	c.diarizationURL = getEnv("DIARIZATION_URL", "")
+
+	c.llmProvider = getEnv("LLM_PROVIDER", providerOllama)
+	c.openAIAPIKey = getEnv("OPENAI_API_KEY", "")
+	c.openAIBaseURL = getEnv("OPENAI_BASE_URL", "https://api.openai.com/v1")
+	c.openAIModel = getEnv("OPENAI_MODEL", "gpt-4o-mini")
+	c.anthropicAPIKey = getEnv("ANTHROPIC_API_KEY", "")
+	c.anthropicBaseURL = getEnv("ANTHROPIC_BASE_URL", "https://api.anthropic.com")
+	c.anthropicModel = getEnv("ANTHROPIC_MODEL", "claude-3-5-haiku-latest")
+	c.anthropicMaxTokens = getEnvAsInt("ANTHROPIC_MAX_TOKENS", 1024)
+	c.vllmURL = getEnv("VLLM_URL", "")
+	c.vllmAPIKey = getEnv("VLLM_API_KEY", "")
+	c.vllmModel = getEnv("VLLM_MODEL", "")
+
+	c.otlpEndpoint = getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	c.otlpTracesURL = getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	c.otlpHeaders = getEnv("OTEL_EXPORTER_OTLP_HEADERS", "")
+	c.otelServiceName = getEnv("OTEL_SERVICE_NAME", "whisper-ollama-go")
+	c.traceSampleRatio = getEnvAsFloat("OTEL_TRACES_SAMPLER_ARG", 1)
+
+	c.metricsEnabled = getEnvAsBool("METRICS_ENABLED", true)
+
+	c.uploadIdleTimeout = getEnvAsInt("UPLOAD_IDLE_TIMEOUT", 10)
+	c.maxUploadBytes = getEnvAsInt("MAX_UPLOAD_BYTES", 2<<30)
+
+	c.readyzTimeout = getEnvAsInt("READYZ_TIMEOUT", 2)
+	c.readyzCacheSeconds = getEnvAsInt("READYZ_CACHE_SECONDS", 5)
+
+	c.shutdownTimeout = getEnvAsInt("SHUTDOWN_TIMEOUT", 30)
+
+	c.traceFile = getEnv("TRACE_FILE", "")
+	c.traceMaxSizeMB = getEnvAsInt("TRACE_FILE_MAX_MB", 100)
+	c.traceMaxBackups = getEnvAsInt("TRACE_FILE_BACKUPS", 5)
+	return c
+}
+
+// apply sets up the state derived from the settings, once they have been
+// validated, and puts c in use
+func (c *config) apply() {
+	c.trustedProxyNets, _ = parseCIDRs(c.trustedProxies)
+	c.ollamaModelWeights, _ = parseWeights(c.modelWeights)
+	c.clientWeights, _ = parseWeights(c.clientWeightsConfig)
+	c.retryStatuses, _ = parseRetryStatuses(c.retryOnStatus)
+	c.routeRateLimits, _ = parseRouteLimits(c.rateLimitRoutes)
+	c.languageModels, _ = parseLanguageModels(c.languageModelsConfig)
+	c.modelRules, _ = parseModelPolicy(c.modelAliasesConfig, c.allowedModelsConfig)
+	c.promptTemplates, _ = loadPromptTemplates(c.promptTemplatesDir)
+	c.llmPipelines, _ = loadPipelines(c.pipelinesFile, c.promptTemplates)
+	c.piiPatterns, _ = parsePIIPatterns(c.piiPatternsConfig)
+	c.logExcluded = parsePathSet(c.logExcludePaths)
+	c.wsAllowedOrigins = parsePathSet(strings.ToLower(c.wsAllowedOriginsConfig))
+	c.transcriber, _ = c.newTranscriber(strings.ToLower(c.asrBackend))
+	c.synthesizer, _ = c.newSynthesizer(strings.ToLower(c.ttsBackend), c.ttsURL)
+	c.llmProviders = c.newLLMProviders()
+	c.defaultLLM = c.llmProviders[strings.ToLower(c.llmProvider)]
+
+	staticKeys, _ := parseAPIKeys(c.apiKeysConfig, c.apiKeyRateLimits, c.apiKeyModels)
+	apiKeys.setStatic(staticKeys)
+	jwks.configure(c.oidcIssuer, c.jwksURL)
+	currentConfig.Store(c)
 }
 
 func main() {
-	// Initialize semaphore for controlling concurrency
-	semaphore = make(chan struct{}, maxConcurrent)
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML config file; environment variables take precedence")
+	flag.Parse()
+	c, err := initConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := c.validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if c.autoConcurrency {
+		c.maxConcurrent = c.autoConcurrencyLimit()
+	}
+	c.apply()
+	if c.apiKeysFile != "" {
+		if err := apiKeys.load(c.apiKeysFile); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+	}
+
+	// Initialize slot pool for controlling concurrency
+	slots = newSlotPool(c.maxConcurrent, c.priorityReservedFraction)
+	if c.fairQueuing {
+		admission = newFairQueue(slots, c.queueMaxWaiting)
+	} else if c.maxQueueDepth > 0 {
+		admission = newFairQueue(slots, c.maxQueueDepth)
+	}
+	if c.ollamaMaxConcurrent > 0 {
+		ollamaSlots = newWeightedSemaphore(c.ollamaMaxConcurrent)
+	}
+	ollamaBreaker = newCircuitBreaker(upstreamOllama, c.breakerThreshold, time.Duration(c.breakerCooldown)*time.Second)
+	whisperBreaker = newCircuitBreaker(upstreamWhisper, c.breakerThreshold, time.Duration(c.breakerCooldown)*time.Second)
+
+	// Present the configured CAs and client certificate to upstreams
+	upstreamTLS, _ := c.upstreamTLSConfig()
+	if upstreamTLS != nil {
+		upstreamTransport = newUpstreamTransport(upstreamTLS)
+	}
 
-	// Set up HTTP server with sensible timeouts
+	// Set up HTTP server with sensible timeouts. The write timeout is set
+	// per request by logMiddleware, so a reloaded REQUEST_TIMEOUT applies.
+	serverTLS, _ := c.serverTLSConfig()
 	server := &http.Server{
-		Addr:         ":" + serverPort,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: time.Duration(requestTimeout+30) * time.Second,
-		Handler:      setupRoutes(),
+		Addr:        ":" + c.serverPort,
+		ReadTimeout: 30 * time.Second,
+		Handler:     setupRoutes(),
+		TLSConfig:   serverTLS,
 	}
 
-	log.Printf("Starting Whisper-Ollama bridge on port %s", serverPort)
-	log.Printf("Whisper URL: %s", whisperURL)
-	log.Printf("Ollama URL: %s", ollamaURL)
-	log.Printf("Max concurrent requests: %d", maxConcurrent)
+	if c.traceFile != "" {
+		traces, err = newTraceWriter(c.traceFile, int64(c.traceMaxSizeMB)<<20, c.traceMaxBackups)
+		if err != nil {
+			log.Fatalf("Failed to open trace file: %v", err)
+		}
+		defer traces.Close()
+		log.Printf("Writing request traces to %s", c.traceFile)
+	}
+
+	// Export spans until the requests in flight have finished on shutdown
+	if endpoint := otlpTracesEndpoint(); endpoint != "" {
+		headers, _ := parseOTLPHeaders(c.otlpHeaders)
+		tracer = newSpanExporter(endpoint, headers)
+		ctx, stop := context.WithCancel(context.Background())
+		defer func() {
+			stop()
+			<-tracer.done
+		}()
+		go tracer.run(ctx)
+		log.Printf("Exporting traces to %s", endpoint)
+	}
+
+	// Run async jobs until the server shuts down. Running jobs are
+	// drained like requests.
+	jobs = newJobStore(c.jobMaxStored, c.jobQueueSize)
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	server.RegisterOnShutdown(stopJobs)
+	jobs.start(jobsCtx, c.jobWorkers)
 
-	log.Fatal(server.ListenAndServe())
+	// Keep conversation sessions, evicting expired ones from memory
+	if sessions, err = newSessionStore(); err != nil {
+		log.Fatal(err)
+	}
+	if store, ok := sessions.(*memorySessionStore); ok {
+		sessionsCtx, stopSessions := context.WithCancel(context.Background())
+		server.RegisterOnShutdown(stopSessions)
+		store.start(sessionsCtx)
+	}
+
+	// Cache transcriptions by the audio's hash, and LLM responses by the
+	// prompt's
+	if transcriptions, err = newCache("TRANSCRIPTION_CACHE", c.transcriptionCacheKind, c.transcriptionCacheMaxEntries, transcriptionKeyPrefix); err != nil {
+		log.Fatal(err)
+	}
+	if llmResponses, err = newCache("LLM_CACHE", c.llmCacheKind, c.llmCacheMaxEntries, llmResponseKeyPrefix); err != nil {
+		log.Fatal(err)
+	}
+
+	// Record results, saving the queued ones on shutdown
+	if results, err = newResultStore(context.Background()); err != nil {
+		log.Fatalf("Failed to open the results store: %v", err)
+	}
+	if results != nil {
+		resultWriter = newResultQueue(results)
+		defer resultWriter.Close()
+		log.Printf("Recording results in the %s store", c.resultsStoreKind)
+	}
+
+	// Keep synthesized speech for download
+	speeches = newSpeechStore(c.speechMaxStored)
+	speechCtx, stopSpeech := context.WithCancel(context.Background())
+	server.RegisterOnShutdown(stopSpeech)
+	speeches.start(speechCtx)
+
+	// Find out early whether Ollama has anything to run
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := ollamaModels.refresh(ctx); err != nil {
+			log.Printf("Could not list Ollama models: %v", err)
+		}
+	}()
+
+	// Keep upstreams warm until the server shuts down
+	if c.keepaliveInterval > 0 {
+		ctx, stop := context.WithCancel(context.Background())
+		server.RegisterOnShutdown(stop)
+		startKeepalive(ctx, time.Duration(c.keepaliveInterval)*time.Second)
+		log.Printf("Keepalive interval: %ds", c.keepaliveInterval)
+	}
+
+	log.Printf("Starting Whisper-Ollama bridge on port %s", c.serverPort)
+	if serverTLS != nil {
+		log.Printf("Serving HTTPS, client certificates: %s", describeClientAuth(serverTLS.ClientAuth))
+	}
+
+	// Serve the gRPC API on its own port until the server shuts down. Its
+	// calls are counted in flight, so they are drained with the requests.
+	if c.grpcPort != "" {
+		grpcServer := newGRPCServer(serverTLS)
+		server.RegisterOnShutdown(func() { grpcServer.Shutdown(context.Background()) })
+		go func() {
+			var err error
+			if grpcServer.TLSConfig != nil {
+				err = grpcServer.ListenAndServeTLS("", "")
+			} else {
+				err = grpcServer.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("gRPC server failed: %v", err)
+			}
+		}()
+		log.Printf("Serving gRPC on port %s", c.grpcPort)
+	}
+	if c.transcriber.name() == asrDeepgram {
+		log.Printf("ASR backend: %s", asrDeepgram)
+	} else {
+		log.Printf("ASR backend: %s at %s", c.transcriber.name(), c.whisperURL)
+	}
+	log.Printf("Ollama URL: %s", c.ollamaURL)
+	if c.spilloverOllamaURL != "" {
+		log.Printf("Spillover Ollama URL: %s", c.spilloverOllamaURL)
+	}
+	shared, reserved := slots.capacity()
+	log.Printf("Max concurrent requests: %d (%d shared, %d reserved for high priority)", c.maxConcurrent, shared, reserved)
+	if c.chaosMode {
+		log.Printf("WARNING: CHAOS_MODE is on, /process will fail %g%%, be delayed %g%% and corrupted %g%% of the time",
+			c.chaosErrorRate*100, c.chaosLatencyRate*100, c.chaosCorruptRate*100)
+	}
+	if c.fairQueuing {
+		log.Printf("Fair queuing: up to %d waiting requests, %ds timeout", c.queueMaxWaiting, c.queueTimeout)
+	} else if c.maxQueueDepth > 0 {
+		log.Printf("Queuing: up to %d waiting requests, %ds timeout", c.maxQueueDepth, c.maxQueueWait)
+	}
+
+	// Process the audio dropped in the hot folders until the server shuts
+	// down
+	if c.watchDirs != "" {
+		ctx, stop := context.WithCancel(context.Background())
+		server.RegisterOnShutdown(stop)
+		go newFolderWatcher().run(ctx)
+		log.Printf("Watching %s for audio files", c.watchDirs)
+	}
+
+	// Consume audio from Kafka until the server shuts down, then leave
+	// the consumer group before exiting
+	if c.kafkaBrokers != "" {
+		consumer := newKafkaConsumer()
+		ctx, stop := context.WithCancel(context.Background())
+		server.RegisterOnShutdown(stop)
+		defer func() {
+			stop()
+			<-consumer.done
+		}()
+		go consumer.run(ctx)
+		log.Printf("Consuming %s from Kafka at %s as group %s", c.kafkaInputTopic, c.kafkaBrokers, c.kafkaGroupID)
+	}
+
+	// Serve the pipeline over NATS until the server shuts down, finishing
+	// the messages being processed before exiting
+	if c.natsURL != "" {
+		service := newNATSService()
+		ctx, stop := context.WithCancel(context.Background())
+		server.RegisterOnShutdown(stop)
+		defer func() {
+			stop()
+			<-service.done
+		}()
+		go service.run(ctx)
+		if c.natsStream != "" {
+			log.Printf("Pulling %s from JetStream stream %s at %s as consumer %s", c.natsSubject, c.natsStream, service.opts.addr, c.natsConsumer)
+		} else {
+			log.Printf("Serving %s over NATS at %s in queue group %s", c.natsSubject, service.opts.addr, c.natsQueue)
+		}
+	}
+
+	// Pick up config file changes until the server shuts down
+	if *configPath != "" {
+		ctx, stop := context.WithCancel(context.Background())
+		server.RegisterOnShutdown(stop)
+		go watchConfig(ctx, *configPath)
+		log.Printf("Watching config file %s", *configPath)
+	}
+
+	if err := serve(server, time.Duration(c.shutdownTimeout)*time.Second); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func setupRoutes() http.Handler {
@@ -82,25 +1174,81 @@ func setupRoutes() http.Handler {
 		w.Write([]byte("OK"))
 	})
 
+	// Readiness check based on the last known upstream state
+	mux.HandleFunc("/readyz", readyHandler)
+
 	// Main processing endpoint
-	mux.HandleFunc("/process", processAudioHandler)
+	mux.HandleFunc("/process", withChaos(processAudioHandler))
+	mux.HandleFunc("/process/batch", batchHandler)
+
+	// OpenAI-compatible API
+	mux.HandleFunc("/v1/audio/transcriptions", openAITranscriptionsHandler)
+	mux.HandleFunc("/v1/chat/completions", openAIChatHandler)
+
+	// Prometheus metrics
+	if cfg().metricsEnabled {
+		mux.HandleFunc("/metrics", metricsHandler)
+	}
+
+	// Async jobs
+	mux.HandleFunc("/jobs", jobsHandler)
+	mux.HandleFunc("/jobs/{id}", jobHandler)
+	mux.HandleFunc("/results", resultsHandler)
+	mux.HandleFunc("/results/{id}", resultHandler)
+
+	// Conversation sessions
+	mux.HandleFunc("/sessions/{id}", sessionHandler)
 
-	// Add logging middleware
-	return logMiddleware(mux)
+	// Synthesized speech of tts requests
+	mux.HandleFunc("/speech/{id}", speechHandler)
+
+	// Live transcription of audio streamed in the request body
+	mux.HandleFunc("/live", liveHandler)
+
+	// Live transcription and LLM answer over a WebSocket
+	mux.HandleFunc("/ws/stream", wsStreamHandler)
+
+	// Audio metadata without transcription
+	mux.HandleFunc("/inspect", inspectHandler)
+
+	// Models of the ASR backend and the LLM providers
+	mux.HandleFunc("/models", modelsHandler)
+
+	// Admin endpoints
+	mux.HandleFunc("/admin/benchmark", requireAdmin(benchmarkHandler))
+	mux.HandleFunc("/admin/keys", requireAdmin(keysHandler))
+	mux.HandleFunc("/admin/keys/{name}", requireAdmin(keyHandler))
+
+	// Add logging, tracing, authentication and request ID middleware
+	return requestIDMiddleware(logMiddleware(tracingMiddleware(authMiddleware(mux, rateLimitMiddleware(mux)))))
 }
 
 // Process audio handler
 func processAudioHandler(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
+	trace := traceFromContext(r.Context())
+	trace.traced = true
 
-	// Acquire semaphore slot or reject if too many concurrent requests
-	select {
-	case semaphore <- struct{}{}:
-		defer func() { <-semaphore }()
-	default:
+	// Refuse oversized uploads before taking a slot or reading the body
+	if rejectLargeUpload(w, r) {
+		return
+	}
+
+	// Priority is read from the query string so it is known before the
+	// upload body is parsed
+	prio, err := parsePriority(r.URL.Query().Get("priority"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Acquire a slot or reject if too many concurrent requests
+	release, err := admit(r, prio)
+	if err != nil {
 		http.Error(w, "Server is at capacity, please try again later", http.StatusServiceUnavailable)
 		return
 	}
+	defer release()
 
 	// Only accept POST
 	if r.Method != http.MethodPost {
@@ -108,200 +1256,605 @@ func processAudioHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set timeout for the entire request processing
-	ctx := r.Context()
-	var cancel context.CancelFunc
-	ctx, cancel = context.WithTimeout(ctx, time.Duration(requestTimeout)*time.Second)
+	apiVersion, err := parseAPIVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Set timeout for the entire request processing. The context is passed
+	// to the upstream calls so they abort when the client goes away.
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfg().requestTimeout)*time.Second)
 	defer cancel()
 
-	// Get multipart form
-	err := r.ParseMultipartForm(32 << 20) // 32MB max memory
+	// Route this request to canary upstreams when asked to
+	ctx, err = withURLOverrides(ctx, r)
 	if err != nil {
-		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	// Get form values
-	model := r.FormValue("model")
-	if model == "" {
-		model = "llama3" // Default model
+	// Give the slot back at once rather than wait for an upload that
+	// can't be transcribed
+	if queryMode(r) != modeLLMOnly && overridesFromContext(ctx).whisper == "" && writeCircuitOpen(w, whisperBreaker) {
+		return
 	}
 
-	prompt := r.FormValue("prompt")
-	if prompt == "" {
-		prompt = "Process this transcription:"
-	}
+	// Abort uploads from clients that stop sending
+	upload := newUploadReader(ctx, w, r.Body, time.Duration(cfg().uploadIdleTimeout)*time.Second, int64(cfg().maxUploadBytes))
+	defer upload.stop()
+	r.Body = upload
+
+	// The upload span covers parsing the request and buffering the audio
+	_, uploadSpan := startSpan(ctx, "upload", spanKindInternal)
+	defer uploadSpan.end(nil)
 
-	// Get the audio file
-	file, handler, err := r.FormFile("file")
+	// Get the request parameters and audio
+	input, err := readProcessInput(r)
 	if err != nil {
-		http.Error(w, "Failed to get audio file: "+err.Error(), http.StatusBadRequest)
+		if writeUploadFailure(w, upload) {
+			return
+		}
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
+	defer input.Audio.Close()
+	// Each extra candidate occupies its own slot so multi-candidate
+	// requests can't overload the server
+	for i := 1; i < input.N; i++ {
+		releaseExtra, ok := slots.tryAcquire(prio)
+		if !ok {
+			http.Error(w, "Server is at capacity, please try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer releaseExtra()
+	}
 
-	// Create temp file to store the uploaded file
-	tempFile, err := os.CreateTemp("", "upload-*."+filepath.Ext(handler.Filename))
-	if err != nil {
-		http.Error(w, "Failed to create temp file: "+err.Error(), http.StatusInternalServerError)
-		return
+	// Buffer the upload to a temp file unless it is streamed straight to
+	// Whisper, or there is none. Multipart uploads were written to one
+	// while the form was read.
+	audioPath := ""
+	if !input.Streamed && input.Mode != modeLLMOnly {
+		audioPath, trace.fileSize = spooledUploadPath(input.Audio)
+		if audioPath == "" {
+			// Create temp file to store the uploaded file
+			tempFile, err := os.CreateTemp("", "upload-*"+filepath.Ext(input.Filename))
+			if err != nil {
+				http.Error(w, "Failed to create temp file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer os.Remove(tempFile.Name())
+			defer tempFile.Close()
+
+			// Copy uploaded file to temp file
+			written, err := io.Copy(tempFile, input.Audio)
+			if err != nil {
+				if writeUploadFailure(w, upload) {
+					return
+				}
+				// audio_url downloads fail with the status to answer
+				if _, ok := err.(*httpError); ok {
+					writeError(w, err, http.StatusInternalServerError)
+					return
+				}
+				http.Error(w, "Failed to write temp file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tempFile.Close() // Close to ensure all data is written
+			audioPath = tempFile.Name()
+			trace.fileSize = written
+		}
+
+		// Convert what the ASR backend may not read
+		transcodedPath, err := transcodeUpload(ctx, audioPath, input.Channel)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if transcodedPath != audioPath {
+			defer os.Remove(transcodedPath)
+			audioPath = transcodedPath
+		}
+
+		// Whisper downmixes on its own, only a single channel needs work
+		if input.Channel != channelMix {
+			channelPath, err := selectChannel(audioPath, input.Channel)
+			if err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			defer os.Remove(channelPath)
+			audioPath = channelPath
+		}
+	}
+	trace.model = input.Model
+	trace.uploadMs = time.Since(startTime).Milliseconds()
+	if !input.Streamed {
+		stageDuration.observe(time.Since(startTime).Seconds(), stageUpload)
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
+	uploadSpan.setAttributes("audio.filename", input.Filename, "audio.size", trace.fileSize, "upload.streamed", input.Streamed)
+	uploadSpan.end(nil)
 
-	// Copy uploaded file to temp file
-	_, err = io.Copy(tempFile, file)
-	if err != nil {
-		http.Error(w, "Failed to write temp file: "+err.Error(), http.StatusInternalServerError)
+	// Don't spend a transcription on a request that will fail at the LLM
+	// step anyway
+	if !cfg().degradeToTranscription && !input.EstimateTokens && !isSubtitleFormat(input.ResponseFormat) && input.Mode != modeTranscribeOnly && input.LLM.name() == providerOllama && ollamaOverride(ctx) == "" &&
+		(writeCircuitOpen(w, ollamaBreaker) || writeNoModels(ctx, w)) {
 		return
 	}
-	tempFile.Close() // Close to ensure all data is written
 
-	// Transcribe audio with Whisper
-	transcription, err := transcribeWithWhisper(tempFile.Name())
+	// Reject silent WAV uploads before spending a transcription on them.
+	// Formats we can't decode are passed through unchecked.
+	uploadPath := audioPath
+	if cfg().detectSilence && audioPath != "" {
+		level, err := wavLoudness(audioPath)
+		if err == nil && level < cfg().silenceThreshold {
+			http.Error(w, "audio appears to be silent", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// Cut the silence out, and reject audio without speech
+	if audioPath != "" {
+		speechPath, speech, err := stripSilence(audioPath)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if speech != nil {
+			defer os.Remove(speechPath)
+			audioPath, input.Speech = speechPath, speech
+		}
+	}
+
+	var stream tokenStream
+	if input.RawStream {
+		stream = newRawStream(w)
+	} else if input.Stream {
+		stream = newSSEStream(w)
+	}
+
+	result, err := runPipelineWithRetries(ctx, input, audioPath, stream)
 	if err != nil {
+		recordResult(ctx, resultEndpointProcess, requestIDFromContext(ctx), input, nil, err)
+		if stream != nil && stream.started() {
+			// Chunk events were sent before the transcription failed
+			stream.finish(CombinedResponse{}, ProcessStats{}, err)
+			return
+		}
+		if writeUploadFailure(w, upload) {
+			return
+		}
+		if writeCircuitOpenError(w, err) {
+			return
+		}
+		if writeUpstreamOverload(w, err) {
+			return
+		}
 		http.Error(w, "Transcription failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	trace.model = result.Response.Model
+	trace.transcriptionMs = result.Stats.TranscriptionTime
+	trace.llmMs = result.Stats.LLMTime
 
-	// Process with Ollama
-	response, err := processWithOllama(model, prompt, transcription)
-	if err != nil {
-		// Return transcription even if Ollama processing fails
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(CombinedResponse{
-			Transcription: transcription,
-			Response:      "Ollama processing failed: " + err.Error(),
-			ProcessTime:   time.Since(startTime).Milliseconds(),
-			Model:         model,
-		})
+	// The generated text has been sent already, only the trailers are left
+	if stream != nil && stream.started() {
+		result.Response.ProcessTime = time.Since(startTime).Milliseconds()
+		if err := saveOutputs(ctx, input, &result.Response, requestIDFromContext(ctx)); err != nil {
+			log.Printf("Failed to save outputs: %v request_id=%s", err, requestIDFromContext(ctx))
+		}
+		recordResult(ctx, resultEndpointProcess, requestIDFromContext(ctx), input, result, nil)
+		stream.finish(result.Response, result.Stats, result.LLMErr)
+		return
+	}
+
+	if result.LLMErr != nil && writeUpstreamOverload(w, result.LLMErr) {
+		recordResult(ctx, resultEndpointProcess, requestIDFromContext(ctx), input, result, nil)
 		return
 	}
 
 	// Return combined response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(CombinedResponse{
-		Transcription: transcription,
-		Response:      response,
-		ProcessTime:   time.Since(startTime).Milliseconds(),
-		Model:         model,
-	})
+	elapsed := time.Since(startTime)
+	result.Response.ProcessTime = elapsed.Milliseconds()
+	if uploadPath != "" {
+		if info, err := probeAudioFile(uploadPath); err == nil && info.Duration > 0 {
+			result.Response.AudioDuration = info.Duration
+			audioSeconds.add(info.Duration)
+			result.Response.RealtimeFactor = realtimeFactor(info.Duration, elapsed)
+		}
+	}
+	if err := saveOutputs(ctx, input, &result.Response, requestIDFromContext(ctx)); err != nil {
+		recordResult(ctx, resultEndpointProcess, requestIDFromContext(ctx), input, result, fmt.Errorf("failed to save outputs: %w", err))
+		http.Error(w, "Failed to save outputs: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	recordResult(ctx, resultEndpointProcess, requestIDFromContext(ctx), input, result, nil)
+	writeProcessResponse(w, input, apiVersion, result)
 }
 
 // Transcribe audio with Whisper
-func transcribeWithWhisper(filePath string) (string, error) {
+func transcribeWithWhisper(ctx context.Context, filePath string, opts whisperOptions) (*WhisperResponse, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file: %w", err)
+		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	// Create multipart request
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+	return transcribeWithWhisperOptions(ctx, filepath.Base(filePath), file, opts)
+}
+
+// Transcribe audio read from r with Whisper. The multipart request body is
+// produced through a pipe while it is sent, so the audio is never buffered
+// in full.
+func transcribeStreamWithWhisper(ctx context.Context, filename string, r io.Reader) (*WhisperResponse, error) {
+	return transcribeWithWhisperOptions(ctx, filename, r, whisperOptions{})
+}
 
-	part, err := writer.CreateFormFile("audio_file", filepath.Base(filePath))
+// whisperOptions are optional ASR parameters, left to the Whisper
+// service's defaults when empty
+type whisperOptions struct {
+	Language       string // spoken language code, detected when empty
+	InitialPrompt  string // text that conditions the transcription
+	WordTimestamps bool   // include word timings in the segments
+	Translate      bool   // translate the speech to English instead
+	Diarize        bool   // label the segments with their speakers
+	NumSpeakers    int    // speakers in the audio, detected when 0
+}
+
+// transcribeWithWhisperOptions sends the audio read from r to the
+// configured ASR backend
+func transcribeWithWhisperOptions(ctx context.Context, filename string, r io.Reader, opts whisperOptions) (*WhisperResponse, error) {
+	ctx, span := startSpan(ctx, "transcription", spanKindClient)
+	span.setAttributes("asr.backend", cfg().transcriber.name())
+	start := time.Now()
+	var whisperResp *WhisperResponse
+	var err error
+	if audio := replayableAudio(r); audio != nil {
+		err = withRetries(ctx, upstreamWhisper, cfg().whisperRetries, func() (err error) {
+			whisperResp, err = guardedTranscribe(ctx, filename, audio(), opts)
+			return err
+		})
+	} else {
+		whisperResp, err = guardedTranscribe(ctx, filename, r, opts)
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to create form file: %w", err)
+		countUpstreamError(ctx, upstreamWhisper, err)
+		span.end(err)
+		return nil, err
 	}
+	stageDuration.observe(time.Since(start).Seconds(), stageWhisper)
+	span.setAttributes("asr.language", whisperResp.Language, "asr.segments", len(whisperResp.Segments))
+	span.end(nil)
 
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return "", fmt.Errorf("failed to copy file: %w", err)
+	// Backends report a given language in their own form, if at all
+	if opts.Language != "" {
+		whisperResp.Language = opts.Language
+	}
+
+	// Some ASR backends omit the top-level text and only return segments
+	if strings.TrimSpace(whisperResp.Text) == "" && len(whisperResp.Segments) > 0 {
+		whisperResp.Text = textFromSegments(whisperResp.Segments)
 	}
+	fillConfidence(whisperResp.Segments)
 
-	// Close multipart writer
-	err = writer.Close()
+	return whisperResp, nil
+}
+
+// Process a prompt with the request's LLM provider
+func processWithLLM(ctx context.Context, model, prompt string, options map[string]any) (*OllamaResponse, error) {
+	return generateWithLLM(ctx, model, prompt, options, nil)
+}
+
+// generateWithLLM runs a generation on the LLM provider chosen for ctx.
+// With onToken set the generation is streamed and onToken is called with
+// every piece of text as it arrives; the returned response then holds the
+// full text and the final stats.
+func generateWithLLM(ctx context.Context, model, prompt string, options map[string]any, onToken func(string) error) (*OllamaResponse, error) {
+	llm := llmFromContext(ctx)
+	cacheKey, cacheable := llmCacheKey(ctx, llm.name(), model, prompt, options)
+	if cacheable {
+		if resp := cachedLLMResponse(ctx, cacheKey); resp != nil {
+			if onToken != nil {
+				if err := onToken(resp.Response); err != nil {
+					return nil, err
+				}
+			}
+			return resp, nil
+		}
+	}
+	ctx, span := startSpan(ctx, "llm", spanKindClient)
+	span.setAttributes("gen_ai.system", llm.name(), "gen_ai.request.model", model, "llm.streamed", onToken != nil)
+	start := time.Now()
+
+	// A generation is only retried until it has streamed its first token
+	var streamed bool
+	if onToken != nil {
+		callback := onToken
+		onToken = func(token string) error {
+			streamed = true
+			return callback(token)
+		}
+	}
+	var resp *OllamaResponse
+	err := withRetries(ctx, llm.name(), cfg().llmRetries, func() (err error) {
+		resp, err = llm.generate(ctx, model, prompt, options, onToken)
+		if err != nil && streamed {
+			return finalError{err}
+		}
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to close writer: %w", err)
+		countUpstreamError(ctx, llm.name(), err)
+		span.end(err)
+		return nil, err
+	}
+	stageDuration.observe(time.Since(start).Seconds(), stageLLM)
+	span.setAttributes(
+		"gen_ai.response.model", resp.Model,
+		"gen_ai.usage.input_tokens", resp.PromptEvalCount,
+		"gen_ai.usage.output_tokens", resp.EvalCount,
+	)
+	if resp.DoneReason != "" {
+		span.setAttributes("gen_ai.response.finish_reasons", resp.DoneReason)
 	}
+	span.end(nil)
+	if resp.DoneReason == doneReasonLength {
+		log.Printf("%s generation with %s was truncated (done_reason=length) request_id=%s", llm.name(), model, requestIDFromContext(ctx))
+	}
+	if cacheable {
+		cacheLLMResponse(ctx, cacheKey, resp)
+	}
+	return resp, nil
+}
 
-	// Create request
-	client := &http.Client{
-		Timeout: time.Duration(requestTimeout) * time.Second,
+// generateWithOllama runs a generation of the complete prompt on Ollama.
+// With a session's history the prompt continues the conversation on the
+// chat API.
+func generateWithOllama(ctx context.Context, model, prompt string, options map[string]any, onToken func(string) error) (*OllamaResponse, error) {
+	// Prepare request
+	system, format, history, options := splitOptions(options)
+	if len(history) > 0 {
+		return continueWithOllama(ctx, OllamaChatRequest{
+			Model:    model,
+			Messages: chatMessages(system, history, prompt),
+			Format:   format,
+			Stream:   onToken != nil,
+			Options:  options,
+		}, onToken)
+	}
+	ollamaReq := OllamaRequest{
+		Model:   model,
+		Prompt:  prompt,
+		System:  system,
+		Format:  format,
+		Stream:  onToken != nil,
+		Options: options,
 	}
 
-	req, err := http.NewRequest("POST", whisperURL+"/asr", body)
+	resp, backend, err := postToOllama(ctx, model, "/api/generate", ollamaReq)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
+	defer backend.release()
+	defer resp.Body.Close()
 
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	// Read response
+	var ollamaResp OllamaResponse
+	if onToken == nil {
+		err = json.NewDecoder(resp.Body).Decode(&ollamaResp)
+	} else {
+		err = readOllamaStream(resp.Body, &ollamaResp, onToken)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	ollamaResp.Spillover = backend.spillover
+	return &ollamaResp, nil
+}
 
-	// Send request
-	resp, err := client.Do(req)
+// continueWithOllama runs a generation on Ollama's chat API, reporting it
+// like generateWithOllama does
+func continueWithOllama(ctx context.Context, chatReq OllamaChatRequest, onToken func(string) error) (*OllamaResponse, error) {
+	resp, backend, err := postToOllama(ctx, chatReq.Model, "/api/chat", chatReq)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+		return nil, err
 	}
+	defer backend.release()
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("whisper returned non-200 status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+	chatResp := &OllamaChatResponse{}
+	if onToken == nil {
+		if err := json.NewDecoder(resp.Body).Decode(chatResp); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+	} else {
+		chatResp, err = readOllamaChatStream(resp.Body, func(chunk OllamaChatResponse) error {
+			if chunk.Message.Content == "" {
+				return nil
+			}
+			return onToken(chunk.Message.Content)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &OllamaResponse{
+		Model:           chatResp.Model,
+		Response:        chatResp.Message.Content,
+		Finished:        chatResp.Finished,
+		DoneReason:      chatResp.DoneReason,
+		PromptEvalCount: chatResp.PromptEvalCount,
+		EvalCount:       chatResp.EvalCount,
+		EvalDuration:    chatResp.EvalDuration,
+		Spillover:       backend.spillover,
+	}, nil
+}
+
+// chatMessages returns the messages of a chat request for prompt after a
+// session's history, with the system prompt first if there is one
+func chatMessages(system string, history []OllamaChatMessage, prompt string) []OllamaChatMessage {
+	messages := make([]OllamaChatMessage, 0, len(history)+2)
+	if system != "" {
+		messages = append(messages, OllamaChatMessage{Role: "system", Content: system})
 	}
+	messages = append(messages, history...)
+	return append(messages, OllamaChatMessage{Role: "user", Content: prompt})
+}
 
-	// Read response
-	var whisperResp WhisperResponse
-	err = json.NewDecoder(resp.Body).Decode(&whisperResp)
+// chatWithOllama sends a conversation to Ollama's chat API. With onChunk
+// set the reply is streamed and onChunk receives every chunk, including the
+// final one with the stats; the returned response then holds the whole
+// reply.
+func chatWithOllama(ctx context.Context, chatReq OllamaChatRequest, onChunk func(OllamaChatResponse) error) (reply *OllamaChatResponse, err error) {
+	chatReq.Stream = onChunk != nil
+	ctx, span := startSpan(ctx, "chat", spanKindClient)
+	span.setAttributes("gen_ai.system", providerOllama, "gen_ai.request.model", chatReq.Model, "llm.streamed", chatReq.Stream)
+	defer func() { span.end(err) }()
+
+	var resp *http.Response
+	var backend *ollamaBackend
+	err = withRetries(ctx, upstreamOllama, cfg().llmRetries, func() (err error) {
+		resp, backend, err = postToOllama(ctx, chatReq.Model, "/api/chat", chatReq)
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+		countUpstreamError(ctx, upstreamOllama, err)
+		return nil, err
 	}
+	defer backend.release()
+	defer resp.Body.Close()
 
-	return whisperResp.Text, nil
+	if onChunk == nil {
+		var chatResp OllamaChatResponse
+		if err := json.NewDecoder(resp.Body).Decode(&chatResp); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		return &chatResp, nil
+	}
+	return readOllamaChatStream(resp.Body, onChunk)
 }
 
-// Process transcription with Ollama
-func processWithOllama(model, prompt, transcription string) (string, error) {
-	// Prepare request
-	ollamaReq := OllamaRequest{
-		Model:  model,
-		Prompt: fmt.Sprintf("%s\n\nTranscription: %s", prompt, transcription),
-		Stream: false,
+// readOllamaChatStream reads a streamed chat reply, passing every chunk to
+// onChunk, and returns the final chunk with the whole reply
+func readOllamaChatStream(body io.Reader, onChunk func(OllamaChatResponse) error) (*OllamaChatResponse, error) {
+	decoder := json.NewDecoder(body)
+	var text strings.Builder
+	for {
+		var chunk OllamaChatResponse
+		if err := decoder.Decode(&chunk); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		text.WriteString(chunk.Message.Content)
+		if err := onChunk(chunk); err != nil {
+			return nil, err
+		}
+		if chunk.Finished {
+			chunk.Message.Content = text.String()
+			return &chunk, nil
+		}
 	}
+}
 
-	reqBody, err := json.Marshal(ollamaReq)
+// postToOllama sends payload as JSON to an Ollama API path on the backend
+// chosen for model, recording the outcome with the backend's breaker. On
+// success the caller must close the response body and release the backend.
+func postToOllama(ctx context.Context, model, path string, payload any) (*http.Response, *ollamaBackend, error) {
+	reqBody, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return nil, nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
 	// Create request
-	client := &http.Client{
-		Timeout: time.Duration(requestTimeout) * time.Second,
+	client := upstreamClient(time.Duration(cfg().requestTimeout) * time.Second)
+
+	backend, err := acquireOllamaBackend(ctx, model)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := backend.post(ctx, client, path, reqBody)
+	if err != nil {
+		backend.record(err)
+		backend.release()
+		return nil, nil, err
 	}
+	backend.record(nil)
+	return resp, backend, nil
+}
 
-	req, err := http.NewRequest("POST", ollamaURL+"/api/generate", bytes.NewBuffer(reqBody))
+// sendToOllama posts a JSON body to url and returns the response when it
+// is 200 OK
+func sendToOllama(ctx context.Context, client *http.Client, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	setUpstreamRequestID(req)
+	setTraceParent(req)
 
 	// Send request
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("ollama returned non-200 status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+		err := newUpstreamError(upstreamOllama, resp)
+		resp.Body.Close()
+		return nil, err
 	}
+	return resp, nil
+}
 
-	// Read response
-	var ollamaResp OllamaResponse
-	err = json.NewDecoder(resp.Body).Decode(&ollamaResp)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+// readOllamaStream reads a streamed generation: one JSON object per line,
+// each with the next piece of text, the last one with done set and the
+// stats. The pieces are joined into resp.Response.
+func readOllamaStream(body io.Reader, resp *OllamaResponse, onToken func(string) error) error {
+	decoder := json.NewDecoder(body)
+	var text strings.Builder
+	for {
+		var chunk OllamaResponse
+		if err := decoder.Decode(&chunk); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if chunk.Response != "" {
+			text.WriteString(chunk.Response)
+			if err := onToken(chunk.Response); err != nil {
+				return err
+			}
+		}
+		if chunk.Finished {
+			*resp = chunk
+			resp.Response = text.String()
+			return nil
+		}
 	}
+}
 
-	return ollamaResp.Response, nil
+// parsePathSet parses a comma-separated list of URL paths
+func parsePathSet(value string) map[string]bool {
+	paths := make(map[string]bool)
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths[path] = true
+		}
+	}
+	return paths
 }
 
 // Logging middleware
 func logMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		http.NewResponseController(w).SetWriteDeadline(start.Add(time.Duration(cfg().requestTimeout+30) * time.Second))
 
 		// Create a custom response writer to capture status code
 		rw := &responseWriter{
@@ -309,15 +1862,61 @@ func logMiddleware(next http.Handler) http.Handler {
 			statusCode:     http.StatusOK,
 		}
 
-		next.ServeHTTP(rw, r)
+		trace := &requestTrace{}
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		req := r.WithContext(context.WithValue(r.Context(), requestTraceKey, trace))
+		next.ServeHTTP(rw, req)
+
+		// The mux sets the matched pattern, which keeps job IDs and
+		// unknown paths from becoming labels
+		route := req.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.add(1, route, r.Method, strconv.Itoa(rw.statusCode))
+		httpDuration.observe(time.Since(start).Seconds(), route)
+
+		if traces != nil && trace.traced {
+			traces.emit(traceEvent{
+				Timestamp:       start.UTC(),
+				RequestID:       requestIDFromContext(r.Context()),
+				Method:          r.Method,
+				Path:            r.URL.Path,
+				Status:          rw.statusCode,
+				ClientIP:        clientIP(r),
+				DurationMs:      time.Since(start).Milliseconds(),
+				UploadMs:        trace.uploadMs,
+				TranscriptionMs: trace.transcriptionMs,
+				LLMMs:           trace.llmMs,
+				Model:           trace.model,
+				FileSize:        trace.fileSize,
+				APIKey:          keyName(trace.apiKey),
+				Subject:         trace.claims.subject(),
+				Tenant:          trace.claims.tenant(),
+			})
+		}
 
-		// Log request
+		// Log request, except for noisy probes
+		if cfg().logExcluded[r.URL.Path] {
+			return
+		}
+		var keyField string
+		if trace.apiKey != nil {
+			keyField = " key=" + trace.apiKey.Name
+		}
+		if trace.claims != nil {
+			keyField = fmt.Sprintf(" sub=%s tenant=%s", trace.claims.Subject, trace.claims.Tenant)
+		}
 		log.Printf(
-			"%s %s %d %s",
+			"%s %s %d %s client=%s request_id=%s%s",
 			r.Method,
-			r.RequestURI,
+			redactedURI(r),
 			rw.statusCode,
 			time.Since(start),
+			clientIP(r),
+			requestIDFromContext(r.Context()),
+			keyField,
 		)
 	})
 }
@@ -333,19 +1932,58 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying connection
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack hands the connection to WebSocket handlers, which write their
+// own 101 response
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
 // Helper functions for environment variables
 func getEnv(key, fallback string) string {
-	if value, exists := os.LookupEnv(key); exists {
+	if value, exists := lookupSetting(key, settingString); exists {
 		return value
 	}
 	return fallback
 }
 
 func getEnvAsInt(key string, fallback int) int {
-	if value, exists := os.LookupEnv(key); exists {
-		if intVal, err := strconv.Atoi(value); err == nil {
+	if value, exists := lookupSetting(key, settingInt); exists {
+		intVal, err := strconv.Atoi(value)
+		if err == nil {
 			return intVal
 		}
+		configErrors = append(configErrors, fmt.Errorf("%s=%q: %w", key, value, err))
+	}
+	return fallback
+}
+
+func getEnvAsBool(key string, fallback bool) bool {
+	if value, exists := lookupSetting(key, settingBool); exists {
+		boolVal, err := strconv.ParseBool(value)
+		if err == nil {
+			return boolVal
+		}
+		configErrors = append(configErrors, fmt.Errorf("%s=%q: %w", key, value, err))
+	}
+	return fallback
+}
+
+func getEnvAsFloat(key string, fallback float64) float64 {
+	if value, exists := lookupSetting(key, settingFloat); exists {
+		floatVal, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return floatVal
+		}
+		configErrors = append(configErrors, fmt.Errorf("%s=%q: %w", key, value, err))
 	}
 	return fallback
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain sets the server up with its default configuration, the way main
+// does before serving
+func TestMain(m *testing.M) {
+	c, err := initConfig("")
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := c.validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	c.apply()
+	slots = newSlotPool(c.maxConcurrent, c.priorityReservedFraction)
+	ollamaBreaker = newCircuitBreaker(upstreamOllama, c.breakerThreshold, time.Duration(c.breakerCooldown)*time.Second)
+	whisperBreaker = newCircuitBreaker(upstreamWhisper, c.breakerThreshold, time.Duration(c.breakerCooldown)*time.Second)
+	os.Exit(m.Run())
+}
+
+// withWhisperURL returns ctx with its Whisper calls sent to url, as an
+// X-Whisper-URL override would
+func withWhisperURL(ctx context.Context, url string) context.Context {
+	return context.WithValue(ctx, upstreamOverridesKey, upstreamOverrides{whisper: url})
+}
+
+// setForTest sets *v to value for the rest of the test
+func setForTest[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+// setConfigForTest puts a copy of the configuration in use, changed by
+// set, in use for the rest of the test
+func setConfigForTest(t *testing.T, set func(c *config)) {
+	t.Helper()
+	old := cfg()
+	c := *old
+	set(&c)
+	currentConfig.Store(&c)
+	t.Cleanup(func() { currentConfig.Store(old) })
+}
+
+func TestLogMiddlewarePanicLeavesFlight(t *testing.T) {
+	before := inFlight.Load()
+	handler := logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	func() {
+		defer func() { recover() }()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+	}()
+	if got := inFlight.Load(); got != before {
+		t.Errorf("requests in flight = %d after a panicking handler, want %d", got, before)
+	}
+}
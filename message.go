@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// processMessage runs the pipeline on a message from a queue, recording
+// the result for endpoint: a /process JSON body with the audio as a data
+// URI or an audio_url, or the audio itself, processed with the defaults.
+// It returns the message's result under id, holding the error that failed
+// it, if any, which is also returned.
+func processMessage(ctx context.Context, endpoint, id string, value []byte) (BatchItem, error) {
+	item := BatchItem{ID: id}
+	result, err := runMessage(ctx, endpoint, id, value, &item)
+	if err != nil {
+		item.Error = err.Error()
+		return item, err
+	}
+	item.Result = &result.Response
+	return item, nil
+}
+
+func runMessage(ctx context.Context, endpoint, id string, value []byte, item *BatchItem) (*pipelineResult, error) {
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, requestIDKey, id), time.Duration(cfg().jobTimeout)*time.Second)
+	defer cancel()
+
+	var input *processInput
+	var err error
+	if body := bytes.TrimSpace(value); bytes.HasPrefix(body, []byte("{")) {
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/process", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		if input, err = readProcessInput(r); err != nil {
+			return nil, err
+		}
+	} else {
+		format := sniffAudioFormat(value[:min(len(value), sniffLength)])
+		if format == "" || !audioFormatAllowed(format) {
+			return nil, errors.New("the message is neither a JSON request nor audio in an allowed format")
+		}
+		if input, err = readUpload(ctx, nil, "audio."+format, bytes.NewReader(value)); err != nil {
+			return nil, err
+		}
+	}
+	defer input.Audio.Close()
+	item.Filename = input.Filename
+	switch {
+	case input.RawStream || input.Stream:
+		return nil, errors.New("messages can't be streamed")
+	case input.ResponseFormat != responseFormatJSON || input.Download || (input.TTS && input.TTSDelivery != speechDeliveryURL):
+		return nil, errors.New("message results are always JSON")
+	}
+	input.Caller = endpoint
+	return processUpload(ctx, endpoint, id, input, nil)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Latency buckets in seconds, from quick LLM replies to long transcriptions
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// Bridge metrics, exposed on /metrics in the Prometheus text format
+var (
+	httpRequests = newMetric("bridge_http_requests_total", "counter",
+		"HTTP requests by route, method and status code, including requests left out of the access log", "route", "method", "code")
+	httpDuration = newHistogram("bridge_http_request_duration_seconds",
+		"Time to answer HTTP requests by route", latencyBuckets, "route")
+	stageDuration = newHistogram("bridge_stage_duration_seconds",
+		"Duration of the pipeline stages: upload (buffering the upload), whisper (transcription) and llm (generation)", latencyBuckets, "stage")
+	queueWait = newHistogram("bridge_queue_wait_seconds",
+		"Time admitted requests waited for a slot in the admission queue", latencyBuckets)
+	upstreamErrors = newMetric("bridge_upstream_errors_total", "counter",
+		"Failed calls to the ASR backend (whisper) and the LLM providers", "upstream")
+	upstreamRetries = newMetric("bridge_upstream_retries_total", "counter",
+		"Upstream calls repeated after a retryable failure (WHISPER_RETRIES, LLM_RETRIES)", "upstream")
+	apiKeyRequests = newMetric("bridge_api_key_requests_total", "counter",
+		"Requests authenticated with each API key", "key")
+	tokenRequests = newMetric("bridge_token_requests_total", "counter",
+		"Requests authenticated with a JWT, by tenant claim", "tenant")
+	audioSeconds = newMetric("bridge_audio_seconds_total", "counter",
+		"Seconds of audio processed by /process and /jobs")
+	transcriptionCacheRequests = newMetric("bridge_transcription_cache_requests_total", "counter",
+		"Transcription cache lookups by result: hit, miss, or bypass when the request skipped the cache", "result")
+	llmCacheRequests = newMetric("bridge_llm_cache_requests_total", "counter",
+		"LLM response cache lookups by result: hit, miss, or bypass when the request skipped the cache", "result")
+	watchFiles = newMetric("bridge_watch_files_total", "counter",
+		"Files processed from the hot folders by result: ok or failed", "result")
+	kafkaMessages = newMetric("bridge_kafka_messages_total", "counter",
+		"Kafka messages processed by result: ok or failed", "result")
+	natsMessages = newMetric("bridge_nats_messages_total", "counter",
+		"NATS messages processed by result: ok, failed or rejected when every worker was busy", "result")
+	whisperFailovers = newMetric("bridge_whisper_failovers_total", "counter",
+		"Transcriptions sent to another WHISPER_URL backend after one failed")
+	ollamaFailovers = newMetric("bridge_ollama_failovers_total", "counter",
+		"Generations sent to another OLLAMA_URL host after one failed")
+	modelPulls = newMetric("bridge_model_pulls_total", "counter",
+		"Ollama models pulled by AUTO_PULL_MODELS by result: ok or failed", "result")
+
+	// Requests being served, counted by logMiddleware
+	inFlight atomic.Int64
+)
+
+// Pipeline stages in bridge_stage_duration_seconds
+const (
+	stageUpload  = "upload"
+	stageWhisper = "whisper"
+	stageLLM     = "llm"
+)
+
+// metric is a counter or histogram with labels. The bridge does without a
+// Prometheus client library, so this implements just the parts of the text
+// exposition format it needs.
+type metric struct {
+	name    string
+	kind    string // counter or histogram
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries // by label values, joined with \xff
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counter value or histogram sum
+	counts      []uint64 // histogram observations per bucket, not cumulative
+	count       uint64
+}
+
+func newMetric(name, kind, help string, labels ...string) *metric {
+	return initMetric(&metric{name: name, kind: kind, help: help, labels: labels})
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return initMetric(&metric{name: name, kind: "histogram", help: help, labels: labels, buckets: buckets})
+}
+
+func initMetric(m *metric) *metric {
+	m.series = make(map[string]*metricSeries)
+	// Unlabelled metrics are reported from the start
+	if len(m.labels) == 0 {
+		m.get(nil)
+	}
+	return m
+}
+
+// get returns the series for the label values. Called with mu held.
+func (m *metric) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues, counts: make([]uint64, len(m.buckets)+1)}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add increases a counter
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+// observe records a histogram observation
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	i, _ := slices.BinarySearch(m.buckets, v)
+	s.counts[i]++
+	s.count++
+	s.value += v
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeMetricHeader(w, m.name, m.kind, m.help)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			writeSample(w, m.name, m.labels, s.labelValues, "", "", s.value)
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, m.name+"_bucket", m.labels, s.labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(w, m.name+"_bucket", m.labels, s.labelValues, "le", "+Inf", float64(s.count))
+		writeSample(w, m.name+"_sum", m.labels, s.labelValues, "", "", s.value)
+		writeSample(w, m.name+"_count", m.labels, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+func writeMetricHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes one line, with an extra label such as le when
+// extraName is set
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=%q", label, values[i])
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=%q", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %s\n", formatFloat(v))
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// gauge writes a gauge read at scrape time
+func gauge(w *bufio.Writer, name, help string, v float64) {
+	writeMetricHeader(w, name, "gauge", help)
+	writeSample(w, name, nil, nil, "", "", v)
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+
+	for _, m := range []*metric{httpRequests, httpDuration, stageDuration, queueWait, upstreamErrors, upstreamRetries, apiKeyRequests, tokenRequests, audioSeconds, transcriptionCacheRequests, llmCacheRequests, watchFiles, kafkaMessages, natsMessages, whisperFailovers, ollamaFailovers, modelPulls} {
+		m.write(b)
+	}
+
+	gauge(b, "bridge_http_requests_in_flight", "HTTP requests being served", float64(inFlight.Load()))
+	shared, reserved := slots.capacity()
+	gauge(b, "bridge_slots_capacity", "Concurrent request slots (MAX_CONCURRENT_REQUESTS)", float64(shared+reserved))
+	gauge(b, "bridge_slots_in_use", "Concurrent request slots taken", float64(slots.inUse()))
+	if admission != nil {
+		gauge(b, "bridge_queue_waiting", "Requests waiting in the admission queue", float64(admission.waiting()))
+		gauge(b, "bridge_queue_capacity", "Requests allowed to wait in the admission queue", float64(admission.maxWaiting))
+	}
+	if ollamaSlots != nil {
+		gauge(b, "bridge_ollama_slots_in_use", "Slots of OLLAMA_MAX_CONCURRENT taken by generations", float64(ollamaSlots.inUse()))
+	}
+	whisperBackends.writeMetrics(b)
+	ollamaHosts.writeMetrics(b)
+	if jobs != nil {
+		gauge(b, "bridge_jobs_stored", "Async jobs held in the job store", float64(jobs.size()))
+	}
+	if cache, ok := transcriptions.(*memoryCache); ok {
+		gauge(b, "bridge_transcription_cache_entries", "Transcriptions held in the in-memory transcription cache", float64(cache.size()))
+	}
+	if cache, ok := llmResponses.(*memoryCache); ok {
+		gauge(b, "bridge_llm_cache_entries", "Responses held in the in-memory LLM response cache", float64(cache.size()))
+	}
+}
+
+// countUpstreamError counts a failed upstream call, unless it wasn't made
+// because of an open circuit breaker or failed because the request was
+// cancelled or timed out
+func countUpstreamError(ctx context.Context, upstream string, err error) {
+	if ctx.Err() == nil && !errors.Is(err, errCircuitOpen) {
+		upstreamErrors.add(1, upstream)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// modelPolicy holds the model aliases of MODEL_ALIASES and the models of
+// ALLOWED_MODELS
+type modelPolicy struct {
+	aliases map[string]string // by lowercased alias
+	allowed map[string]bool   // by ollamaModelName, nil allows any model
+	names   []string          // ALLOWED_MODELS as given, for errors
+}
+
+// parseModelPolicy parses MODEL_ALIASES, e.g. "fast=llama3:8b-q4,smart=llama3:70b",
+// and ALLOWED_MODELS, a comma-separated list of models. Aliases are
+// matched case-insensitively and must name allowed models.
+func parseModelPolicy(aliases, allowed string) (*modelPolicy, error) {
+	p := &modelPolicy{aliases: make(map[string]string)}
+	for _, entry := range strings.Split(aliases, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		alias, model, ok := strings.Cut(entry, "=")
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		model = strings.TrimSpace(model)
+		if !ok || alias == "" || model == "" {
+			return nil, fmt.Errorf("MODEL_ALIASES: invalid entry %q (expected alias=model)", entry)
+		}
+		p.aliases[alias] = model
+	}
+	if p.names = splitList(allowed); len(p.names) > 0 {
+		p.allowed = make(map[string]bool)
+		for _, model := range p.names {
+			p.allowed[ollamaModelName(model)] = true
+		}
+	}
+	for alias, model := range p.aliases {
+		if !p.allows(model) {
+			return nil, fmt.Errorf("MODEL_ALIASES: %s: model %q is not on ALLOWED_MODELS", alias, model)
+		}
+	}
+	return p, nil
+}
+
+// resolve returns the model an alias stands for, or model itself, and
+// rejects models that aren't on ALLOWED_MODELS with 400
+func (p *modelPolicy) resolve(model string) (string, error) {
+	if target, ok := p.aliases[strings.ToLower(strings.TrimSpace(model))]; ok {
+		model = target
+	}
+	if !p.allows(model) {
+		return "", newHTTPError(http.StatusBadRequest, "model %q is not allowed (allowed: %s)", model, p.choices())
+	}
+	return model, nil
+}
+
+// allows reports whether model is on ALLOWED_MODELS, or any model is
+// allowed
+func (p *modelPolicy) allows(model string) bool {
+	return p.allowed == nil || p.allowed[ollamaModelName(model)]
+}
+
+// choices lists the allowed models and the aliases, for errors
+func (p *modelPolicy) choices() string {
+	choices := slices.Clone(p.names)
+	for alias := range p.aliases {
+		choices = append(choices, alias)
+	}
+	slices.Sort(choices)
+	return strings.Join(choices, ", ")
+}
+
+// resolveModel applies MODEL_ALIASES and ALLOWED_MODELS to a model
+func resolveModel(model string) (string, error) {
+	return cfg().modelRules.resolve(model)
+}
+
+// requestModel returns the model for a request to llm that asked for
+// model: the model or alias it named, else the default model of the key
+// it authenticated with for the default provider, else the provider's
+// default. defaulted reports the last case, which LANGUAGE_MODELS may
+// override.
+func requestModel(r *http.Request, llm LLMProvider, model string) (resolved string, defaulted bool, err error) {
+	if model == "" {
+		if key := traceFromContext(r.Context()).apiKey; key != nil && key.DefaultModel != "" && llm == cfg().defaultLLM {
+			model = key.DefaultModel
+		} else {
+			model, defaulted = llm.defaultModel(), true
+		}
+	}
+	if model == "" {
+		return "", false, newHTTPError(http.StatusBadRequest, "model is required for provider %s", llm.name())
+	}
+	resolved, err = resolveModel(model)
+	return resolved, defaulted, err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Longest a model pull may take. Pulls outlive the requests waiting for
+// them, so a request that times out doesn't waste the download.
+const modelPullTimeout = time.Hour
+
+// PullProgress reports how far the pull of a model a generation waits for
+// has come, as sent in SSE pull events
+type PullProgress struct {
+	Model     string  `json:"model"`
+	Host      string  `json:"host"`
+	Status    string  `json:"status"`
+	Digest    string  `json:"digest,omitempty"`
+	Total     int64   `json:"total,omitempty"`
+	Completed int64   `json:"completed,omitempty"`
+	Percent   float64 `json:"percent,omitempty"`
+}
+
+// ollamaPullStatus is one line of Ollama's streamed /api/pull response
+type ollamaPullStatus struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest"`
+	Total     int64  `json:"total"`
+	Completed int64  `json:"completed"`
+	Error     string `json:"error"`
+}
+
+// modelPull is a pull in progress on one host. Requests for the model
+// wait for it rather than starting their own.
+type modelPull struct {
+	host *ollamaHost
+	done chan struct{}
+	err  error // set before done is closed
+
+	mu       sync.Mutex
+	progress PullProgress
+	changed  chan struct{} // closed and replaced on every update
+}
+
+// modelPuller runs the pulls of AUTO_PULL_MODELS, one per model at a time
+type modelPuller struct {
+	mu    sync.Mutex
+	pulls map[string]*modelPull // by ollamaModelName
+}
+
+var ollamaPulls = &modelPuller{pulls: make(map[string]*modelPull)}
+
+// wait pulls model on host, or joins the pull of model already running on
+// another host, and returns the host that has the model once it's done.
+// Progress is passed to the reporter of ctx, if any. A request that gives
+// up waiting leaves the pull running.
+func (p *modelPuller) wait(ctx context.Context, host *ollamaHost, model string) (*ollamaHost, error) {
+	pull := p.start(host, model)
+	report, _ := ctx.Value(pullProgressKey).(func(PullProgress))
+	var last PullProgress
+	for {
+		pull.mu.Lock()
+		progress, changed := pull.progress, pull.changed
+		pull.mu.Unlock()
+		if report != nil && progress.Status != "" && progress != last {
+			report(progress)
+			last = progress
+		}
+		select {
+		case <-pull.done:
+			if pull.err != nil {
+				return nil, pull.err
+			}
+			return pull.host, nil
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// start returns the running pull of model, starting one on host if there
+// is none
+func (p *modelPuller) start(host *ollamaHost, model string) *modelPull {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name := ollamaModelName(model)
+	if pull, ok := p.pulls[name]; ok {
+		return pull
+	}
+	pull := &modelPull{
+		host:     host,
+		done:     make(chan struct{}),
+		progress: PullProgress{Model: model, Host: host.url},
+		changed:  make(chan struct{}),
+	}
+	p.pulls[name] = pull
+	go func() {
+		pull.err = pull.run(model)
+		p.mu.Lock()
+		delete(p.pulls, name)
+		p.mu.Unlock()
+		close(pull.done)
+	}()
+	return pull
+}
+
+// run pulls model and records the host's new listing
+func (pull *modelPull) run(model string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), modelPullTimeout)
+	defer cancel()
+
+	log.Printf("Pulling %s on Ollama host %s", model, pull.host.url)
+	start := time.Now()
+	if err := pullOllamaModel(ctx, pull.host.url, model, pull.update); err != nil {
+		modelPulls.add(1, "failed")
+		log.Printf("Pulling %s on Ollama host %s failed: %v", model, pull.host.url, err)
+		return newHTTPError(http.StatusBadGateway, "pulling model %q on %s failed: %v", model, pull.host.url, err)
+	}
+	modelPulls.add(1, "ok")
+	log.Printf("Pulled %s on Ollama host %s in %s", model, pull.host.url, time.Since(start).Round(time.Second))
+
+	if tags, err := fetchOllamaTags(ctx, pull.host.url); err == nil {
+		pull.host.setModels(tags)
+	} else {
+		// Generate anyway, Ollama has the model even if the listing failed
+		log.Printf("Listing models on Ollama host %s after pulling %s failed: %v", pull.host.url, model, err)
+	}
+	ollamaModels.refresh(ctx)
+	return nil
+}
+
+// update records a line of Ollama's progress. Download progress is only
+// passed on when it grew by a whole percent, as Ollama reports it many
+// times a second.
+func (pull *modelPull) update(status ollamaPullStatus) {
+	pull.mu.Lock()
+	defer pull.mu.Unlock()
+	progress := pull.progress
+	progress.Status, progress.Digest = status.Status, status.Digest
+	progress.Total, progress.Completed, progress.Percent = status.Total, status.Completed, 0
+	if status.Total > 0 {
+		progress.Percent = math.Floor(float64(status.Completed) * 100 / float64(status.Total))
+	}
+	if progress.Status == pull.progress.Status && progress.Digest == pull.progress.Digest && progress.Percent == pull.progress.Percent {
+		return
+	}
+	pull.progress = progress
+	close(pull.changed)
+	pull.changed = make(chan struct{})
+}
+
+// pullOllamaModel pulls model on the Ollama at url, passing each progress
+// line Ollama streams to update
+func pullOllamaModel(ctx context.Context, url, model string, update func(ollamaPullStatus)) error {
+	body, err := json.Marshal(map[string]any{"model": model, "stream": true})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/api/pull", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := upstreamClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newUpstreamError(upstreamOllama, resp)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var status ollamaPullStatus
+		if err := dec.Decode(&status); err != nil {
+			return fmt.Errorf("reading pull progress: %w", err)
+		}
+		if status.Error != "" {
+			return errors.New(status.Error)
+		}
+		update(status)
+		if status.Status == "success" {
+			return nil
+		}
+	}
+}
+
+// withPullProgress makes the model pulls a generation waits for report
+// their progress to the client, when stream can show it
+func withPullProgress(ctx context.Context, stream tokenStream) context.Context {
+	reporter, ok := stream.(interface{ pull(PullProgress) })
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, pullProgressKey, reporter.pull)
+}
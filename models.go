@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modelsRecheckInterval limits how often /process re-lists the models
+// while Ollama has none or hasn't answered yet
+const modelsRecheckInterval = 5 * time.Second
+
+// modelState tracks whether Ollama has any model pulled. It is unknown
+// until the first successful listing, and requests are only rejected once
+// Ollama has actually reported an empty list.
+type modelState struct {
+	mu        sync.Mutex
+	attempted time.Time
+	known     bool
+	available bool
+}
+
+var ollamaModels = &modelState{}
+
+// ollamaTagsResponse is the part of Ollama's /api/tags response we use
+type ollamaTagsResponse struct {
+	Models []ollamaTag `json:"models"`
+}
+
+// ollamaTag describes a model pulled on an Ollama host
+type ollamaTag struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	Digest     string    `json:"digest"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Details    struct {
+		Format            string `json:"format"`
+		Family            string `json:"family"`
+		ParameterSize     string `json:"parameter_size"`
+		QuantizationLevel string `json:"quantization_level"`
+	} `json:"details"`
+}
+
+// refresh lists the models on every Ollama host and records whether there
+// are any. Failures to reach Ollama leave the previous state in place.
+func (m *modelState) refresh(ctx context.Context) error {
+	m.mu.Lock()
+	m.attempted = time.Now()
+	m.mu.Unlock()
+
+	available, err := ollamaHosts.listModels(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !available && (!m.known || m.available) {
+		log.Printf("Ollama at %s has no models, pull one with `ollama pull <model>`", cfg().ollamaURL)
+	} else if available && m.known && !m.available {
+		log.Printf("Ollama models available again")
+	}
+	m.known = true
+	m.available = available
+	return nil
+}
+
+// recheck lists the models again unless that was tried less than
+// modelsRecheckInterval ago
+func (m *modelState) recheck(ctx context.Context) {
+	m.mu.Lock()
+	stale := time.Since(m.attempted) >= modelsRecheckInterval
+	m.mu.Unlock()
+	if stale {
+		m.refresh(ctx)
+	}
+}
+
+// missing reports whether Ollama was last seen with no models. Until
+// Ollama has reported models, the listing is refreshed at most every
+// modelsRecheckInterval, so a freshly pulled model or an Ollama that came
+// up after the bridge is picked up without waiting for the keepalive
+// pinger.
+func (m *modelState) missing(ctx context.Context) bool {
+	m.mu.Lock()
+	stale := !m.available && time.Since(m.attempted) >= modelsRecheckInterval
+	m.mu.Unlock()
+	if stale {
+		m.refresh(ctx)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.known && !m.available
+}
+
+// writeNoModels responds with 503 when Ollama has no models and reports
+// whether it did. With AUTO_PULL_MODELS the model is pulled instead.
+func writeNoModels(ctx context.Context, w http.ResponseWriter) bool {
+	if cfg().autoPullModels || !ollamaModels.missing(ctx) {
+		return false
+	}
+	http.Error(w, cfg().noModelsMessage, http.StatusServiceUnavailable)
+	return true
+}
+
+// How long GET /models waits for the backends
+const modelsListTimeout = 10 * time.Second
+
+// ModelsResponse is the answer of GET /models: what the ASR backend and
+// the LLM providers can run, for clients to offer as choices
+type ModelsResponse struct {
+	ASR    ASRModels `json:"asr"`
+	LLM    LLMModels `json:"llm"`
+	Errors []string  `json:"errors,omitempty"` // backends that couldn't be listed
+}
+
+// ASRModels describes the ASR backend
+type ASRModels struct {
+	Backend   string   `json:"backend"`
+	Model     string   `json:"model,omitempty"`     // the model asked for, empty when the server has one
+	Available []string `json:"available,omitempty"` // models a faster-whisper server offers
+	Translate bool     `json:"translate"`
+	Servers   int      `json:"servers,omitempty"` // WHISPER_URL servers
+}
+
+// LLMModels lists the models requests can use
+type LLMModels struct {
+	DefaultProvider string            `json:"default_provider"`
+	DefaultModel    string            `json:"default_model"` // for the caller
+	Providers       []LLMProviderInfo `json:"providers"`
+	Models          []LLMModelInfo    `json:"models"`
+	Aliases         map[string]string `json:"aliases,omitempty"`
+}
+
+// LLMProviderInfo names a configured provider and its default model
+type LLMProviderInfo struct {
+	Name         string `json:"name"`
+	DefaultModel string `json:"default_model,omitempty"`
+}
+
+// LLMModelInfo describes a model pulled on Ollama
+type LLMModelInfo struct {
+	Name              string     `json:"name"`
+	Provider          string     `json:"provider"`
+	Family            string     `json:"family,omitempty"`
+	Format            string     `json:"format,omitempty"`
+	ParameterSize     string     `json:"parameter_size,omitempty"`
+	QuantizationLevel string     `json:"quantization_level,omitempty"`
+	ContextLength     int        `json:"context_length,omitempty"`
+	SizeBytes         int64      `json:"size_bytes,omitempty"`
+	ModifiedAt        *time.Time `json:"modified_at,omitempty"`
+	Hosts             []string   `json:"hosts,omitempty"` // with several OLLAMA_URL hosts
+}
+
+// modelsHandler lists the ASR backend's model and the Ollama models of
+// every OLLAMA_URL host, with their metadata. Models off ALLOWED_MODELS
+// are left out.
+func modelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), modelsListTimeout)
+	defer cancel()
+
+	resp := ModelsResponse{
+		ASR: ASRModels{Backend: cfg().transcriber.name(), Translate: canTranslate(cfg().transcriber)},
+		LLM: LLMModels{DefaultProvider: cfg().defaultLLM.name(), Models: []LLMModelInfo{}},
+	}
+	switch t := cfg().transcriber.(type) {
+	case fasterWhisperTranscriber:
+		resp.ASR.Model = t.model
+		available, err := fetchFasterWhisperModels(ctx)
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %v", asrFasterWhisper, err))
+		}
+		resp.ASR.Available = available
+	case *deepgramTranscriber:
+		resp.ASR.Model = t.model
+	}
+	if cfg().transcriber.name() != asrDeepgram {
+		resp.ASR.Servers = len(whisperBackends.list())
+	}
+
+	resp.LLM.DefaultModel, _, _ = requestModel(r, cfg().defaultLLM, "")
+	for _, name := range slices.Sorted(maps.Keys(cfg().llmProviders)) {
+		resp.LLM.Providers = append(resp.LLM.Providers, LLMProviderInfo{Name: name, DefaultModel: cfg().llmProviders[name].defaultModel()})
+	}
+	if len(cfg().modelRules.aliases) > 0 {
+		resp.LLM.Aliases = cfg().modelRules.aliases
+	}
+
+	models, errs := listOllamaModelInfo(ctx)
+	resp.Errors = append(resp.Errors, errs...)
+	for _, model := range models {
+		if cfg().modelRules.allows(model.Name) {
+			resp.LLM.Models = append(resp.LLM.Models, model)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// listOllamaModelInfo lists the models of every OLLAMA_URL host, merging
+// those on several hosts, with the context length from /api/show. It
+// returns an error message for each host that couldn't be listed.
+func listOllamaModelInfo(ctx context.Context) ([]LLMModelInfo, []string) {
+	urls := splitBackendURLs(cfg().ollamaURL)
+	tags := make([][]ollamaTag, len(urls))
+	errs := make([]error, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tags[i], errs[i] = fetchOllamaTags(ctx, url)
+		}()
+	}
+	wg.Wait()
+
+	var models []LLMModelInfo
+	var messages []string
+	byName := make(map[string]int)
+	for i, url := range urls {
+		if errs[i] != nil {
+			messages = append(messages, fmt.Sprintf("%s %s: %v", providerOllama, url, errs[i]))
+			continue
+		}
+		for _, tag := range tags[i] {
+			if j, ok := byName[ollamaModelName(tag.Name)]; ok {
+				models[j].Hosts = append(models[j].Hosts, url)
+				continue
+			}
+			byName[ollamaModelName(tag.Name)] = len(models)
+			model := LLMModelInfo{
+				Name:              tag.Name,
+				Provider:          providerOllama,
+				Family:            tag.Details.Family,
+				Format:            tag.Details.Format,
+				ParameterSize:     tag.Details.ParameterSize,
+				QuantizationLevel: tag.Details.QuantizationLevel,
+				ContextLength:     ollamaContextLengths.get(ctx, url, tag),
+				SizeBytes:         tag.Size,
+				Hosts:             []string{url},
+			}
+			if !tag.ModifiedAt.IsZero() {
+				model.ModifiedAt = &tag.ModifiedAt
+			}
+			models = append(models, model)
+		}
+	}
+	if len(urls) < 2 {
+		for i := range models {
+			models[i].Hosts = nil
+		}
+	}
+	slices.SortFunc(models, func(a, b LLMModelInfo) int { return strings.Compare(a.Name, b.Name) })
+	return models, messages
+}
+
+// contextLengths caches the context length of Ollama models by digest,
+// which /api/tags doesn't report and /api/show is too slow to ask for on
+// every listing
+type contextLengths struct {
+	mu       sync.Mutex
+	byDigest map[string]int
+}
+
+var ollamaContextLengths = &contextLengths{byDigest: make(map[string]int)}
+
+// get returns the context length of the model tag on the Ollama at url,
+// or 0 when it can't be found out
+func (c *contextLengths) get(ctx context.Context, url string, tag ollamaTag) int {
+	c.mu.Lock()
+	length, ok := c.byDigest[tag.Digest]
+	c.mu.Unlock()
+	if ok {
+		return length
+	}
+
+	length, err := fetchOllamaContextLength(ctx, url, tag.Name)
+	if err != nil {
+		return 0
+	}
+	if tag.Digest != "" {
+		c.mu.Lock()
+		c.byDigest[tag.Digest] = length
+		c.mu.Unlock()
+	}
+	return length
+}
+
+// fetchOllamaContextLength reads a model's context length from the
+// <architecture>.context_length entry of its /api/show model info
+func fetchOllamaContextLength(ctx context.Context, url, model string) (int, error) {
+	body, err := json.Marshal(map[string]string{"model": model})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/api/show", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := upstreamClient(0).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("showing %s: status %d", model, resp.StatusCode)
+	}
+
+	var show struct {
+		ModelInfo map[string]any `json:"model_info"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&show); err != nil {
+		return 0, fmt.Errorf("showing %s: %w", model, err)
+	}
+	architecture, _ := show.ModelInfo["general.architecture"].(string)
+	length, _ := show.ModelInfo[architecture+".context_length"].(float64)
+	return int(length), nil
+}
+
+// fetchFasterWhisperModels returns the models a faster-whisper server
+// offers at /v1/models
+func fetchFasterWhisperModels(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, whisperBaseURL(ctx)+"/v1/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upstreamClient(0).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing models: status %d", resp.StatusCode)
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("listing models: %w", err)
+	}
+	models := make([]string, len(list.Data))
+	for i, model := range list.Data {
+		models[i] = model.ID
+	}
+	slices.Sort(models)
+	return models, nil
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bound on connecting to NATS, on a write, and on a JetStream API request
+const natsTimeout = 10 * time.Second
+
+// How often the client pings the server, so a dead connection is noticed
+// after two unanswered pings
+const natsPingInterval = 30 * time.Second
+
+// Largest message accepted when the server doesn't say
+const natsDefaultMaxPayload = 1 << 20
+
+// JetStream API error codes the bridge acts on
+const natsStreamNotFound = 10059
+
+// errNATSPayloadTooLarge is returned for messages over the server's
+// max_payload
+var errNATSPayloadTooLarge = errors.New("nats: message larger than the server's max_payload")
+
+// natsOptions is where to connect to NATS and how to authenticate
+type natsOptions struct {
+	addr     string
+	user     string
+	password string
+	token    string
+}
+
+// parseNATSURL parses a nats://[user:password@|token@]host[:port] URL
+func parseNATSURL(rawURL string) (natsOptions, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return natsOptions{}, err
+	}
+	if u.Scheme != "nats" || u.Hostname() == "" {
+		return natsOptions{}, fmt.Errorf("expected nats://host:port, got %q", rawURL)
+	}
+	opts := natsOptions{addr: u.Host}
+	if u.Port() == "" {
+		opts.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			opts.user, opts.password = u.User.Username(), password
+		} else {
+			opts.token = u.User.Username()
+		}
+	}
+	return opts, nil
+}
+
+// natsMsg is a message delivered on a subscription
+type natsMsg struct {
+	Subject string
+	Reply   string
+	Header  textproto.MIMEHeader // nil for messages without headers
+	Status  string               // status of a status message, like JetStream's 404 and 408
+	Data    []byte
+}
+
+// natsConn is a connection to a NATS server speaking the client protocol,
+// the few commands the bridge needs, without a client library. A reader
+// goroutine delivers messages to the channel of their subscription. The
+// connection doesn't reconnect: once done is closed, callers dial again.
+type natsConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	maxPayload int
+
+	mu      sync.Mutex // guards writes and subs
+	subs    map[string]chan<- natsMsg
+	nextSID int
+
+	pings atomic.Int32 // pings sent without a pong
+
+	done      chan struct{}
+	err       error // why the connection ended, set before done is closed
+	closeOnce sync.Once
+}
+
+// natsInfo is the INFO the server sends on connect
+type natsInfo struct {
+	MaxPayload  int  `json:"max_payload"`
+	Headers     bool `json:"headers"`
+	TLSRequired bool `json:"tls_required"`
+}
+
+// dialNATS connects and authenticates to the server, naming the
+// connection name
+func dialNATS(ctx context.Context, opts natsOptions, name string) (*natsConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, natsTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", opts.addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	netConn.SetDeadline(deadline)
+	c := &natsConn{
+		conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		subs:   make(map[string]chan<- natsMsg),
+		done:   make(chan struct{}),
+	}
+	if err := c.handshake(opts, name); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+	go c.read()
+	go c.ping()
+	return c, nil
+}
+
+// handshake reads the server's INFO, sends CONNECT and waits for the PONG
+// that confirms it
+func (c *natsConn) handshake(opts natsOptions, name string) error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	op, args, _ := strings.Cut(line, " ")
+	if op != "INFO" {
+		return fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(args), &info); err != nil {
+		return fmt.Errorf("nats: invalid INFO: %w", err)
+	}
+	switch {
+	case info.TLSRequired:
+		return errors.New("nats: the server requires TLS, which isn't supported")
+	case !info.Headers:
+		return errors.New("nats: the server doesn't support headers, NATS 2.2 or later is required")
+	}
+	c.maxPayload = info.MaxPayload
+	if c.maxPayload <= 0 {
+		c.maxPayload = natsDefaultMaxPayload
+	}
+
+	connect, err := json.Marshal(map[string]any{
+		"verbose":       false,
+		"pedantic":      false,
+		"name":          name,
+		"lang":          "go",
+		"version":       "1.0.0",
+		"protocol":      1,
+		"headers":       true,
+		"no_responders": true,
+		"user":          opts.user,
+		"pass":          opts.password,
+		"auth_token":    opts.token,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		return err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch op {
+		case "PONG":
+			return nil
+		case "-ERR":
+			return fmt.Errorf("nats: %s", strings.Trim(args, "'"))
+		}
+	}
+}
+
+// read delivers messages and answers pings until the connection fails
+func (c *natsConn) read() {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "MSG", "HMSG":
+			if err := c.readMsg(strings.ToUpper(op) == "HMSG", strings.Fields(args)); err != nil {
+				c.fail(err)
+				return
+			}
+		case "PING":
+			c.write([]byte("PONG\r\n"))
+		case "PONG":
+			c.pings.Store(0)
+		case "INFO", "+OK":
+		case "-ERR":
+			// The server closes the connection after the errors that end it
+			log.Printf("NATS: %s", strings.Trim(args, "'"))
+		default:
+			c.fail(fmt.Errorf("nats: unexpected %q", line))
+			return
+		}
+	}
+}
+
+// readMsg reads the payload of a MSG or HMSG with the arguments args and
+// delivers it
+func (c *natsConn) readMsg(headers bool, args []string) error {
+	// MSG <subject> <sid> [reply] <size>
+	// HMSG <subject> <sid> [reply] <header size> <size>
+	fixed := 3
+	if headers {
+		fixed = 4
+	}
+	if len(args) != fixed && len(args) != fixed+1 {
+		return fmt.Errorf("nats: invalid message arguments %q", strings.Join(args, " "))
+	}
+	msg := natsMsg{Subject: args[0]}
+	if len(args) == fixed+1 {
+		msg.Reply = args[2]
+	}
+	size, err := strconv.Atoi(args[len(args)-1])
+	// JetStream can add headers to a message the size of max_payload
+	if err != nil || size < 0 || size > c.maxPayload+64<<10 {
+		return fmt.Errorf("nats: invalid message size %q", args[len(args)-1])
+	}
+	headerSize := 0
+	if headers {
+		if headerSize, err = strconv.Atoi(args[len(args)-2]); err != nil || headerSize < 0 || headerSize > size {
+			return fmt.Errorf("nats: invalid header size %q", args[len(args)-2])
+		}
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return err
+	}
+	msg.Data = data[headerSize:size]
+	if headers {
+		if msg.Header, msg.Status, err = parseNATSHeader(data[:headerSize]); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	ch := c.subs[args[1]]
+	c.mu.Unlock()
+	if ch == nil {
+		return nil
+	}
+	select {
+	case ch <- msg:
+	case <-c.done:
+	}
+	return nil
+}
+
+// parseNATSHeader parses a NATS/1.0 header block and its status line
+func parseNATSHeader(data []byte) (textproto.MIMEHeader, string, error) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	line, err := reader.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "NATS/1.0") {
+		return nil, "", fmt.Errorf("nats: invalid header %q", line)
+	}
+	status, _, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "NATS/1.0")), " ")
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", fmt.Errorf("nats: invalid header: %w", err)
+	}
+	return header, status, nil
+}
+
+// ping pings the server every natsPingInterval, failing the connection
+// when two pings went unanswered
+func (c *natsConn) ping() {
+	ticker := time.NewTicker(natsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if c.pings.Add(1) > 2 {
+			c.fail(errors.New("nats: the server stopped answering pings"))
+			return
+		}
+		c.write([]byte("PING\r\n"))
+	}
+}
+
+// readLine reads a protocol line without its CRLF
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// write writes a command, failing the connection when it can't
+func (c *natsConn) write(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	if _, err := c.conn.Write(data); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// subscribe delivers the messages on subject to ch, shared with the other
+// members of queue when it isn't empty. It returns the subscription ID.
+func (c *natsConn) subscribe(subject, queue string, ch chan<- natsMsg) (string, error) {
+	c.mu.Lock()
+	c.nextSID++
+	sid := strconv.Itoa(c.nextSID)
+	c.subs[sid] = ch
+	c.mu.Unlock()
+	command := "SUB " + subject + " " + sid + "\r\n"
+	if queue != "" {
+		command = "SUB " + subject + " " + queue + " " + sid + "\r\n"
+	}
+	return sid, c.write([]byte(command))
+}
+
+// unsubscribe ends the subscription sid
+func (c *natsConn) unsubscribe(sid string) error {
+	c.mu.Lock()
+	delete(c.subs, sid)
+	c.mu.Unlock()
+	return c.write([]byte("UNSUB " + sid + "\r\n"))
+}
+
+// publish sends data on subject, with the headers in header when there
+// are any and the reply subject reply when it isn't empty
+func (c *natsConn) publish(subject, reply string, header textproto.MIMEHeader, data []byte) error {
+	var headerBlock []byte
+	if len(header) > 0 {
+		var b bytes.Buffer
+		b.WriteString("NATS/1.0\r\n")
+		for key, values := range header {
+			for _, value := range values {
+				fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+			}
+		}
+		b.WriteString("\r\n")
+		headerBlock = b.Bytes()
+	}
+	size := len(headerBlock) + len(data)
+	if size > c.maxPayload {
+		return errNATSPayloadTooLarge
+	}
+
+	var b bytes.Buffer
+	b.Grow(size + len(subject) + len(reply) + 32)
+	if headerBlock != nil {
+		b.WriteString("HPUB " + subject + " ")
+	} else {
+		b.WriteString("PUB " + subject + " ")
+	}
+	if reply != "" {
+		b.WriteString(reply + " ")
+	}
+	if headerBlock != nil {
+		b.WriteString(strconv.Itoa(len(headerBlock)) + " ")
+	}
+	b.WriteString(strconv.Itoa(size) + "\r\n")
+	b.Write(headerBlock)
+	b.Write(data)
+	b.WriteString("\r\n")
+	return c.write(b.Bytes())
+}
+
+// request publishes data on subject and waits for the first reply
+func (c *natsConn) request(ctx context.Context, subject string, data []byte) (natsMsg, error) {
+	inbox := "_INBOX." + newRequestID()
+	replies := make(chan natsMsg, 1)
+	sid, err := c.subscribe(inbox, "", replies)
+	if err != nil {
+		return natsMsg{}, err
+	}
+	defer c.unsubscribe(sid)
+	if err := c.publish(subject, inbox, nil, data); err != nil {
+		return natsMsg{}, err
+	}
+	select {
+	case msg := <-replies:
+		if msg.Status == "503" {
+			return natsMsg{}, fmt.Errorf("nats: no responders on %s", subject)
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return natsMsg{}, ctx.Err()
+	case <-c.done:
+		return natsMsg{}, c.err
+	}
+}
+
+// natsAPIError is an error returned by the JetStream API
+type natsAPIError struct {
+	Code        int    `json:"code"`
+	ErrCode     int    `json:"err_code"`
+	Description string `json:"description"`
+}
+
+func (e *natsAPIError) Error() string {
+	return fmt.Sprintf("jetstream: %s (error %d)", e.Description, e.ErrCode)
+}
+
+// jsRequest sends a request to the JetStream API at $JS.API.<api>. A
+// JetStream server that isn't enabled has no responders.
+func (c *natsConn) jsRequest(ctx context.Context, api string, req any) error {
+	ctx, cancel := context.WithTimeout(ctx, natsTimeout)
+	defer cancel()
+	var data []byte
+	if req != nil {
+		var err error
+		if data, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	msg, err := c.request(ctx, "$JS.API."+api, data)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Error *natsAPIError `json:"error"`
+	}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return fmt.Errorf("jetstream: invalid response: %w", err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	return nil
+}
+
+// close closes the connection
+func (c *natsConn) close() {
+	c.fail(errors.New("nats: connection closed"))
+}
+
+// fail ends the connection with err, the first time
+func (c *natsConn) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.conn.Close()
+		close(c.done)
+	})
+}
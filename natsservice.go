@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint NATS results are recorded for, and the caller they are
+// recorded under
+const resultEndpointNATS = "nats"
+
+// Header of a JetStream message naming the subject its result is
+// published to
+const natsReplyToHeader = "Reply-To"
+
+// Service timings: the first and longest waits before reconnecting, how
+// long JetStream waits for the ack of a message before redelivering it and
+// how often a message being processed is marked in progress to hold it
+// off, and how long a pull request waits for messages
+const (
+	natsRetryBackoff     = 2 * time.Second
+	natsMaxRetryInterval = 30 * time.Second
+	natsAckWait          = 30 * time.Second
+	natsProgressInterval = 10 * time.Second
+	natsPullExpires      = 30 * time.Second
+)
+
+// Messages a subscription holds before the connection waits for them to be
+// taken
+const natsSubscriptionQueue = 64
+
+// natsService serves the pipeline over NATS. Without NATS_STREAM it is a
+// request/reply service: it takes the requests on NATS_SUBJECT as a member
+// of the NATS_QUEUE queue group and replies with the results. With
+// NATS_STREAM it pulls the messages stored in that JetStream stream from
+// the NATS_CONSUMER durable consumer, shared by every bridge, and only
+// acknowledges a message once its result is published, so every message
+// gets a result at least once. Up to NATS_WORKERS messages are processed
+// at once.
+type natsService struct {
+	opts          natsOptions
+	subject       string
+	queue         string
+	stream        string
+	consumer      string
+	resultSubject string
+
+	workers chan struct{}  // one token per message being processed
+	freed   chan struct{}  // signaled when a worker is done
+	wg      sync.WaitGroup // messages being processed
+
+	done chan struct{} // closed once run has finished its messages
+}
+
+func newNATSService() *natsService {
+	opts, _ := parseNATSURL(cfg().natsURL)
+	return &natsService{
+		opts:          opts,
+		subject:       cfg().natsSubject,
+		queue:         cfg().natsQueue,
+		stream:        cfg().natsStream,
+		consumer:      cfg().natsConsumer,
+		resultSubject: cfg().natsResultSubject,
+		workers:       make(chan struct{}, cfg().natsWorkers),
+		freed:         make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+}
+
+// run serves until ctx is done, reconnecting after failures, and finishes
+// the messages being processed on the way out
+func (ns *natsService) run(ctx context.Context) {
+	defer close(ns.done)
+	backoff := natsRetryBackoff
+	for ctx.Err() == nil {
+		conn, err := dialNATS(ctx, ns.opts, "whisper-llm-bridge")
+		if err == nil {
+			backoff = natsRetryBackoff
+			err = ns.session(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("NATS: %v, reconnecting in %s", err, backoff)
+		sleepContext(ctx, backoff)
+		backoff = min(backoff*2, natsMaxRetryInterval)
+	}
+}
+
+// session serves on conn until ctx is done or the connection fails. The
+// messages being processed are finished before the connection is closed.
+func (ns *natsService) session(ctx context.Context, conn *natsConn) error {
+	defer conn.close()
+	defer ns.wg.Wait()
+	if ns.stream == "" {
+		return ns.serve(ctx, conn)
+	}
+	return ns.pull(ctx, conn)
+}
+
+// serve takes requests from the subject, replying at once to those that
+// come while every worker is busy
+func (ns *natsService) serve(ctx context.Context, conn *natsConn) error {
+	msgs := make(chan natsMsg, natsSubscriptionQueue)
+	if _, err := conn.subscribe(ns.subject, ns.queue, msgs); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-conn.done:
+			return fmt.Errorf("connection lost: %w", conn.err)
+		case msg := <-msgs:
+			if !ns.dispatch(ctx, conn, msg, false) {
+				natsMessages.add(1, "rejected")
+				id := newRequestID()
+				ns.publish(conn, ns.resultTo(msg, false), id, BatchItem{ID: id, Error: "Server is at capacity, please try again later"})
+			}
+		}
+	}
+}
+
+// pull creates the stream and the consumer when they are missing and
+// pulls a message for each free worker. Messages are only pulled for free
+// workers, but one that finds them all busy is handed back for
+// redelivery.
+func (ns *natsService) pull(ctx context.Context, conn *natsConn) error {
+	if err := ns.ensureConsumer(ctx, conn); err != nil {
+		return err
+	}
+	inbox := "_INBOX." + newRequestID()
+	msgs := make(chan natsMsg, natsSubscriptionQueue)
+	if _, err := conn.subscribe(inbox, "", msgs); err != nil {
+		return err
+	}
+	next, err := json.Marshal(map[string]any{"batch": 1, "expires": natsPullExpires})
+	if err != nil {
+		return err
+	}
+
+	// Each pull request ends with a message or a status, so pending counts
+	// the requests waiting. Should the ends get lost, they are reissued
+	// once nothing came for two expiries.
+	pending := 0
+	idle := time.NewTimer(2 * natsPullExpires)
+	defer idle.Stop()
+	for {
+		for ; pending < cap(ns.workers)-len(ns.workers); pending++ {
+			if err := conn.publish("$JS.API.CONSUMER.MSG.NEXT."+ns.stream+"."+ns.consumer, inbox, nil, next); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-conn.done:
+			return fmt.Errorf("connection lost: %w", conn.err)
+		case <-ns.freed:
+			continue
+		case <-idle.C:
+			pending = 0
+		case msg := <-msgs:
+			pending = max(pending-1, 0)
+			if msg.Status == "" && !ns.dispatch(ctx, conn, msg, true) {
+				conn.publish(msg.Reply, "", nil, []byte("-NAK"))
+			}
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(2 * natsPullExpires)
+	}
+}
+
+// ensureConsumer creates the stream, as a work queue on the subject, when
+// it is missing, and the durable consumer the bridges share
+func (ns *natsService) ensureConsumer(ctx context.Context, conn *natsConn) error {
+	var apiErr *natsAPIError
+	err := conn.jsRequest(ctx, "STREAM.INFO."+ns.stream, nil)
+	if errors.As(err, &apiErr) && apiErr.ErrCode == natsStreamNotFound {
+		err = conn.jsRequest(ctx, "STREAM.CREATE."+ns.stream, map[string]any{
+			"name":      ns.stream,
+			"subjects":  []string{ns.subject},
+			"retention": "workqueue",
+			"storage":   "file",
+		})
+		if err == nil {
+			log.Printf("Created JetStream stream %s on %s", ns.stream, ns.subject)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up stream %s: %w", ns.stream, err)
+	}
+	err = conn.jsRequest(ctx, "CONSUMER.DURABLE.CREATE."+ns.stream+"."+ns.consumer, map[string]any{
+		"stream_name": ns.stream,
+		"config": map[string]any{
+			"durable_name":   ns.consumer,
+			"deliver_policy": "all",
+			"ack_policy":     "explicit",
+			"ack_wait":       natsAckWait,
+			"filter_subject": ns.subject,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up consumer %s: %w", ns.consumer, err)
+	}
+	return nil
+}
+
+// dispatch processes msg on a free worker, reporting false when every
+// worker is busy
+func (ns *natsService) dispatch(ctx context.Context, conn *natsConn, msg natsMsg, jetStream bool) bool {
+	select {
+	case ns.workers <- struct{}{}:
+	default:
+		return false
+	}
+	ns.wg.Add(1)
+	go func() {
+		defer func() {
+			<-ns.workers
+			select {
+			case ns.freed <- struct{}{}:
+			default:
+			}
+			ns.wg.Done()
+		}()
+		ns.handle(ctx, conn, msg, jetStream)
+	}()
+	return true
+}
+
+// handle processes a message and publishes its result. A JetStream
+// message is marked in progress while it is processed, then acknowledged,
+// or handed back for redelivery when ctx is done first or the result
+// can't be published.
+func (ns *natsService) handle(ctx context.Context, conn *natsConn, msg natsMsg, jetStream bool) {
+	id := newRequestID()
+	stopProgress := func() {}
+	if jetStream {
+		stopProgress = ns.markInProgress(conn, msg.Reply)
+	}
+	item, err := processMessage(ctx, resultEndpointNATS, id, msg.Data)
+	stopProgress()
+	if err != nil {
+		if ctx.Err() != nil && jetStream {
+			conn.publish(msg.Reply, "", nil, []byte("-NAK"))
+			return
+		}
+		natsMessages.add(1, "failed")
+		log.Printf("NATS message on %s failed: %v request_id=%s", msg.Subject, err, id)
+	} else {
+		natsMessages.add(1, "ok")
+		log.Printf("NATS message on %s processed request_id=%s", msg.Subject, id)
+	}
+
+	err = ns.publish(conn, ns.resultTo(msg, jetStream), id, item)
+	if !jetStream {
+		return
+	}
+	if err != nil {
+		conn.publish(msg.Reply, "", nil, []byte("-NAK"))
+		return
+	}
+	conn.publish(msg.Reply, "", nil, []byte("+ACK"))
+}
+
+// resultTo returns the subject the result of msg is published to: its
+// reply subject, the Reply-To header of a JetStream message, or
+// NATS_RESULT_SUBJECT
+func (ns *natsService) resultTo(msg natsMsg, jetStream bool) string {
+	if jetStream {
+		if subject := strings.TrimSpace(msg.Header.Get(natsReplyToHeader)); subject != "" {
+			return subject
+		}
+	} else if msg.Reply != "" {
+		return msg.Reply
+	}
+	return ns.resultSubject
+}
+
+// publish sends a result to subject, under the request ID. A result too
+// large for the server is replaced by the error saying so.
+func (ns *natsService) publish(conn *natsConn, subject, id string, item BatchItem) error {
+	if subject == "" {
+		return nil
+	}
+	header := textproto.MIMEHeader{cfg().requestIDHeader: {id}}
+	data, err := json.Marshal(item)
+	if err == nil {
+		err = conn.publish(subject, "", header, data)
+	}
+	if errors.Is(err, errNATSPayloadTooLarge) {
+		data, err = json.Marshal(BatchItem{ID: item.ID, Filename: item.Filename, Error: "the result is larger than the NATS server's max_payload"})
+		if err == nil {
+			err = conn.publish(subject, "", header, data)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to publish the result to %s: %v request_id=%s", subject, err, id)
+	}
+	return err
+}
+
+// markInProgress tells JetStream every natsProgressInterval that the
+// message with the ack subject ack is still being processed, until the
+// returned function is called
+func (ns *natsService) markInProgress(conn *natsConn, ack string) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(natsProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				conn.publish(ack, "", nil, []byte("+WPI"))
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// checkNATSConfig reports what is wrong with the NATS_ settings
+func (c *config) checkNATSConfig() error {
+	if c.natsURL == "" {
+		return nil
+	}
+	if _, err := parseNATSURL(c.natsURL); err != nil {
+		return fmt.Errorf("NATS_URL: %w", err)
+	}
+	switch {
+	case c.natsSubject == "" || strings.ContainsAny(c.natsSubject, " \t\r\n"):
+		return fmt.Errorf("NATS_SUBJECT must be a subject, got %q", c.natsSubject)
+	case strings.ContainsAny(c.natsQueue+c.natsResultSubject, " \t\r\n"):
+		return errors.New("NATS_QUEUE and NATS_RESULT_SUBJECT can't contain spaces")
+	case c.natsStream != "" && c.natsConsumer == "":
+		return errors.New("NATS_CONSUMER can't be empty with NATS_STREAM")
+	case strings.ContainsAny(c.natsStream+c.natsConsumer, ".*> \t\r\n"):
+		return errors.New("NATS_STREAM and NATS_CONSUMER can't contain dots, wildcards or spaces")
+	case c.natsWorkers < 1:
+		return fmt.Errorf("NATS_WORKERS must be at least 1, got %d", c.natsWorkers)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ollamaHost is one of the OLLAMA_URL servers and the models it has
+type ollamaHost struct {
+	*poolBackend
+
+	modelsMu sync.Mutex
+	listed   bool            // whether /api/tags has answered yet
+	models   map[string]bool // by ollamaModelName
+}
+
+// setModels records the models the host listed
+func (h *ollamaHost) setModels(tags []ollamaTag) {
+	models := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		models[ollamaModelName(tag.Name)] = true
+	}
+	h.modelsMu.Lock()
+	defer h.modelsMu.Unlock()
+	h.listed, h.models = true, models
+}
+
+// has reports whether the host listed model, and whether it has listed its
+// models at all
+func (h *ollamaHost) has(model string) (has, listed bool) {
+	h.modelsMu.Lock()
+	defer h.modelsMu.Unlock()
+	return h.models[ollamaModelName(model)], h.listed
+}
+
+func (h *ollamaHost) modelCount() int {
+	h.modelsMu.Lock()
+	defer h.modelsMu.Unlock()
+	return len(h.models)
+}
+
+// ollamaPool places generations on the OLLAMA_URL servers. Each generation
+// goes to a host that listed its model in /api/tags, picked by
+// OLLAMA_ROUTING among those that are up, and fails over to the other
+// hosts with the model when the host can't be reached or answers with a
+// 5xx. When no host is known to have the model, the hosts that haven't
+// listed their models yet are tried, and when every host has, the request
+// fails with 404. With a single URL it only forwards to it.
+type ollamaPool struct {
+	mu    sync.Mutex
+	urls  string // OLLAMA_URL the hosts were made from
+	hosts []*ollamaHost
+
+	next atomic.Uint64 // round-robin position
+}
+
+// Ollama hosts of OLLAMA_URL
+var ollamaHosts = &ollamaPool{}
+
+// list returns the hosts of the current OLLAMA_URL, keeping the state and
+// models of those that stayed in it after a reload
+func (p *ollamaPool) list() []*ollamaHost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	urls := cfg().ollamaURL
+	if p.hosts != nil && p.urls == urls {
+		return p.hosts
+	}
+	var hosts []*ollamaHost
+	for _, url := range splitBackendURLs(urls) {
+		i := slices.IndexFunc(p.hosts, func(h *ollamaHost) bool { return h.url == url })
+		if i >= 0 {
+			hosts = append(hosts, p.hosts[i])
+		} else {
+			hosts = append(hosts, &ollamaHost{poolBackend: &poolBackend{kind: "Ollama host", url: url}})
+		}
+	}
+	p.urls, p.hosts = urls, hosts
+	return hosts
+}
+
+// route returns the hosts to try for a generation with model, in order.
+// The model listings are refreshed once, at most every
+// modelsRecheckInterval, before giving up on a model no host has. With
+// AUTO_PULL_MODELS such a model is pulled on the host OLLAMA_ROUTING picks
+// instead, even with a single URL, and the generation waits for it.
+func (p *ollamaPool) route(ctx context.Context, model string) ([]*ollamaHost, error) {
+	hosts := p.list()
+	if model == "" || (len(hosts) < 2 && !cfg().autoPullModels) {
+		return hosts, nil
+	}
+	candidates, listed := p.withModel(hosts, model)
+	if len(candidates) == 0 {
+		ollamaModels.recheck(ctx)
+		candidates, listed = p.withModel(hosts, model)
+	}
+	if len(candidates) == 0 {
+		if listed && cfg().autoPullModels {
+			host, err := ollamaPulls.wait(ctx, routeBackends(hosts, &p.next, cfg().ollamaRouting)[0], model)
+			if err != nil {
+				return nil, err
+			}
+			return []*ollamaHost{host}, nil
+		}
+		if listed {
+			return nil, newHTTPError(http.StatusNotFound, "model %q is not available on any Ollama host, pull it with `ollama pull %s`", model, model)
+		}
+		if len(hosts) < 2 {
+			return hosts, nil
+		}
+		// Hosts that haven't listed their models yet might have it
+		for _, h := range hosts {
+			if _, ok := h.has(model); !ok {
+				candidates = append(candidates, h)
+			}
+		}
+		log.Printf("No Ollama host is known to have %s, trying those that haven't listed their models request_id=%s", model, requestIDFromContext(ctx))
+	}
+	return routeBackends(candidates, &p.next, cfg().ollamaRouting), nil
+}
+
+// withModel returns the hosts that listed model, and whether every host
+// has listed its models
+func (p *ollamaPool) withModel(hosts []*ollamaHost, model string) ([]*ollamaHost, bool) {
+	var matched []*ollamaHost
+	allListed := true
+	for _, h := range hosts {
+		has, listed := h.has(model)
+		if has {
+			matched = append(matched, h)
+		}
+		allListed = allListed && listed
+	}
+	return matched, allListed
+}
+
+// listModels lists the models of every host and reports whether any host
+// has one. It fails only when no host answered.
+func (p *ollamaPool) listModels(ctx context.Context) (bool, error) {
+	hosts := p.list()
+	if len(hosts) == 0 {
+		hosts = []*ollamaHost{{poolBackend: &poolBackend{url: cfg().ollamaURL}}}
+	}
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tags, err := fetchOllamaTags(ctx, h.url)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			h.setModels(tags)
+		}()
+	}
+	wg.Wait()
+
+	if len(hosts) == 1 && errs[0] != nil {
+		return false, errs[0]
+	}
+	if !slices.Contains(errs, nil) {
+		for i, h := range hosts {
+			errs[i] = fmt.Errorf("%s: %w", h.url, errs[i])
+		}
+		return false, errors.Join(errs...)
+	}
+	return slices.ContainsFunc(hosts, func(h *ollamaHost) bool { return h.modelCount() > 0 }), nil
+}
+
+// ping checks every host, marking each up or down, and fails when none
+// answers. With model set, the hosts that have it, or haven't listed
+// their models yet, are asked to load it.
+func (p *ollamaPool) ping(ctx context.Context, model string) error {
+	hosts := p.list()
+	if len(hosts) < 2 {
+		return pingOllamaHost(ctx, cfg().ollamaURL, model)
+	}
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			load := model
+			if has, listed := h.has(model); listed && !has {
+				load = ""
+			}
+			if errs[i] = pingOllamaHost(ctx, h.url, load); errs[i] != nil {
+				h.markDown(errs[i])
+				errs[i] = fmt.Errorf("%s: %w", h.url, errs[i])
+			} else {
+				h.markUp()
+			}
+		}()
+	}
+	wg.Wait()
+	if slices.Contains(errs, nil) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// writeMetrics writes the state of each host when there are several
+func (p *ollamaPool) writeMetrics(w *bufio.Writer) {
+	hosts := p.list()
+	if len(hosts) < 2 {
+		return
+	}
+	writeMetricHeader(w, "bridge_ollama_host_up", "gauge", "Whether an OLLAMA_URL host is routed to (1) or skipped after failing (0)")
+	for _, h := range hosts {
+		up := 0.0
+		if h.available() {
+			up = 1
+		}
+		writeSample(w, "bridge_ollama_host_up", []string{"backend"}, []string{h.url}, "", "", up)
+	}
+	writeMetricHeader(w, "bridge_ollama_host_in_flight", "gauge", "Generations being sent to each OLLAMA_URL host")
+	for _, h := range hosts {
+		writeSample(w, "bridge_ollama_host_in_flight", []string{"backend"}, []string{h.url}, "", "", float64(h.load()))
+	}
+	writeMetricHeader(w, "bridge_ollama_host_models", "gauge", "Models each OLLAMA_URL host listed at its last /api/tags")
+	for _, h := range hosts {
+		writeSample(w, "bridge_ollama_host_models", []string{"backend"}, []string{h.url}, "", "", float64(h.modelCount()))
+	}
+}
+
+// post sends body to path on the backend. With several OLLAMA_URL hosts
+// it fails over to the next one when a host can't be reached or fails
+// with a 5xx, and counts the generation in flight on the host that
+// answered until the backend is released.
+func (b *ollamaBackend) post(ctx context.Context, client *http.Client, path string, body []byte) (*http.Response, error) {
+	if len(b.hosts) < 2 {
+		return sendToOllama(ctx, client, b.url+path, body)
+	}
+	var err error
+	for i, h := range b.hosts {
+		if i > 0 {
+			if ctx.Err() != nil || !isUpstreamFailure(err) {
+				break
+			}
+			log.Printf("Failing over from Ollama host %s to %s request_id=%s", b.hosts[i-1].url, h.url, requestIDFromContext(ctx))
+			ollamaFailovers.add(1)
+		}
+		h.inFlight.Add(1)
+		var resp *http.Response
+		resp, err = sendToOllama(ctx, client, h.url+path, body)
+		if err == nil {
+			h.markUp()
+			release := b.release
+			b.url, b.release = h.url, func() {
+				h.inFlight.Add(-1)
+				release()
+			}
+			return resp, nil
+		}
+		h.inFlight.Add(-1)
+		if isUpstreamFailure(err) && ctx.Err() == nil {
+			h.markDown(err)
+		}
+	}
+	return nil, err
+}
+
+// fetchOllamaTags returns the models the Ollama at url has pulled
+func fetchOllamaTags(ctx context.Context, url string) ([]ollamaTag, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upstreamClient(0).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing models: status %d", resp.StatusCode)
+	}
+
+	var tags ollamaTagsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("listing models: %w", err)
+	}
+	return tags.Models, nil
+}
+
+// pingOllamaHost checks the Ollama API at url. With model set, a generate
+// request with an empty prompt loads the model without producing any
+// tokens.
+func pingOllamaHost(ctx context.Context, url, model string) error {
+	if model == "" {
+		return probe(ctx, http.MethodGet, url+"/api/version", nil)
+	}
+	body, err := json.Marshal(OllamaRequest{Model: model})
+	if err != nil {
+		return err
+	}
+	return probe(ctx, http.MethodPost, url+"/api/generate", body)
+}
+
+// ollamaModelName normalizes a model name the way Ollama resolves it: a
+// name without a tag means its latest tag
+func ollamaModelName(model string) string {
+	model = strings.ToLower(strings.TrimSpace(model))
+	if !strings.Contains(model[strings.LastIndex(model, "/")+1:], ":") {
+		model += ":latest"
+	}
+	return model
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OpenAI response formats of /v1/audio/transcriptions
+const (
+	openAIFormatJSON        = "json"
+	openAIFormatText        = "text"
+	openAIFormatSRT         = "srt"
+	openAIFormatVerboseJSON = "verbose_json"
+	openAIFormatVTT         = "vtt"
+)
+
+// OpenAITranscription is the json response format
+type OpenAITranscription struct {
+	Text string `json:"text"`
+}
+
+// OpenAIVerboseTranscription is the verbose_json response format. Segments
+// are passed through from Whisper, which uses OpenAI's segment fields.
+type OpenAIVerboseTranscription struct {
+	Task     string       `json:"task"`
+	Language string       `json:"language"`
+	Duration float64      `json:"duration"`
+	Text     string       `json:"text"`
+	Segments []Segment    `json:"segments,omitempty"`
+	Words    []OpenAIWord `json:"words,omitempty"`
+}
+
+// OpenAIWord is a word with its timing, returned for word granularity
+type OpenAIWord struct {
+	Word  string  `json:"word"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// OpenAIError is OpenAI's error envelope, which the SDKs parse
+type OpenAIError struct {
+	Error OpenAIErrorBody `json:"error"`
+}
+
+// OpenAIErrorBody describes the failure, param and code are always null
+type OpenAIErrorBody struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// openAITranscriptionsHandler mimics OpenAI's audio transcription API so
+// OpenAI SDK clients can use the bridge as their base URL. It only
+// transcribes, there is no LLM step. The model field is accepted but
+// ignored, as the Whisper service decides the model, and so is
+// temperature.
+func openAITranscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+	if announcesLargeUpload(r) {
+		w.Header().Set("Connection", "close")
+		writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", uploadTooLargeMessage())
+		return
+	}
+
+	release, err := admit(r, priorityNormal)
+	if err != nil {
+		writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", "Server is at capacity, please try again later")
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfg().requestTimeout)*time.Second)
+	defer cancel()
+
+	upload := newUploadReader(ctx, w, r.Body, time.Duration(cfg().uploadIdleTimeout)*time.Second, int64(cfg().maxUploadBytes))
+	defer upload.stop()
+	r.Body = upload
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		if upload.tooLarge.Load() {
+			writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", uploadTooLargeMessage())
+			return
+		}
+		if upload.stalled.Load() {
+			writeOpenAIError(w, http.StatusRequestTimeout, "invalid_request_error", errUploadStalled.Error())
+			return
+		}
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Failed to parse form: "+err.Error())
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Missing audio file in the file field")
+		return
+	}
+	defer file.Close()
+	// Multipart files can seek, so the check leaves file at its start
+	if _, err := checkAudioFormat(file, header.Filename); err != nil {
+		writeOpenAIError(w, err.(*httpError).status, "invalid_request_error", err.Error())
+		return
+	}
+
+	format := r.FormValue("response_format")
+	if format == "" {
+		format = openAIFormatJSON
+	}
+	switch format {
+	case openAIFormatJSON, openAIFormatText, openAIFormatSRT, openAIFormatVerboseJSON, openAIFormatVTT:
+	default:
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error",
+			"response_format must be one of json, text, srt, verbose_json or vtt")
+		return
+	}
+	granularities := r.MultipartForm.Value["timestamp_granularities[]"]
+	words := slices.Contains(granularities, "word")
+	if len(granularities) > 0 && format != openAIFormatVerboseJSON {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error",
+			"timestamp_granularities requires response_format verbose_json")
+		return
+	}
+
+	resp, err := transcribeWithWhisperOptions(ctx, header.Filename, file, whisperOptions{
+		Language:       r.FormValue("language"),
+		InitialPrompt:  r.FormValue("prompt"),
+		WordTimestamps: words,
+	})
+	if err != nil {
+		status := http.StatusBadGateway
+		var upstreamErr *upstreamError
+		var openErr *circuitOpenError
+		if errors.As(err, &upstreamErr) && upstreamErr.overloaded() {
+			w.Header().Set("Retry-After", upstreamErr.retryAfter())
+			status = http.StatusServiceUnavailable
+		} else if errors.As(err, &openErr) {
+			w.Header().Set("Retry-After", openErr.breaker.retryAfter())
+			status = http.StatusServiceUnavailable
+		}
+		writeOpenAIError(w, status, "server_error", "Transcription failed: "+err.Error())
+		return
+	}
+	if cfg().redactPIIEnabled {
+		redactWhisperResponse(resp)
+	}
+	text := strings.TrimSpace(resp.Text)
+
+	switch format {
+	case openAIFormatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(text + "\n"))
+	case openAIFormatSRT, openAIFormatVTT:
+		writeSubtitles(w, format, resp.Segments)
+	case openAIFormatVerboseJSON:
+		verbose := OpenAIVerboseTranscription{
+			Task:     "transcribe",
+			Language: resp.Language,
+			Text:     text,
+		}
+		if slices.Contains(granularities, "segment") || len(granularities) == 0 {
+			verbose.Segments = resp.Segments
+		}
+		if cues := subtitleCues(resp.Segments); len(cues) > 0 {
+			verbose.Duration = cues[len(cues)-1].End
+		}
+		if words {
+			verbose.Words = openAIWords(resp.Segments)
+		}
+		writeOpenAIJSON(w, http.StatusOK, verbose)
+	default:
+		writeOpenAIJSON(w, http.StatusOK, OpenAITranscription{Text: text})
+	}
+}
+
+// openAIWords flattens the word timings Whisper reports per segment
+func openAIWords(segments []Segment) []OpenAIWord {
+	var words []OpenAIWord
+	for _, segment := range segments {
+		for _, word := range segment.Words {
+			words = append(words, OpenAIWord{Word: strings.TrimSpace(word.Word), Start: word.Start, End: word.End})
+		}
+	}
+	return words
+}
+
+// writeOpenAIJSON writes v with OpenAI's snake_case keys whatever
+// RESPONSE_KEY_STYLE is, as the SDKs expect them
+func writeOpenAIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeOpenAIError(w http.ResponseWriter, status int, errType, message string) {
+	writeOpenAIJSON(w, status, OpenAIError{Error: OpenAIErrorBody{Message: message, Type: errType}})
+}
+
+// OpenAIChatRequest is the body of /v1/chat/completions. Sampling fields
+// without an Ollama equivalent are ignored.
+type OpenAIChatRequest struct {
+	Model               string              `json:"model"`
+	Messages            []OpenAIChatMessage `json:"messages"`
+	Stream              bool                `json:"stream"`
+	StreamOptions       *OpenAIStreamOpts   `json:"stream_options"`
+	Temperature         *float64            `json:"temperature"`
+	TopP                *float64            `json:"top_p"`
+	MaxTokens           *int                `json:"max_tokens"`
+	MaxCompletionTokens *int                `json:"max_completion_tokens"`
+	Stop                any                 `json:"stop"` // a string or a list
+	Seed                *int                `json:"seed"`
+	FrequencyPenalty    *float64            `json:"frequency_penalty"`
+	PresencePenalty     *float64            `json:"presence_penalty"`
+}
+
+// OpenAIStreamOpts asks for a final chunk with the token usage
+type OpenAIStreamOpts struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// OpenAIChatMessage is a chat message. Content is a string or a list of
+// content parts, of which only text parts are supported.
+type OpenAIChatMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+// OpenAIChatCompletion is a chat.completion response or, when streaming,
+// a chat.completion.chunk
+type OpenAIChatCompletion struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []OpenAIChatChoice `json:"choices"`
+	Usage   *OpenAIUsage       `json:"usage,omitempty"`
+}
+
+// OpenAIChatChoice holds the reply in message, or in delta for chunks
+type OpenAIChatChoice struct {
+	Index        int                `json:"index"`
+	Message      *OllamaChatMessage `json:"message,omitempty"`
+	Delta        *OllamaChatMessage `json:"delta,omitempty"`
+	FinishReason *string            `json:"finish_reason"`
+}
+
+// OpenAIUsage reports the tokens of a completion
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// openAIChatHandler translates OpenAI chat completions to Ollama's chat
+// API, streamed as OpenAI-style SSE chunks when stream is set, so the
+// bridge can serve OpenAI SDK clients for both transcription and chat.
+func openAIChatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+
+	var req OpenAIChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Failed to parse JSON body: "+err.Error())
+		return
+	}
+	chatReq, err := ollamaChatRequest(req)
+	if err == nil {
+		chatReq.Model, err = resolveModel(chatReq.Model)
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	release, err := admit(r, priorityNormal)
+	if err != nil {
+		writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", "Server is at capacity, please try again later")
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfg().requestTimeout)*time.Second)
+	defer cancel()
+
+	if err := allowOllama(ctx); err != nil {
+		w.Header().Set("Retry-After", ollamaBreaker.retryAfter())
+		writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", err.Error())
+		return
+	}
+
+	completion := OpenAIChatCompletion{
+		ID:      "chatcmpl-" + requestIDFromContext(ctx),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   chatReq.Model,
+	}
+
+	var onChunk func(OllamaChatResponse) error
+	started := false
+	if req.Stream {
+		rc := http.NewResponseController(w)
+		completion.Object = "chat.completion.chunk"
+		onChunk = func(chunk OllamaChatResponse) error {
+			if !started {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("X-Accel-Buffering", "no")
+				w.WriteHeader(http.StatusOK)
+				started = true
+			}
+			event := completion
+			choice := OpenAIChatChoice{Delta: &OllamaChatMessage{Role: "assistant", Content: chunk.Message.Content}}
+			if chunk.Finished {
+				choice.FinishReason = openAIFinishReason(chunk.DoneReason)
+			}
+			event.Choices = []OpenAIChatChoice{choice}
+			if err := writeSSEData(w, event); err != nil {
+				return err
+			}
+			if chunk.Finished && req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+				event.Choices = []OpenAIChatChoice{}
+				event.Usage = openAIUsage(&chunk)
+				writeSSEData(w, event)
+			}
+			return rc.Flush()
+		}
+	}
+
+	chatResp, err := chatWithOllama(ctx, chatReq, onChunk)
+	if started {
+		if err != nil {
+			writeSSEData(w, OpenAIError{Error: OpenAIErrorBody{Message: err.Error(), Type: "server_error"}})
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+		return
+	}
+	if err != nil {
+		status := http.StatusBadGateway
+		var upstreamErr *upstreamError
+		if errors.As(err, &upstreamErr) {
+			switch {
+			case upstreamErr.overloaded():
+				w.Header().Set("Retry-After", upstreamErr.retryAfter())
+				status = http.StatusServiceUnavailable
+			case upstreamErr.StatusCode == http.StatusNotFound:
+				// Ollama answers 404 for models that aren't pulled
+				status = http.StatusNotFound
+			}
+		}
+		writeOpenAIError(w, status, "server_error", "Ollama chat failed: "+err.Error())
+		return
+	}
+
+	completion.Choices = []OpenAIChatChoice{{
+		Message:      &OllamaChatMessage{Role: "assistant", Content: chatResp.Message.Content},
+		FinishReason: openAIFinishReason(chatResp.DoneReason),
+	}}
+	completion.Usage = openAIUsage(chatResp)
+	writeOpenAIJSON(w, http.StatusOK, completion)
+}
+
+// ollamaChatRequest converts an OpenAI chat request, mapping the sampling
+// parameters to Ollama options
+func ollamaChatRequest(req OpenAIChatRequest) (OllamaChatRequest, error) {
+	if req.Model == "" {
+		return OllamaChatRequest{}, errors.New("model is required")
+	}
+	if len(req.Messages) == 0 {
+		return OllamaChatRequest{}, errors.New("messages must not be empty")
+	}
+
+	chatReq := OllamaChatRequest{Model: req.Model, Options: make(map[string]any)}
+	for i, message := range req.Messages {
+		content, err := openAIMessageText(message.Content)
+		if err != nil {
+			return OllamaChatRequest{}, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		chatReq.Messages = append(chatReq.Messages, OllamaChatMessage{Role: message.Role, Content: content})
+	}
+
+	if req.Temperature != nil {
+		chatReq.Options["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		chatReq.Options["top_p"] = *req.TopP
+	}
+	if req.MaxCompletionTokens != nil {
+		chatReq.Options["num_predict"] = *req.MaxCompletionTokens
+	} else if req.MaxTokens != nil {
+		chatReq.Options["num_predict"] = *req.MaxTokens
+	}
+	if req.Seed != nil {
+		chatReq.Options["seed"] = *req.Seed
+	}
+	if req.FrequencyPenalty != nil {
+		chatReq.Options["frequency_penalty"] = *req.FrequencyPenalty
+	}
+	if req.PresencePenalty != nil {
+		chatReq.Options["presence_penalty"] = *req.PresencePenalty
+	}
+	switch stop := req.Stop.(type) {
+	case nil:
+	case string:
+		chatReq.Options["stop"] = []string{stop}
+	case []any:
+		var words []string
+		for _, word := range stop {
+			text, ok := word.(string)
+			if !ok {
+				return OllamaChatRequest{}, errors.New("stop must be a string or a list of strings")
+			}
+			words = append(words, text)
+		}
+		chatReq.Options["stop"] = words
+	default:
+		return OllamaChatRequest{}, errors.New("stop must be a string or a list of strings")
+	}
+	return chatReq, nil
+}
+
+// openAIMessageText returns the text of a message's content
+func openAIMessageText(content any) (string, error) {
+	switch content := content.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return content, nil
+	case []any:
+		var texts []string
+		for _, part := range content {
+			fields, _ := part.(map[string]any)
+			if fields["type"] != "text" {
+				return "", fmt.Errorf("content part of type %v is not supported", fields["type"])
+			}
+			text, _ := fields["text"].(string)
+			texts = append(texts, text)
+		}
+		return strings.Join(texts, "\n"), nil
+	default:
+		return "", errors.New("content must be a string or a list of content parts")
+	}
+}
+
+// openAIFinishReason maps Ollama's done_reason to OpenAI's finish_reason
+func openAIFinishReason(doneReason string) *string {
+	reason := "stop"
+	if doneReason == doneReasonLength {
+		reason = "length"
+	}
+	return &reason
+}
+
+func openAIUsage(resp *OllamaChatResponse) *OpenAIUsage {
+	return &OpenAIUsage{
+		PromptTokens:     resp.PromptEvalCount,
+		CompletionTokens: resp.EvalCount,
+		TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+	}
+}
+
+// writeSSEData writes v as an unnamed SSE event, as OpenAI streams do
+func writeSSEData(w http.ResponseWriter, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"strconv"
+)
+
+// Keys of the system prompt, the output schema and a session's earlier
+// messages among the generation options. Ollama takes them next to the
+// options rather than among them, and the hosted providers as a system
+// message, a response format and earlier messages. The history is set by
+// the bridge only.
+const (
+	systemOption  = "system"
+	formatOption  = "format"
+	historyOption = "history"
+)
+
+// Generation options /process takes as fields of their own, and whether
+// each is an integer. Any other Ollama option can be given in the options
+// field.
+var llmOptionFields = []struct {
+	name    string
+	integer bool
+}{
+	{"temperature", false},
+	{"top_p", false},
+	{"top_k", true},
+	{"num_predict", true},
+	{"seed", true},
+}
+
+// parseLLMOptions reads the generation options of a form: the options
+// field, a JSON object of Ollama options, then the fields of
+// llmOptionFields and system, which take precedence
+func parseLLMOptions(get func(string) string) (map[string]any, error) {
+	options := make(map[string]any)
+	if raw := get("options"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &options); err != nil {
+			return nil, newHTTPError(http.StatusBadRequest, "invalid options: %v", err)
+		}
+	}
+	for _, field := range llmOptionFields {
+		value := get(field.name)
+		if value == "" {
+			continue
+		}
+		var err error
+		if field.integer {
+			options[field.name], err = strconv.Atoi(value)
+		} else {
+			options[field.name], err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return nil, newHTTPError(http.StatusBadRequest, "invalid %s: %q is not a number", field.name, value)
+		}
+	}
+	if system := get(systemOption); system != "" {
+		options[systemOption] = system
+	}
+	return checkLLMOptions(options)
+}
+
+// checkLLMOptions checks the ranges of the options the bridge knows and
+// normalizes stop to a list of strings. It returns nil when there are no
+// options, so the providers' defaults apply.
+func checkLLMOptions(options map[string]any) (map[string]any, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+	number := func(name string) (float64, bool, error) {
+		value, ok := options[name]
+		if !ok {
+			return 0, false, nil
+		}
+		switch n := value.(type) {
+		case int:
+			return float64(n), true, nil
+		case float64:
+			return n, true, nil
+		}
+		return 0, false, newHTTPError(http.StatusBadRequest, "invalid %s: must be a number", name)
+	}
+	ranges := []struct {
+		name     string
+		min, max float64
+	}{
+		{"temperature", 0, 2},
+		{"top_p", 0, 1},
+		{"top_k", 0, 1000},
+		// -1 generates until the model stops, -2 until the context is full
+		{"num_predict", -2, 1 << 20},
+	}
+	for _, r := range ranges {
+		n, ok, err := number(r.name)
+		if err != nil {
+			return nil, err
+		}
+		if ok && (n < r.min || n > r.max) {
+			return nil, newHTTPError(http.StatusBadRequest, "%s must be between %g and %g, got %g", r.name, r.min, r.max, n)
+		}
+	}
+
+	switch stop := options["stop"].(type) {
+	case nil, []string:
+	case string:
+		options["stop"] = []string{stop}
+	case []any:
+		words := make([]string, len(stop))
+		for i, word := range stop {
+			s, ok := word.(string)
+			if !ok {
+				return nil, newHTTPError(http.StatusBadRequest, "invalid stop: must be a string or a list of strings")
+			}
+			words[i] = s
+		}
+		options["stop"] = words
+	default:
+		return nil, newHTTPError(http.StatusBadRequest, "invalid stop: must be a string or a list of strings")
+	}
+	if _, ok := options[systemOption].(string); !ok && options[systemOption] != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid system: must be a string")
+	}
+	if _, ok := options[historyOption]; ok {
+		return nil, newHTTPError(http.StatusBadRequest, "history can't be set in options, use session_id")
+	}
+	return options, nil
+}
+
+// splitOptions splits the system prompt, the output schema and the
+// history off the generation options, leaving options unchanged
+func splitOptions(options map[string]any) (system string, format any, history []OllamaChatMessage, rest map[string]any) {
+	system, _ = options[systemOption].(string)
+	format = options[formatOption]
+	history, _ = options[historyOption].([]OllamaChatMessage)
+	if system == "" && format == nil && history == nil {
+		return "", nil, nil, options
+	}
+	rest = maps.Clone(options)
+	delete(rest, systemOption)
+	delete(rest, formatOption)
+	delete(rest, historyOption)
+	return system, format, history, rest
+}
+
+// withHistory adds a session's earlier messages to the generation options
+func withHistory(options map[string]any, history []OllamaChatMessage) map[string]any {
+	if len(history) == 0 {
+		return options
+	}
+	return mergeLLMOptions(map[string]any{historyOption: history}, options)
+}
+
+// mergeLLMOptions returns the request's options with defaults for the ones
+// it doesn't set
+func mergeLLMOptions(options, defaults map[string]any) map[string]any {
+	merged := make(map[string]any, len(defaults)+len(options))
+	maps.Copy(merged, defaults)
+	maps.Copy(merged, options)
+	return merged
+}
+
+// llmOptions collects the generation options of a JSON request, like
+// parseLLMOptions does for forms
+func (req *JSONProcessRequest) llmOptions() (map[string]any, error) {
+	options := make(map[string]any)
+	maps.Copy(options, req.Options)
+	if req.Temperature != nil {
+		options["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		options["top_p"] = *req.TopP
+	}
+	if req.TopK != nil {
+		options["top_k"] = *req.TopK
+	}
+	if req.NumPredict != nil {
+		options["num_predict"] = *req.NumPredict
+	}
+	if req.Seed != nil {
+		options["seed"] = *req.Seed
+	}
+	if req.System != "" {
+		options[systemOption] = req.System
+	}
+	return checkLLMOptions(options)
+}
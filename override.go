@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// upstreamOverrides are the per-request upstream base URLs set through the
+// X-Whisper-URL and X-Ollama-URL headers
+type upstreamOverrides struct {
+	whisper string
+	ollama  string
+}
+
+// withURLOverrides stores the upstream URL overrides of r in ctx. Overrides
+// need ALLOW_URL_OVERRIDE, the admin token and a host on
+// URL_OVERRIDE_HOSTS; anything else is rejected rather than silently sent
+// to the default upstreams.
+func withURLOverrides(ctx context.Context, r *http.Request) (context.Context, error) {
+	overrides := upstreamOverrides{
+		whisper: strings.TrimSpace(r.Header.Get("X-Whisper-URL")),
+		ollama:  strings.TrimSpace(r.Header.Get("X-Ollama-URL")),
+	}
+	if overrides == (upstreamOverrides{}) {
+		return ctx, nil
+	}
+
+	if !cfg().allowURLOverride {
+		return ctx, newHTTPError(http.StatusForbidden, "upstream URL override is disabled")
+	}
+	if !adminAuthorized(r) {
+		return ctx, newHTTPError(http.StatusUnauthorized, "upstream URL override requires the admin token")
+	}
+	for _, override := range []string{overrides.whisper, overrides.ollama} {
+		if override == "" {
+			continue
+		}
+		if err := checkOverrideURL(override); err != nil {
+			return ctx, newHTTPError(http.StatusForbidden, "%v", err)
+		}
+	}
+	overrides.whisper = strings.TrimRight(overrides.whisper, "/")
+	overrides.ollama = strings.TrimRight(overrides.ollama, "/")
+	log.Printf("Upstream override whisper=%q ollama=%q request_id=%s", overrides.whisper, overrides.ollama, requestIDFromContext(ctx))
+	return context.WithValue(ctx, upstreamOverridesKey, overrides), nil
+}
+
+// checkOverrideURL accepts http(s) URLs whose host is on URL_OVERRIDE_HOSTS.
+// An entry without a port allows every port of that host.
+func checkOverrideURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid upstream URL %q", raw)
+	}
+	for _, allowed := range strings.Split(cfg().urlOverrideHosts, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "" {
+			continue
+		}
+		if strings.EqualFold(u.Host, allowed) || strings.EqualFold(u.Hostname(), allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("upstream host %q is not allowed", u.Host)
+}
+
+func overridesFromContext(ctx context.Context) upstreamOverrides {
+	overrides, _ := ctx.Value(upstreamOverridesKey).(upstreamOverrides)
+	return overrides
+}
+
+// whisperBaseURL returns the Whisper URL for the request in ctx: its
+// override, else the WHISPER_URL backend it was routed to, else the first
+// one
+func whisperBaseURL(ctx context.Context) string {
+	if override := overridesFromContext(ctx).whisper; override != "" {
+		return override
+	}
+	if backend, ok := ctx.Value(whisperBackendKey).(string); ok {
+		return backend
+	}
+	if urls := splitBackendURLs(cfg().whisperURL); len(urls) > 0 {
+		return urls[0]
+	}
+	return cfg().whisperURL
+}
+
+// ollamaOverride returns the Ollama URL override of the request in ctx, or
+// an empty string
+func ollamaOverride(ctx context.Context) string {
+	return overridesFromContext(ctx).ollama
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// piiPattern is a kind of personal data masked by REDACT_PII
+type piiPattern struct {
+	name    string
+	mask    string
+	re      *regexp.Regexp
+	matches func(string) bool // optional check to cut false positives
+}
+
+// Built-in PII patterns, applied in this order. Card numbers run before
+// phone numbers so a card isn't half-masked as a phone number.
+var knownPIIPatterns = []piiPattern{
+	{
+		name: "email",
+		mask: "[EMAIL]",
+		re:   regexp.MustCompile(`(?i)\b[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}\b`),
+	},
+	{
+		name:    "credit_card",
+		mask:    "[CREDIT_CARD]",
+		re:      regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		matches: luhnValid,
+	},
+	{
+		name: "ssn",
+		mask: "[SSN]",
+		re:   regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+	},
+	{
+		name: "phone",
+		mask: "[PHONE]",
+		re:   regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{2,4}\)[ .-]?)?\b\d{3,4}[ .-]?\d{3,4}(?:[ .-]?\d{3,4})?\b`),
+	},
+	{
+		name: "ip_address",
+		mask: "[IP_ADDRESS]",
+		re:   regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`),
+	},
+}
+
+// parsePIIPatterns selects built-in patterns by name from a comma-separated
+// list. "all" selects every pattern.
+func parsePIIPatterns(value string) ([]piiPattern, error) {
+	var patterns []piiPattern
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			return knownPIIPatterns, nil
+		}
+		found := false
+		for _, pattern := range knownPIIPatterns {
+			if pattern.name == name {
+				patterns = append(patterns, pattern)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown pattern %q", name)
+		}
+	}
+	// Keep the built-in order whatever order they were listed in
+	ordered := patterns[:0:0]
+	for _, known := range knownPIIPatterns {
+		for _, pattern := range patterns {
+			if pattern.name == known.name {
+				ordered = append(ordered, known)
+				break
+			}
+		}
+	}
+	return ordered, nil
+}
+
+// redactPII masks the configured PII patterns in text and returns the
+// number of replacements
+func redactPII(text string) (string, int) {
+	count := 0
+	for _, pattern := range cfg().piiPatterns {
+		text = pattern.re.ReplaceAllStringFunc(text, func(match string) string {
+			if pattern.matches != nil && !pattern.matches(match) {
+				return match
+			}
+			count++
+			return pattern.mask
+		})
+	}
+	return text, count
+}
+
+// redactWhisperResponse masks PII in the transcription and in the text of
+// every segment. Words and tokens are dropped rather than masked: a phone
+// number or card spans several of them, so no single one matches. It
+// returns the original transcription and the number of replacements.
+func redactWhisperResponse(resp *WhisperResponse) (raw string, count int) {
+	raw = resp.Text
+	resp.Text, count = redactPII(resp.Text)
+	for i := range resp.Segments {
+		segment := &resp.Segments[i]
+		segment.Text, _ = redactPII(segment.Text)
+		segment.Words = nil
+		segment.Tokens = nil
+	}
+	return raw, count
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum used by
+// payment card numbers
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
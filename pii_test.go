@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// piiWhisperBody is a verbose Whisper answer with word timestamps, an
+// email address in the text of its segment and in its words
+const piiWhisperBody = `{
+	"text": "Mail jane.doe@example.com today",
+	"language": "en",
+	"segments": [{
+		"id": 0, "start": 0, "end": 2, "text": "Mail jane.doe@example.com today",
+		"tokens": [50364, 13, 2055],
+		"words": [
+			{"word": " Mail", "start": 0, "end": 0.4},
+			{"word": " jane.doe@example.com", "start": 0.4, "end": 1.5},
+			{"word": " today", "start": 1.5, "end": 2}
+		]
+	}]
+}`
+
+func TestRedactWhisperResponse(t *testing.T) {
+	var resp WhisperResponse
+	if err := json.Unmarshal([]byte(piiWhisperBody), &resp); err != nil {
+		t.Fatal(err)
+	}
+	raw, count := redactWhisperResponse(&resp)
+	if raw != "Mail jane.doe@example.com today" || count != 1 {
+		t.Errorf("redactWhisperResponse = %q, %d; want the original text and 1", raw, count)
+	}
+	if resp.Text != "Mail [EMAIL] today" {
+		t.Errorf("text = %q, want the email masked", resp.Text)
+	}
+	segment := resp.Segments[0]
+	if segment.Text != "Mail [EMAIL] today" {
+		t.Errorf("segment text = %q, want the email masked", segment.Text)
+	}
+	if segment.Words != nil || segment.Tokens != nil {
+		t.Errorf("segment words = %v, tokens = %v; want both dropped", segment.Words, segment.Tokens)
+	}
+	if data, _ := json.Marshal(resp); bytes.Contains(data, []byte("jane.doe")) {
+		t.Errorf("redacted response %s still has the email", data)
+	}
+}
+
+func TestOpenAIWordTimestampsRedacted(t *testing.T) {
+	setConfigForTest(t, func(c *config) { c.redactPIIEnabled = true })
+	whisper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(piiWhisperBody))
+	}))
+	defer whisper.Close()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "a.wav")
+	part.Write([]byte(wavMagic))
+	form.WriteField("response_format", openAIFormatVerboseJSON)
+	form.WriteField("timestamp_granularities[]", "word")
+	form.WriteField("timestamp_granularities[]", "segment")
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/v1/audio/transcriptions", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r = r.WithContext(withWhisperURL(r.Context(), whisper.URL))
+	rec := httptest.NewRecorder()
+	openAITranscriptionsHandler(rec, r)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "jane.doe") {
+		t.Errorf("verbose_json response %s has the unmasked email", rec.Body)
+	}
+	var verbose OpenAIVerboseTranscription
+	if err := json.Unmarshal(rec.Body.Bytes(), &verbose); err != nil {
+		t.Fatal(err)
+	}
+	if verbose.Text != "Mail [EMAIL] today" {
+		t.Errorf("text = %q, want the email masked", verbose.Text)
+	}
+	if len(verbose.Words) != 0 {
+		t.Errorf("words = %v, want none with REDACT_PII on", verbose.Words)
+	}
+}
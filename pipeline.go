@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Delay before the first pipeline retry, growing linearly per attempt
+const pipelineRetryBackoff = 500 * time.Millisecond
+
+// pipelineResult is the outcome of one transcription and LLM run
+type pipelineResult struct {
+	Response    CombinedResponse
+	WhisperResp *WhisperResponse
+	Stats       ProcessStats
+
+	// LLMErr is set when the single LLM call failed. The response then
+	// carries the transcription and the failure message.
+	LLMErr error
+
+	// Speech is the spoken answer of tts requests
+	Speech *speech
+}
+
+// runPipeline transcribes the input audio and runs the LLM step on it.
+// Transcription failures and an open Ollama breaker (unless degrading to
+// transcription-only) are returned as errors. The LLM step runs on the
+// input's provider. With mode llm_only the input's text stands in for the
+// transcription.
+func runPipeline(ctx context.Context, input *processInput, audioPath string, stream tokenStream) (*pipelineResult, error) {
+	model, n := input.Model, input.N
+	ctx = withLLM(ctx, input.LLM)
+	if input.Cache == cacheBypass {
+		ctx = withLLMCacheMode(ctx, llmCacheRefresh)
+	}
+
+	// Transcribe audio with Whisper
+	transcriptionStart := time.Now()
+	var whisperResp *WhisperResponse
+	var cached bool
+	var err error
+	opts := whisperOptions{Language: input.Language, WordTimestamps: input.WordTimestamps, Translate: input.Translate}
+	if input.Diarize && cfg().diarizationURL == "" {
+		// The ASR backend labels the speakers itself
+		opts.Diarize, opts.NumSpeakers = true, input.NumSpeakers
+	}
+	if input.Mode == modeLLMOnly {
+		whisperResp = &WhisperResponse{Text: input.Text, Language: input.Language}
+	} else if input.Streamed {
+		whisperResp, err = transcribeWithWhisperOptions(ctx, input.Filename, input.Audio, opts)
+	} else {
+		whisperResp, cached, err = transcribeCached(withChunkProgress(ctx, stream), audioPath, opts, input.Cache == cacheBypass)
+	}
+	if err == nil && input.Diarize && cfg().diarizationURL != "" {
+		if err = diarizeAudio(ctx, audioPath, input.NumSpeakers, whisperResp.Segments); err != nil {
+			err = fmt.Errorf("diarization failed: %w", err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if input.Speech != nil {
+		input.Speech.restoreTimings(whisperResp.Segments)
+	}
+	transcriptionTime := time.Since(transcriptionStart)
+
+	// Mask personal data before the text reaches the LLM or the client
+	var unredacted string
+	var redactions int
+	if cfg().redactPIIEnabled {
+		unredacted, redactions = redactWhisperResponse(whisperResp)
+	}
+	transcription := whisperResp.Text
+
+	result := &pipelineResult{
+		Response: CombinedResponse{
+			Transcription:  transcription,
+			Model:          model,
+			WhisperModel:   whisperResp.Model,
+			WhisperVersion: whisperResp.Version,
+			Language:       whisperResp.Language,
+		},
+		WhisperResp: whisperResp,
+	}
+	resp := &result.Response
+	resp.Translated = input.Translate
+	resp.TranscriptionChunks = whisperResp.Chunks
+	resp.TranscriptionCached = cached
+	if input.Speech != nil {
+		resp.SilenceRemoved = math.Round(input.Speech.removed*100) / 100
+	}
+	if input.Language == "" {
+		resp.LanguageDetected = resp.Language != ""
+		resp.LanguageConfidence = whisperResp.LanguageProbability
+	}
+	resp.PIIRedactions = redactions
+	if cfg().redactPIIDebug {
+		resp.UnredactedTranscription = unredacted
+	}
+
+	// Pick the model for the detected language unless the client or its
+	// API key chose one. A translation reaches the LLM in English.
+	textLanguage := whisperResp.Language
+	if input.Translate {
+		textLanguage = "en"
+	}
+	if input.ModelDefaulted {
+		if languageModel, ok := modelForLanguage(textLanguage); ok {
+			if resolved, err := resolveModel(languageModel); err == nil {
+				model = resolved
+				resp.Model = model
+				resp.ModelAutoSelected = true
+			}
+		}
+	}
+
+	// Normalise the transcription before it reaches the LLM, keeping the
+	// raw text alongside
+	if input.CleanTranscription {
+		transcription = cleanTranscription(transcription)
+		resp.RawTranscription = resp.Transcription
+		resp.Transcription = transcription
+	}
+
+	// Meeting-style audio reaches the LLM as who said what
+	if input.Diarize {
+		if attributed, speakers := speakerTranscript(whisperResp.Segments, input.CleanTranscription); speakers > 0 {
+			transcription = attributed
+			resp.SpeakerTranscription = attributed
+			resp.Speakers = speakers
+		} else {
+			log.Printf("Diarization labeled no segments request_id=%s", requestIDFromContext(ctx))
+		}
+	}
+
+	llmStart := time.Now()
+	var ollamaResp *OllamaResponse
+	var history []OllamaChatMessage
+	llmText, llmPrompt, llmOptions := transcription, "", input.Options
+	if isSubtitleFormat(input.ResponseFormat) {
+		// Subtitles are made of the transcription alone
+		resp.LLMSkipped = true
+		resp.LLMSkippedReason = "response_format " + input.ResponseFormat + " requested"
+	} else if input.Mode == modeTranscribeOnly {
+		resp.LLMSkipped = true
+		resp.LLMSkippedReason = "mode " + modeTranscribeOnly + " requested"
+	} else if input.EstimateTokens {
+		// Let the client check the prompt size before paying for generation
+		if llmPrompt, err = processPrompt(input, transcription, whisperResp.Language); err != nil {
+			return nil, err
+		}
+		resp.EstimatedPromptTokens = estimateTokens(llmPrompt)
+		resp.LLMSkipped = true
+		resp.LLMSkippedReason = "estimate_tokens requested"
+	} else if err := llmFromContext(ctx).allow(ctx); err != nil {
+		// Only reachable with DEGRADE_TO_TRANSCRIPTION, or when the breaker
+		// opened during transcription
+		if !cfg().degradeToTranscription {
+			return nil, err
+		}
+		resp.LLMSkipped = true
+		resp.LLMSkippedReason = err.Error()
+	} else if llmText, err = translateTranscription(ctx, model, input.TranslateTo, transcription, &resp.Translation); err != nil {
+		// The translation the LLM step would work on failed
+		result.LLMErr = err
+		resp.Response = "Ollama processing failed: " + err.Error()
+	} else if llmText, err = summarizeLong(ctx, model, llmText, &resp.SummarizedChunks); err != nil {
+		// Condensing a long transcription failed
+		result.LLMErr = err
+		resp.Response = "Ollama processing failed: " + err.Error()
+	} else if history, err = loadSession(ctx, input.sessionKey()); err != nil {
+		// The conversation to continue is out of reach
+		result.LLMErr = err
+		resp.Response = "Ollama processing failed: " + err.Error()
+	} else if input.Pipeline != nil {
+		// Run the configured steps instead of the single LLM call
+		resp.Pipeline = input.Pipeline.Name
+		ollamaResp, err = runSteps(ctx, input, llmText, whisperResp.Language, resp)
+		if err != nil {
+			result.LLMErr = err
+			resp.Response = "Ollama processing failed: " + err.Error()
+		} else {
+			resp.Response = ollamaResp.Response
+		}
+	} else if llmPrompt, err = processPrompt(input, llmText, whisperResp.Language); err != nil {
+		return nil, err
+	} else if llmOptions = withHistory(input.Options, history); n > 1 {
+		// Generate several candidates when requested
+		resp.Candidates = generateCandidates(ctx, model, llmPrompt, llmOptions, n)
+		resp.Response = "Ollama processing failed: all candidates failed"
+		if best, ok := firstSuccessful(resp.Candidates); ok {
+			resp.Response = best.Response
+			ollamaResp = best.ollamaResp
+		}
+	} else if stream != nil {
+		// Send tokens to the client as they are generated
+		stream.begin(resp)
+		ollamaResp, err = generateWithLLM(withPullProgress(ctx, stream), model, llmPrompt, llmOptions, stream.write)
+		if err != nil {
+			result.LLMErr = err
+			resp.Response = "Ollama processing failed: " + err.Error()
+		} else {
+			resp.Response = ollamaResp.Response
+		}
+	} else if input.Schema != nil {
+		// Extract JSON matching the request's schema
+		var structured structuredResult
+		ollamaResp, structured, err = generateStructured(ctx, model, llmPrompt, llmOptions, input.Schema)
+		if err != nil {
+			result.LLMErr = err
+			resp.Response = "Ollama processing failed: " + err.Error()
+		} else {
+			resp.Response = ollamaResp.Response
+			resp.Structured = structured.Output
+			resp.SchemaAttempts = structured.Attempts
+			resp.SchemaErrors = structured.Errors
+		}
+	} else {
+		// Run the LLM step, returning the transcription even if it fails
+		ollamaResp, err = processWithLLM(ctx, model, llmPrompt, llmOptions)
+		if err != nil {
+			result.LLMErr = err
+			resp.Response = "Ollama processing failed: " + err.Error()
+		} else {
+			resp.Response = ollamaResp.Response
+		}
+	}
+
+	if resp.Translation != "" {
+		resp.TranslatedTo = input.TranslateTo
+	}
+	if input.SessionID != "" {
+		// Remember the exchange for the session's next request
+		resp.SessionID = input.SessionID
+		resp.SessionTurns = len(history) / 2
+		if ollamaResp != nil && result.LLMErr == nil {
+			saveSession(ctx, input.sessionKey(), history, llmText, resp.Response)
+		}
+	}
+	if input.TTS && result.LLMErr == nil && !resp.LLMSkipped && strings.TrimSpace(resp.Response) != "" {
+		// Speak the answer for voice-in/voice-out clients
+		speakResponse(ctx, input, result)
+	}
+	if ollamaResp != nil {
+		resp.Spillover = ollamaResp.Spillover
+		resp.LLMCached = ollamaResp.Cached
+		resp.DoneReason = ollamaResp.DoneReason
+		resp.Warning = truncationWarning(ollamaResp.DoneReason)
+	}
+	result.Stats = newProcessStats(transcriptionTime, time.Since(llmStart), ollamaResp)
+	return result, nil
+}
+
+// runPipelineWithRetries reruns the whole pipeline up to PIPELINE_RETRIES
+// times while it fails with a retryable error. Every attempt reads the audio
+// afresh from the upload's temp file; streamed uploads can't be replayed
+// and are never retried, nor are raw streams that already sent tokens. All
+// attempts share ctx, so the request deadline bounds the total time.
+func runPipelineWithRetries(ctx context.Context, input *processInput, audioPath string, stream tokenStream) (*pipelineResult, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := runPipeline(ctx, input, audioPath, stream)
+
+		failure := err
+		if failure == nil && result.LLMErr != nil {
+			failure = result.LLMErr
+		}
+		if failure == nil || input.Streamed || (stream != nil && stream.started()) || attempt >= cfg().pipelineRetries || !isRetryable(failure) {
+			return result, err
+		}
+
+		log.Printf("Pipeline attempt %d failed, retrying: %v request_id=%s", attempt+1, failure, requestIDFromContext(ctx))
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(time.Duration(attempt+1) * pipelineRetryBackoff):
+		}
+	}
+}
+
+// isRetryable reports whether err is a transient failure worth retrying:
+// transport errors and upstream 5xx or 429 answers. Client errors, an open
+// circuit breaker and cancellation are final.
+func isRetryable(err error) bool {
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var he *httpError
+	if errors.As(err, &he) {
+		return false
+	}
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		return ue.StatusCode >= http.StatusInternalServerError || ue.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,482 @@
+// Package client is a Go client of the whisper-llm-bridge HTTP API. It
+// builds the multipart uploads of /process and /jobs, decodes the
+// responses into typed values, reads streamed answers token by token and
+// retries requests the bridge turned away because it was overloaded.
+//
+//	c := client.New("http://bridge:8080")
+//	c.Token = os.Getenv("BRIDGE_API_KEY")
+//	f, _ := os.Open("call.wav")
+//	defer f.Close()
+//	resp, err := c.Process(ctx, client.ProcessRequest{Audio: f, Filename: "call.wav", Template: "summary"})
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client defaults: retries of a request turned away with 429, 502, 503 or
+// 504 or failing to connect, the backoff before the first retry, doubled
+// for each further one, and the longest wait between attempts, also when
+// the bridge's Retry-After asks for more
+const (
+	DefaultMaxRetries   = 3
+	DefaultRetryBackoff = time.Second
+	maxRetryWait        = time.Minute
+)
+
+// Client calls a bridge. Its fields may be changed until the first
+// request; it is safe for concurrent use after that.
+type Client struct {
+	// BaseURL of the bridge, e.g. http://bridge:8080
+	BaseURL string
+
+	// HTTPClient sends the requests; http.DefaultClient when nil. Leave its
+	// Timeout at zero for streamed answers and long recordings, and bound
+	// requests with their context instead.
+	HTTPClient *http.Client
+
+	// Token is an API key or JWT sent as a bearer token, none when empty
+	Token string
+
+	// MaxRetries is how often a request is retried, RetryBackoff the wait
+	// before the first retry. Zero disables retries.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// New returns a client of the bridge at baseURL with the default retries
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimRight(baseURL, "/"),
+		MaxRetries:   DefaultMaxRetries,
+		RetryBackoff: DefaultRetryBackoff,
+	}
+}
+
+// Error is a response of the bridge with an error status
+type Error struct {
+	StatusCode int
+	Message    string
+
+	// RetryAfter is the wait the bridge asked for with Retry-After, zero
+	// when it didn't
+	RetryAfter time.Duration
+
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("bridge returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("bridge returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the request may succeed when retried: the
+// bridge or its upstreams were overloaded or unavailable
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// errNotReplayable is returned when a request should be retried but its
+// audio can't be read again
+var errNotReplayable = errors.New("audio can't be rewound for a retry")
+
+// ProcessRequest is a recording to process and the /process fields to
+// process it with. Fields left empty aren't sent, so the bridge's defaults
+// apply.
+type ProcessRequest struct {
+	// Audio is the recording, streamed to the bridge as it is read. Leave
+	// it nil with AudioURL or Mode llm_only. Requests are only retried
+	// when it is an io.Seeker, such as an *os.File or a *bytes.Reader, so
+	// it can be read again from where it started.
+	Audio    io.Reader
+	Filename string
+	AudioURL string
+
+	// Mode is full, transcribe_only or llm_only, Text the text of llm_only
+	// requests
+	Mode string
+	Text string
+
+	Prompt      string
+	System      string
+	Model       string
+	Provider    string
+	Template    string
+	Pipeline    string
+	Language    string
+	Task        string
+	TranslateTo string
+	SessionID   string
+
+	// Schema the LLM's reply must match, returned parsed as Structured
+	Schema json.RawMessage
+
+	// Candidates is the n field, the number of LLM candidates
+	Candidates  int
+	Temperature *float64
+	NumPredict  int
+	Diarize     bool
+
+	// Priority is high or normal
+	Priority string
+
+	// Fields are further /process form fields, e.g. "tts": "true"
+	Fields map[string]string
+}
+
+// ProcessResponse is the /process response, as of api_version 2
+type ProcessResponse struct {
+	// RequestID is the bridge's X-Request-ID of the request, also the ID
+	// its result is recorded under in the result history
+	RequestID string `json:"-"`
+
+	Transcription      string   `json:"transcription"`
+	RawTranscription   string   `json:"raw_transcription,omitempty"`
+	Response           string   `json:"response"`
+	ProcessTime        int64    `json:"process_time_ms"`
+	Model              string   `json:"model"`
+	ModelAutoSelected  bool     `json:"model_auto_selected,omitempty"`
+	Language           string   `json:"language,omitempty"`
+	LanguageDetected   bool     `json:"language_detected,omitempty"`
+	LanguageConfidence *float64 `json:"language_confidence,omitempty"`
+	Translated         bool     `json:"translated,omitempty"`
+	Translation        string   `json:"translation,omitempty"`
+	TranslatedTo       string   `json:"translated_to,omitempty"`
+
+	Candidates []Candidate `json:"candidates,omitempty"`
+	Pipeline   string      `json:"pipeline,omitempty"`
+	Steps      []Step      `json:"steps,omitempty"`
+
+	Structured     json.RawMessage `json:"structured,omitempty"`
+	SchemaAttempts int             `json:"schema_attempts,omitempty"`
+	SchemaErrors   []string        `json:"schema_errors,omitempty"`
+
+	SessionID    string `json:"session_id,omitempty"`
+	SessionTurns int    `json:"session_turns,omitempty"`
+
+	SpeakerTranscription string `json:"speaker_transcription,omitempty"`
+	Speakers             int    `json:"speakers,omitempty"`
+
+	SpeechURL    string `json:"speech_url,omitempty"`
+	SpeechFormat string `json:"speech_format,omitempty"`
+	SpeechError  string `json:"speech_error,omitempty"`
+
+	LLMSkipped       bool   `json:"llm_skipped,omitempty"`
+	LLMSkippedReason string `json:"llm_skipped_reason,omitempty"`
+	DoneReason       string `json:"done_reason,omitempty"`
+	Warning          string `json:"warning,omitempty"`
+
+	AudioDuration         float64 `json:"audio_duration_seconds,omitempty"`
+	RealtimeFactor        float64 `json:"realtime_factor,omitempty"`
+	EstimatedPromptTokens int     `json:"estimated_prompt_tokens,omitempty"`
+
+	Segments []Segment `json:"segments,omitempty"`
+	Stats    Stats     `json:"stats"`
+}
+
+// Candidate is one of the answers of a request with several candidates
+type Candidate struct {
+	Response    string `json:"response"`
+	ProcessTime int64  `json:"process_time_ms"`
+	DoneReason  string `json:"done_reason,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Step is the answer of one step of a pipeline
+type Step struct {
+	Name        string `json:"name"`
+	Model       string `json:"model"`
+	Response    string `json:"response,omitempty"`
+	ProcessTime int64  `json:"process_time_ms"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Segment is a timed piece of the transcription, in seconds
+type Segment struct {
+	ID         int      `json:"id"`
+	Start      float64  `json:"start"`
+	End        float64  `json:"end"`
+	Text       string   `json:"text"`
+	Speaker    string   `json:"speaker,omitempty"`
+	Confidence *float64 `json:"confidence,omitempty"`
+	Words      []Word   `json:"words,omitempty"`
+}
+
+// Word is a word of a segment, with word_timestamps
+type Word struct {
+	Word        string   `json:"word"`
+	Start       float64  `json:"start"`
+	End         float64  `json:"end"`
+	Probability *float64 `json:"probability,omitempty"`
+}
+
+// Stats are the timings and token counts of a request
+type Stats struct {
+	TranscriptionTime int64   `json:"transcription_time_ms"`
+	LLMTime           int64   `json:"llm_time_ms"`
+	PromptTokens      int     `json:"prompt_tokens"`
+	CompletionTokens  int     `json:"completion_tokens"`
+	TokensPerSecond   float64 `json:"tokens_per_second"`
+}
+
+// Process runs the pipeline on a recording and returns the response
+func (c *Client) Process(ctx context.Context, req ProcessRequest) (*ProcessResponse, error) {
+	resp, err := c.post(ctx, "/process", req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result ProcessResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode the response: %w", err)
+	}
+	result.RequestID = resp.Header.Get("X-Request-ID")
+	return &result, nil
+}
+
+// form returns the form fields of req, with extra on top
+func (req *ProcessRequest) form(extra map[string]string) (url.Values, error) {
+	form := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			form.Set(key, value)
+		}
+	}
+	set("audio_url", req.AudioURL)
+	set("mode", req.Mode)
+	set("text", req.Text)
+	set("prompt", req.Prompt)
+	set("system", req.System)
+	set("model", req.Model)
+	set("provider", req.Provider)
+	set("template", req.Template)
+	set("pipeline", req.Pipeline)
+	set("language", req.Language)
+	set("task", req.Task)
+	set("translate_to", req.TranslateTo)
+	set("session_id", req.SessionID)
+	if len(req.Schema) > 0 {
+		if !json.Valid(req.Schema) {
+			return nil, errors.New("Schema isn't valid JSON")
+		}
+		form.Set("schema", string(req.Schema))
+	}
+	if req.Candidates > 0 {
+		form.Set("n", strconv.Itoa(req.Candidates))
+	}
+	if req.Temperature != nil {
+		form.Set("temperature", strconv.FormatFloat(*req.Temperature, 'f', -1, 64))
+	}
+	if req.NumPredict > 0 {
+		form.Set("num_predict", strconv.Itoa(req.NumPredict))
+	}
+	if req.Diarize {
+		form.Set("diarize", "true")
+	}
+	for key, value := range req.Fields {
+		form.Set(key, value)
+	}
+	for key, value := range extra {
+		form.Set(key, value)
+	}
+	return form, nil
+}
+
+// post sends req as a multipart form to path, retrying while the bridge
+// is overloaded, and returns the response when its status is 2xx
+func (c *Client) post(ctx context.Context, path string, req ProcessRequest, extra map[string]string) (*http.Response, error) {
+	form, err := req.form(extra)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"api_version": {"2"}}
+	if req.Priority != "" {
+		query.Set("priority", req.Priority)
+	}
+	target := c.BaseURL + path + "?" + query.Encode()
+
+	// Where the audio starts, to rewind it for a retry
+	var start int64 = -1
+	if seeker, ok := req.Audio.(io.Seeker); ok {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			start = -1
+		}
+	}
+	var body *uploadBody
+	defer func() {
+		if body != nil {
+			body.stop()
+		}
+	}()
+	return c.do(ctx, func(attempt int) (*http.Request, error) {
+		if body != nil {
+			// The last attempt's upload must be done with the audio
+			// before it is rewound
+			body.stop()
+		}
+		if attempt > 0 && req.Audio != nil {
+			if start < 0 {
+				return nil, errNotReplayable
+			}
+			if _, err := req.Audio.(io.Seeker).Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		body = newUploadBody(form, req.Filename, req.Audio)
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", body.contentType)
+		return httpReq, nil
+	})
+}
+
+// uploadBody streams a multipart form, with the audio last, as it is read
+type uploadBody struct {
+	*io.PipeReader
+	contentType string
+	done        chan struct{} // closed once the form is written
+}
+
+func newUploadBody(form url.Values, filename string, audio io.Reader) *uploadBody {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	body := &uploadBody{PipeReader: pr, contentType: mw.FormDataContentType(), done: make(chan struct{})}
+	go func() {
+		defer close(body.done)
+		pw.CloseWithError(func() error {
+			for key, values := range form {
+				for _, value := range values {
+					if err := mw.WriteField(key, value); err != nil {
+						return err
+					}
+				}
+			}
+			if audio != nil {
+				if filename == "" {
+					filename = "audio"
+				}
+				part, err := mw.CreateFormFile("file", filename)
+				if err != nil {
+					return err
+				}
+				if _, err := io.Copy(part, audio); err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		}())
+	}()
+	return body
+}
+
+// stop ends the upload and waits until the audio is no longer read. The
+// response has already been received, so the rest isn't needed.
+func (b *uploadBody) stop() {
+	b.Close()
+	<-b.done
+}
+
+// do sends the request newRequest returns for each attempt, and retries
+// on connection failures and temporary error statuses. The response is
+// returned when its status is 2xx, else the *Error for it.
+func (c *Client) do(ctx context.Context, newRequest func(attempt int) (*http.Request, error)) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest(attempt)
+		if err != nil {
+			return nil, err
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		resp, err := httpClient.Do(req)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		case resp.StatusCode < 300:
+			return resp, nil
+		default:
+			apiErr := readError(resp)
+			if !apiErr.Temporary() {
+				return nil, apiErr
+			}
+			err, wait = apiErr, apiErr.RetryAfter
+		}
+		if attempt >= c.MaxRetries {
+			return nil, err
+		}
+		if wait == 0 {
+			wait = c.RetryBackoff << attempt
+			wait += rand.N(wait/4 + 1)
+		}
+		if err := sleep(ctx, min(wait, maxRetryWait)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readError reads the error response resp and closes it
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+		RequestID:  resp.Header.Get("X-Request-ID"),
+	}
+	// A JSON error body, such as {"error": "..."}
+	var jsonErr struct {
+		Error any `json:"error"`
+	}
+	if json.Unmarshal(body, &jsonErr) == nil {
+		switch e := jsonErr.Error.(type) {
+		case string:
+			apiErr.Message = e
+		case map[string]any:
+			if msg, ok := e["message"].(string); ok {
+				apiErr.Message = msg
+			}
+		}
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
+
+// sleep waits for d, or returns the error of ctx when it is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
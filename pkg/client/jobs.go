@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Job statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// How often WaitJob polls by default
+const DefaultPollInterval = 2 * time.Second
+
+// Job is an async job of /jobs
+type Job struct {
+	ID         string           `json:"id"`
+	Status     string           `json:"status"`
+	CreatedAt  time.Time        `json:"created_at"`
+	StartedAt  *time.Time       `json:"started_at,omitempty"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Result     *ProcessResponse `json:"result,omitempty"`
+}
+
+// Finished reports whether the job has reached a final status
+func (j *Job) Finished() bool {
+	return j.Status != JobQueued && j.Status != JobRunning
+}
+
+// SubmitJob queues a recording as an async job, for recordings too long
+// to hold a request open for
+func (c *Client) SubmitJob(ctx context.Context, req ProcessRequest) (*Job, error) {
+	resp, err := c.post(ctx, "/jobs", req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var job Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, fmt.Errorf("failed to decode the job: %w", err)
+	}
+	return &job, nil
+}
+
+// Job returns the job with the given ID
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	return c.jobRequest(ctx, http.MethodGet, id)
+}
+
+// CancelJob cancels a queued or running job
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+	return c.jobRequest(ctx, http.MethodDelete, id)
+}
+
+// WaitJob polls the job with the given ID every interval, or every
+// DefaultPollInterval when it is zero, until it has finished, and returns
+// it. A failed or cancelled job is returned with its status, not as an
+// error.
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (*Job, error) {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	for {
+		job, err := c.Job(ctx, id)
+		if err != nil || job.Finished() {
+			return job, err
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) jobRequest(ctx context.Context, method, id string) (*Job, error) {
+	resp, err := c.do(ctx, func(int) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, method, c.BaseURL+"/jobs/"+url.PathEscape(id), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var job Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, fmt.Errorf("failed to decode the job: %w", err)
+	}
+	return &job, nil
+}
+
+// ListJobs returns the bridge's jobs with the status, any when empty,
+// newest first, up to limit of them, or the bridge's default number when
+// limit is zero. With authentication on, these are the caller's own jobs.
+func (c *Client) ListJobs(ctx context.Context, status string, limit int) ([]Job, error) {
+	query := url.Values{}
+	if status != "" {
+		query.Set("status", status)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	resp, err := c.do(ctx, func(int) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/jobs?"+query.Encode(), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Jobs []Job `json:"jobs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode the jobs: %w", err)
+	}
+	return list.Jobs, nil
+}
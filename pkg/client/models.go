@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Models describes what the bridge's backends can run, from GET /models
+type Models struct {
+	ASR    ASRModels `json:"asr"`
+	LLM    LLMModels `json:"llm"`
+	Errors []string  `json:"errors,omitempty"` // backends that couldn't be listed
+}
+
+// ASRModels describes the bridge's ASR backend
+type ASRModels struct {
+	Backend   string   `json:"backend"`
+	Model     string   `json:"model,omitempty"`
+	Available []string `json:"available,omitempty"`
+	Translate bool     `json:"translate"`
+	Servers   int      `json:"servers,omitempty"`
+}
+
+// LLMModels lists the LLM models requests can use
+type LLMModels struct {
+	DefaultProvider string            `json:"default_provider"`
+	DefaultModel    string            `json:"default_model"`
+	Providers       []LLMProvider     `json:"providers"`
+	Models          []LLMModel        `json:"models"`
+	Aliases         map[string]string `json:"aliases,omitempty"`
+}
+
+// LLMProvider is a configured LLM provider
+type LLMProvider struct {
+	Name         string `json:"name"`
+	DefaultModel string `json:"default_model,omitempty"`
+}
+
+// LLMModel is a model pulled on the bridge's Ollama
+type LLMModel struct {
+	Name              string     `json:"name"`
+	Provider          string     `json:"provider"`
+	Family            string     `json:"family,omitempty"`
+	Format            string     `json:"format,omitempty"`
+	ParameterSize     string     `json:"parameter_size,omitempty"`
+	QuantizationLevel string     `json:"quantization_level,omitempty"`
+	ContextLength     int        `json:"context_length,omitempty"`
+	SizeBytes         int64      `json:"size_bytes,omitempty"`
+	ModifiedAt        *time.Time `json:"modified_at,omitempty"`
+	Hosts             []string   `json:"hosts,omitempty"`
+}
+
+// Models returns the models the bridge's backends can run, for offering
+// as choices. Models the bridge doesn't allow are left out.
+func (c *Client) Models(ctx context.Context) (*Models, error) {
+	resp, err := c.do(ctx, func(int) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/models", nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var models Models
+	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+		return nil, fmt.Errorf("failed to decode the models: %w", err)
+	}
+	return &models, nil
+}
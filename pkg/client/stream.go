@@ -0,0 +1,218 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Kinds of stream events
+const (
+	EventTranscription = "transcription"
+	EventToken         = "token"
+	EventDone          = "done"
+)
+
+// Event is an event of a streamed answer: the transcription, once it is
+// ready, a token of the answer, or the full response, last
+type Event struct {
+	Type string
+
+	// Transcription and Model of a transcription event
+	Transcription string
+	Model         string
+
+	// Token of a token event, with the tokens generated so far and the
+	// milliseconds since generation started
+	Token     string
+	EvalCount int
+	ElapsedMs int64
+
+	// Response of the done event
+	Response *ProcessResponse
+}
+
+// Stream reads the events of a streamed answer
+//
+//	stream, err := c.ProcessStream(ctx, req)
+//	if err != nil {
+//		return err
+//	}
+//	defer stream.Close()
+//	for stream.Next() {
+//		if ev := stream.Event(); ev.Type == client.EventToken {
+//			fmt.Print(ev.Token)
+//		}
+//	}
+//	return stream.Err()
+type Stream struct {
+	body      io.ReadCloser
+	scanner   *bufio.Scanner
+	requestID string
+	event     Event
+	err       error
+	done      bool
+
+	// Set when the bridge answered with the regular response instead of
+	// events, which it does when the LLM step fails or is skipped before
+	// generation starts
+	response *ProcessResponse
+}
+
+// ProcessStream runs the pipeline on a recording and streams the answer
+// as it is generated. The stream is closed after its done event; close it
+// to stop reading earlier.
+func (c *Client) ProcessStream(ctx context.Context, req ProcessRequest) (*Stream, error) {
+	resp, err := c.post(ctx, "/process", req, map[string]string{"stream": "true"})
+	if err != nil {
+		return nil, err
+	}
+	s := &Stream{body: resp.Body, requestID: resp.Header.Get("X-Request-ID")}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		defer resp.Body.Close()
+		var result ProcessResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return nil, fmt.Errorf("failed to decode the response: %w", err)
+		}
+		result.RequestID = s.requestID
+		s.response = &result
+		return s, nil
+	}
+	s.scanner = bufio.NewScanner(resp.Body)
+	s.scanner.Buffer(nil, 16<<20)
+	return s, nil
+}
+
+// Next reads the next event, reporting false at the end of the stream or
+// when it failed
+func (s *Stream) Next() bool {
+	if s.done {
+		return false
+	}
+	if s.response != nil {
+		s.event, s.done = Event{Type: EventDone, Response: s.response}, true
+		return true
+	}
+	name, data, err := s.read()
+	if err != nil {
+		s.fail(err)
+		return false
+	}
+	var ev Event
+	switch name {
+	case EventTranscription:
+		var payload struct {
+			Transcription string `json:"transcription"`
+			Model         string `json:"model"`
+		}
+		err = json.Unmarshal(data, &payload)
+		ev = Event{Type: name, Transcription: payload.Transcription, Model: payload.Model}
+	case EventToken:
+		var payload struct {
+			Token     string `json:"token"`
+			EvalCount int    `json:"eval_count"`
+			ElapsedMs int64  `json:"elapsed_ms"`
+		}
+		err = json.Unmarshal(data, &payload)
+		ev = Event{Type: name, Token: payload.Token, EvalCount: payload.EvalCount, ElapsedMs: payload.ElapsedMs}
+	case EventDone:
+		var result ProcessResponse
+		err = json.Unmarshal(data, &result)
+		result.RequestID = s.requestID
+		ev = Event{Type: name, Response: &result}
+	case "error":
+		var payload struct {
+			Error string `json:"error"`
+		}
+		if err = json.Unmarshal(data, &payload); err == nil {
+			err = fmt.Errorf("generation failed: %s", payload.Error)
+		}
+	default:
+		err = fmt.Errorf("unexpected event %q", name)
+	}
+	if err != nil {
+		s.fail(err)
+		return false
+	}
+	s.event = ev
+	if ev.Type == EventDone {
+		s.done = true
+		s.body.Close()
+	}
+	return true
+}
+
+// read reads the name and data of the next event
+func (s *Stream) read() (name string, data []byte, err error) {
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		switch {
+		case line == "":
+			if name != "" {
+				return name, data, nil
+			}
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	return "", nil, errors.New("stream ended before the done event")
+}
+
+func (s *Stream) fail(err error) {
+	s.err, s.done = err, true
+	s.body.Close()
+}
+
+// Event returns the event Next read
+func (s *Stream) Event() Event {
+	return s.event
+}
+
+// Err returns the error that ended the stream, nil when it ended with the
+// done event
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Response returns the response of the done event, nil before it
+func (s *Stream) Response() *ProcessResponse {
+	if s.event.Type == EventDone {
+		return s.event.Response
+	}
+	return nil
+}
+
+// Close stops reading the stream
+func (s *Stream) Close() error {
+	s.done = true
+	return s.body.Close()
+}
+
+// StreamTokens is ProcessStream for callers that only want the tokens as
+// they come and then the response: onToken is called with every token, in
+// order
+func (c *Client) StreamTokens(ctx context.Context, req ProcessRequest, onToken func(token string)) (*ProcessResponse, error) {
+	stream, err := c.ProcessStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	for stream.Next() {
+		if ev := stream.Event(); ev.Type == EventToken && onToken != nil {
+			onToken(ev.Token)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	return stream.Response(), nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Messages of the Postgres frontend/backend protocol, written out byte by
+// byte from the protocol documentation rather than with the bridge's code
+const (
+	// StartupMessage of user bridge to database results
+	postgresStartupFixture = "0000004a" + "00030000" +
+		"7573657200" + "62726964676500" + "646174616261736500" + "726573756c747300" +
+		"6170706c69636174696f6e5f6e616d6500" + "776869737065722d6c6c6d2d62726964676500" + "00"
+
+	// Parse, Bind, Execute and Sync of SELECT id, note FROM t WHERE id = $1
+	// with $1 = r1, as text
+	postgresQueryFixture = "50" + "0000002c" + "00" + "53454c4543542069642c206e6f74652046524f4d2074205748455245206964203d20243100" + "0000" +
+		"42" + "00000012" + "00" + "00" + "0000" + "0001" + "00000002" + "7231" + "0000" +
+		"45" + "00000009" + "00" + "00000000" +
+		"53" + "00000004"
+
+	// Query CREATE TABLE t (id text)
+	postgresSimpleQueryFixture = "51" + "0000001d" + "435245415445205441424c4520742028696420746578742900"
+
+	// ParseComplete, BindComplete, a DataRow of r1 and NULL,
+	// CommandComplete and ReadyForQuery
+	postgresRowsFixture = "31" + "00000004" + "32" + "00000004" +
+		"44" + "00000010" + "0002" + "00000002" + "7231" + "ffffffff" +
+		"43" + "0000000d" + "53454c454354203100" +
+		"5a" + "00000005" + "49"
+
+	// ErrorResponse 42P01 as Postgres 16 sends it for a missing table,
+	// then ReadyForQuery
+	postgresErrorFixture = "45" + "00000064" + "534552524f5200" + "564552524f5200" + "433432503031" + "00" +
+		"4d72656c6174696f6e2022742220646f6573206e6f7420657869737400" + "50313500" +
+		"4670617273655f72656c6174696f6e2e6300" + "4c3133393200" + "527061727365724f70656e5461626c650000" +
+		"5a" + "00000005" + "49"
+)
+
+// postgresScript plays the server side of a Postgres connection, one
+// message at a time
+type postgresScript struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// servePostgres listens for clients and hands over each connection
+func servePostgres(t *testing.T) (string, <-chan *postgresScript) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	scripts := make(chan *postgresScript, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			context.AfterFunc(t.Context(), func() { conn.Close() })
+			scripts <- &postgresScript{t: t, conn: conn, reader: bufio.NewReader(conn)}
+		}
+	}()
+	return ln.Addr().String(), scripts
+}
+
+// read reads exactly n bytes from the client
+func (s *postgresScript) read(n int) []byte {
+	s.t.Helper()
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, n)
+	if _, err := io.ReadFull(s.reader, b); err != nil {
+		s.t.Fatalf("reading from the client: %v", err)
+	}
+	return b
+}
+
+// expectBytes reads the bytes of a fixture from the client
+func (s *postgresScript) expectBytes(want string) {
+	s.t.Helper()
+	if got := hex.EncodeToString(s.read(len(want) / 2)); got != want {
+		s.t.Fatalf("client sent %s, want %s", got, want)
+	}
+}
+
+// expect reads a message, which must be of kind, and returns its body
+func (s *postgresScript) expect(kind byte) []byte {
+	s.t.Helper()
+	header := s.read(5)
+	if header[0] != kind {
+		s.t.Fatalf("client sent message %q, want %q", header[0], kind)
+	}
+	return s.read(int(binary.BigEndian.Uint32(header[1:])) - 4)
+}
+
+func (s *postgresScript) send(kind byte, body []byte) {
+	s.conn.Write(postgresMessage(kind, body))
+}
+
+func (s *postgresScript) sendHex(fixture string) {
+	b, _ := hex.DecodeString(fixture)
+	s.conn.Write(b)
+}
+
+// auth sends an authentication request
+func (s *postgresScript) auth(method uint32, data []byte) {
+	s.send('R', append(binary.BigEndian.AppendUint32(nil, method), data...))
+}
+
+// ready completes a successful startup the way Postgres does
+func (s *postgresScript) ready() {
+	s.auth(0, nil)
+	s.send('S', append(cstring("server_version"), cstring("16.2")...))
+	s.send('K', []byte{0, 0, 0x30, 0x39, 1, 2, 3, 4})
+	s.send('Z', []byte("I"))
+}
+
+// inBackground calls f on the client side and returns a channel with its
+// error
+func inBackground(f func() error) <-chan error {
+	errs := make(chan error, 1)
+	go func() { errs <- f() }()
+	return errs
+}
+
+func waitClient(t *testing.T, errs <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("client didn't finish")
+		return nil
+	}
+}
+
+func TestNewPostgresClient(t *testing.T) {
+	tests := []struct {
+		url                            string
+		addr, user, password, database string
+		tls                            bool
+		wantErr                        bool
+	}{
+		{url: "postgres://bridge:secret@db:5433/results", addr: "db:5433", user: "bridge", password: "secret", database: "results"},
+		{url: "postgresql://bridge@db", addr: "db:5432", user: "bridge", database: "bridge"},
+		{url: "postgres://db", addr: "db:5432", user: "postgres", database: "postgres"},
+		{url: "postgres://u:p%40ss@db/results?sslmode=require", addr: "db:5432", user: "u", password: "p@ss", database: "results", tls: true},
+		{url: "postgres://db/results?sslmode=disable", addr: "db:5432", user: "postgres", database: "results"},
+		{url: "postgres://db/results?sslmode=prefer", wantErr: true},
+		{url: "mysql://db/results", wantErr: true},
+		{url: "postgres:///results", wantErr: true},
+	}
+	for _, tt := range tests {
+		c, err := newPostgresClient(tt.url)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("newPostgresClient(%q) succeeded, want an error", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newPostgresClient(%q): %v", tt.url, err)
+			continue
+		}
+		if c.addr != tt.addr || c.user != tt.user || c.password != tt.password || c.database != tt.database || c.tls != tt.tls {
+			t.Errorf("newPostgresClient(%q) = %+v", tt.url, c)
+		}
+	}
+}
+
+func TestPostgresQuery(t *testing.T) {
+	addr, scripts := servePostgres(t)
+	client, _ := newPostgresClient("postgres://bridge@" + addr + "/results")
+	var rows [][]string
+	errs := inBackground(func() (err error) {
+		rows, err = client.query(t.Context(), "SELECT id, note FROM t WHERE id = $1", "r1")
+		return err
+	})
+
+	s := <-scripts
+	s.expectBytes(postgresStartupFixture)
+	s.ready()
+	s.expectBytes(postgresQueryFixture)
+	s.sendHex(postgresRowsFixture)
+	if err := waitClient(t, errs); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if want := [][]string{{"r1", ""}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+
+	// The connection is reused
+	errs = inBackground(func() error { return client.exec(t.Context(), "CREATE TABLE t (id text)") })
+	s.expectBytes(postgresSimpleQueryFixture)
+	s.send('C', cstring("CREATE TABLE"))
+	s.send('Z', []byte("I"))
+	if err := waitClient(t, errs); err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+}
+
+func TestPostgresQueryError(t *testing.T) {
+	addr, scripts := servePostgres(t)
+	client, _ := newPostgresClient("postgres://bridge@" + addr + "/results")
+	errs := inBackground(func() error {
+		_, err := client.query(t.Context(), "SELECT id, note FROM t WHERE id = $1", "r1")
+		return err
+	})
+	s := <-scripts
+	s.expectBytes(postgresStartupFixture)
+	s.ready()
+	s.expectBytes(postgresQueryFixture)
+	s.sendHex(postgresErrorFixture)
+	var pgErr *postgresError
+	if err := waitClient(t, errs); !errors.As(err, &pgErr) || pgErr.Code != "42P01" || pgErr.Message != `relation "t" does not exist` {
+		t.Fatalf("query = %v, want the 42P01 error", err)
+	}
+
+	// A query error leaves the connection usable
+	errs = inBackground(func() error { return client.exec(t.Context(), "CREATE TABLE t (id text)") })
+	s.expectBytes(postgresSimpleQueryFixture)
+	s.send('C', cstring("CREATE TABLE"))
+	s.send('Z', []byte("I"))
+	if err := waitClient(t, errs); err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+}
+
+func TestPostgresBrokenConnectionDropped(t *testing.T) {
+	addr, scripts := servePostgres(t)
+	client, _ := newPostgresClient("postgres://bridge@" + addr + "/results")
+	errs := inBackground(func() error { return client.exec(t.Context(), "CREATE TABLE t (id text)") })
+	s := <-scripts
+	s.expectBytes(postgresStartupFixture)
+	s.ready()
+	s.expectBytes(postgresSimpleQueryFixture)
+	s.sendHex("44" + "7fffffff") // a DataRow larger than any accepted
+	if err := waitClient(t, errs); err == nil || !strings.Contains(err.Error(), "bad message length") {
+		t.Fatalf("exec = %v, want a bad message length", err)
+	}
+
+	// The next query opens a new connection
+	errs = inBackground(func() error { return client.exec(t.Context(), "CREATE TABLE t (id text)") })
+	s = <-scripts
+	s.expectBytes(postgresStartupFixture)
+	s.ready()
+	s.expectBytes(postgresSimpleQueryFixture)
+	s.send('Z', []byte("I"))
+	if err := waitClient(t, errs); err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+}
+
+func TestPostgresCleartextPassword(t *testing.T) {
+	addr, scripts := servePostgres(t)
+	client, _ := newPostgresClient("postgres://bridge:secret@" + addr + "/results")
+	errs := inBackground(func() error { return client.exec(t.Context(), "") })
+	s := <-scripts
+	s.expectBytes(postgresStartupFixture)
+	s.auth(3, nil)
+	if got := string(s.expect('p')); got != "secret\x00" {
+		t.Errorf("password message %q", got)
+	}
+	s.ready()
+	s.expect('Q')
+	s.send('Z', []byte("I"))
+	if err := waitClient(t, errs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostgresMD5Password(t *testing.T) {
+	addr, scripts := servePostgres(t)
+	client, _ := newPostgresClient("postgres://bridge:secret@" + addr + "/results")
+	errs := inBackground(func() error { return client.exec(t.Context(), "") })
+	s := <-scripts
+	s.expectBytes(postgresStartupFixture)
+	s.auth(5, []byte{1, 2, 3, 4})
+	// "md5" + md5(md5(password + user) + salt)
+	if got := string(s.expect('p')); got != "md5ddb20e68be1bad6bc45f4550997a27bf\x00" {
+		t.Errorf("password message %q", got)
+	}
+	s.ready()
+	s.expect('Q')
+	s.send('Z', []byte("I"))
+	if err := waitClient(t, errs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostgresAuthFailure(t *testing.T) {
+	addr, scripts := servePostgres(t)
+	client, _ := newPostgresClient("postgres://bridge:wrong@" + addr + "/results")
+	errs := inBackground(func() error { return client.exec(t.Context(), "") })
+	s := <-scripts
+	s.expectBytes(postgresStartupFixture)
+	s.auth(3, nil)
+	s.expect('p')
+	s.send('E', []byte("SFATAL\x00VFATAL\x00C28P01\x00Mpassword authentication failed for user \"bridge\"\x00\x00"))
+	var pgErr *postgresError
+	if err := waitClient(t, errs); !errors.As(err, &pgErr) || pgErr.Code != "28P01" {
+		t.Errorf("exec = %v, want the 28P01 error", err)
+	}
+}
+
+func TestPostgresSSLRefused(t *testing.T) {
+	addr, scripts := servePostgres(t)
+	client, _ := newPostgresClient("postgres://bridge@" + addr + "/results?sslmode=require")
+	errs := inBackground(func() error { return client.exec(t.Context(), "") })
+	s := <-scripts
+	s.expectBytes("00000008" + "04d2162f") // SSLRequest
+	s.conn.Write([]byte("N"))
+	if err := waitClient(t, errs); err == nil || !strings.Contains(err.Error(), "doesn't support TLS") {
+		t.Errorf("exec = %v, want TLS refused", err)
+	}
+}
+
+// scramServer checks a SCRAM-SHA-256 exchange the way Postgres does,
+// holding the stored and server keys of the password
+type scramServer struct {
+	salt       []byte
+	iterations int
+	storedKey  [32]byte
+	serverKey  []byte
+}
+
+func newSCRAMServer(password string) *scramServer {
+	s := &scramServer{salt: []byte("0123456789abcdef"), iterations: 4096}
+	salted := pbkdf2SHA256([]byte(password), s.salt, s.iterations)
+	s.storedKey = sha256.Sum256(hmacSHA256(salted, "Client Key"))
+	s.serverKey = hmacSHA256(salted, "Server Key")
+	return s
+}
+
+func TestPostgresSCRAM(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		password      string
+		badServerSign bool
+		wantErr       string
+	}{
+		{name: "ok", password: "secret"},
+		{name: "wrong password", password: "wrong", wantErr: "28P01"},
+		{name: "server doesn't know the password", password: "secret", badServerSign: true, wantErr: "signature doesn't match"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, scripts := servePostgres(t)
+			client, _ := newPostgresClient("postgres://bridge:" + tt.password + "@" + addr + "/results")
+			errs := inBackground(func() error { return client.exec(t.Context(), "") })
+			s := <-scripts
+			s.expectBytes(postgresStartupFixture)
+			s.auth(10, append(append(cstring("SCRAM-SHA-256-PLUS"), cstring("SCRAM-SHA-256")...), 0))
+
+			// SASLInitialResponse: the mechanism and client-first-message
+			initial := s.expect('p')
+			mechanism, rest, _ := strings.Cut(string(initial), "\x00")
+			clientFirst := rest[4:]
+			if mechanism != "SCRAM-SHA-256" || int(binary.BigEndian.Uint32([]byte(rest))) != len(clientFirst) ||
+				!strings.HasPrefix(clientFirst, "n,,n=,r=") {
+				t.Fatalf("SASLInitialResponse %q", initial)
+			}
+			server := newSCRAMServer("secret")
+			nonce := strings.TrimPrefix(clientFirst, "n,,n=,r=") + "3rfcNHYJY1ZVvWVs7j"
+			serverFirst := "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString(server.salt) + ",i=4096"
+			s.auth(11, []byte(serverFirst))
+
+			// SASLResponse: the client-final-message with its proof
+			clientFinal := string(s.expect('p'))
+			withoutProof, proof, _ := strings.Cut(clientFinal, ",p=")
+			if withoutProof != "c=biws,r="+nonce {
+				t.Fatalf("client-final-message %q", clientFinal)
+			}
+			authMessage := strings.TrimPrefix(clientFirst, "n,,") + "," + serverFirst + "," + withoutProof
+			proofBytes, _ := base64.StdEncoding.DecodeString(proof)
+			signature := hmacSHA256(server.storedKey[:], authMessage)
+			clientKey := make([]byte, len(proofBytes))
+			for i := range proofBytes {
+				clientKey[i] = proofBytes[i] ^ signature[i%len(signature)]
+			}
+			if sum := sha256.Sum256(clientKey); !hmac.Equal(sum[:], server.storedKey[:]) {
+				s.send('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed for user \"bridge\"\x00\x00"))
+			} else {
+				serverSignature := hmacSHA256(server.serverKey, authMessage)
+				if tt.badServerSign {
+					serverSignature[0] ^= 1
+				}
+				s.auth(12, []byte("v="+base64.StdEncoding.EncodeToString(serverSignature)))
+				if !tt.badServerSign {
+					s.ready()
+					s.expect('Q')
+					s.send('Z', []byte("I"))
+				}
+			}
+
+			err := waitClient(t, errs)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("exec = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSCRAMClientRFC7677(t *testing.T) {
+	// The example exchange of RFC 7677, section 3, whose user name is
+	// "user" where Postgres sends none
+	s := &scramClient{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	s.clientFirst()
+	s.firstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+	final, err := s.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; final != want {
+		t.Errorf("client-final-message = %q, want %q", final, want)
+	}
+	if err := s.verifyServer("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Errorf("verifyServer: %v", err)
+	}
+
+	// A server nonce that doesn't extend the client's is refused
+	if _, err := s.clientFinal("r=someone-else,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Error("clientFinal accepted a foreign nonce")
+	}
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914, section 11, truncated to the 32 bytes SCRAM uses
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations)); got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+func TestParseDataRow(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{"0000", []string{}, false},
+		{"0002" + "00000002" + "7231" + "ffffffff", []string{"r1", ""}, false},
+		{"0001" + "00000000", []string{""}, false},
+		{"0002" + "00000002" + "7231", nil, true},
+		{"0001" + "00000005" + "7231", nil, true},
+		{"00", nil, true},
+	}
+	for _, tt := range tests {
+		body, _ := hex.DecodeString(tt.body)
+		row, err := parseDataRow(body)
+		if (err != nil) != tt.wantErr || !tt.wantErr && !reflect.DeepEqual(row, tt.want) {
+			t.Errorf("parseDataRow(%s) = %q, %v; want %q", tt.body, row, err, tt.want)
+		}
+	}
+}
+
+func TestPostgresResultStoreGet(t *testing.T) {
+	addr, scripts := servePostgres(t)
+	client, _ := newPostgresClient("postgres://bridge@" + addr + "/results")
+	store := postgresResultStore{client}
+	var record *ResultRecord
+	errs := inBackground(func() (err error) {
+		record, err = store.get(t.Context(), "res-1")
+		return err
+	})
+	s := <-scripts
+	s.expectBytes(postgresStartupFixture)
+	s.ready()
+
+	parse := s.expect('P')
+	if sql := string(parse[1:]); !strings.HasPrefix(sql, resultSelect+" WHERE id = $1\x00") {
+		t.Errorf("query %q", sql)
+	}
+	bind := s.expect('B')
+	if !strings.HasSuffix(string(bind), "\x00\x01\x00\x00\x00\x05res-1\x00\x00") {
+		t.Errorf("Bind %q, want the one parameter res-1", bind)
+	}
+	s.expect('E')
+	s.expect('S')
+
+	columns := []string{"res-1", "req-1", "2026-10-16T12:00:00.5Z", "process", "alice", "a.wav", "12.5", "en", "llama3", "ollama",
+		"hello", "hi there", "1500", "900", "600", ""}
+	row := binary.BigEndian.AppendUint16(nil, uint16(len(columns)))
+	for _, column := range columns {
+		row = binary.BigEndian.AppendUint32(row, uint32(len(column)))
+		row = append(row, column...)
+	}
+	s.send('1', nil)
+	s.send('2', nil)
+	s.send('D', row)
+	s.send('C', cstring("SELECT 1"))
+	s.send('Z', []byte("I"))
+	if err := waitClient(t, errs); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	want := &ResultRecord{
+		ID: "res-1", RequestID: "req-1", CreatedAt: time.Date(2026, 10, 16, 12, 0, 0, 5e8, time.UTC),
+		Endpoint: "process", Caller: "alice", Filename: "a.wav", AudioDuration: 12.5, Language: "en", Model: "llama3",
+		Provider: "ollama", Transcription: "hello", Response: "hi there", ProcessTime: 1500, TranscriptionTime: 900, LLMTime: 600,
+	}
+	if !reflect.DeepEqual(record, want) {
+		t.Errorf("record = %+v, want %+v", record, want)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// audioInfo describes an audio file as far as it can be determined from
+// its headers. Zero values mean unknown.
+type audioInfo struct {
+	Format        string  `json:"format"`
+	SizeBytes     int64   `json:"size_bytes"`
+	Duration      float64 `json:"duration_seconds,omitempty"`
+	SampleRate    int     `json:"sample_rate,omitempty"`
+	Channels      int     `json:"channels,omitempty"`
+	BitsPerSample int     `json:"bits_per_sample,omitempty"`
+}
+
+// probeAudioFile sniffs the format of the file at path and reads duration,
+// sample rate and channels from the WAV, FLAC or MP3 headers. Other formats
+// would need a decoder and only report the format and size.
+func probeAudioFile(path string) (*audioInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, sniffLength)
+	n, _ := io.ReadFull(file, header)
+	info := &audioInfo{
+		Format:    sniffAudioFormat(header[:n]),
+		SizeBytes: stat.Size(),
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	switch info.Format {
+	case formatWAV:
+		probeWAV(file, info)
+	case formatFLAC:
+		probeFLAC(file, info)
+	case formatMP3:
+		probeMP3(file, info)
+	}
+	return info, nil
+}
+
+func probeWAV(r io.ReadSeeker, info *audioInfo) {
+	wav, err := readWAVHeader(r)
+	if err != nil {
+		return
+	}
+	info.SampleRate = wav.SampleRate
+	info.Channels = wav.Channels
+	info.BitsPerSample = wav.BitsPerSample
+	if bytesPerSecond := wav.SampleRate * wav.Channels * wav.BitsPerSample / 8; bytesPerSecond > 0 {
+		info.Duration = float64(wav.DataSize) / float64(bytesPerSecond)
+	}
+}
+
+// probeFLAC reads the STREAMINFO block, which always follows the "fLaC"
+// marker
+func probeFLAC(r io.Reader, info *audioInfo) {
+	var buf [4 + 4 + 34]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return
+	}
+	streamInfo := buf[8:]
+
+	// Bits 80-99 sample rate, 100-102 channels-1, 103-107 bits per
+	// sample-1, 108-143 total samples
+	packed := binary.BigEndian.Uint64(streamInfo[10:18])
+	info.SampleRate = int(packed >> 44)
+	info.Channels = int(packed>>41&0x7) + 1
+	info.BitsPerSample = int(packed>>36&0x1F) + 1
+	totalSamples := packed & 0xFFFFFFFFF
+	if info.SampleRate > 0 && totalSamples > 0 {
+		info.Duration = float64(totalSamples) / float64(info.SampleRate)
+	}
+}
+
+// MPEG-1 Layer III bitrates (kbit/s) and sample rates, plus the MPEG-2/2.5
+// variants
+var (
+	mp3BitratesV1   = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mp3BitratesV2   = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	mp3SampleRates  = [4]int{44100, 48000, 32000, 0}
+	mp3RateDivisors = map[byte]int{3: 1, 2: 2, 0: 4} // version bits -> divisor
+)
+
+// probeMP3 reads the first Layer III frame header after any ID3v2 tag and
+// estimates the duration from the file size, assuming a constant bitrate
+func probeMP3(r io.ReadSeeker, info *audioInfo) {
+	var id3 [10]byte
+	if _, err := io.ReadFull(r, id3[:]); err != nil {
+		return
+	}
+	audioStart := int64(0)
+	if string(id3[0:3]) == "ID3" {
+		// Syncsafe tag size excluding the 10-byte header
+		size := int64(id3[6])<<21 | int64(id3[7])<<14 | int64(id3[8])<<7 | int64(id3[9])
+		audioStart = 10 + size
+	}
+	if _, err := r.Seek(audioStart, io.SeekStart); err != nil {
+		return
+	}
+
+	var frame [4]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return
+	}
+	if frame[0] != 0xFF || frame[1]&0xE0 != 0xE0 {
+		return
+	}
+	version := frame[1] >> 3 & 0x3
+	divisor, ok := mp3RateDivisors[version]
+	if !ok || frame[1]>>1&0x3 != 1 { // Layer III only
+		return
+	}
+
+	bitrates := mp3BitratesV1
+	if version != 3 {
+		bitrates = mp3BitratesV2
+	}
+	bitrate := bitrates[frame[2]>>4] * 1000
+	info.SampleRate = mp3SampleRates[frame[2]>>2&0x3] / divisor
+	info.Channels = 2
+	if frame[3]>>6 == 3 {
+		info.Channels = 1
+	}
+	if bitrate > 0 {
+		info.Duration = float64(info.SizeBytes-audioStart) * 8 / float64(bitrate)
+	}
+}
+
+// realtimeFactor is the audio seconds processed per second of processing
+// time, rounded to two decimals. Above 1 the pipeline keeps up with
+// realtime audio.
+func realtimeFactor(duration float64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return math.Round(duration/elapsed.Seconds()*100) / 100
+}
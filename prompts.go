@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Extension of the prompt template files in PROMPT_TEMPLATES_DIR
+const promptTemplateExt = ".tmpl"
+
+// promptData holds the variables a prompt template can use
+type promptData struct {
+	// Prompt is the request's prompt, DEFAULT_PROMPT when it has none
+	Prompt string
+	// Transcription is the text the LLM works on: the transcription, or
+	// its translation or summaries
+	Transcription string
+	// Language is the code of the audio's language, when known
+	Language string
+	// Filename is the name of the uploaded file
+	Filename string
+}
+
+// Prompt of requests without a template: the request's prompt followed by
+// the transcription
+var defaultPromptTemplate = template.Must(template.New("default").Parse("{{.Prompt}}\n\nTranscription: {{.Transcription}}"))
+
+// buildPrompt assembles the prompt sent to the LLM for a transcription
+func buildPrompt(prompt, transcription string) string {
+	text, _ := renderPrompt(defaultPromptTemplate, promptData{Prompt: prompt, Transcription: transcription})
+	return text
+}
+
+func renderPrompt(tmpl *template.Template, data promptData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// loadPromptTemplates parses the *.tmpl files in dir as Go text/template
+// templates named after the file, e.g. meeting_summary.tmpl is
+// meeting_summary. Each is tried on empty data so a template using a
+// variable that doesn't exist fails here rather than on a request.
+func loadPromptTemplates(dir string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	if dir == "" {
+		return templates, nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+promptTemplateExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(path), promptTemplateExt)
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(string(text))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := renderPrompt(tmpl, promptData{}); err != nil {
+			return nil, err
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// lookupPromptTemplate returns the template named by the template field,
+// or nil for the default prompt
+func lookupPromptTemplate(name string) (*template.Template, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if tmpl, ok := cfg().promptTemplates[name]; ok {
+		return tmpl, nil
+	}
+	if len(cfg().promptTemplates) == 0 {
+		return nil, newHTTPError(http.StatusBadRequest, "unknown template %q (no templates are configured)", name)
+	}
+	names := make([]string, 0, len(cfg().promptTemplates))
+	for name := range cfg().promptTemplates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return nil, newHTTPError(http.StatusBadRequest, "unknown template %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// processPrompt is the prompt of the LLM step of a /process request, from
+// its template or the default one
+func processPrompt(input *processInput, transcription, language string) (string, error) {
+	tmpl := input.Template
+	if tmpl == nil {
+		tmpl = defaultPromptTemplate
+	}
+	prompt, err := renderPrompt(tmpl, promptData{
+		Prompt:        input.Prompt,
+		Transcription: transcription,
+		Language:      language,
+		Filename:      input.Filename,
+	})
+	if err != nil {
+		return "", fmt.Errorf("rendering prompt template %s: %w", tmpl.Name(), err)
+	}
+	return prompt, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protobuf wire types the bridge reads and writes
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoEncoder appends protobuf fields to a message, the few kinds the
+// gRPC API needs, without generated code. Zero values are left out, as
+// proto3 does.
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) tag(field, wireType int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (e *protoEncoder) int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, protoVarint)
+	e.buf = binary.AppendUvarint(e.buf, uint64(v))
+}
+
+func (e *protoEncoder) bool(field int, v bool) {
+	if v {
+		e.int64(field, 1)
+	}
+}
+
+func (e *protoEncoder) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, protoFixed64)
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+}
+
+func (e *protoEncoder) string(field int, v string) {
+	if v == "" {
+		return
+	}
+	e.tag(field, protoBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *protoEncoder) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	e.tag(field, protoBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// message writes the embedded message encode writes, even when empty, so
+// a oneof field set to an empty message is still seen
+func (e *protoEncoder) message(field int, encode func(*protoEncoder)) {
+	var m protoEncoder
+	encode(&m)
+	e.tag(field, protoBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(m.buf)))
+	e.buf = append(e.buf, m.buf...)
+}
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// protoDecoder reads the fields of a protobuf message in order
+type protoDecoder struct {
+	buf []byte
+}
+
+// next reads the tag of the next field, reporting false at the end of
+// the message
+func (d *protoDecoder) next() (field, wireType int, ok bool, err error) {
+	if len(d.buf) == 0 {
+		return 0, 0, false, nil
+	}
+	tag, err := d.varint()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+		return 0, 0, false, fmt.Errorf("protobuf: invalid field number %d", tag>>3)
+	}
+	return int(tag >> 3), int(tag & 7), true, nil
+}
+
+func (d *protoDecoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, errProtoTruncated
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+// bytes reads a length-delimited field, sharing the message's memory
+func (d *protoDecoder) bytes() ([]byte, error) {
+	n, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.buf)) {
+		return nil, errProtoTruncated
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+// skip passes over a field of wireType the bridge doesn't read
+func (d *protoDecoder) skip(wireType int) error {
+	var n int
+	switch wireType {
+	case protoVarint:
+		_, err := d.varint()
+		return err
+	case protoFixed64:
+		n = 8
+	case protoBytes:
+		_, err := d.bytes()
+		return err
+	case protoFixed32:
+		n = 4
+	default:
+		return fmt.Errorf("protobuf: unsupported wire type %d", wireType)
+	}
+	if len(d.buf) < n {
+		return errProtoTruncated
+	}
+	d.buf = d.buf[n:]
+	return nil
+}
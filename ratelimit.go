@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often idle buckets are dropped from the rate limiter
+const rateLimitSweepInterval = time.Minute
+
+// Routes that are never rate limited, so probes and scrapes keep working
+// for a client that is being limited
+var rateLimitExempt = map[string]bool{"/health": true, "/readyz": true, "/metrics": true}
+
+// rateLimiter keeps a token bucket per client and route. A bucket holds up
+// to burst tokens and refills at the route's rate; each request takes a
+// token and is refused with 429 when none is left. Routes without a limit
+// of their own share one bucket per client.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64 // tokens per second
+	burst  float64
+}
+
+// refill adds the tokens earned since the last request
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// rateLimit is the rate and bucket size for a route pattern, or ok false
+// when the route isn't limited
+func rateLimit(route string) (perMinute, burst int, ok bool) {
+	c := cfg()
+	if rateLimitExempt[route] {
+		return 0, 0, false
+	}
+	perMinute, burst = c.rateLimitPerMinute, c.rateLimitBurst
+	if limit, own := c.routeRateLimits[route]; own {
+		perMinute, burst = limit, limit
+	}
+	if burst == 0 {
+		burst = perMinute
+	}
+	return perMinute, burst, perMinute > 0
+}
+
+// take removes a token from the bucket for key. It returns the tokens left
+// and, when the request is refused, how long until a token is available.
+func (l *rateLimiter) take(key string, perMinute, burst int, now time.Time) (remaining int, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	// Limits may have been reloaded since the bucket was made
+	b.rate, b.burst = float64(perMinute)/60, float64(burst)
+	b.refill(now)
+	if b.tokens < 1 {
+		return 0, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens--
+	return int(b.tokens), 0
+}
+
+// sweep drops buckets that have refilled completely, which are the same
+// as no bucket. Called with mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitMiddleware limits each client, identified as clientID does, to
+// the rate of the route mux would serve the request with, or to its key's
+// own rate on routes without a limit of their own. The limit is reported
+// in X-RateLimit-Limit, the requests left in X-RateLimit-Remaining and the
+// seconds until the bucket is full again in X-RateLimit-Reset.
+func rateLimitMiddleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		perMinute, burst, ok := rateLimit(route)
+		_, own := cfg().routeRateLimits[route]
+		if apiKey := traceFromContext(r.Context()).apiKey; apiKey != nil && apiKey.RateLimitPerMinute > 0 && !own && !rateLimitExempt[route] {
+			perMinute, burst, ok = apiKey.RateLimitPerMinute, apiKey.RateLimitPerMinute, true
+		}
+		if !ok {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		key := clientID(r)
+		if own {
+			key = route + "\xff" + key
+		}
+		remaining, wait := limiter.take(key, perMinute, burst, time.Now())
+		refill := float64(burst-remaining) * 60 / float64(perMinute)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(refill))))
+		if wait == 0 {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		message := fmt.Sprintf("rate limit of %d requests per minute exceeded, retry in %ds", perMinute, retryAfter)
+		if strings.HasPrefix(r.URL.Path, "/v1/") {
+			writeOpenAIError(w, http.StatusTooManyRequests, "requests", message)
+			return
+		}
+		http.Error(w, message, http.StatusTooManyRequests)
+	})
+}
+
+// parseRouteLimits parses RATE_LIMIT_ROUTES, e.g.
+// "/process=10,/v1/chat/completions=120": requests per minute by route
+// pattern, where 0 lifts the limit for the route
+func parseRouteLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, limit, ok := strings.Cut(entry, "=")
+		route = strings.TrimSpace(route)
+		if !ok || !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("invalid entry %q (expected /route=requests per minute)", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit %q for %s (expected a non-negative integer)", limit, route)
+		}
+		limits[route] = n
+	}
+	return limits, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useAPIKeys turns authentication on with the keys of an API_KEYS value
+// for the rest of the test
+func useAPIKeys(t *testing.T, value string) {
+	t.Helper()
+	keys, err := parseAPIKeys(value, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &keyStore{byHash: make(map[string]*APIKey)}
+	store.setStatic(keys)
+	setForTest(t, &apiKeys, store)
+}
+
+// rateLimitedHandler serves /process behind the authentication and rate
+// limiting middleware, with a limit of burst requests
+func rateLimitedHandler(t *testing.T, burst int) http.Handler {
+	t.Helper()
+	setConfigForTest(t, func(c *config) {
+		c.rateLimitPerMinute = 60
+		c.rateLimitBurst = burst
+	})
+	setForTest(t, &limiter, &rateLimiter{buckets: make(map[string]*tokenBucket)})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/process", func(w http.ResponseWriter, r *http.Request) {})
+	return authMiddleware(mux, rateLimitMiddleware(mux))
+}
+
+// limitedRequest sends a request from addr with an X-API-Key and returns
+// the status
+func limitedRequest(handler http.Handler, addr, key string) int {
+	r := httptest.NewRequest(http.MethodPost, "/process", nil)
+	r = r.WithContext(context.WithValue(r.Context(), requestTraceKey, &requestTrace{}))
+	r.RemoteAddr = addr + ":40000"
+	if key != "" {
+		r.Header.Set("X-API-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec.Code
+}
+
+func TestRateLimitIgnoresUnverifiedKeys(t *testing.T) {
+	handler := rateLimitedHandler(t, 2)
+	// A fresh key per request doesn't buy a fresh bucket
+	var statuses []int
+	for i := range 3 {
+		statuses = append(statuses, limitedRequest(handler, "10.0.0.1", fmt.Sprintf("random-%d", i)))
+	}
+	if want := []int{200, 200, 429}; fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if status := limitedRequest(handler, "10.0.0.2", "random-0"); status != http.StatusOK {
+		t.Errorf("another address got %d, want 200", status)
+	}
+}
+
+func TestRateLimitByVerifiedKey(t *testing.T) {
+	useAPIKeys(t, "team-a=sk-a,team-b=sk-b")
+	handler := rateLimitedHandler(t, 2)
+	for i := range 2 {
+		if status := limitedRequest(handler, "10.0.0.1", "sk-a"); status != http.StatusOK {
+			t.Fatalf("request %d of team-a = %d, want 200", i+1, status)
+		}
+	}
+	if status := limitedRequest(handler, "10.0.0.1", "sk-a"); status != http.StatusTooManyRequests {
+		t.Errorf("third request of team-a = %d, want 429", status)
+	}
+	// The same address with another key has a bucket of its own
+	if status := limitedRequest(handler, "10.0.0.1", "sk-b"); status != http.StatusOK {
+		t.Errorf("team-b = %d, want 200", status)
+	}
+}
+
+func TestClientID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/process", nil)
+	r.RemoteAddr = "10.0.0.7:40000"
+	r.Header.Set("X-API-Key", "team-a")
+	if got := clientID(r); got != "10.0.0.7" {
+		t.Errorf("clientID with an unverified key = %q, want the address", got)
+	}
+
+	trace := &requestTrace{apiKey: &APIKey{Name: "team-a"}}
+	if got := clientID(r.WithContext(context.WithValue(r.Context(), requestTraceKey, trace))); got != "team-a" {
+		t.Errorf("clientID with a verified key = %q, want its name", got)
+	}
+	trace = &requestTrace{claims: &tokenClaims{Subject: "user-1", Tenant: "acme"}}
+	if got := clientID(r.WithContext(context.WithValue(r.Context(), requestTraceKey, trace))); got != "acme" {
+		t.Errorf("clientID with a token = %q, want its tenant", got)
+	}
+}
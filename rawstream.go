@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// tokenStream sends generated text to the client while Ollama produces it.
+// Once started the response is committed, so the request can no longer be
+// retried or answered with an error status.
+type tokenStream interface {
+	// begin is called before generation with the response so far
+	begin(resp *CombinedResponse)
+	// write sends one piece of generated text
+	write(token string) error
+	// started reports whether anything was sent
+	started() bool
+	// finish ends the stream, err is the failure that cut it short
+	finish(resp CombinedResponse, stats ProcessStats, err error)
+}
+
+// maxTranscriptionHeaderBytes caps the X-Transcription header of raw
+// streams, as clients and proxies commonly limit headers to 8-16KB
+const maxTranscriptionHeaderBytes = 8 << 10
+
+// rawStream writes generated tokens straight to the response body as
+// text/plain, flushing after each, for clients that can't parse SSE or
+// NDJSON. The response starts with the first token, so failures before
+// that still get a regular response. The transcription is sent in the
+// X-Transcription header and the final stats in trailers.
+type rawStream struct {
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	resp *CombinedResponse
+	sent bool
+}
+
+func newRawStream(w http.ResponseWriter) *rawStream {
+	return &rawStream{w: w, rc: http.NewResponseController(w)}
+}
+
+// begin records the response whose transcription goes in the header
+func (s *rawStream) begin(resp *CombinedResponse) {
+	s.resp = resp
+}
+
+// write sends one piece of generated text
+func (s *rawStream) write(token string) error {
+	if !s.sent {
+		header := s.w.Header()
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Model", s.resp.Model)
+		if encoded := url.PathEscape(s.resp.Transcription); len(encoded) <= maxTranscriptionHeaderBytes {
+			header.Set("X-Transcription", encoded)
+		} else {
+			header.Set("X-Transcription-Omitted", "too long")
+		}
+		header.Set("Trailer", "X-Done-Reason, X-Prompt-Tokens, X-Completion-Tokens, X-Process-Time-Ms, X-Stream-Error")
+		s.w.WriteHeader(http.StatusOK)
+		s.sent = true
+	}
+	if _, err := s.w.Write([]byte(token)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+func (s *rawStream) started() bool {
+	return s.sent
+}
+
+// finish sets the trailers once generation has ended. err is the failure
+// that cut the stream short, if any.
+func (s *rawStream) finish(resp CombinedResponse, stats ProcessStats, err error) {
+	header := s.w.Header()
+	if err != nil {
+		header.Set("X-Stream-Error", err.Error())
+	}
+	header.Set("X-Done-Reason", resp.DoneReason)
+	header.Set("X-Prompt-Tokens", strconv.Itoa(stats.PromptTokens))
+	header.Set("X-Completion-Tokens", strconv.Itoa(stats.CompletionTokens))
+	header.Set("X-Process-Time-Ms", strconv.FormatInt(resp.ProcessTime, 10))
+}
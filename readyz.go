@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ReadyResponse is returned by /readyz
+type ReadyResponse struct {
+	Status    string                    `json:"status"`
+	Reason    string                    `json:"reason,omitempty"`
+	Upstreams map[string]UpstreamReport `json:"upstreams,omitempty"`
+}
+
+// UpstreamReport is the last known state of an upstream, from the
+// readiness probes or the keepalive pinger
+type UpstreamReport struct {
+	Status      string     `json:"status"` // up or down
+	LatencyMs   int64      `json:"latency_ms"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastCheck   *time.Time `json:"last_check,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Serializes readiness probes, so concurrent /readyz calls share one
+// round of probes instead of each hitting the upstreams
+var readyProbes sync.Mutex
+
+// readyHandler reports whether the bridge can serve /process requests. It
+// probes the ASR backend and, when it is the default LLM provider,
+// Ollama, reusing results younger than READYZ_CACHE_SECONDS so frequent
+// probes stay cheap.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) error{upstreamWhisper: pingWhisper}
+	if cfg().defaultLLM.name() == providerOllama {
+		checks[upstreamOllama] = pingOllamaAPI
+	}
+	probeUpstreams(r.Context(), checks)
+
+	resp := ReadyResponse{Status: "ready", Upstreams: make(map[string]UpstreamReport)}
+	for _, name := range []string{upstreamWhisper, upstreamOllama} {
+		status := upstreams.get(name)
+		if status.LastCheck.IsZero() {
+			continue
+		}
+		report := UpstreamReport{
+			Status:    "up",
+			LatencyMs: status.LastLatency.Milliseconds(),
+			LastCheck: &status.LastCheck,
+			LastError: status.LastError,
+		}
+		if !status.LastSuccess.IsZero() {
+			report.LastSuccess = &status.LastSuccess
+		}
+		if status.LastError != "" {
+			report.Status = "down"
+		}
+		resp.Upstreams[name] = report
+		if _, required := checks[name]; required && status.LastError != "" && resp.Reason == "" {
+			resp.Status = "degraded"
+			resp.Reason = name + " is unreachable"
+		}
+	}
+
+	for _, b := range []*circuitBreaker{whisperBreaker, ollamaBreaker} {
+		if err := b.allow(); err != nil && resp.Reason == "" {
+			resp.Status = "degraded"
+			resp.Reason = err.Error()
+		}
+	}
+
+	if cfg().defaultLLM.name() == providerOllama && !cfg().autoPullModels && ollamaModels.missing(r.Context()) {
+		resp.Status = "degraded"
+		resp.Reason = cfg().noModelsMessage
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// probeUpstreams runs the checks whose upstream wasn't checked within
+// READYZ_CACHE_SECONDS, concurrently and within READYZ_TIMEOUT, and
+// records the results
+func probeUpstreams(ctx context.Context, checks map[string]func(context.Context) error) {
+	readyProbes.Lock()
+	defer readyProbes.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg().readyzTimeout)*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for name, ping := range checks {
+		if time.Since(upstreams.get(name).LastCheck) < time.Duration(cfg().readyzCacheSeconds)*time.Second {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			upstreams.check(ctx, name, ping)
+		}()
+	}
+	wg.Wait()
+}
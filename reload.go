@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How often the config file is checked for changes
+const configWatchInterval = 5 * time.Second
+
+// Settings that only take effect on restart: they size pools and queues,
+// start background work or set up the server
+var restartSettings = map[string]bool{
+	"SERVER_PORT":                        true,
+	"GRPC_PORT":                          true,
+	"TLS_CERT_FILE":                      true,
+	"TLS_KEY_FILE":                       true,
+	"TLS_CLIENT_CA_FILE":                 true,
+	"TLS_CLIENT_AUTH":                    true,
+	"UPSTREAM_TLS_CA_FILE":               true,
+	"UPSTREAM_TLS_CERT_FILE":             true,
+	"UPSTREAM_TLS_KEY_FILE":              true,
+	"MAX_CONCURRENT_REQUESTS":            true,
+	"PRIORITY_RESERVED_FRACTION":         true,
+	"AUTO_CONCURRENCY":                   true,
+	"REQUEST_MEMORY_MB":                  true,
+	"CONCURRENCY_PER_CPU":                true,
+	"FAIR_QUEUING":                       true,
+	"QUEUE_MAX_WAITING":                  true,
+	"MAX_QUEUE_DEPTH":                    true,
+	"OLLAMA_MAX_CONCURRENT":              true,
+	"BREAKER_FAILURE_THRESHOLD":          true,
+	"BREAKER_COOLDOWN":                   true,
+	"KEEPALIVE_INTERVAL":                 true,
+	"API_KEYS_FILE":                      true,
+	"JOB_WORKERS":                        true,
+	"JOB_QUEUE_SIZE":                     true,
+	"JOB_MAX_STORED":                     true,
+	"SESSION_STORE":                      true,
+	"REDIS_URL":                          true,
+	"TRANSCRIPTION_CACHE":                true,
+	"TRANSCRIPTION_CACHE_MAX_ENTRIES":    true,
+	"LLM_CACHE":                          true,
+	"LLM_CACHE_MAX_ENTRIES":              true,
+	"RESULTS_STORE":                      true,
+	"RESULTS_FILE":                       true,
+	"RESULTS_DATABASE_URL":               true,
+	"WATCH_DIRS":                         true,
+	"WATCH_OUTPUT_DIR":                   true,
+	"WATCH_INTERVAL":                     true,
+	"KAFKA_BROKERS":                      true,
+	"KAFKA_INPUT_TOPIC":                  true,
+	"KAFKA_OUTPUT_TOPIC":                 true,
+	"KAFKA_GROUP_ID":                     true,
+	"NATS_URL":                           true,
+	"NATS_SUBJECT":                       true,
+	"NATS_QUEUE":                         true,
+	"NATS_STREAM":                        true,
+	"NATS_CONSUMER":                      true,
+	"NATS_RESULT_SUBJECT":                true,
+	"NATS_WORKERS":                       true,
+	"SESSION_MAX_STORED":                 true,
+	"SPEECH_MAX_STORED":                  true,
+	"TRACE_FILE":                         true,
+	"TRACE_FILE_MAX_MB":                  true,
+	"TRACE_FILE_BACKUPS":                 true,
+	"METRICS_ENABLED":                    true,
+	"OTEL_EXPORTER_OTLP_ENDPOINT":        true,
+	"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": true,
+	"OTEL_EXPORTER_OTLP_HEADERS":         true,
+	"OTEL_SERVICE_NAME":                  true,
+}
+
+// watchConfig reloads the config file at path when it changes or the
+// process gets SIGHUP, until ctx is done
+func watchConfig(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	modTime := configModTime(path)
+	for {
+		select {
+		case <-hup:
+			log.Printf("Reloading configuration on SIGHUP")
+		case <-ticker.C:
+			current := configModTime(path)
+			if current.Equal(modTime) {
+				continue
+			}
+			modTime = current
+			log.Printf("Config file %s changed, reloading", path)
+		case <-ctx.Done():
+			return
+		}
+		if err := reloadConfig(path); err != nil {
+			log.Printf("Configuration not reloaded, keeping the current settings: %v", err)
+		}
+	}
+}
+
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig applies the config file at path to new requests; requests
+// in flight may see the old or the new values. Settings that need a
+// restart keep their current value, and an invalid file changes nothing:
+// the new configuration is read and validated on the side and only then
+// replaces the current one.
+func reloadConfig(path string) error {
+	if path == "" {
+		return fmt.Errorf("no config file, the environment can't change at runtime")
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	var changed, ignored []string
+	for _, key := range settingNames(fileSettings, settings) {
+		old, hadOld := fileSettings[key]
+		value, hasValue := settings[key]
+		if old == value && hadOld == hasValue {
+			continue
+		}
+		if _, fromEnv := os.LookupEnv(key); fromEnv {
+			continue
+		}
+		if !restartSettings[key] {
+			changed = append(changed, key)
+			continue
+		}
+		ignored = append(ignored, key)
+		if hadOld {
+			settings[key] = old
+		} else {
+			delete(settings, key)
+		}
+	}
+	if len(ignored) > 0 {
+		log.Printf("Restart to apply changes to %s", strings.Join(ignored, ", "))
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	previous := fileSettings
+	fileSettings = settings
+	configErrors = nil
+	next := loadConfig()
+	if err := next.validate(); err != nil {
+		fileSettings = previous
+		return err
+	}
+	// MAX_CONCURRENT_REQUESTS may have been sized by AUTO_CONCURRENCY
+	next.maxConcurrent = cfg().maxConcurrent
+	next.apply()
+	log.Printf("Configuration reloaded, changed %s", strings.Join(changed, ", "))
+	return nil
+}
+
+// settingNames returns the keys of both setting maps, sorted
+func settingNames(a, b map[string]string) []string {
+	var names []string
+	for key := range a {
+		names = append(names, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			names = append(names, key)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// transcriptionRequest returns an OpenAI transcription request for a
+// tiny WAV upload
+func transcriptionRequest() *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "a.wav")
+	part.Write([]byte(wavMagic))
+	form.WriteField("response_format", openAIFormatJSON)
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/v1/audio/transcriptions", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.RemoteAddr = "10.0.0.1:40000"
+	return r
+}
+
+// Run with -race: requests read the configuration while it is reloaded
+func TestReloadConfigWhileServing(t *testing.T) {
+	setForTest(t, &fileSettings, nil)
+	setForTest(t, &configErrors, nil)
+	setForTest(t, &limiter, &rateLimiter{buckets: make(map[string]*tokenBucket)})
+	setConfigForTest(t, func(c *config) {})
+
+	var whisperURLs []string
+	for range 2 {
+		whisper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"text": "hello", "language": "en"}`))
+		}))
+		defer whisper.Close()
+		whisperURLs = append(whisperURLs, whisper.URL)
+	}
+	valid := []string{
+		fmt.Sprintf("whisper_url: %s\nrequest_timeout: 60\nlog_exclude_paths: [/health]\n"+
+			"rate_limit_routes: {/v1/audio/transcriptions: 100000}\nclient_weights: {team-a: 2}\n", whisperURLs[0]),
+		fmt.Sprintf("whisper_url: %s\nrequest_timeout: 120\nlog_exclude_paths: [/health, /v1/audio/transcriptions]\n"+
+			"redact_pii: true\nredact_pii_patterns: [email]\n", whisperURLs[1]),
+	}
+	invalid := fmt.Sprintf("whisper_url: %s\nrequest_timeout: 0\nlog_exclude_paths: []\n", whisperURLs[0])
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(valid[0])
+	if err := reloadConfig(path); err != nil {
+		t.Fatalf("reloadConfig() = %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/audio/transcriptions", openAITranscriptionsHandler)
+	handler := logMiddleware(rateLimitMiddleware(mux))
+	stop := make(chan struct{})
+	var requests, failures, invalidSeen atomic.Int32
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, transcriptionRequest())
+				requests.Add(1)
+				if rec.Code != http.StatusOK {
+					failures.Add(1)
+					t.Logf("request failed with %d: %s", rec.Code, rec.Body)
+				}
+				if cfg().requestTimeout == 0 {
+					invalidSeen.Add(1)
+				}
+			}
+		}()
+	}
+
+	for i := range 20 {
+		write(valid[(i+1)%2])
+		if err := reloadConfig(path); err != nil {
+			t.Errorf("reload %d: reloadConfig() = %v", i, err)
+		}
+		write(invalid)
+		if err := reloadConfig(path); err == nil {
+			t.Errorf("reload %d: reloadConfig() of an invalid file succeeded", i)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if requests.Load() == 0 {
+		t.Fatal("no requests were served during the reloads")
+	}
+	if n := failures.Load(); n > 0 {
+		t.Errorf("%d of %d requests failed during the reloads", n, requests.Load())
+	}
+	if n := invalidSeen.Load(); n > 0 {
+		t.Errorf("requests saw REQUEST_TIMEOUT=0 of the invalid file %d times", n)
+	}
+	if got := cfg().requestTimeout; got != 60 {
+		t.Errorf("REQUEST_TIMEOUT after the reloads = %d, want 60 of the last valid file", got)
+	}
+}
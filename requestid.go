@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	requestTraceKey
+	upstreamOverridesKey
+	llmProviderKey
+	llmCacheModeKey
+	spanKey
+	whisperBackendKey
+	pullProgressKey
+	chunkProgressKey
+)
+
+// requestIDMiddleware assigns every request an ID, reusing the client's
+// X-Request-ID when it looks sane. The ID is echoed in the response and
+// stored in the request context for logging and upstream forwarding.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIDFromContext returns the request ID stored by requestIDMiddleware
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// setUpstreamRequestID forwards the request ID of req's context to an
+// upstream using the REQUEST_ID_HEADER header name
+func setUpstreamRequestID(req *http.Request) {
+	if id := requestIDFromContext(req.Context()); id != "" {
+		req.Header.Set(cfg().requestIDHeader, id)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts up to 128 visible ASCII characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Response schema versions selectable by clients
+const (
+	apiVersion1 = 1
+	apiVersion2 = 2
+)
+
+// CombinedResponseV1 is the v1 response: the fields /process returned
+// when v1 was fixed, and the fields of features a request has to ask for.
+// Fields added since that a setting or the pipeline turns on, such as
+// pii_redactions or transcription_cached, are v2 only, so v1 clients never
+// see a field they weren't built for.
+type CombinedResponseV1 struct {
+	Transcription string      `json:"transcription"`
+	Response      string      `json:"response"`
+	ProcessTime   int64       `json:"process_time_ms"`
+	Model         string      `json:"model"`
+	Candidates    []Candidate `json:"candidates,omitempty"`
+
+	// schema
+	Structured     json.RawMessage `json:"structured,omitempty"`
+	SchemaAttempts int             `json:"schema_attempts,omitempty"`
+	SchemaErrors   []string        `json:"schema_errors,omitempty"`
+
+	// session_id
+	SessionID    string `json:"session_id,omitempty"`
+	SessionTurns int    `json:"session_turns,omitempty"`
+
+	// tts
+	SpeechURL    string `json:"speech_url,omitempty"`
+	SpeechFormat string `json:"speech_format,omitempty"`
+	SpeechTime   int64  `json:"speech_time_ms,omitempty"`
+	SpeechError  string `json:"speech_error,omitempty"`
+
+	// diarize
+	SpeakerTranscription string `json:"speaker_transcription,omitempty"`
+	Speakers             int    `json:"speakers,omitempty"`
+
+	// pipeline
+	Pipeline string       `json:"pipeline,omitempty"`
+	Steps    []StepResult `json:"steps,omitempty"`
+
+	// task=translate and translate_to
+	Translated   bool   `json:"translated,omitempty"`
+	Translation  string `json:"translation,omitempty"`
+	TranslatedTo string `json:"translated_to,omitempty"`
+
+	// clean_transcription
+	RawTranscription string `json:"raw_transcription,omitempty"`
+
+	// estimate_tokens
+	EstimatedPromptTokens int `json:"estimated_prompt_tokens,omitempty"`
+}
+
+// CombinedResponseV2 extends the v1 response with transcription details and
+// processing statistics
+type CombinedResponseV2 struct {
+	CombinedResponse
+	Segments []Segment    `json:"segments"`
+	Language string       `json:"language"`
+	Stats    ProcessStats `json:"stats"`
+}
+
+// ProcessStats reports per-stage timings and LLM token counts
+type ProcessStats struct {
+	TranscriptionTime int64   `json:"transcription_time_ms"`
+	LLMTime           int64   `json:"llm_time_ms"`
+	PromptTokens      int     `json:"prompt_tokens"`
+	CompletionTokens  int     `json:"completion_tokens"`
+	TokensPerSecond   float64 `json:"tokens_per_second"`
+}
+
+// parseAPIVersion selects the response schema from the api_version query
+// parameter or a version parameter on the Accept header, e.g.
+// "Accept: application/json; version=2". Defaults to v1.
+func parseAPIVersion(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("api_version")
+	if value == "" {
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			if _, params, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && params["version"] != "" {
+				value = params["version"]
+				break
+			}
+		}
+	}
+
+	switch strings.TrimPrefix(strings.ToLower(value), "v") {
+	case "", "1":
+		return apiVersion1, nil
+	case "2":
+		return apiVersion2, nil
+	default:
+		return 0, fmt.Errorf("unsupported api_version %q (expected 1 or 2)", value)
+	}
+}
+
+// newProcessStats computes stats from the stage timings and the Ollama
+// response, which may be nil when the LLM step failed
+func newProcessStats(transcriptionTime, llmTime time.Duration, ollamaResp *OllamaResponse) ProcessStats {
+	stats := ProcessStats{
+		TranscriptionTime: transcriptionTime.Milliseconds(),
+		LLMTime:           llmTime.Milliseconds(),
+	}
+	if ollamaResp != nil {
+		stats.PromptTokens = ollamaResp.PromptEvalCount
+		stats.CompletionTokens = ollamaResp.EvalCount
+		if ollamaResp.EvalDuration > 0 {
+			stats.TokensPerSecond = float64(ollamaResp.EvalCount) / time.Duration(ollamaResp.EvalDuration).Seconds()
+		}
+	}
+	return stats
+}
+
+// writeProcessResponse writes the result of /process in the requested
+// response_format: the combined JSON, the LLM's answer as plain text (the
+// transcription when the LLM was skipped), or subtitles of the
+// transcription
+func writeProcessResponse(w http.ResponseWriter, input *processInput, version int, result *pipelineResult) {
+	if input.Download {
+		ext := input.ResponseFormat
+		if ext == responseFormatText {
+			ext = "txt"
+		}
+		setDownload(w, input.Filename, ext)
+	}
+	switch input.ResponseFormat {
+	case responseFormatSRT, responseFormatVTT:
+		writeSubtitles(w, input.ResponseFormat, result.WhisperResp.Segments)
+	case responseFormatText:
+		if result.LLMErr != nil {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, result.Response.Response, http.StatusBadGateway)
+			return
+		}
+		text := result.Response.Response
+		if result.Response.LLMSkipped {
+			text = result.Response.Transcription
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(strings.TrimSpace(text) + "\n"))
+	default:
+		if result.Speech != nil && input.TTSDelivery == speechDeliveryMultipart {
+			writeSpeechResponse(w, version, result)
+			return
+		}
+		writeCombinedResponse(w, version, result.Response, result.WhisperResp, result.Stats)
+	}
+}
+
+// writeCombinedResponse encodes resp using the requested schema version and
+// the configured key style
+func writeCombinedResponse(w http.ResponseWriter, version int, resp CombinedResponse, whisperResp *WhisperResponse, stats ProcessStats) {
+	writeJSON(w, http.StatusOK, combinedBody(version, resp, whisperResp, stats))
+}
+
+// combinedBody returns the response body of the requested schema version
+func combinedBody(version int, resp CombinedResponse, whisperResp *WhisperResponse, stats ProcessStats) any {
+	if version == apiVersion2 {
+		return CombinedResponseV2{
+			CombinedResponse: resp,
+			Segments:         whisperResp.Segments,
+			Language:         cmp.Or(resp.Language, whisperResp.Language),
+			Stats:            stats,
+		}
+	}
+	return v1Response(resp)
+}
+
+// v1Response copies the fields of the v1 schema from resp
+func v1Response(resp CombinedResponse) CombinedResponseV1 {
+	return CombinedResponseV1{
+		Transcription:         resp.Transcription,
+		Response:              resp.Response,
+		ProcessTime:           resp.ProcessTime,
+		Model:                 resp.Model,
+		Candidates:            resp.Candidates,
+		Structured:            resp.Structured,
+		SchemaAttempts:        resp.SchemaAttempts,
+		SchemaErrors:          resp.SchemaErrors,
+		SessionID:             resp.SessionID,
+		SessionTurns:          resp.SessionTurns,
+		SpeechURL:             resp.SpeechURL,
+		SpeechFormat:          resp.SpeechFormat,
+		SpeechTime:            resp.SpeechTime,
+		SpeechError:           resp.SpeechError,
+		SpeakerTranscription:  resp.SpeakerTranscription,
+		Speakers:              resp.Speakers,
+		Pipeline:              resp.Pipeline,
+		Steps:                 resp.Steps,
+		Translated:            resp.Translated,
+		Translation:           resp.Translation,
+		TranslatedTo:          resp.TranslatedTo,
+		RawTranscription:      resp.RawTranscription,
+		EstimatedPromptTokens: resp.EstimatedPromptTokens,
+	}
+}
+
+// writeSpeechResponse writes the combined JSON and the spoken answer as
+// the response and speech parts of a multipart/form-data response, which
+// browsers can read with Response.formData()
+func writeSpeechResponse(w http.ResponseWriter, version int, result *pipelineResult) {
+	data, err := marshalResponse(combinedBody(version, result.Response, result.WhisperResp, result.Stats))
+	if err != nil {
+		http.Error(w, "Failed to encode response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", writer.FormDataContentType())
+	w.WriteHeader(http.StatusOK)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="response"`)
+	header.Set("Content-Type", "application/json")
+	part, _ := writer.CreatePart(header)
+	part.Write(append(data, '\n'))
+
+	header = textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="speech"; filename="speech.%s"`, result.Speech.format))
+	header.Set("Content-Type", result.Speech.contentType())
+	part, _ = writer.CreatePart(header)
+	part.Write(result.Speech.audio)
+	writer.Close()
+}
+
+// writeJSON writes v as a JSON response using the configured key style
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := marshalResponse(v)
+	if err != nil {
+		http.Error(w, "Failed to encode response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// doneReasonLength is the Ollama done_reason for generations that stopped
+// at the num_predict limit
+const doneReasonLength = "length"
+
+// truncationWarning returns a hint for generations cut off by the token
+// limit, or an empty string
+func truncationWarning(doneReason string) string {
+	if !cfg().warnOnTruncation || doneReason != doneReasonLength {
+		return ""
+	}
+	return "response was truncated at the token limit; consider a larger num_predict"
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// jsonKeys returns the top-level keys of v encoded as JSON
+func jsonKeys(t *testing.T, v any) []string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestV1ResponseLeavesOutSettingFields(t *testing.T) {
+	confidence := 0.9
+	resp := CombinedResponse{
+		Transcription:           "hello",
+		Response:                "hi",
+		ProcessTime:             1200,
+		Model:                   "llama3",
+		PIIRedactions:           1,
+		UnredactedTranscription: "hello",
+		SummarizedChunks:        2,
+		TranscriptionChunks:     3,
+		TranscriptionCached:     true,
+		LLMCached:               true,
+		SilenceRemoved:          1.5,
+		ModelAutoSelected:       true,
+		OutputLocation:          "s3://bucket/key",
+		Language:                "en",
+		LanguageDetected:        true,
+		LanguageConfidence:      &confidence,
+		LLMSkipped:              true,
+		LLMSkippedReason:        "breaker open",
+		WhisperModel:            "large-v3",
+		WhisperVersion:          "1.0",
+		Spillover:               true,
+		DoneReason:              "stop",
+		Warning:                 "truncated",
+		AudioDuration:           4,
+		RealtimeFactor:          2,
+	}
+	want := []string{"model", "process_time_ms", "response", "transcription"}
+	if got := jsonKeys(t, v1Response(resp)); !slices.Equal(got, want) {
+		t.Errorf("v1 keys = %v, want %v", got, want)
+	}
+}
+
+func TestV1ResponseKeepsRequestedFields(t *testing.T) {
+	resp := CombinedResponse{
+		Transcription:         "hello",
+		Candidates:            []Candidate{{Response: "a"}},
+		Structured:            json.RawMessage(`{"ok": true}`),
+		SchemaAttempts:        1,
+		SessionID:             "s1",
+		SessionTurns:          2,
+		SpeechURL:             "/speech/1",
+		SpeakerTranscription:  "A: hello",
+		Speakers:              1,
+		Pipeline:              "summary",
+		Steps:                 []StepResult{{Name: "one"}},
+		Translation:           "bonjour",
+		TranslatedTo:          "fr",
+		RawTranscription:      "um hello",
+		EstimatedPromptTokens: 12,
+	}
+	v1 := v1Response(resp)
+	for _, key := range []string{"candidates", "structured", "schema_attempts", "session_id", "session_turns", "speech_url",
+		"speaker_transcription", "speakers", "pipeline", "steps", "translation", "translated_to", "raw_transcription", "estimated_prompt_tokens"} {
+		if !slices.Contains(jsonKeys(t, v1), key) {
+			t.Errorf("v1 response lacks %s, which the request asked for", key)
+		}
+	}
+
+	// Every v1 field copies the field of the same name
+	v1Value, respValue := reflect.ValueOf(v1), reflect.ValueOf(resp)
+	for i := range v1Value.NumField() {
+		name := v1Value.Type().Field(i).Name
+		if !reflect.DeepEqual(v1Value.Field(i).Interface(), respValue.FieldByName(name).Interface()) {
+			t.Errorf("v1 %s = %v, want %v", name, v1Value.Field(i), respValue.FieldByName(name))
+		}
+	}
+}
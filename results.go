@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Values of RESULTS_STORE
+const (
+	resultsStoreOff      = "off"
+	resultsStoreFile     = "file"
+	resultsStorePostgres = "postgres"
+)
+
+// Endpoints results are recorded for
+const (
+	resultEndpointProcess = "process"
+	resultEndpointJobs    = "jobs"
+)
+
+// Results listed by GET /results by default and at most
+const (
+	defaultResultsLimit = 50
+	maxResultsLimit     = 500
+)
+
+// Bound on saving one result
+const resultSaveTimeout = 10 * time.Second
+
+// ResultRecord is a request's outcome as kept by the results store
+type ResultRecord struct {
+	ID                string    `json:"id"` // the job's ID, or the request's
+	RequestID         string    `json:"request_id"`
+	CreatedAt         time.Time `json:"created_at"`
+	Endpoint          string    `json:"endpoint"`
+	Caller            string    `json:"caller,omitempty"`
+	Filename          string    `json:"filename,omitempty"`
+	AudioDuration     float64   `json:"audio_duration_seconds,omitempty"`
+	Language          string    `json:"language,omitempty"`
+	Model             string    `json:"model,omitempty"`
+	Provider          string    `json:"provider,omitempty"`
+	Transcription     string    `json:"transcription"`
+	Response          string    `json:"response"`
+	ProcessTime       int64     `json:"process_time_ms"`
+	TranscriptionTime int64     `json:"transcription_time_ms"`
+	LLMTime           int64     `json:"llm_time_ms"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// ResultsResponse is a page of GET /results. NextOffset is set when there
+// may be more.
+type ResultsResponse struct {
+	Results    []ResultRecord `json:"results"`
+	NextOffset int            `json:"next_offset,omitempty"`
+}
+
+// resultFilter selects results, newest first
+type resultFilter struct {
+	Caller   string
+	Model    string
+	Language string
+	Query    string // in the transcription or the response, ignoring case
+	Failed   *bool  // only failed, or only successful, results
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+	Offset   int
+}
+
+// matches reports whether r passes the filter's conditions
+func (f resultFilter) matches(r *ResultRecord) bool {
+	query := strings.ToLower(f.Query)
+	switch {
+	case f.Caller != "" && r.Caller != f.Caller,
+		f.Model != "" && r.Model != f.Model,
+		f.Language != "" && r.Language != f.Language,
+		f.Failed != nil && *f.Failed != (r.Error != ""),
+		!f.Since.IsZero() && r.CreatedAt.Before(f.Since),
+		!f.Until.IsZero() && !r.CreatedAt.Before(f.Until),
+		query != "" && !strings.Contains(strings.ToLower(r.Transcription), query) && !strings.Contains(strings.ToLower(r.Response), query):
+		return false
+	}
+	return true
+}
+
+// resultStore keeps the results of /process and /jobs requests
+type resultStore interface {
+	save(ctx context.Context, record ResultRecord) error
+	list(ctx context.Context, filter resultFilter) ([]ResultRecord, error)
+	// get returns nil for an unknown result
+	get(ctx context.Context, id string) (*ResultRecord, error)
+}
+
+// Results store and the writer that saves to it off the request path, set
+// up by main from RESULTS_STORE; nil when results aren't kept
+var (
+	results      resultStore
+	resultWriter *resultQueue
+)
+
+// newResultStore returns the store RESULTS_STORE names, nil for off
+func newResultStore(ctx context.Context) (resultStore, error) {
+	switch cfg().resultsStoreKind {
+	case resultsStoreOff:
+		return nil, nil
+	case resultsStoreFile:
+		return newFileResultStore(cfg().resultsFile)
+	case resultsStorePostgres:
+		client, err := newPostgresClient(cfg().resultsDatabaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("RESULTS_DATABASE_URL: %w", err)
+		}
+		store := postgresResultStore{client}
+		if err := store.migrate(ctx); err != nil {
+			return nil, fmt.Errorf("creating the results table: %w", err)
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("RESULTS_STORE must be %s, %s or %s, got %q", resultsStoreOff, resultsStoreFile, resultsStorePostgres, cfg().resultsStoreKind)
+}
+
+// callerName names the client a result is recorded for: the name of the
+// key it authenticated with, else the tenant or subject of its JWT, else
+// its address
+func callerName(r *http.Request) string {
+	trace := traceFromContext(r.Context())
+	if trace.apiKey != nil {
+		return trace.apiKey.Name
+	}
+	if claims := trace.claims; claims != nil && (claims.Tenant != "" || claims.Subject != "") {
+		return cmp.Or(claims.Tenant, claims.Subject)
+	}
+	return clientIP(r)
+}
+
+// scopedCaller returns the caller whose jobs and sessions r may reach: its
+// callerName with authentication on, or "" for those of any caller
+func scopedCaller(r *http.Request) string {
+	if apiKeys.enabled() || cfg().jwtEnabled() {
+		return callerName(r)
+	}
+	return ""
+}
+
+// recordResult queues the outcome of a request for the results store:
+// the result, err when the request failed, or both when the result
+// couldn't be delivered. estimate_tokens requests aren't recorded.
+func recordResult(ctx context.Context, endpoint, id string, input *processInput, result *pipelineResult, err error) {
+	if resultWriter == nil || input.EstimateTokens {
+		return
+	}
+	record := ResultRecord{
+		ID:        id,
+		RequestID: requestIDFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+		Endpoint:  endpoint,
+		Caller:    input.Caller,
+		Filename:  input.Filename,
+		Model:     input.Model,
+	}
+	if input.LLM != nil {
+		record.Provider = input.LLM.name()
+	}
+	if input.Mode == modeLLMOnly {
+		record.Transcription = input.Text
+	}
+	if result != nil {
+		resp := &result.Response
+		record.AudioDuration = resp.AudioDuration
+		record.Language = resp.Language
+		record.Model = cmp.Or(resp.Model, record.Model)
+		record.Transcription = resp.Transcription
+		record.Response = resp.Response
+		record.ProcessTime = resp.ProcessTime
+		record.TranscriptionTime = result.Stats.TranscriptionTime
+		record.LLMTime = result.Stats.LLMTime
+	}
+	if err == nil && result != nil {
+		err = result.LLMErr
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	resultWriter.add(record)
+}
+
+// resultQueue saves results from a background goroutine so a slow store
+// never holds up responses. Results are dropped when the queue is full.
+type resultQueue struct {
+	store   resultStore
+	records chan ResultRecord
+	dropped atomic.Int64
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newResultQueue(store resultStore) *resultQueue {
+	q := &resultQueue{store: store, records: make(chan ResultRecord, 1024), done: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+// add queues a record without blocking
+func (q *resultQueue) add(record ResultRecord) {
+	select {
+	case q.records <- record:
+	default:
+		if q.dropped.Add(1)%100 == 1 {
+			log.Printf("Results queue full, dropped %d results so far", q.dropped.Load())
+		}
+	}
+}
+
+// Close saves the queued records
+func (q *resultQueue) Close() {
+	q.once.Do(func() {
+		close(q.records)
+		<-q.done
+	})
+}
+
+func (q *resultQueue) run() {
+	defer close(q.done)
+	for record := range q.records {
+		ctx, cancel := context.WithTimeout(context.Background(), resultSaveTimeout)
+		if err := q.store.save(ctx, record); err != nil {
+			log.Printf("Failed to save result %s: %v request_id=%s", record.ID, err, record.RequestID)
+		}
+		cancel()
+	}
+}
+
+// parseResultFilter reads the filter of GET /results from the query
+func parseResultFilter(r *http.Request) (resultFilter, error) {
+	query := r.URL.Query()
+	filter := resultFilter{
+		Caller:   query.Get("caller"),
+		Model:    query.Get("model"),
+		Language: query.Get("language"),
+		Query:    query.Get("q"),
+		Limit:    defaultResultsLimit,
+	}
+	var err error
+	if value := query.Get("status"); value != "" {
+		failed := value == "failed"
+		if !failed && value != "ok" {
+			return filter, newHTTPError(http.StatusBadRequest, "status must be ok or failed, got %q", value)
+		}
+		filter.Failed = &failed
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return filter, newHTTPError(http.StatusBadRequest, "invalid %s: %v", name, err)
+			}
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > maxResultsLimit {
+			return filter, newHTTPError(http.StatusBadRequest, "limit must be between 1 and %d", maxResultsLimit)
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		if filter.Offset, err = strconv.Atoi(value); err != nil || filter.Offset < 0 {
+			return filter, newHTTPError(http.StatusBadRequest, "offset must not be negative")
+		}
+	}
+	return filter, nil
+}
+
+// resultsHandler lists the recorded results matching the query's filters.
+// With authentication on, callers only see their own results.
+func resultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if results == nil {
+		http.Error(w, "results are not kept; set RESULTS_STORE", http.StatusNotFound)
+		return
+	}
+	filter, err := parseResultFilter(r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if apiKeys.enabled() || cfg().jwtEnabled() {
+		filter.Caller = callerName(r)
+	}
+	records, err := results.list(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Failed to list results: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp := ResultsResponse{Results: records}
+	if resp.Results == nil {
+		resp.Results = []ResultRecord{}
+	}
+	if len(records) == filter.Limit {
+		resp.NextOffset = filter.Offset + filter.Limit
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// resultHandler returns one recorded result
+func resultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if results == nil {
+		http.Error(w, "results are not kept; set RESULTS_STORE", http.StatusNotFound)
+		return
+	}
+	record, err := results.get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to load result: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if record == nil || ((apiKeys.enabled() || cfg().jwtEnabled()) && record.Caller != callerName(r)) {
+		http.Error(w, "result not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+// fileResultStore appends results to a JSON Lines file and answers queries
+// from memory, where the whole file is kept
+type fileResultStore struct {
+	mu      sync.RWMutex
+	file    *os.File
+	records []ResultRecord // oldest first
+	index   map[string]int
+}
+
+// newFileResultStore loads the results kept at path and opens it for
+// appending. Lines that can't be parsed, such as one cut short by a crash,
+// are skipped.
+func newFileResultStore(path string) (*fileResultStore, error) {
+	s := &fileResultStore{index: make(map[string]int)}
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 64<<20)
+		skipped := 0
+		for scanner.Scan() {
+			var record ResultRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.ID == "" {
+				skipped++
+				continue
+			}
+			s.add(record)
+		}
+		err := scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		if skipped > 0 {
+			log.Printf("Skipped %d unreadable lines of %s", skipped, path)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	return s, nil
+}
+
+// add keeps a record in memory, replacing an earlier one with its ID
+func (s *fileResultStore) add(record ResultRecord) {
+	if i, ok := s.index[record.ID]; ok {
+		s.records[i] = record
+		return
+	}
+	s.index[record.ID] = len(s.records)
+	s.records = append(s.records, record)
+}
+
+func (s *fileResultStore) save(ctx context.Context, record ResultRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.add(record)
+	return nil
+}
+
+func (s *fileResultStore) list(ctx context.Context, filter resultFilter) ([]ResultRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var page []ResultRecord
+	skipped := 0
+	for i := len(s.records) - 1; i >= 0 && len(page) < filter.Limit; i-- {
+		if !filter.matches(&s.records[i]) {
+			continue
+		}
+		if skipped < filter.Offset {
+			skipped++
+			continue
+		}
+		page = append(page, s.records[i])
+	}
+	return page, nil
+}
+
+func (s *fileResultStore) get(ctx context.Context, id string) (*ResultRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.index[id]
+	if !ok {
+		return nil, nil
+	}
+	record := s.records[i]
+	return &record, nil
+}
+
+// postgresResultStore keeps results in the bridge_results table
+type postgresResultStore struct {
+	client *postgresClient
+}
+
+// Columns of bridge_results, in the order records are read and written
+const resultColumns = "id, request_id, created_at, endpoint, caller, filename, audio_duration, language, model, provider, " +
+	"transcription, response, process_time_ms, transcription_time_ms, llm_time_ms, error"
+
+// migrate creates the table and its indexes unless they exist
+func (s postgresResultStore) migrate(ctx context.Context) error {
+	return s.client.exec(ctx, `
+CREATE TABLE IF NOT EXISTS bridge_results (
+	id text PRIMARY KEY,
+	request_id text NOT NULL,
+	created_at timestamptz NOT NULL,
+	endpoint text NOT NULL,
+	caller text NOT NULL,
+	filename text NOT NULL,
+	audio_duration double precision NOT NULL,
+	language text NOT NULL,
+	model text NOT NULL,
+	provider text NOT NULL,
+	transcription text NOT NULL,
+	response text NOT NULL,
+	process_time_ms bigint NOT NULL,
+	transcription_time_ms bigint NOT NULL,
+	llm_time_ms bigint NOT NULL,
+	error text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS bridge_results_created_at ON bridge_results (created_at DESC);
+CREATE INDEX IF NOT EXISTS bridge_results_caller ON bridge_results (caller, created_at DESC);`)
+}
+
+func (s postgresResultStore) save(ctx context.Context, r ResultRecord) error {
+	_, err := s.client.query(ctx, "INSERT INTO bridge_results ("+resultColumns+") "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) "+
+		"ON CONFLICT (id) DO UPDATE SET "+
+		"created_at = EXCLUDED.created_at, audio_duration = EXCLUDED.audio_duration, language = EXCLUDED.language, "+
+		"model = EXCLUDED.model, transcription = EXCLUDED.transcription, response = EXCLUDED.response, "+
+		"process_time_ms = EXCLUDED.process_time_ms, transcription_time_ms = EXCLUDED.transcription_time_ms, "+
+		"llm_time_ms = EXCLUDED.llm_time_ms, error = EXCLUDED.error",
+		r.ID, r.RequestID, r.CreatedAt.Format(time.RFC3339Nano), r.Endpoint, r.Caller, r.Filename,
+		strconv.FormatFloat(r.AudioDuration, 'f', -1, 64), r.Language, r.Model, r.Provider,
+		r.Transcription, r.Response,
+		strconv.FormatInt(r.ProcessTime, 10), strconv.FormatInt(r.TranscriptionTime, 10), strconv.FormatInt(r.LLMTime, 10),
+		r.Error)
+	return err
+}
+
+// Selects resultColumns, with created_at in RFC 3339 whatever the
+// session's DateStyle and TimeZone
+var resultSelect = "SELECT " + strings.Replace(resultColumns, "created_at",
+	`to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')`, 1) + " FROM bridge_results"
+
+func (s postgresResultStore) list(ctx context.Context, filter resultFilter) ([]ResultRecord, error) {
+	var conditions, args []string
+	where := func(condition, arg string) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.ReplaceAll(condition, "?", "$"+strconv.Itoa(len(args))))
+	}
+	if filter.Caller != "" {
+		where("caller = ?", filter.Caller)
+	}
+	if filter.Model != "" {
+		where("model = ?", filter.Model)
+	}
+	if filter.Language != "" {
+		where("language = ?", filter.Language)
+	}
+	if filter.Query != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(filter.Query)
+		where("(transcription ILIKE ? OR response ILIKE ?)", "%"+escaped+"%")
+	}
+	if filter.Failed != nil {
+		if *filter.Failed {
+			conditions = append(conditions, "error <> ''")
+		} else {
+			conditions = append(conditions, "error = ''")
+		}
+	}
+	if !filter.Since.IsZero() {
+		where("created_at >= ?", filter.Since.Format(time.RFC3339Nano))
+	}
+	if !filter.Until.IsZero() {
+		where("created_at < ?", filter.Until.Format(time.RFC3339Nano))
+	}
+
+	sql := resultSelect
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += fmt.Sprintf(" ORDER BY created_at DESC LIMIT %d OFFSET %d", filter.Limit, filter.Offset)
+	rows, err := s.client.query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]ResultRecord, 0, len(rows))
+	for _, row := range rows {
+		record, err := parseResultRow(row)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (s postgresResultStore) get(ctx context.Context, id string) (*ResultRecord, error) {
+	rows, err := s.client.query(ctx, resultSelect+" WHERE id = $1", id)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	record, err := parseResultRow(rows[0])
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// parseResultRow reads a row of resultColumns
+func parseResultRow(row []string) (ResultRecord, error) {
+	if len(row) != 16 {
+		return ResultRecord{}, fmt.Errorf("expected 16 columns, got %d", len(row))
+	}
+	r := ResultRecord{
+		ID:            row[0],
+		RequestID:     row[1],
+		Endpoint:      row[3],
+		Caller:        row[4],
+		Filename:      row[5],
+		Language:      row[7],
+		Model:         row[8],
+		Provider:      row[9],
+		Transcription: row[10],
+		Response:      row[11],
+		Error:         row[15],
+	}
+	var err error
+	if r.CreatedAt, err = time.Parse(time.RFC3339Nano, row[2]); err != nil {
+		return r, fmt.Errorf("invalid created_at %q: %w", row[2], err)
+	}
+	r.AudioDuration, _ = strconv.ParseFloat(row[6], 64)
+	r.ProcessTime, _ = strconv.ParseInt(row[12], 10, 64)
+	r.TranscriptionTime, _ = strconv.ParseInt(row[13], 10, 64)
+	r.LLMTime, _ = strconv.ParseInt(row[14], 10, 64)
+	return r, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// finalError marks a failure an attempt can't be repeated after, whatever
+// its cause, such as a generation that already streamed tokens
+type finalError struct{ err error }
+
+func (e finalError) Error() string { return e.err.Error() }
+func (e finalError) Unwrap() error { return e.err }
+
+// withRetries calls attempt until it succeeds, fails for good or has been
+// retried retries times, backing off exponentially with jitter between
+// calls. Only failures retryUpstream accepts are retried. ctx bounds the
+// waits as well as the calls.
+func withRetries(ctx context.Context, upstream string, retries int, attempt func() error) error {
+	for n := 0; ; n++ {
+		err := attempt()
+		var final finalError
+		if errors.As(err, &final) {
+			return final.err
+		}
+		if err == nil || n >= retries || ctx.Err() != nil || !retryUpstream(err) {
+			return err
+		}
+
+		delay := retryDelay(n, err)
+		log.Printf("%s call failed, retrying in %s (retry %d of %d): %v request_id=%s",
+			upstream, delay.Round(time.Millisecond), n+1, retries, err, requestIDFromContext(ctx))
+		upstreamRetries.add(1, upstream)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryUpstream reports whether a failed upstream call may be repeated:
+// the connection was refused or dropped before an answer, or the upstream
+// answered with a status in RETRY_ON_STATUS. Timeouts, cancellation, an
+// open circuit breaker, other statuses and malformed answers are final.
+func retryUpstream(err error) bool {
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		return cfg().retryStatuses[ue.StatusCode]
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryDelay returns the wait before retry n (from 0): RETRY_BACKOFF_MS
+// doubled for every earlier retry, capped at RETRY_MAX_BACKOFF_MS and
+// spread by RETRY_JITTER. A longer Retry-After from the upstream is
+// honoured up to the cap.
+func retryDelay(n int, err error) time.Duration {
+	c := cfg()
+	maxDelay := time.Duration(c.retryMaxBackoffMS) * time.Millisecond
+	delay := time.Duration(c.retryBackoffMS) * time.Millisecond
+	for i := 0; i < n && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	delay += time.Duration(float64(delay) * c.retryJitter * (2*rand.Float64() - 1))
+
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		if seconds, err := strconv.Atoi(ue.RetryAfter); err == nil && seconds > 0 {
+			delay = max(delay, min(time.Duration(seconds)*time.Second, maxDelay))
+		}
+	}
+	return delay
+}
+
+// replayableAudio returns a function that gives a fresh reader of the
+// audio left in r for each attempt, or nil when r can't be read twice,
+// such as a streamed upload. Each reader is independent, so an abandoned
+// attempt still reading its copy doesn't disturb the next one.
+func replayableAudio(r io.Reader) func() io.Reader {
+	ra, ok := r.(io.ReaderAt)
+	seeker, isSeeker := r.(io.Seeker)
+	if !ok || !isSeeker {
+		return nil
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil
+	}
+	seeker.Seek(offset, io.SeekStart)
+	return func() io.Reader {
+		return io.NewSectionReader(ra, offset, size-offset)
+	}
+}
+
+// parseRetryStatuses parses RETRY_ON_STATUS, a comma-separated list of
+// HTTP status codes
+func parseRetryStatuses(s string) (map[int]bool, error) {
+	statuses := make(map[int]bool)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("%q is not an error status code", field)
+		}
+		statuses[code] = true
+	}
+	return statuses, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Upstream name of the S3 endpoint
+const upstreamS3 = "s3"
+
+// SHA-256 of an empty payload, signed for requests without a body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Endpoint returns the base URL of S3_ENDPOINT, or of AWS S3 in
+// S3_REGION when it isn't set
+func s3Endpoint() string {
+	c := cfg()
+	if c.s3EndpointURL != "" {
+		return strings.TrimSuffix(c.s3EndpointURL, "/")
+	}
+	return "https://s3." + c.s3Region + ".amazonaws.com"
+}
+
+// s3ObjectURL returns the URL of an object, in the path style MinIO uses
+// with S3_PATH_STYLE and as a virtual host of the bucket otherwise
+func s3ObjectURL(bucket, key string) (*url.URL, error) {
+	u, err := url.Parse(s3Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	if cfg().s3PathStyle {
+		u.Path = "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	// Send the path escaped as it is signed
+	u.RawPath = s3EscapePath(u.Path)
+	return u, nil
+}
+
+// newS3Request returns a request for an object, signed with AWS Signature
+// Version 4 when S3_ACCESS_KEY_ID is set and anonymous otherwise
+func newS3Request(ctx context.Context, method, bucket, key string, body []byte) (*http.Request, error) {
+	u, err := s3ObjectURL(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+	if cfg().s3AccessKeyID != "" {
+		signS3Request(req, body, time.Now().UTC())
+	}
+	return req, nil
+}
+
+// signS3Request adds the AWS Signature Version 4 headers to req, whose
+// payload is body
+func signS3Request(req *http.Request, body []byte, now time.Time) {
+	c := cfg()
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := []string{"host:" + req.URL.Host, "x-amz-content-sha256:" + payloadHash, "x-amz-date:" + amzDate}
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	if c.s3SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.s3SessionToken)
+		headers = append(headers, "x-amz-security-token:"+c.s3SessionToken)
+		signed += ";x-amz-security-token"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		"", // no query
+		strings.Join(headers, "\n") + "\n",
+		signed,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + c.s3Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := []byte("AWS4" + c.s3SecretAccessKey)
+	for _, part := range []string{date, c.s3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.s3AccessKeyID, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes a path the way SigV4 canonical requests for S3
+// expect: every byte but the unreserved characters and slashes
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// fetchS3Audio starts downloading the object an s3://bucket/key audio_url
+// names, whose bucket must be on S3_INPUT_BUCKETS. The AUDIO_URL_MAX_MB
+// and AUDIO_URL_TIMEOUT limits apply as for http(s) URLs.
+func fetchS3Audio(ctx context.Context, u *url.URL) (io.ReadCloser, string, error) {
+	if cfg().s3InputBuckets == "" {
+		return nil, "", newHTTPError(http.StatusBadRequest, "s3:// audio_url is disabled (S3_INPUT_BUCKETS)")
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, "", newHTTPError(http.StatusBadRequest, "audio_url must name an object as s3://bucket/key")
+	}
+	allowed := false
+	for _, name := range strings.Split(cfg().s3InputBuckets, ",") {
+		allowed = allowed || strings.TrimSpace(name) == bucket
+	}
+	if !allowed {
+		return nil, "", newHTTPError(http.StatusForbidden, "audio_url bucket %q is not allowed", bucket)
+	}
+
+	req, err := newS3Request(ctx, http.MethodGet, bucket, key, nil)
+	if err != nil {
+		return nil, "", newHTTPError(http.StatusBadRequest, "invalid audio_url: %v", err)
+	}
+	setUpstreamRequestID(req)
+	resp, err := upstreamClient(time.Duration(cfg().audioURLTimeout) * time.Second).Do(req)
+	if err != nil {
+		countUpstreamError(ctx, upstreamS3, err)
+		return nil, "", downloadError(err)
+	}
+	return audioDownload(resp, key)
+}
+
+// s3OutputData is what S3_OUTPUT_PREFIX is rendered with
+type s3OutputData struct {
+	ID        string // the job's ID, or the request's
+	RequestID string
+	Date      string // 2006-01-02, in UTC
+	Time      string // 150405, in UTC
+	Name      string // the audio's file name without its extension
+	Model     string
+	Language  string
+}
+
+// renderS3OutputPrefix renders S3_OUTPUT_PREFIX, without leading or
+// trailing slashes
+func (c *config) renderS3OutputPrefix(data s3OutputData) (string, error) {
+	tmpl, err := template.New("S3_OUTPUT_PREFIX").Parse(c.s3OutputPrefix)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	prefix := strings.Trim(b.String(), "/")
+	if prefix == "" {
+		return "", fmt.Errorf("the prefix renders empty")
+	}
+	return prefix, nil
+}
+
+// safeKeyPart keeps the characters of a client-supplied name that are
+// safe in object keys, replacing the others with underscores
+func safeKeyPart(name string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// saveOutputs writes the transcription, the LLM's answer and the whole
+// response as transcript.txt, response.txt and result.json under the
+// rendered S3_OUTPUT_PREFIX in S3_OUTPUT_BUCKET, and records where in
+// resp. Empty texts aren't written, nor anything for estimate_tokens
+// requests or when S3_OUTPUT_BUCKET isn't set.
+func saveOutputs(ctx context.Context, input *processInput, resp *CombinedResponse, id string) error {
+	if cfg().s3OutputBucket == "" || input.EstimateTokens {
+		return nil
+	}
+	now := time.Now().UTC()
+	name := strings.TrimSuffix(path.Base(input.Filename), path.Ext(input.Filename))
+	if name == "" || name == "." {
+		name = "audio"
+	}
+	prefix, err := cfg().renderS3OutputPrefix(s3OutputData{
+		ID:        id,
+		RequestID: requestIDFromContext(ctx),
+		Date:      now.Format("2006-01-02"),
+		Time:      now.Format("150405"),
+		Name:      safeKeyPart(name),
+		Model:     safeKeyPart(resp.Model),
+		Language:  resp.Language,
+	})
+	if err != nil {
+		return fmt.Errorf("S3_OUTPUT_PREFIX: %w", err)
+	}
+
+	ctx, span := startSpan(ctx, "s3_output", spanKindClient)
+	resp.OutputLocation = "s3://" + cfg().s3OutputBucket + "/" + prefix + "/"
+	result, err := json.Marshal(resp)
+	if err != nil {
+		span.end(err)
+		return err
+	}
+	objects := []struct {
+		name, contentType string
+		body              []byte
+	}{
+		{"transcript.txt", "text/plain; charset=utf-8", []byte(resp.Transcription)},
+		{"response.txt", "text/plain; charset=utf-8", []byte(resp.Response)},
+		{"result.json", "application/json", result},
+	}
+	for _, object := range objects {
+		if len(object.body) == 0 {
+			continue
+		}
+		if err := putS3Object(ctx, cfg().s3OutputBucket, prefix+"/"+object.name, object.contentType, object.body); err != nil {
+			resp.OutputLocation = ""
+			countUpstreamError(ctx, upstreamS3, err)
+			span.end(err)
+			return fmt.Errorf("writing %s: %w", object.name, err)
+		}
+	}
+	span.setAttributes("s3.bucket", cfg().s3OutputBucket, "s3.prefix", prefix)
+	span.end(nil)
+	return nil
+}
+
+// putS3Object uploads an object
+func putS3Object(ctx context.Context, bucket, key, contentType string, body []byte) error {
+	req, err := newS3Request(ctx, http.MethodPut, bucket, key, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	setUpstreamRequestID(req)
+	resp, err := upstreamClient(time.Duration(cfg().requestTimeout) * time.Second).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newUpstreamError(upstreamS3, resp)
+	}
+	return nil
+}
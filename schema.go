@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Largest schema accepted in the schema field
+	maxSchemaBytes = 64 << 10
+	// Validation errors reported, and sent back to the LLM, per attempt
+	maxSchemaErrors = 10
+)
+
+// Instruction appended to the prompt when a schema is given
+const schemaInstruction = "Reply with a single JSON value, without any other text, that matches this JSON Schema:\n%s"
+
+// Added to the prompt to have the LLM repair a reply that didn't match the
+// schema
+const schemaRepairPrompt = `Your previous reply was:
+%s
+
+It doesn't match the JSON Schema:
+%s
+
+Reply again with only the corrected JSON value.`
+
+// Schema keywords the validator checks. Annotations such as title,
+// description and examples are allowed and ignored; any other keyword is
+// refused, so a schema never silently checks less than it says.
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true,
+	"minLength": true, "maxLength": true, "pattern": true, "format": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+	"anyOf": true, "allOf": true,
+	"title": true, "description": true, "examples": true, "default": true, "$schema": true,
+}
+
+// parseSchema parses the schema field, a JSON Schema object
+func parseSchema(raw []byte) (map[string]any, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if len(raw) > maxSchemaBytes {
+		return nil, newHTTPError(http.StatusBadRequest, "schema is larger than %d bytes", maxSchemaBytes)
+	}
+	// A JSON body may send the schema as a string as well as an object
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		raw = []byte(text)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid schema: must be a JSON object: %v", err)
+	}
+	if err := checkSchema(schema, "schema"); err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "invalid schema: %v", err)
+	}
+	return schema, nil
+}
+
+// checkSchema checks that a schema only uses the supported keywords, with
+// values of the right types
+func checkSchema(schema map[string]any, path string) error {
+	for keyword, value := range schema {
+		if !schemaKeywords[keyword] {
+			return fmt.Errorf("%s: %s is not supported", path, keyword)
+		}
+		var ok bool
+		switch keyword {
+		case "type":
+			switch t := value.(type) {
+			case string:
+				ok = validSchemaType(t)
+			case []any:
+				ok = len(t) > 0
+				for _, name := range t {
+					s, isString := name.(string)
+					ok = ok && isString && validSchemaType(s)
+				}
+			}
+		case "enum":
+			_, ok = value.([]any)
+		case "properties":
+			var properties map[string]any
+			if properties, ok = value.(map[string]any); ok {
+				for name, property := range properties {
+					sub, isSchema := property.(map[string]any)
+					if !isSchema {
+						return fmt.Errorf("%s.properties.%s: must be a schema", path, name)
+					}
+					if err := checkSchema(sub, path+".properties."+name); err != nil {
+						return err
+					}
+				}
+			}
+		case "required":
+			var names []any
+			if names, ok = value.([]any); ok {
+				for _, name := range names {
+					_, isString := name.(string)
+					ok = ok && isString
+				}
+			}
+		case "additionalProperties":
+			switch v := value.(type) {
+			case bool:
+				ok = true
+			case map[string]any:
+				if err := checkSchema(v, path+".additionalProperties"); err != nil {
+					return err
+				}
+				ok = true
+			}
+		case "items":
+			var sub map[string]any
+			if sub, ok = value.(map[string]any); ok {
+				if err := checkSchema(sub, path+".items"); err != nil {
+					return err
+				}
+			}
+		case "anyOf", "allOf":
+			var subs []any
+			if subs, ok = value.([]any); ok && len(subs) > 0 {
+				for i, s := range subs {
+					sub, isSchema := s.(map[string]any)
+					if !isSchema {
+						return fmt.Errorf("%s.%s[%d]: must be a schema", path, keyword, i)
+					}
+					if err := checkSchema(sub, fmt.Sprintf("%s.%s[%d]", path, keyword, i)); err != nil {
+						return err
+					}
+				}
+			}
+		case "minItems", "maxItems", "minLength", "maxLength":
+			var n float64
+			n, ok = value.(float64)
+			ok = ok && n >= 0 && n == math.Trunc(n)
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum":
+			_, ok = value.(float64)
+		case "pattern":
+			var pattern string
+			if pattern, ok = value.(string); ok {
+				if _, err := regexp.Compile(pattern); err != nil {
+					return fmt.Errorf("%s.pattern: %v", path, err)
+				}
+			}
+		case "format", "title", "description", "$schema":
+			_, ok = value.(string)
+		default: // const, examples, default
+			ok = true
+		}
+		if !ok {
+			return fmt.Errorf("%s.%s: invalid value", path, keyword)
+		}
+	}
+	return nil
+}
+
+func validSchemaType(name string) bool {
+	switch name {
+	case "object", "array", "string", "number", "integer", "boolean", "null":
+		return true
+	}
+	return false
+}
+
+// validateJSON checks value, as decoded by encoding/json, against schema
+// and appends what doesn't match to errs
+func validateJSON(schema map[string]any, value any, path string, errs *[]string) {
+	fail := func(format string, args ...any) {
+		if len(*errs) < maxSchemaErrors {
+			*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+		}
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		fail("expected %s, got %s", describeType(t), jsonType(value))
+		return
+	}
+	if enum, ok := schema["enum"].([]any); ok && !containsJSON(enum, value) {
+		fail("must be one of %s", compactJSON(enum))
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		fail("must be %s", compactJSON(c))
+	}
+	for _, sub := range schemaList(schema["allOf"]) {
+		validateJSON(sub, value, path, errs)
+	}
+	if anyOf := schemaList(schema["anyOf"]); len(anyOf) > 0 {
+		matched := false
+		for _, sub := range anyOf {
+			var subErrs []string
+			if validateJSON(sub, value, path, &subErrs); len(subErrs) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("matches none of the anyOf schemas")
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := v[name.(string)]; !ok {
+				fail("missing required property %s", name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		for name, item := range v {
+			if sub, ok := properties[name].(map[string]any); ok {
+				validateJSON(sub, item, path+"."+name, errs)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					fail("unexpected property %s", name)
+				}
+			case map[string]any:
+				validateJSON(additional, item, path+"."+name, errs)
+			}
+		}
+	case []any:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(v)) < n {
+			fail("must have at least %g items", n)
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(v)) > n {
+			fail("must have at most %g items", n)
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				validateJSON(items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if n, ok := schema["minLength"].(float64); ok && length < n {
+			fail("must be at least %g characters long", n)
+		}
+		if n, ok := schema["maxLength"].(float64); ok && length > n {
+			fail("must be at most %g characters long", n)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(v) {
+			fail("must match %s", pattern)
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && v < n {
+			fail("must be at least %g", n)
+		}
+		if n, ok := schema["maximum"].(float64); ok && v > n {
+			fail("must be at most %g", n)
+		}
+		if n, ok := schema["exclusiveMinimum"].(float64); ok && v <= n {
+			fail("must be greater than %g", n)
+		}
+		if n, ok := schema["exclusiveMaximum"].(float64); ok && v >= n {
+			fail("must be less than %g", n)
+		}
+	}
+}
+
+func schemaList(value any) []map[string]any {
+	list, _ := value.([]any)
+	schemas := make([]map[string]any, 0, len(list))
+	for _, s := range list {
+		schemas = append(schemas, s.(map[string]any))
+	}
+	return schemas
+}
+
+func matchesType(t, value any) bool {
+	if names, ok := t.([]any); ok {
+		for _, name := range names {
+			if matchesType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	switch name := t.(string); name {
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	default:
+		return jsonType(value) == name
+	}
+}
+
+func jsonType(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+func describeType(t any) string {
+	if names, ok := t.([]any); ok {
+		parts := make([]string, len(names))
+		for i, name := range names {
+			parts[i] = name.(string)
+		}
+		return strings.Join(parts, " or ")
+	}
+	return t.(string)
+}
+
+func containsJSON(list []any, value any) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compactJSON(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// extractJSON finds the JSON value in an LLM reply, which may be wrapped in
+// a Markdown code fence or surrounded by text
+func extractJSON(reply string) (any, error) {
+	text := strings.TrimSpace(reply)
+	if fenced, ok := strings.CutPrefix(text, "```"); ok {
+		if newline := strings.IndexByte(fenced, '\n'); newline >= 0 {
+			fenced = fenced[newline+1:]
+		}
+		text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(fenced), "```"))
+	}
+	var value any
+	err := json.Unmarshal([]byte(text), &value)
+	if err == nil {
+		return value, nil
+	}
+	start := strings.IndexAny(text, "{[")
+	end := strings.LastIndexAny(text, "}]")
+	if start >= 0 && end > start && json.Unmarshal([]byte(text[start:end+1]), &value) == nil {
+		return value, nil
+	}
+	return nil, fmt.Errorf("reply is not valid JSON: %v", err)
+}
+
+// structuredResult is the outcome of a generation constrained by a schema
+type structuredResult struct {
+	Output   json.RawMessage // the matching JSON, or nil
+	Attempts int
+	Errors   []string // of the last attempt, when no attempt matched
+}
+
+// generateStructured runs the LLM step asking for JSON that matches schema.
+// The schema is added to the prompt and passed to providers that can
+// constrain their output with it. A reply that isn't valid JSON or doesn't
+// match is sent back with the problems, up to SCHEMA_MAX_RETRIES times.
+// The returned response is the last one, with the token counts of all
+// attempts.
+func generateStructured(ctx context.Context, model, prompt string, options map[string]any, schema map[string]any) (*OllamaResponse, structuredResult, error) {
+	options = mergeLLMOptions(map[string]any{formatOption: schema}, options)
+	schemaText, _ := json.MarshalIndent(schema, "", "  ")
+	prompt += "\n\n" + fmt.Sprintf(schemaInstruction, schemaText)
+	attemptPrompt := prompt
+
+	var result structuredResult
+	total := &OllamaResponse{}
+	for attempt := 0; attempt <= cfg().schemaMaxRetries; attempt++ {
+		resp, err := processWithLLM(ctx, model, attemptPrompt, options)
+		if err != nil {
+			return nil, result, err
+		}
+		result.Attempts++
+		total.Model, total.Response, total.DoneReason = resp.Model, resp.Response, resp.DoneReason
+		total.Spillover = total.Spillover || resp.Spillover
+		total.PromptEvalCount += resp.PromptEvalCount
+		total.EvalCount += resp.EvalCount
+		total.EvalDuration += resp.EvalDuration
+		total.Finished = true
+
+		result.Errors = nil
+		value, err := extractJSON(resp.Response)
+		if err != nil {
+			result.Errors = []string{err.Error()}
+		} else {
+			validateJSON(schema, value, "$", &result.Errors)
+		}
+		if len(result.Errors) == 0 {
+			result.Output, _ = json.Marshal(value)
+			return total, result, nil
+		}
+		attemptPrompt = prompt + "\n\n" + fmt.Sprintf(schemaRepairPrompt, resp.Response, "- "+strings.Join(result.Errors, "\n- "))
+	}
+	return total, result, nil
+}
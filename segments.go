@@ -0,0 +1,71 @@
+package main
+
+import "math"
+
+// Segment is a timed stretch of a transcription, with OpenAI's segment
+// fields as Whisper reports them. The decoding statistics are missing for
+// backends that don't report them.
+type Segment struct {
+	ID               int      `json:"id"`
+	Seek             int      `json:"seek,omitempty"`
+	Start            float64  `json:"start"` // seconds
+	End              float64  `json:"end"`
+	Text             string   `json:"text"`
+	Tokens           []int    `json:"tokens,omitempty"`
+	Temperature      *float64 `json:"temperature,omitempty"`
+	AvgLogprob       *float64 `json:"avg_logprob,omitempty"`
+	CompressionRatio *float64 `json:"compression_ratio,omitempty"`
+	NoSpeechProb     *float64 `json:"no_speech_prob,omitempty"`
+
+	// Confidence is between 0 and 1: the backend's own, else the mean
+	// token probability (exp(avg_logprob)), else the mean probability of
+	// the words that have one
+	Confidence *float64 `json:"confidence,omitempty"`
+
+	// Words are set when word timestamps were requested and the backend
+	// supports them
+	Words []Word `json:"words,omitempty"`
+
+	// Speaker labels the segment's speaker when diarization was requested
+	Speaker string `json:"speaker,omitempty"`
+}
+
+// Word is a word of a segment with its timing
+type Word struct {
+	Word        string   `json:"word"`
+	Start       float64  `json:"start"`
+	End         float64  `json:"end"`
+	Probability *float64 `json:"probability,omitempty"`
+}
+
+// timed reports whether the backend gave the segment's timings
+func (s Segment) timed() bool {
+	return s.End > 0
+}
+
+// fillConfidence sets the confidence of segments whose backend didn't
+// report one, where it can be derived
+func fillConfidence(segments []Segment) {
+	for i := range segments {
+		segment := &segments[i]
+		switch {
+		case segment.Confidence != nil:
+		case segment.AvgLogprob != nil:
+			confidence := math.Exp(*segment.AvgLogprob)
+			segment.Confidence = &confidence
+		default:
+			var sum float64
+			var n int
+			for _, word := range segment.Words {
+				if word.Probability != nil {
+					sum += *word.Probability
+					n++
+				}
+			}
+			if n > 0 {
+				confidence := sum / float64(n)
+				segment.Confidence = &confidence
+			}
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Values of SESSION_STORE
+const (
+	sessionStoreMemory = "memory"
+	sessionStoreRedis  = "redis"
+)
+
+// How often expired sessions are evicted from memory
+const sessionJanitorInterval = time.Minute
+
+// Prefix of the Redis keys of sessions
+const sessionKeyPrefix = "whisper-llm-bridge:session:"
+
+// Session IDs are chosen by clients and end up in Redis keys
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// sessionStore keeps the conversation of each session between requests:
+// the text each request sent to the LLM and its reply, as chat messages.
+// Sessions expire SESSION_TTL seconds after their last request.
+type sessionStore interface {
+	// load returns the session's messages, or none for an unknown or
+	// expired session
+	load(ctx context.Context, id string) ([]OllamaChatMessage, error)
+	// save replaces the session's messages and restarts its TTL
+	save(ctx context.Context, id string, messages []OllamaChatMessage) error
+	// delete forgets the session
+	delete(ctx context.Context, id string) error
+}
+
+// Session store, set up by main from SESSION_STORE
+var sessions sessionStore
+
+// newSessionStore returns the store SESSION_STORE names
+func newSessionStore() (sessionStore, error) {
+	switch cfg().sessionStoreKind {
+	case sessionStoreMemory:
+		return newMemorySessionStore(cfg().sessionMaxStored), nil
+	case sessionStoreRedis:
+		client, err := newRedisClient(cfg().redisURL)
+		if err != nil {
+			return nil, fmt.Errorf("REDIS_URL: %w", err)
+		}
+		return redisSessionStore{client}, nil
+	}
+	return nil, fmt.Errorf("SESSION_STORE must be %s or %s, got %q", sessionStoreMemory, sessionStoreRedis, cfg().sessionStoreKind)
+}
+
+// parseSessionID checks the session_id field: up to 128 letters, digits,
+// dots, dashes, underscores and colons
+func parseSessionID(value string) (string, error) {
+	if value == "" || sessionIDPattern.MatchString(value) {
+		return value, nil
+	}
+	return "", newHTTPError(http.StatusBadRequest, "invalid session_id: use up to 128 letters, digits, '.', '_', ':' and '-'")
+}
+
+// scopedSessionKey returns the key of a caller's session in the store,
+// that of the session shared by every caller when caller is empty. Callers
+// are kept apart so that one can't read or continue another's conversation
+// by guessing or reusing its ID; IDs hold no '/', so keys can't collide.
+func scopedSessionKey(caller, id string) string {
+	if caller == "" {
+		return id
+	}
+	return caller + "/" + id
+}
+
+// sessionKey returns the key of the input's session in the store, see
+// scopedCaller
+func (input *processInput) sessionKey() string {
+	if apiKeys.enabled() || cfg().jwtEnabled() {
+		return scopedSessionKey(input.Caller, input.SessionID)
+	}
+	return input.SessionID
+}
+
+// loadSession returns the earlier messages of the request's session, none
+// without a session
+func loadSession(ctx context.Context, id string) ([]OllamaChatMessage, error) {
+	if id == "" {
+		return nil, nil
+	}
+	messages, err := sessions.load(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("loading session: %w", err)
+	}
+	return messages, nil
+}
+
+// saveSession adds an exchange to the session's messages, keeping the last
+// SESSION_MAX_TURNS exchanges. A failure only loses the exchange, so it is
+// logged rather than failing the request.
+func saveSession(ctx context.Context, id string, history []OllamaChatMessage, text, reply string) {
+	messages := append(history[:len(history):len(history)],
+		OllamaChatMessage{Role: "user", Content: text},
+		OllamaChatMessage{Role: "assistant", Content: reply})
+	if max := 2 * cfg().sessionMaxTurns; len(messages) > max {
+		messages = messages[len(messages)-max:]
+	}
+	if err := sessions.save(ctx, id, messages); err != nil {
+		log.Printf("Failed to save session %s: %v request_id=%s", id, err, requestIDFromContext(ctx))
+	}
+}
+
+// memorySessionStore keeps sessions in memory, evicting them when they
+// expire and the least recently used one when SESSION_MAX_STORED are kept
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+	lru      *list.List // front is most recently used
+	max      int
+}
+
+type memorySession struct {
+	id       string
+	messages []OllamaChatMessage
+	expires  time.Time
+	elem     *list.Element
+}
+
+func newMemorySessionStore(maxStored int) *memorySessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]*memorySession),
+		lru:      list.New(),
+		max:      maxStored,
+	}
+}
+
+// start runs the janitor until ctx is done
+func (s *memorySessionStore) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(sessionJanitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.evictExpired(time.Now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *memorySessionStore) load(ctx context.Context, id string) ([]OllamaChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.expires) {
+		return nil, nil
+	}
+	return session.messages, nil
+}
+
+func (s *memorySessionStore) save(ctx context.Context, id string, messages []OllamaChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		for len(s.sessions) >= s.max {
+			s.remove(s.lru.Back().Value.(*memorySession))
+		}
+		session = &memorySession{id: id}
+		session.elem = s.lru.PushFront(session)
+		s.sessions[id] = session
+	}
+	session.messages = messages
+	session.expires = time.Now().Add(time.Duration(cfg().sessionTTL) * time.Second)
+	s.lru.MoveToFront(session.elem)
+	return nil
+}
+
+func (s *memorySessionStore) delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[id]; ok {
+		s.remove(session)
+	}
+	return nil
+}
+
+// evictExpired removes the sessions that expired by now
+func (s *memorySessionStore) evictExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		if now.After(session.expires) {
+			s.remove(session)
+		}
+	}
+}
+
+// remove forgets session; s.mu must be held
+func (s *memorySessionStore) remove(session *memorySession) {
+	s.lru.Remove(session.elem)
+	delete(s.sessions, session.id)
+}
+
+// redisSessionStore keeps sessions in Redis as JSON, expiring them with
+// Redis's own TTL, so several bridges can share them
+type redisSessionStore struct {
+	client *redisClient
+}
+
+func (s redisSessionStore) load(ctx context.Context, id string) ([]OllamaChatMessage, error) {
+	value, err := s.client.do(ctx, "GET", sessionKeyPrefix+id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	data, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to GET: %v", value)
+	}
+	var messages []OllamaChatMessage
+	if err := json.Unmarshal([]byte(data), &messages); err != nil {
+		return nil, fmt.Errorf("invalid session data: %w", err)
+	}
+	return messages, nil
+}
+
+func (s redisSessionStore) save(ctx context.Context, id string, messages []OllamaChatMessage) error {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.do(ctx, "SET", sessionKeyPrefix+id, string(data), "EX", fmt.Sprint(cfg().sessionTTL))
+	return err
+}
+
+func (s redisSessionStore) delete(ctx context.Context, id string) error {
+	_, err := s.client.do(ctx, "DEL", sessionKeyPrefix+id)
+	return err
+}
+
+// SessionResponse is a session as returned by /sessions/{id}
+type SessionResponse struct {
+	ID       string              `json:"id"`
+	Messages []OllamaChatMessage `json:"messages"`
+}
+
+// sessionHandler returns a session's messages with GET and forgets the
+// session with DELETE. With authentication on, it only reaches the
+// caller's own sessions.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseSessionID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	key := scopedSessionKey(scopedCaller(r), id)
+	switch r.Method {
+	case http.MethodGet:
+		messages, err := sessions.load(r.Context(), key)
+		if err != nil {
+			http.Error(w, "Failed to load session: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		if len(messages) == 0 {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, SessionResponse{ID: id, Messages: messages})
+	case http.MethodDelete:
+		if err := sessions.delete(r.Context(), key); err != nil {
+			http.Error(w, "Failed to delete session: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How often shutdown checks for WebSocket sessions that are still open
+const drainPollInterval = 100 * time.Millisecond
+
+// serve runs server until SIGTERM or SIGINT, then stops accepting
+// requests and gives the requests in flight and running async jobs up to
+// drainTimeout to finish. Whatever is left then is cut off. A second
+// signal exits at once.
+func serve(server *http.Server, drainTimeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			served <- server.ListenAndServeTLS("", "")
+			return
+		}
+		served <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	log.Printf("Shutting down, draining %d requests in flight for up to %s", inFlight.Load(), drainTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	start := time.Now()
+
+	err := server.Shutdown(drainCtx)
+	if err == nil {
+		err = waitHijacked(drainCtx)
+	}
+	if err == nil && jobs != nil && !jobs.wait(drainCtx) {
+		err = drainCtx.Err()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Drain deadline passed, dropping %d requests in flight", inFlight.Load())
+		server.Close()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Drained in %s", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// waitHijacked waits for the WebSocket sessions, which Shutdown doesn't
+// track once their connection is hijacked. logMiddleware counts them in
+// inFlight until their handler returns.
+func waitHijacked(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for inFlight.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
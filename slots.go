@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Request priorities
+type priority int
+
+const (
+	priorityNormal priority = iota
+	priorityHigh
+)
+
+func (p priority) String() string {
+	if p == priorityHigh {
+		return "high"
+	}
+	return "normal"
+}
+
+// parsePriority maps the optional priority value to a priority level.
+// An empty value means normal priority.
+func parsePriority(value string) (priority, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "normal":
+		return priorityNormal, nil
+	case "high":
+		return priorityHigh, nil
+	default:
+		return priorityNormal, fmt.Errorf("invalid priority %q (expected high or normal)", value)
+	}
+}
+
+// slotPool is a two-tier semaphore for limiting concurrent requests.
+//
+// The total capacity is split into a shared pool and a reserved pool:
+//
+//	reserved = floor(total * reservedFraction)
+//	shared   = total - reserved
+//
+// The reserved pool is clamped so the shared pool always keeps at least one
+// slot. Normal requests may only use the shared pool, high-priority requests
+// take a reserved slot first and fall back to the shared pool, so a flood of
+// normal requests can never occupy the slots set aside for interactive use.
+type slotPool struct {
+	shared   chan struct{}
+	reserved chan struct{}
+
+	// onRelease is called after a slot is freed, set by a fairQueue
+	onRelease func()
+}
+
+func newSlotPool(total int, reservedFraction float64) *slotPool {
+	reserved := int(math.Floor(float64(total) * reservedFraction))
+	if reserved > total-1 {
+		reserved = total - 1
+	}
+	if reserved < 0 {
+		reserved = 0
+	}
+	return &slotPool{
+		shared:   make(chan struct{}, total-reserved),
+		reserved: make(chan struct{}, reserved),
+	}
+}
+
+// tryAcquire takes a slot for a request of the given priority without
+// blocking. On success it returns a function that releases the slot.
+func (p *slotPool) tryAcquire(prio priority) (release func(), ok bool) {
+	if prio == priorityHigh {
+		select {
+		case p.reserved <- struct{}{}:
+			return p.releaser(p.reserved), true
+		default:
+		}
+	}
+
+	select {
+	case p.shared <- struct{}{}:
+		return p.releaser(p.shared), true
+	default:
+		return nil, false
+	}
+}
+
+func (p *slotPool) releaser(pool chan struct{}) func() {
+	return func() {
+		<-pool
+		if p.onRelease != nil {
+			p.onRelease()
+		}
+	}
+}
+
+// capacity returns the size of the shared and reserved pools.
+func (p *slotPool) capacity() (shared, reserved int) {
+	return cap(p.shared), cap(p.reserved)
+}
+
+// inUse returns the number of slots taken in both pools
+func (p *slotPool) inUse() int {
+	return len(p.shared) + len(p.reserved)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// Slots for concurrent generations on the primary Ollama, nil when
+// OLLAMA_MAX_CONCURRENT is unlimited. Each generation takes as many slots
+// as its model's weight.
+var ollamaSlots *weightedSemaphore
+
+// ollamaBackend is the Ollama instance chosen for one generation
+type ollamaBackend struct {
+	url       string
+	hosts     []*ollamaHost // OLLAMA_URL hosts to try, in order, when several
+	spillover bool
+	override  bool
+	release   func()
+}
+
+// acquireOllamaBackend picks the Ollama instance for a generation. The
+// primary is used while it has free slots. When it is saturated, requests
+// overflow to SPILLOVER_OLLAMA_URL if configured, trading latency for
+// availability, and otherwise wait for a primary slot. The primary is the
+// OLLAMA_URL host, or the hosts with the model when there are several. A
+// request with an X-Ollama-URL override goes straight to that URL.
+func acquireOllamaBackend(ctx context.Context, model string) (*ollamaBackend, error) {
+	if override := ollamaOverride(ctx); override != "" {
+		return &ollamaBackend{url: override, override: true, release: func() {}}, nil
+	}
+	if err := ollamaBreaker.allow(); err != nil {
+		return nil, err
+	}
+	hosts, err := ollamaHosts.route(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+	url := cfg().ollamaURL
+	if len(hosts) > 0 {
+		url = hosts[0].url
+	}
+	if ollamaSlots == nil {
+		return &ollamaBackend{url: url, hosts: hosts, release: func() {}}, nil
+	}
+
+	weight := modelWeight(model)
+	primary := &ollamaBackend{url: url, hosts: hosts, release: func() { ollamaSlots.release(weight) }}
+	if ollamaSlots.tryAcquire(weight) {
+		return primary, nil
+	}
+
+	if cfg().spilloverOllamaURL != "" {
+		log.Printf("Ollama at capacity, spilling over to %s request_id=%s", cfg().spilloverOllamaURL, requestIDFromContext(ctx))
+		return &ollamaBackend{url: cfg().spilloverOllamaURL, spillover: true, release: func() {}}, nil
+	}
+
+	if err := ollamaSlots.acquire(ctx, weight); err != nil {
+		return nil, err
+	}
+	return primary, nil
+}
+
+// record reports a call outcome to the Ollama circuit breaker. The
+// spillover backend and override URLs are not covered by the breaker.
+func (b *ollamaBackend) record(err error) {
+	if !b.spillover && !b.override {
+		ollamaBreaker.record(err)
+	}
+}
+
+// allowOllama checks the Ollama circuit breaker, which doesn't apply to
+// requests routed to an override URL
+func allowOllama(ctx context.Context) error {
+	if ollamaOverride(ctx) != "" {
+		return nil
+	}
+	return ollamaBreaker.allow()
+}
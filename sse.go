@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SSETranscriptionEvent opens an SSE response with the finished
+// transcription, before any text is generated
+type SSETranscriptionEvent struct {
+	Transcription string `json:"transcription"`
+	Model         string `json:"model"`
+}
+
+// SSETokenEvent carries one piece of generated text with the tokens and
+// milliseconds since generation started, so clients can show live
+// throughput
+type SSETokenEvent struct {
+	Token     string `json:"token"`
+	EvalCount int    `json:"eval_count"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// SSEDoneEvent closes a successful SSE response with the complete answer
+// and the final stats
+type SSEDoneEvent struct {
+	CombinedResponse
+	Stats ProcessStats `json:"stats"`
+}
+
+// SSEErrorEvent closes an SSE response whose generation failed
+type SSEErrorEvent struct {
+	Error string `json:"error"`
+}
+
+// sseStream sends the generation as Server-Sent Events: chunk_transcribed
+// events while a long recording is transcribed in chunks, a transcription
+// event once the transcription is ready, pull events while a model pulled
+// by AUTO_PULL_MODELS downloads, a token event per generated chunk and a
+// final done or error event. Ollama streams one token per chunk, so the
+// chunk count is the running eval_count.
+type sseStream struct {
+	w     http.ResponseWriter
+	rc    *http.ResponseController
+	sent  bool
+	start time.Time
+	count int
+}
+
+func newSSEStream(w http.ResponseWriter) *sseStream {
+	return &sseStream{w: w, rc: http.NewResponseController(w)}
+}
+
+// open starts the response, unless a chunk_transcribed event already did
+func (s *sseStream) open() {
+	if s.sent {
+		return
+	}
+	header := s.w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the events
+	header.Set("X-Accel-Buffering", "no")
+	s.w.WriteHeader(http.StatusOK)
+	s.sent = true
+}
+
+// begin sends the transcription before generation starts
+func (s *sseStream) begin(resp *CombinedResponse) {
+	s.open()
+	s.start = time.Now()
+	s.event("transcription", SSETranscriptionEvent{Transcription: resp.Transcription, Model: resp.Model})
+}
+
+// chunk reports a transcribed chunk of a long recording, which starts the
+// response ahead of the transcription event
+func (s *sseStream) chunk(progress ChunkProgress) {
+	s.open()
+	s.event("chunk_transcribed", progress)
+}
+
+func (s *sseStream) write(token string) error {
+	s.count++
+	return s.event("token", SSETokenEvent{
+		Token:     token,
+		EvalCount: s.count,
+		ElapsedMs: time.Since(s.start).Milliseconds(),
+	})
+}
+
+// pull reports the progress of a model pull the generation waits for
+func (s *sseStream) pull(progress PullProgress) {
+	s.event("pull", progress)
+}
+
+func (s *sseStream) started() bool {
+	return s.sent
+}
+
+func (s *sseStream) finish(resp CombinedResponse, stats ProcessStats, err error) {
+	if err != nil {
+		s.event("error", SSEErrorEvent{Error: err.Error()})
+		return
+	}
+	s.event("done", SSEDoneEvent{CombinedResponse: resp, Stats: stats})
+}
+
+// event writes one SSE event with a JSON payload and flushes it
+func (s *sseStream) event(name string, v any) error {
+	data, err := marshalResponse(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Input of a step that names no other: the text the LLM step would get,
+// i.e. the transcription, or its translation or summaries
+const stepInputTranscription = "transcription"
+
+// llmPipeline is a named sequence of LLM calls from PIPELINES_FILE, run
+// instead of the single LLM step with pipeline=name
+type llmPipeline struct {
+	Name  string    `yaml:"-"`
+	Steps []llmStep `yaml:"steps"`
+}
+
+// llmStep is an LLM call of a pipeline. Its input is the previous step's
+// output, or the transcription for the first step, unless Input names
+// another step or "transcription".
+type llmStep struct {
+	Name     string         `yaml:"name"`
+	Prompt   string         `yaml:"prompt"`
+	Template string         `yaml:"template"` // from PROMPT_TEMPLATES_DIR, instead of Prompt
+	Model    string         `yaml:"model"`    // the request's model when empty
+	System   string         `yaml:"system"`
+	Options  map[string]any `yaml:"options"`
+	Input    string         `yaml:"input"`
+}
+
+// StepResult is the outcome of a pipeline step in the response
+type StepResult struct {
+	Name        string `json:"name"`
+	Model       string `json:"model"`
+	Response    string `json:"response,omitempty"`
+	ProcessTime int64  `json:"process_time_ms"`
+	Error       string `json:"error,omitempty"`
+}
+
+// loadPipelines reads the pipelines in the YAML file at path, e.g.
+//
+//	meeting:
+//	  steps:
+//	    - name: clean
+//	      prompt: Fix punctuation and remove filler words.
+//	    - name: summary
+//	      template: meeting_summary
+//	    - name: action_items
+//	      prompt: List the action items with their owners.
+//	      input: clean
+//
+// Templates are looked up in templates.
+func loadPipelines(path string, templates map[string]*template.Template) (map[string]*llmPipeline, error) {
+	pipelines := make(map[string]*llmPipeline)
+	if path == "" {
+		return pipelines, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&pipelines); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for name, p := range pipelines {
+		if p == nil || len(p.Steps) == 0 {
+			return nil, fmt.Errorf("pipeline %s has no steps", name)
+		}
+		p.Name = name
+		seen := map[string]bool{stepInputTranscription: true}
+		for i := range p.Steps {
+			step := &p.Steps[i]
+			if step.Name == "" || step.Name == stepInputTranscription || seen[step.Name] {
+				return nil, fmt.Errorf("pipeline %s: step %d needs a unique name other than %s", name, i+1, stepInputTranscription)
+			}
+			if (step.Prompt == "") == (step.Template == "") {
+				return nil, fmt.Errorf("pipeline %s: step %s needs either a prompt or a template", name, step.Name)
+			}
+			if _, ok := templates[step.Template]; step.Template != "" && !ok {
+				return nil, fmt.Errorf("pipeline %s: step %s uses unknown template %q", name, step.Name, step.Template)
+			}
+			if step.Input != "" && !seen[step.Input] {
+				return nil, fmt.Errorf("pipeline %s: step %s takes the output of %q, which isn't an earlier step", name, step.Name, step.Input)
+			}
+			if step.System != "" {
+				step.Options = mergeLLMOptions(map[string]any{systemOption: step.System}, step.Options)
+			}
+			if step.Options, err = checkLLMOptions(step.Options); err != nil {
+				return nil, fmt.Errorf("pipeline %s: step %s: %w", name, step.Name, err)
+			}
+			seen[step.Name] = true
+		}
+	}
+	return pipelines, nil
+}
+
+// lookupPipeline returns the pipeline named by the pipeline field, or nil
+// for the single LLM step
+func lookupPipeline(name string) (*llmPipeline, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if p, ok := cfg().llmPipelines[name]; ok {
+		return p, nil
+	}
+	if len(cfg().llmPipelines) == 0 {
+		return nil, newHTTPError(http.StatusBadRequest, "unknown pipeline %q (no pipelines are configured)", name)
+	}
+	names := make([]string, 0, len(cfg().llmPipelines))
+	for name := range cfg().llmPipelines {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return nil, newHTTPError(http.StatusBadRequest, "unknown pipeline %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// runSteps runs the steps of the request's pipeline in order on text,
+// recording each in resp.Steps, and stops at the first that fails. The
+// request's generation options apply to steps that don't set their own.
+// The returned response has the last step's text and done reason, and the
+// token counts and durations of all steps.
+func runSteps(ctx context.Context, input *processInput, text, language string, resp *CombinedResponse) (*OllamaResponse, error) {
+	outputs := map[string]string{stepInputTranscription: text}
+	total := &OllamaResponse{}
+	previous := text
+	for _, step := range input.Pipeline.Steps {
+		stepInput := previous
+		if step.Input != "" {
+			stepInput = outputs[step.Input]
+		}
+		model := step.Model
+		if model == "" {
+			model = input.Model
+		}
+
+		var prompt string
+		var err error
+		if step.Template != "" {
+			prompt, err = renderPrompt(cfg().promptTemplates[step.Template], promptData{
+				Prompt:        input.Prompt,
+				Transcription: stepInput,
+				Language:      language,
+				Filename:      input.Filename,
+			})
+		} else {
+			prompt = buildPrompt(step.Prompt, stepInput)
+		}
+		if err == nil && step.Model != "" {
+			model, err = resolveModel(step.Model)
+		}
+
+		result := StepResult{Name: step.Name, Model: model}
+		var stepResp *OllamaResponse
+		start := time.Now()
+		if err == nil {
+			stepResp, err = processWithLLM(ctx, model, prompt, mergeLLMOptions(step.Options, input.Options))
+		}
+		result.ProcessTime = time.Since(start).Milliseconds()
+		if err != nil {
+			result.Error = err.Error()
+			resp.Steps = append(resp.Steps, result)
+			return nil, fmt.Errorf("step %s: %w", step.Name, err)
+		}
+		result.Response = stepResp.Response
+		resp.Steps = append(resp.Steps, result)
+
+		outputs[step.Name] = strings.TrimSpace(stepResp.Response)
+		previous = outputs[step.Name]
+		total.Model, total.Response, total.DoneReason = stepResp.Model, stepResp.Response, stepResp.DoneReason
+		total.Spillover = total.Spillover || stepResp.Spillover
+		total.PromptEvalCount += stepResp.PromptEvalCount
+		total.EvalCount += stepResp.EvalCount
+		total.EvalDuration += stepResp.EvalDuration
+	}
+	total.Finished = true
+	return total, nil
+}
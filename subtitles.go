@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Values of the response_format field of /process
+const (
+	responseFormatJSON = "json"
+	responseFormatText = "text"
+	responseFormatSRT  = "srt"
+	responseFormatVTT  = "vtt"
+)
+
+// parseResponseFormat parses the response_format field of /process,
+// defaulting to JSON
+func parseResponseFormat(value string) (string, error) {
+	switch format := strings.ToLower(strings.TrimSpace(value)); format {
+	case "":
+		return responseFormatJSON, nil
+	case responseFormatJSON, responseFormatText, responseFormatSRT, responseFormatVTT:
+		return format, nil
+	}
+	return "", newHTTPError(http.StatusBadRequest, "response_format must be one of json, text, srt or vtt, got %q", value)
+}
+
+// isSubtitleFormat reports whether format renders the transcription as
+// subtitles
+func isSubtitleFormat(format string) bool {
+	return format == responseFormatSRT || format == responseFormatVTT
+}
+
+// writeSubtitles renders the timed text of Whisper segments as an SRT or
+// VTT file
+func writeSubtitles(w http.ResponseWriter, format string, segments []Segment) {
+	cues := subtitleCues(segments)
+	if format == responseFormatSRT {
+		w.Header().Set("Content-Type", "application/x-subrip; charset=utf-8")
+		w.Write([]byte(formatSRT(cues)))
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Write([]byte(formatVTT(cues)))
+}
+
+// setDownload marks the response as a file to save, named after the
+// uploaded file with the extension ext
+func setDownload(w http.ResponseWriter, upload, ext string) {
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", downloadFilename(upload, ext)))
+}
+
+// downloadFilename derives a download name from the uploaded file's base
+// name. Only letters, digits, dots, dashes and underscores are kept, so
+// the name can't break out of the header or name a path.
+func downloadFilename(upload, ext string) string {
+	base := filepath.Base(strings.ReplaceAll(upload, "\\", "/"))
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		case r == ' ':
+			return '_'
+		}
+		return -1
+	}, base)
+	if name = strings.Trim(name, "._"); name == "" {
+		name = "transcript"
+	}
+	return name + "." + ext
+}
+
+// subtitleCue is one timed line of a subtitle file
+type subtitleCue struct {
+	Start, End float64 // seconds
+	Text       string
+	Speaker    string // set for diarized segments
+}
+
+// subtitleCues extracts the timed text of Whisper segments, skipping
+// segments without text or timings
+func subtitleCues(segments []Segment) []subtitleCue {
+	var cues []subtitleCue
+	for _, segment := range segments {
+		if text := strings.TrimSpace(segment.Text); text != "" && segment.timed() {
+			cues = append(cues, subtitleCue{Start: segment.Start, End: segment.End, Text: text, Speaker: segment.Speaker})
+		}
+	}
+	return cues
+}
+
+// formatSRT renders cues as a SubRip file, which has no notion of
+// speakers, so they prefix the text
+func formatSRT(cues []subtitleCue) string {
+	var b strings.Builder
+	for i, cue := range cues {
+		text := cue.Text
+		if cue.Speaker != "" {
+			text = cue.Speaker + ": " + text
+		}
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1,
+			subtitleTimestamp(cue.Start, ","), subtitleTimestamp(cue.End, ","), text)
+	}
+	return b.String()
+}
+
+// formatVTT renders cues as a WebVTT file, with speakers as voice spans
+func formatVTT(cues []subtitleCue) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		text := cue.Text
+		if cue.Speaker != "" {
+			text = "<v " + cue.Speaker + ">" + text
+		}
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n",
+			subtitleTimestamp(cue.Start, "."), subtitleTimestamp(cue.End, "."), text)
+	}
+	return b.String()
+}
+
+// subtitleTimestamp formats seconds as HH:MM:SS followed by the decimal
+// separator and milliseconds
+func subtitleTimestamp(seconds float64, separator string) string {
+	ms := int64(math.Round(math.Max(seconds, 0) * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Prompts of the map-reduce summarization of long transcriptions
+const (
+	summarizeChunkPrompt = "Summarize this part of a longer transcription. Keep names, numbers, decisions and action items."
+	summariesPreamble    = "The transcription was too long and has been replaced by summaries of its consecutive parts:"
+)
+
+// summarizeMaxRounds bounds how often summaries are summarized again when
+// they are still too long together
+const summarizeMaxRounds = 3
+
+var sentenceEnd = regexp.MustCompile(`[.!?]+\s+`)
+
+// summarizeLong condenses a transcription that wouldn't fit the LLM
+// context when AUTO_SUMMARIZE_LONG is on. The text is split into chunks of
+// about SUMMARIZE_CHUNK_TOKENS, each chunk is summarized, and the joined
+// summaries take the transcription's place in the final prompt. Short
+// transcriptions are returned unchanged. chunks is set to the number of
+// chunks summarized.
+func summarizeLong(ctx context.Context, model, transcription string, chunks *int) (string, error) {
+	if !cfg().autoSummarizeLong || estimateTokens(transcription) <= cfg().summarizeChunkTokens {
+		return transcription, nil
+	}
+
+	text := transcription
+	for round := 0; round < summarizeMaxRounds && estimateTokens(text) > cfg().summarizeChunkTokens; round++ {
+		parts := splitTranscript(text, cfg().summarizeChunkTokens)
+		summaries := make([]string, len(parts))
+		for i, part := range parts {
+			resp, err := processWithLLM(ctx, model, buildPrompt(summarizeChunkPrompt, part), nil)
+			if err != nil {
+				return "", fmt.Errorf("summarizing part %d of %d: %w", i+1, len(parts), err)
+			}
+			summaries[i] = strings.TrimSpace(resp.Response)
+		}
+		*chunks += len(parts)
+		text = strings.Join(summaries, "\n\n")
+	}
+	return summariesPreamble + "\n\n" + text, nil
+}
+
+// splitTranscript splits text into chunks of at most maxTokens estimated
+// tokens, breaking between sentences where possible and between words
+// otherwise
+func splitTranscript(text string, maxTokens int) []string {
+	var chunks []string
+	var current strings.Builder
+	flush := func() {
+		if chunk := strings.TrimSpace(current.String()); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		current.Reset()
+	}
+	add := func(piece string) {
+		if current.Len() > 0 && estimateTokens(current.String()+piece) > maxTokens {
+			flush()
+		}
+		current.WriteString(piece)
+	}
+
+	for _, sentence := range splitAfterAll(text, sentenceEnd) {
+		if estimateTokens(sentence) <= maxTokens {
+			add(sentence)
+			continue
+		}
+		// A run-on sentence longer than a chunk
+		for _, word := range strings.SplitAfter(sentence, " ") {
+			add(word)
+		}
+	}
+	flush()
+	return chunks
+}
+
+// splitAfterAll splits text after every match of re
+func splitAfterAll(text string, re *regexp.Regexp) []string {
+	var pieces []string
+	last := 0
+	for _, match := range re.FindAllStringIndex(text, -1) {
+		pieces = append(pieces, text[last:match[1]])
+		last = match[1]
+	}
+	if last < len(text) {
+		pieces = append(pieces, text[last:])
+	}
+	return pieces
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Values of TLS_CLIENT_AUTH
+const (
+	clientAuthRequire  = "require"
+	clientAuthOptional = "optional"
+)
+
+// Transport for calls to Whisper, Ollama and the other upstreams, set up
+// by main with the UPSTREAM_TLS_* settings
+var upstreamTransport http.RoundTripper = http.DefaultTransport
+
+// upstreamClient returns a client for upstream calls. A zero timeout
+// leaves the request's context as the only bound.
+func upstreamClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: upstreamTransport}
+}
+
+// serverTLSConfig returns the listener's TLS config, or nil to serve plain
+// HTTP when TLS_CERT_FILE isn't set. With TLS_CLIENT_CA_FILE, clients
+// must present a certificate signed by one of its CAs, or may when
+// TLS_CLIENT_AUTH is optional.
+func (c *config) serverTLSConfig() (*tls.Config, error) {
+	if c.tlsCertFile == "" && c.tlsKeyFile == "" {
+		if c.tlsClientCAFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.tlsCertFile, c.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("TLS_CERT_FILE, TLS_KEY_FILE: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.tlsClientCAFile == "" {
+		return config, nil
+	}
+	config.ClientCAs, err = loadCertPool(x509.NewCertPool(), c.tlsClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("TLS_CLIENT_CA_FILE: %w", err)
+	}
+	switch strings.ToLower(c.tlsClientAuth) {
+	case clientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case clientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH must be %s or %s, got %q", clientAuthRequire, clientAuthOptional, c.tlsClientAuth)
+	}
+	return config, nil
+}
+
+func describeClientAuth(auth tls.ClientAuthType) string {
+	switch auth {
+	case tls.RequireAndVerifyClientCert:
+		return "required"
+	case tls.VerifyClientCertIfGiven:
+		return "verified if given"
+	}
+	return "not requested"
+}
+
+// upstreamTLSConfig returns the TLS config for upstream calls, or nil to
+// use the defaults: UPSTREAM_TLS_CA_FILE adds CAs to the system's, and
+// UPSTREAM_TLS_CERT_FILE and UPSTREAM_TLS_KEY_FILE give the client
+// certificate presented to upstreams that ask for one
+func (c *config) upstreamTLSConfig() (*tls.Config, error) {
+	if c.upstreamCAFile == "" && c.upstreamCertFile == "" && c.upstreamKeyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.upstreamCAFile != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		config.RootCAs, err = loadCertPool(roots, c.upstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("UPSTREAM_TLS_CA_FILE: %w", err)
+		}
+	}
+	if c.upstreamCertFile != "" || c.upstreamKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.upstreamCertFile, c.upstreamKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("UPSTREAM_TLS_CERT_FILE, UPSTREAM_TLS_KEY_FILE: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// loadCertPool adds the PEM certificates in path to pool
+func loadCertPool(pool *x509.CertPool, path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// newUpstreamTransport returns the default transport with config for TLS
+func newUpstreamTransport(config *tls.Config) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return transport
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// estimateTokens approximates the token count of text without a
+// tokenizer. English text averages about four characters or three
+// quarters of a word per token with common tokenizers; the larger of the
+// two estimates is used so dense or non-Latin text isn't undercounted.
+func estimateTokens(text string) int {
+	byChars := (utf8.RuneCountInString(text) + 3) / 4
+	byWords := (len(strings.Fields(text))*4 + 2) / 3
+	return max(byChars, byWords)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// traceEvent is one line of the TRACE_FILE
+type traceEvent struct {
+	Timestamp       time.Time `json:"timestamp"`
+	RequestID       string    `json:"request_id"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	Status          int       `json:"status"`
+	ClientIP        string    `json:"client_ip"`
+	DurationMs      int64     `json:"duration_ms"`
+	UploadMs        int64     `json:"upload_ms,omitempty"`
+	TranscriptionMs int64     `json:"transcription_ms,omitempty"`
+	LLMMs           int64     `json:"llm_ms,omitempty"`
+	Model           string    `json:"model,omitempty"`
+	FileSize        int64     `json:"file_size,omitempty"`
+	APIKey          string    `json:"api_key,omitempty"`
+	Subject         string    `json:"sub,omitempty"`
+	Tenant          string    `json:"tenant,omitempty"`
+}
+
+// requestTrace collects pipeline details while a request is handled. A
+// request is only written to the trace file when the handler marks it as
+// traced.
+type requestTrace struct {
+	traced          bool
+	uploadMs        int64
+	transcriptionMs int64
+	llmMs           int64
+	model           string
+	fileSize        int64
+	apiKey          *APIKey      // the key the request authenticated with
+	claims          *tokenClaims // or the claims of its JWT
+}
+
+// traceFromContext returns the trace of the current request. It is never
+// nil, so handlers can fill it in unconditionally.
+func traceFromContext(ctx context.Context) *requestTrace {
+	if trace, ok := ctx.Value(requestTraceKey).(*requestTrace); ok {
+		return trace
+	}
+	return &requestTrace{}
+}
+
+// traceWriter appends events to a file from a background goroutine so
+// writes never block the request path. Events are dropped when the queue
+// is full, and the file is rotated once it exceeds maxBytes.
+type traceWriter struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	events  chan traceEvent
+	dropped atomic.Int64
+	done    chan struct{}
+	once    sync.Once
+
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+}
+
+// Traces of completed requests, nil when TRACE_FILE is unset
+var traces *traceWriter
+
+func newTraceWriter(path string, maxBytes int64, maxBackups int) (*traceWriter, error) {
+	t := &traceWriter{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+		events:     make(chan traceEvent, 4096),
+		done:       make(chan struct{}),
+	}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	go t.run()
+	return t, nil
+}
+
+// emit queues an event without blocking
+func (t *traceWriter) emit(event traceEvent) {
+	select {
+	case t.events <- event:
+	default:
+		if t.dropped.Add(1)%1000 == 1 {
+			log.Printf("Trace queue full, dropped %d events so far", t.dropped.Load())
+		}
+	}
+}
+
+// Close writes the queued events and closes the file
+func (t *traceWriter) Close() {
+	t.once.Do(func() {
+		close(t.events)
+		<-t.done
+	})
+}
+
+func (t *traceWriter) run() {
+	defer close(t.done)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case event, ok := <-t.events:
+			if !ok {
+				t.buf.Flush()
+				t.file.Close()
+				return
+			}
+			t.write(event)
+		case <-flush.C:
+			t.buf.Flush()
+		}
+	}
+}
+
+func (t *traceWriter) write(event traceEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	if t.maxBytes > 0 && t.size+int64(len(line)) > t.maxBytes {
+		if err := t.rotate(); err != nil {
+			log.Printf("Failed to rotate trace file: %v", err)
+		}
+	}
+	n, _ := t.buf.Write(line)
+	t.size += int64(n)
+}
+
+func (t *traceWriter) open() error {
+	file, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.file = file
+	t.buf = bufio.NewWriterSize(file, 64<<10)
+	t.size = stat.Size()
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N, ..., path to path.1 and reopens path
+func (t *traceWriter) rotate() error {
+	t.buf.Flush()
+	t.file.Close()
+
+	if t.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", t.path, t.maxBackups))
+		for i := t.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", t.path, i), fmt.Sprintf("%s.%d", t.path, i+1))
+		}
+		os.Rename(t.path, t.path+".1")
+	} else {
+		os.Remove(t.path)
+	}
+	return t.open()
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Exporter batching: spans are sent when a batch is full or every
+// spanExportInterval, and dropped when the exporter falls this far behind
+const (
+	spanBatchSize      = 512
+	spanQueueSize      = 2048
+	spanExportInterval = 5 * time.Second
+)
+
+// OTLP exporter, nil while tracing is disabled
+var tracer *spanExporter
+
+// spanContext identifies a span across process boundaries, as carried in
+// the W3C traceparent header
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// span is one timed operation of a trace. A nil span is a no-op, so code
+// can trace unconditionally.
+type span struct {
+	spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu         sync.Mutex
+	attributes map[string]any
+	err        error
+	ended      bool
+}
+
+// startSpan starts a child of the span in ctx, or a new trace. Without
+// tracing enabled it returns ctx unchanged and a nil span.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attributes: make(map[string]any)}
+	if parent, ok := spanContextFromContext(ctx); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = sampleTrace(s.traceID)
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// setAttributes records key/value pairs on the span
+func (s *span) setAttributes(keyValues ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		if key, ok := keyValues[i].(string); ok {
+			s.attributes[key] = keyValues[i+1]
+		}
+	}
+}
+
+// end finishes the span, marking it as failed when err is set, and queues
+// it for export if its trace is sampled. Only the first call counts, so a
+// deferred end can cover early returns.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := s.ended
+	if !ended {
+		s.ended = true
+		s.err = err
+	}
+	s.mu.Unlock()
+	if ended {
+		return
+	}
+	if s.sampled {
+		tracer.queue(s, time.Now())
+	}
+}
+
+// spanContextFromContext returns the current span of ctx, or the remote
+// parent stored by the tracing middleware
+func spanContextFromContext(ctx context.Context) (spanContext, bool) {
+	switch v := ctx.Value(spanKey).(type) {
+	case *span:
+		if v != nil {
+			return v.spanContext, true
+		}
+	case spanContext:
+		return v, true
+	}
+	return spanContext{}, false
+}
+
+// withSpanContext carries the current span of from over to ctx, e.g. to
+// a job that outlives its request
+func withSpanContext(ctx, from context.Context) context.Context {
+	if parent, ok := spanContextFromContext(from); ok {
+		return context.WithValue(ctx, spanKey, parent)
+	}
+	return ctx
+}
+
+// sampleTrace applies the OTEL_TRACES_SAMPLER_ARG ratio to a new trace,
+// deciding by the trace ID so the decision is the same everywhere
+func sampleTrace(traceID [16]byte) bool {
+	if cfg().traceSampleRatio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>11)/(1<<53) < cfg().traceSampleRatio
+}
+
+// parseTraceParent reads a W3C traceparent header
+// (version-traceid-spanid-flags)
+func parseTraceParent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+// setTraceParent propagates the trace context of req's context to an
+// upstream in the traceparent header
+func setTraceParent(req *http.Request) {
+	if tracer == nil {
+		return
+	}
+	if sc, ok := spanContextFromContext(req.Context()); ok {
+		flags := "00"
+		if sc.sampled {
+			flags = "01"
+		}
+		req.Header.Set("traceparent", fmt.Sprintf("00-%x-%x-%s", sc.traceID, sc.spanID, flags))
+	}
+}
+
+// tracingMiddleware opens a server span per request, continuing the
+// client's trace when it sends a traceparent header. The span is named
+// after the matched route once the mux has run.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if parent, ok := parseTraceParent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey, parent)
+		}
+		ctx, s := startSpan(ctx, r.Method, spanKindServer)
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		req := r.WithContext(ctx)
+		next.ServeHTTP(rw, req)
+
+		if req.Pattern != "" {
+			s.name = r.Method + " " + req.Pattern
+			s.setAttributes("http.route", req.Pattern)
+		}
+		s.setAttributes(
+			"http.request.method", r.Method,
+			"url.path", r.URL.Path,
+			"http.response.status_code", rw.statusCode,
+			"request_id", requestIDFromContext(ctx),
+		)
+		var err error
+		if rw.statusCode >= 500 {
+			err = fmt.Errorf("%d %s", rw.statusCode, http.StatusText(rw.statusCode))
+		}
+		s.end(err)
+	})
+}
+
+// spanExporter sends finished spans to an OTLP/HTTP endpoint in batches,
+// using the JSON encoding
+type spanExporter struct {
+	endpoint string
+	headers  map[string]string
+	spans    chan otlpSpan
+	done     chan struct{}
+	client   *http.Client
+}
+
+func newSpanExporter(endpoint string, headers map[string]string) *spanExporter {
+	return &spanExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		spans:    make(chan otlpSpan, spanQueueSize),
+		done:     make(chan struct{}),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// queue converts the span for export, dropping it if the queue is full
+func (e *spanExporter) queue(s *span, end time.Time) {
+	select {
+	case e.spans <- s.otlp(end):
+	default:
+	}
+}
+
+// run sends batches until ctx is done, then flushes the queued spans
+func (e *spanExporter) run(ctx context.Context) {
+	defer close(e.done)
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+
+	var batch []otlpSpan
+	flush := func() {
+		if len(batch) > 0 {
+			if err := e.export(batch); err != nil {
+				log.Printf("Failed to export %d spans: %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *spanExporter) export(spans []otlpSpan) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": cfg().otelServiceName}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "whisper-ollama-go"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return newUpstreamError("OTLP collector", resp)
+	}
+	return nil
+}
+
+// otlpSpan is a span in the OTLP JSON encoding, where IDs are hex and
+// 64-bit integers are strings
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+func (s *span) otlp(end time.Time) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		out.Status = &otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return out
+}
+
+func otlpAttributes(attributes map[string]any) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]any
+		switch value := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": value}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			v = map[string]any{"doubleValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		out = append(out, otlpAttribute{Key: key, Value: v})
+	}
+	return out
+}
+
+// otlpTracesEndpoint returns the URL spans are sent to, following the
+// OTEL_EXPORTER_OTLP_* conventions, or an empty string when tracing is off
+func otlpTracesEndpoint() string {
+	c := cfg()
+	if c.otlpTracesURL != "" {
+		return c.otlpTracesURL
+	}
+	if c.otlpEndpoint != "" {
+		return strings.TrimSuffix(c.otlpEndpoint, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// parseOTLPHeaders parses OTEL_EXPORTER_OTLP_HEADERS, a comma-separated
+// list of name=value pairs
+func parseOTLPHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, headerValue, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, want name=value", pair)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(headerValue)
+	}
+	return headers, nil
+}
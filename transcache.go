@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Prefix of the Redis keys of cached transcriptions
+const transcriptionKeyPrefix = "whisper-llm-bridge:transcription:"
+
+// Transcription cache, set up by main from TRANSCRIPTION_CACHE; nil when
+// transcriptions aren't cached. Entries are cachedTranscriptions keyed by
+// a hash of the audio and the options it was transcribed with.
+var transcriptions byteCache
+
+// cachedTranscription is a transcription as kept in the cache
+type cachedTranscription struct {
+	Response *WhisperResponse `json:"response"`
+	Chunks   int              `json:"chunks,omitempty"`
+}
+
+// transcribeCached transcribes the audio file at path, answering from the
+// transcription cache when the same audio was transcribed with the same
+// options before. With bypass the cache isn't read, but the new
+// transcription replaces the cached one. It reports whether the
+// transcription came from the cache. Cache failures are logged and the
+// audio transcribed as if it weren't cached.
+func transcribeCached(ctx context.Context, path string, opts whisperOptions, bypass bool) (*WhisperResponse, bool, error) {
+	// Requests routed to another ASR backend are kept out of the cache
+	if transcriptions == nil || overridesFromContext(ctx).whisper != "" {
+		resp, err := transcribeAudioFile(ctx, path, opts)
+		return resp, false, err
+	}
+	key, err := transcriptionCacheKey(path, opts)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to hash audio: %w", err)
+	}
+
+	if bypass {
+		transcriptionCacheRequests.add(1, cacheBypassed)
+	} else {
+		entry, err := transcriptions.get(ctx, key)
+		if err != nil {
+			log.Printf("Failed to read the transcription cache: %v request_id=%s", err, requestIDFromContext(ctx))
+		}
+		var cached cachedTranscription
+		if entry != nil && json.Unmarshal(entry, &cached) == nil && cached.Response != nil {
+			transcriptionCacheRequests.add(1, cacheHit)
+			cached.Response.Chunks = cached.Chunks
+			return cached.Response, true, nil
+		}
+		transcriptionCacheRequests.add(1, cacheMiss)
+	}
+
+	resp, err := transcribeAudioFile(ctx, path, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	// Stored before the pipeline redacts or labels the transcription
+	entry, err := json.Marshal(cachedTranscription{Response: resp, Chunks: resp.Chunks})
+	if err == nil {
+		err = transcriptions.set(ctx, key, entry, time.Duration(cfg().transcriptionCacheTTL)*time.Second)
+	}
+	if err != nil {
+		log.Printf("Failed to write the transcription cache: %v request_id=%s", err, requestIDFromContext(ctx))
+	}
+	return resp, false, nil
+}
+
+// transcriptionCacheKey hashes the audio at path together with everything
+// else that shapes its transcription: the ASR backend and model, the
+// options and the chunking of long recordings
+func transcriptionCacheKey(path string, opts whisperOptions) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	audio := sha256.New()
+	if _, err := io.Copy(audio, file); err != nil {
+		return "", err
+	}
+	params, err := json.Marshal(struct {
+		Backend, Model string
+		Options        whisperOptions
+		Chunk, Overlap int
+	}{cfg().transcriber.name(), cfg().asrModel, opts, cfg().audioChunkSeconds, cfg().audioChunkOverlap})
+	if err != nil {
+		return "", err
+	}
+	key := sha256.New()
+	key.Write(audio.Sum(nil))
+	key.Write(params)
+	return hex.EncodeToString(key.Sum(nil)), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Values of TRANSCODE_AUDIO
+const (
+	transcodeOff    = "off"
+	transcodeAuto   = "auto"
+	transcodeAlways = "always"
+)
+
+// Most of ffmpeg's error output kept in the error message
+const maxTranscodeErrorBytes = 512
+
+// parseTranscodeMode checks TRANSCODE_AUDIO
+func parseTranscodeMode(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case transcodeOff, transcodeAuto, transcodeAlways:
+		return mode, nil
+	}
+	return "", fmt.Errorf("TRANSCODE_AUDIO must be %s, %s or %s, got %q", transcodeOff, transcodeAuto, transcodeAlways, value)
+}
+
+// needsTranscode reports whether the upload at path goes through ffmpeg.
+// With auto that is audio in a container the sniffer doesn't know, such as
+// AMR, AIFF or AVI, 3GP recordings from phones, and non-WAV audio a
+// channel is selected from, which only WAV allows.
+func needsTranscode(path, channel string) (bool, error) {
+	switch cfg().transcodeMode {
+	case transcodeOff:
+		return false, nil
+	case transcodeAlways:
+		return true, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	header := make([]byte, sniffLength)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+
+	switch format := sniffAudioFormat(header); {
+	case format == "":
+		return true, nil
+	case format == formatM4A && bytes.HasPrefix(header[8:], []byte("3g")):
+		// 3GP and 3G2 brands
+		return true, nil
+	case format != formatWAV && channel != channelMix:
+		return true, nil
+	}
+	return false, nil
+}
+
+// transcodeUpload converts the upload at path to 16 kHz 16-bit WAV with
+// ffmpeg when TRANSCODE_AUDIO asks for it, returning the path of the WAV,
+// or path itself when the upload is left alone. The WAV is mono unless a
+// channel is to be selected from it.
+//
+// ffmpeg runs with an empty environment, which keeps the bridge's keys
+// from it, may only read and write local files, and is killed after
+// TRANSCODE_TIMEOUT. Point FFMPEG_PATH at a wrapper to confine it further.
+func transcodeUpload(ctx context.Context, path, channel string) (string, error) {
+	needed, err := needsTranscode(path, channel)
+	if err != nil || !needed {
+		return path, err
+	}
+
+	ctx, span := startSpan(ctx, "transcode", spanKindInternal)
+	out, err := os.CreateTemp("", "transcode-*.wav")
+	if err != nil {
+		span.end(err)
+		return "", err
+	}
+	out.Close()
+
+	args := []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error",
+		"-protocol_whitelist", "file",
+		"-i", "file:" + path,
+		"-map", "0:a:0", "-vn", "-sn", "-dn",
+		"-ar", "16000", "-c:a", "pcm_s16le",
+	}
+	if channel == channelMix {
+		args = append(args, "-ac", "1")
+	}
+	args = append(args, "-f", "wav", "-y", "file:"+out.Name())
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg().transcodeTimeout)*time.Second)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cfg().ffmpegPath, args...)
+	cmd.Env = []string{}
+	cmd.Dir = os.TempDir()
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	switch {
+	case err == nil:
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = fmt.Errorf("audio conversion took longer than TRANSCODE_TIMEOUT (%ds)", cfg().transcodeTimeout)
+	case errors.As(err, new(*exec.ExitError)):
+		// ffmpeg couldn't read the upload
+		message := strings.TrimSpace(stderr.String())
+		if len(message) > maxTranscodeErrorBytes {
+			message = message[len(message)-maxTranscodeErrorBytes:]
+		}
+		err = newHTTPError(http.StatusUnsupportedMediaType, "audio could not be converted: %s", message)
+	default:
+		err = fmt.Errorf("running ffmpeg: %w", err)
+	}
+	span.end(err)
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
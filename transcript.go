@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// cleanTranscription normalises raw Whisper output before the LLM stage:
+// surrounding whitespace is trimmed, whitespace runs collapse to a single
+// space and the first letter of every sentence is capitalised. A sentence
+// starts at the beginning of the text or after '.', '!' or '?' followed by
+// whitespace; a digit before the first letter means there is nothing to
+// capitalise.
+func cleanTranscription(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+
+	runes := []rune(text)
+	sentenceStart := true
+	for i, r := range runes {
+		switch {
+		case unicode.IsLetter(r):
+			if sentenceStart {
+				runes[i] = unicode.ToUpper(r)
+			}
+			sentenceStart = false
+		case unicode.IsDigit(r):
+			sentenceStart = false
+		case r == '.' || r == '!' || r == '?':
+			sentenceStart = i+1 < len(runes) && runes[i+1] == ' '
+		}
+	}
+	return string(runes)
+}
+
+// textFromSegments rebuilds a transcription from Whisper segments for ASR
+// backends that only return segments. Segments without text are skipped.
+func textFromSegments(segments []Segment) string {
+	var parts []string
+	for _, segment := range segments {
+		if text := strings.TrimSpace(segment.Text); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, " ")
+}
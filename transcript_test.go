@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCleanTranscription(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", ""},
+		{"only whitespace", " \t\n ", ""},
+		{"trims", "  hello there  ", "Hello there"},
+		{"collapses whitespace", "hello \t  there\n\nfriend", "Hello there friend"},
+		{"sentence starts", "hello. how are you? fine! thanks", "Hello. How are you? Fine! Thanks"},
+		{"no space after period", "see example.com for details", "See example.com for details"},
+		{"decimal number", "it costs 3.5 dollars. ok", "It costs 3.5 dollars. Ok"},
+		{"digit starts sentence", "2 apples. 3 pears", "2 apples. 3 pears"},
+		{"ellipsis", "well... maybe", "Well... Maybe"},
+		{"punctuation before letter", "\"hello\" she said. 'yes'", "\"Hello\" she said. 'Yes'"},
+		{"keeps existing capitals", "NASA launched. The API works", "NASA launched. The API works"},
+		{"non-ASCII letters", "élan vital. über alles", "Élan vital. Über alles"},
+		{"trailing punctuation", "done.", "Done."},
+		{"whitespace before punctuation collapsed", "hello .  world", "Hello . World"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cleanTranscription(tt.in)
+			if got != tt.want {
+				t.Errorf("cleanTranscription(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if again := cleanTranscription(got); again != got {
+				t.Errorf("cleaning %q again gave %q", got, again)
+			}
+		})
+	}
+}
+
+func TestSpeakerTranscriptClean(t *testing.T) {
+	segments := []Segment{
+		{Text: " hello  there. ", Speaker: "SPEAKER_00"},
+		{Text: "how are you?", Speaker: "SPEAKER_00"},
+		{Text: "fine.  thanks", Speaker: "SPEAKER_01"},
+	}
+	want := "SPEAKER_00: Hello there. How are you?\nSPEAKER_01: Fine. Thanks"
+	got, speakers := speakerTranscript(segments, true)
+	if got != want || speakers != 2 {
+		t.Errorf("speakerTranscript = %q, %d; want %q, 2", got, speakers, want)
+	}
+}
+
+func TestTextFromSegments(t *testing.T) {
+	segments := []Segment{{Text: " Hello there. "}, {Text: ""}, {Text: "  "}, {Text: "How are you?"}}
+	if got, want := textFromSegments(segments), "Hello there. How are you?"; got != want {
+		t.Errorf("textFromSegments = %q, want %q", got, want)
+	}
+	if got := textFromSegments(nil); got != "" {
+		t.Errorf("textFromSegments(nil) = %q, want empty", got)
+	}
+}
+
+func TestSegmentsOnlyWhisperResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"no text field", `{"segments": [{"id": 0, "start": 0, "end": 2, "text": " Hello there."}, {"id": 1, "start": 2, "end": 4, "text": " How are you?"}]}`, "Hello there. How are you?"},
+		{"blank text field", `{"text": "  ", "segments": [{"id": 0, "start": 0, "end": 2, "text": "Hello."}]}`, "Hello."},
+		{"text field wins", `{"text": "From the text field", "segments": [{"id": 0, "start": 0, "end": 2, "text": "From segments"}]}`, "From the text field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whisper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.body))
+			}))
+			defer whisper.Close()
+
+			ctx := withWhisperURL(context.Background(), whisper.URL)
+			resp, err := transcribeWithWhisperOptions(ctx, "a.wav", strings.NewReader("audio"), whisperOptions{})
+			if err != nil {
+				t.Fatalf("transcribe: %v", err)
+			}
+			if resp.Text != tt.want {
+				t.Errorf("transcription = %q, want %q", resp.Text, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// Prompt of the translation step, with the target language
+const translatePrompt = "Translate this transcription into %s. Reply with the translation only, without notes or explanations."
+
+// maxTranslateToLength bounds the translate_to field, which ends up in the
+// prompt
+const maxTranslateToLength = 40
+
+// parseTranslateTo checks the translate_to field, a language name or code
+// such as "French" or "fr"
+func parseTranslateTo(value string) (string, error) {
+	language := strings.TrimSpace(value)
+	if len(language) > maxTranslateToLength || strings.IndexFunc(language, func(r rune) bool {
+		return !unicode.IsLetter(r) && r != ' ' && r != '-'
+	}) >= 0 {
+		return "", newHTTPError(http.StatusBadRequest, "invalid translate_to %q (expected a language such as French or fr)", value)
+	}
+	return language, nil
+}
+
+// translateTranscription has the LLM translate a transcription into the
+// language target before the LLM step, which then works on the
+// translation. Long transcriptions are translated in chunks of about
+// SUMMARIZE_CHUNK_TOKENS. translation is set to the translated text;
+// without a target the transcription is returned unchanged.
+func translateTranscription(ctx context.Context, model, target, transcription string, translation *string) (string, error) {
+	if target == "" {
+		return transcription, nil
+	}
+	prompt := fmt.Sprintf(translatePrompt, target)
+	parts := splitTranscript(transcription, cfg().summarizeChunkTokens)
+	translated := make([]string, len(parts))
+	for i, part := range parts {
+		resp, err := processWithLLM(ctx, model, buildPrompt(prompt, part), nil)
+		if err != nil {
+			if len(parts) == 1 {
+				return "", fmt.Errorf("translating: %w", err)
+			}
+			return "", fmt.Errorf("translating part %d of %d: %w", i+1, len(parts), err)
+		}
+		translated[i] = strings.TrimSpace(resp.Response)
+	}
+	*translation = strings.Join(translated, "\n\n")
+	return *translation, nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TTS backend names, used in TTS_BACKEND
+const (
+	ttsPiper  = "piper"
+	ttsCoqui  = "coqui"
+	ttsOpenAI = "openai"
+)
+
+// Audio formats of the tts_format field
+const (
+	speechWAV = "wav"
+	speechMP3 = "mp3"
+)
+
+// Values of the tts_delivery field
+const (
+	speechDeliveryURL       = "url"
+	speechDeliveryMultipart = "multipart"
+)
+
+// Model asked of OpenAI-compatible speech APIs when TTS_MODEL is empty
+const defaultTTSModel = "tts-1"
+
+// Upper bound on the synthesized audio read from a TTS backend
+const maxSpeechBytes = 64 << 20
+
+// How often expired speech is evicted
+const speechJanitorInterval = 30 * time.Second
+
+// Synthesizer runs the optional text-to-speech stage on the LLM's answer
+type Synthesizer interface {
+	// name is the backend's name in the configuration
+	name() string
+	// formats lists the audio formats the backend can produce
+	formats() []string
+	// synthesize speaks text with voice, the backend's default when empty
+	synthesize(ctx context.Context, text, voice, format string) ([]byte, error)
+}
+
+// newSynthesizer returns the backend with the given name at baseURL, or
+// nil when baseURL is empty
+func (c *config) newSynthesizer(name, baseURL string) (Synthesizer, error) {
+	if baseURL == "" {
+		return nil, nil
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	switch name {
+	case ttsPiper:
+		return piperSynthesizer{baseURL: baseURL}, nil
+	case ttsCoqui:
+		return coquiSynthesizer{baseURL: baseURL}, nil
+	case ttsOpenAI:
+		model := c.ttsModel
+		if model == "" {
+			model = defaultTTSModel
+		}
+		return openAISynthesizer{baseURL: baseURL, apiKey: c.ttsAPIKey, model: model}, nil
+	}
+	return nil, fmt.Errorf("unknown TTS_BACKEND %q (want %s, %s or %s)", name, ttsPiper, ttsCoqui, ttsOpenAI)
+}
+
+// piperSynthesizer calls Piper's HTTP server (python3 -m piper.http_server),
+// which answers WAV
+type piperSynthesizer struct {
+	baseURL string
+}
+
+func (piperSynthesizer) name() string      { return ttsPiper }
+func (piperSynthesizer) formats() []string { return []string{speechWAV} }
+
+func (s piperSynthesizer) synthesize(ctx context.Context, text, voice, format string) ([]byte, error) {
+	body := map[string]any{"text": text}
+	if voice != "" {
+		body["voice"] = voice
+	}
+	return postSpeechRequest(ctx, s.baseURL+"/", "", body)
+}
+
+// coquiSynthesizer calls the Coqui TTS server (tts-server), which answers
+// WAV. The voice is its speaker ID.
+type coquiSynthesizer struct {
+	baseURL string
+}
+
+func (coquiSynthesizer) name() string      { return ttsCoqui }
+func (coquiSynthesizer) formats() []string { return []string{speechWAV} }
+
+func (s coquiSynthesizer) synthesize(ctx context.Context, text, voice, format string) ([]byte, error) {
+	query := url.Values{"text": {text}}
+	if voice != "" {
+		query.Set("speaker_id", voice)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+"/api/tts?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return doSpeechRequest(req)
+}
+
+// openAISynthesizer calls an OpenAI-compatible speech API, OpenAI's own or
+// a self-hosted one. TTS_URL goes up to and including /v1.
+type openAISynthesizer struct {
+	baseURL string
+	apiKey  string // optional for self-hosted servers
+	model   string
+}
+
+func (openAISynthesizer) name() string      { return ttsOpenAI }
+func (openAISynthesizer) formats() []string { return []string{speechWAV, speechMP3} }
+
+func (s openAISynthesizer) synthesize(ctx context.Context, text, voice, format string) ([]byte, error) {
+	if voice == "" {
+		voice = "alloy"
+	}
+	body := map[string]any{"model": s.model, "input": text, "voice": voice, "response_format": format}
+	return postSpeechRequest(ctx, s.baseURL+"/audio/speech", s.apiKey, body)
+}
+
+// postSpeechRequest posts body as JSON to a TTS backend and returns the
+// audio it answers
+func postSpeechRequest(ctx context.Context, endpoint, apiKey string, body map[string]any) ([]byte, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	return doSpeechRequest(req)
+}
+
+// doSpeechRequest sends a request to the TTS backend and reads the audio
+func doSpeechRequest(req *http.Request) ([]byte, error) {
+	setUpstreamRequestID(req)
+	setTraceParent(req)
+	resp, err := upstreamClient(time.Duration(cfg().requestTimeout) * time.Second).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError(upstreamTTS, resp)
+	}
+	audio, err := io.ReadAll(io.LimitReader(resp.Body, maxSpeechBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audio: %w", err)
+	}
+	if len(audio) > maxSpeechBytes {
+		return nil, fmt.Errorf("audio is larger than %d MB", maxSpeechBytes>>20)
+	}
+	return audio, nil
+}
+
+// parseSpeechFormat parses the tts_format field, wav by default
+func parseSpeechFormat(value string) (string, error) {
+	switch format := strings.ToLower(strings.TrimSpace(value)); format {
+	case "":
+		return speechWAV, nil
+	case speechWAV, speechMP3:
+		return format, nil
+	}
+	return "", newHTTPError(http.StatusBadRequest, "invalid tts_format %q (expected %s or %s)", value, speechWAV, speechMP3)
+}
+
+// parseSpeechDelivery parses the tts_delivery field, url by default
+func parseSpeechDelivery(value string) (string, error) {
+	switch delivery := strings.ToLower(strings.TrimSpace(value)); delivery {
+	case "":
+		return speechDeliveryURL, nil
+	case speechDeliveryURL, speechDeliveryMultipart:
+		return delivery, nil
+	}
+	return "", newHTTPError(http.StatusBadRequest, "invalid tts_delivery %q (expected %s or %s)", value, speechDeliveryURL, speechDeliveryMultipart)
+}
+
+// checkTTS rejects tts requests the TTS stage can't serve
+func checkTTS(input *processInput) error {
+	if !input.TTS {
+		return nil
+	}
+	switch {
+	case cfg().synthesizer == nil:
+		return newHTTPError(http.StatusBadRequest, "text-to-speech is not configured (TTS_URL)")
+	case !slices.Contains(cfg().synthesizer.formats(), input.TTSFormat):
+		return newHTTPError(http.StatusBadRequest, "the %s TTS backend can't produce %s", cfg().synthesizer.name(), input.TTSFormat)
+	case input.Stream || input.RawStream:
+		return newHTTPError(http.StatusBadRequest, "tts can't be combined with streaming")
+	case input.ResponseFormat != responseFormatJSON:
+		return newHTTPError(http.StatusBadRequest, "tts can't be combined with response_format %s", input.ResponseFormat)
+	case input.Mode == modeTranscribeOnly:
+		return newHTTPError(http.StatusBadRequest, "tts can't be combined with mode %s", modeTranscribeOnly)
+	case input.EstimateTokens:
+		return newHTTPError(http.StatusBadRequest, "tts can't be combined with estimate_tokens")
+	case input.TTSDelivery == speechDeliveryMultipart && input.Download:
+		return newHTTPError(http.StatusBadRequest, "tts_delivery %s can't be combined with download", speechDeliveryMultipart)
+	}
+	return nil
+}
+
+// speech is synthesized audio
+type speech struct {
+	format string
+	audio  []byte
+}
+
+// contentType returns the MIME type of the audio
+func (s *speech) contentType() string {
+	if s.format == speechMP3 {
+		return "audio/mpeg"
+	}
+	return "audio/wav"
+}
+
+// speakResponse synthesizes the LLM's answer in result. With url delivery
+// the audio is stored for /speech/{id}. A failure is reported in the
+// response without failing the request, whose text is still good.
+func speakResponse(ctx context.Context, input *processInput, result *pipelineResult) {
+	resp := &result.Response
+	ctx, span := startSpan(ctx, "tts", spanKindClient)
+	span.setAttributes("tts.backend", cfg().synthesizer.name(), "tts.format", input.TTSFormat)
+	start := time.Now()
+	text := strings.TrimSpace(resp.Response)
+	var audio []byte
+	var err error
+	if len([]rune(text)) > cfg().ttsMaxChars {
+		err = fmt.Errorf("text is longer than TTS_MAX_CHARS (%d)", cfg().ttsMaxChars)
+	} else {
+		audio, err = cfg().synthesizer.synthesize(ctx, text, input.TTSVoice, input.TTSFormat)
+	}
+	span.end(err)
+	if err != nil {
+		countUpstreamError(ctx, upstreamTTS, err)
+		log.Printf("Speech synthesis failed: %v request_id=%s", err, requestIDFromContext(ctx))
+		resp.SpeechError = err.Error()
+		return
+	}
+	resp.SpeechTime = time.Since(start).Milliseconds()
+	resp.SpeechFormat = input.TTSFormat
+	result.Speech = &speech{format: input.TTSFormat, audio: audio}
+	if input.TTSDelivery == speechDeliveryURL {
+		resp.SpeechURL = "/speech/" + speeches.put(result.Speech)
+	}
+}
+
+// speechStore keeps synthesized audio for download, evicting it after
+// SPEECH_TTL seconds and the oldest when SPEECH_MAX_STORED are kept
+type speechStore struct {
+	mu      sync.Mutex
+	entries map[string]*storedSpeech
+	order   *list.List // front is newest
+	max     int
+}
+
+type storedSpeech struct {
+	*speech
+	id      string
+	expires time.Time
+	elem    *list.Element
+}
+
+// Speech kept for /speech/{id}, nil until main starts it
+var speeches *speechStore
+
+func newSpeechStore(maxStored int) *speechStore {
+	return &speechStore{entries: make(map[string]*storedSpeech), order: list.New(), max: maxStored}
+}
+
+// start runs the janitor until ctx is done
+func (s *speechStore) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(speechJanitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.evictExpired(time.Now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// put stores audio and returns its ID
+func (s *speechStore) put(sp *speech) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.entries) >= s.max {
+		s.remove(s.order.Back().Value.(*storedSpeech))
+	}
+	entry := &storedSpeech{speech: sp, id: newRequestID(), expires: time.Now().Add(time.Duration(cfg().speechTTL) * time.Second)}
+	entry.elem = s.order.PushFront(entry)
+	s.entries[entry.id] = entry
+	return entry.id
+}
+
+// get returns the audio with id unless it expired
+func (s *speechStore) get(id string) (*speech, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[id]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.speech, true
+}
+
+// evictExpired removes the audio that expired by now
+func (s *speechStore) evictExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range s.entries {
+		if now.After(entry.expires) {
+			s.remove(entry)
+		}
+	}
+}
+
+// remove forgets entry; s.mu must be held
+func (s *speechStore) remove(entry *storedSpeech) {
+	s.order.Remove(entry.elem)
+	delete(s.entries, entry.id)
+}
+
+// speechHandler serves synthesized audio by ID
+func speechHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sp, ok := speeches.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "speech not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", sp.contentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "speech."+sp.format))
+	w.Write(sp.audio)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errUploadStalled is reported when the client stops sending the body
+var errUploadStalled = errors.New("upload stalled")
+
+// uploadReader wraps a request body so a stalled client can't hold a
+// concurrency slot until the server's read timeout. Each read must make
+// progress within the idle timeout, and a pending read is interrupted as
+// soon as ctx is done. Bodies larger than the limit fail once they pass
+// it, before more than the limit is buffered anywhere.
+type uploadReader struct {
+	body     io.ReadCloser
+	rc       *http.ResponseController
+	ctx      context.Context
+	idle     time.Duration
+	stop     func() bool
+	stalled  atomic.Bool
+	tooLarge atomic.Bool
+}
+
+// newUploadReader wraps body with the idle timeout and a limit in bytes,
+// 0 for none
+func newUploadReader(ctx context.Context, w http.ResponseWriter, body io.ReadCloser, idle time.Duration, limit int64) *uploadReader {
+	if limit > 0 {
+		body = http.MaxBytesReader(w, body, limit)
+	}
+	u := &uploadReader{
+		body: body,
+		rc:   http.NewResponseController(w),
+		ctx:  ctx,
+		idle: idle,
+	}
+	u.stop = context.AfterFunc(ctx, func() {
+		u.rc.SetReadDeadline(time.Now())
+	})
+	return u
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	if err := u.ctx.Err(); err != nil {
+		u.stalled.Store(true)
+		return 0, errUploadStalled
+	}
+	if u.idle > 0 {
+		u.rc.SetReadDeadline(time.Now().Add(u.idle))
+	}
+
+	n, err := u.body.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		u.tooLarge.Store(true)
+		return n, err
+	}
+	if err == io.EOF {
+		// The body is complete. Clear the deadline so it can't fire on
+		// the server's background read while the request is processed.
+		if u.stop() {
+			u.rc.SetReadDeadline(time.Time{})
+		}
+	}
+	if err != nil && err != io.EOF && (u.ctx.Err() != nil || isTimeout(err)) {
+		u.stalled.Store(true)
+		return n, errUploadStalled
+	}
+	return n, err
+}
+
+func (u *uploadReader) Close() error {
+	u.stop()
+	return u.body.Close()
+}
+
+// writeUploadFailure responds with 413 if the upload exceeded
+// MAX_UPLOAD_BYTES, or 408 if it was aborted, whatever error that surfaced
+// as further up. It reports whether it did.
+func writeUploadFailure(w http.ResponseWriter, u *uploadReader) bool {
+	switch {
+	case u.tooLarge.Load():
+		writeUploadTooLarge(w)
+	case u.stalled.Load():
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Upload stalled, request body was not received in time", http.StatusRequestTimeout)
+	default:
+		return false
+	}
+	return true
+}
+
+// UploadTooLargeError is the 413 answer to an upload over MAX_UPLOAD_BYTES
+type UploadTooLargeError struct {
+	Error          string `json:"error"`
+	MaxUploadBytes int    `json:"max_upload_bytes"`
+}
+
+// rejectLargeUpload responds with 413 when the request announces a body
+// over MAX_UPLOAD_BYTES in its Content-Length, before any of it is read,
+// and reports whether it did. Chunked bodies are cut off by the
+// uploadReader instead.
+func rejectLargeUpload(w http.ResponseWriter, r *http.Request) bool {
+	if !announcesLargeUpload(r) {
+		return false
+	}
+	writeUploadTooLarge(w)
+	return true
+}
+
+// announcesLargeUpload reports whether the Content-Length of r is over
+// MAX_UPLOAD_BYTES
+func announcesLargeUpload(r *http.Request) bool {
+	return cfg().maxUploadBytes > 0 && r.ContentLength > int64(cfg().maxUploadBytes)
+}
+
+// writeUploadTooLarge responds with 413, closing the connection rather
+// than reading the rest of the body
+func writeUploadTooLarge(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	writeJSON(w, http.StatusRequestEntityTooLarge, UploadTooLargeError{Error: uploadTooLargeMessage(), MaxUploadBytes: cfg().maxUploadBytes})
+}
+
+func uploadTooLargeMessage() string {
+	return fmt.Sprintf("upload is larger than the limit of %d bytes", cfg().maxUploadBytes)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUpload sends the headers of a multipart POST announcing more body
+// than it then sends, leaving the rest of the upload to the caller
+func startUpload(t *testing.T, server *httptest.Server, path string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	part := "--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.wav\"\r\nContent-Type: audio/wav\r\n\r\nRIFF"
+	fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: bridge\r\nContent-Type: multipart/form-data; boundary=b\r\nContent-Length: 100000\r\n\r\n%s", path, part)
+	return conn
+}
+
+// readStatus reads the status code of the response on conn
+func readStatus(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading the response: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestStalledUploadTimesOut(t *testing.T) {
+	setConfigForTest(t, func(c *config) { c.uploadIdleTimeout = 1 })
+	server := httptest.NewServer(http.HandlerFunc(processAudioHandler))
+	defer server.Close()
+
+	conn := startUpload(t, server, "/process")
+	start := time.Now()
+	if status := readStatus(t, conn); status != http.StatusRequestTimeout {
+		t.Errorf("status = %d, want 408", status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("stalled upload was answered after %s, want about the 1s idle timeout", elapsed)
+	}
+	// The slot is given back as the handler returns, just after it answers
+	deadline := time.Now().Add(time.Second)
+	for slots.inUse() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := slots.inUse(); n != 0 {
+		t.Errorf("%d slots still in use after the stalled upload", n)
+	}
+}
+
+func TestSlowUploadKeepsReading(t *testing.T) {
+	chunks := []string{"slow", " but", " steady"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upload := newUploadReader(r.Context(), w, r.Body, 500*time.Millisecond, 0)
+		defer upload.stop()
+		body, err := io.ReadAll(upload)
+		if err != nil {
+			if !writeUploadFailure(w, upload) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: bridge\r\nContent-Length: %d\r\n\r\n", len(strings.Join(chunks, "")))
+	for _, chunk := range chunks {
+		// Each pause is under the idle timeout, the whole upload isn't
+		time.Sleep(300 * time.Millisecond)
+		conn.Write([]byte(chunk))
+	}
+	if status := readStatus(t, conn); status != http.StatusOK {
+		t.Errorf("status = %d, want 200", status)
+	}
+}
+
+func TestUploadAbortedWithContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+		defer cancel()
+		upload := newUploadReader(ctx, w, r.Body, time.Minute, 0)
+		defer upload.stop()
+		if _, err := io.Copy(io.Discard, upload); err == nil || !writeUploadFailure(w, upload) {
+			t.Errorf("copy ended with %v, want the upload reported as stalled", err)
+		}
+	}))
+	defer server.Close()
+
+	conn := startUpload(t, server, "/")
+	start := time.Now()
+	if status := readStatus(t, conn); status != http.StatusRequestTimeout {
+		t.Errorf("status = %d, want 408", status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("upload was aborted after %s, want about 200ms", elapsed)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// upstreamError is a non-200 answer from Whisper or Ollama
+type upstreamError struct {
+	Service    string
+	StatusCode int
+	Body       string
+	RetryAfter string // upstream Retry-After header, if any
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("%s returned non-200 status: %d, body: %s", e.Service, e.StatusCode, e.Body)
+}
+
+// newUpstreamError builds an upstreamError from a failed response,
+// consuming its body
+func newUpstreamError(service string, resp *http.Response) *upstreamError {
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	return &upstreamError{
+		Service:    service,
+		StatusCode: resp.StatusCode,
+		Body:       string(bodyBytes),
+		RetryAfter: resp.Header.Get("Retry-After"),
+	}
+}
+
+// overloaded reports whether the upstream signalled a transient overload
+func (e *upstreamError) overloaded() bool {
+	return e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusTooManyRequests
+}
+
+// retryAfter returns the Retry-After value to send to our client: the
+// upstream's own value when it's a valid delay or date, otherwise the
+// configured default
+func (e *upstreamError) retryAfter() string {
+	if e.RetryAfter != "" {
+		if _, err := strconv.Atoi(e.RetryAfter); err == nil {
+			return e.RetryAfter
+		}
+		if _, err := http.ParseTime(e.RetryAfter); err == nil {
+			return e.RetryAfter
+		}
+	}
+	return strconv.Itoa(cfg().defaultRetryAfter)
+}
+
+// writeUpstreamOverload reports an overloaded upstream as 503 with a
+// Retry-After header. It returns false when err isn't an overload so the
+// caller can fall back to its usual error handling.
+func writeUpstreamOverload(w http.ResponseWriter, err error) bool {
+	var ue *upstreamError
+	if !errors.As(err, &ue) || !ue.overloaded() {
+		return false
+	}
+	w.Header().Set("Retry-After", ue.retryAfter())
+	http.Error(w, fmt.Sprintf("%s is overloaded, please retry later", ue.Service), http.StatusServiceUnavailable)
+	return true
+}
+
+// firstHeader returns the first non-empty value among the given headers
+func firstHeader(header http.Header, names ...string) string {
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
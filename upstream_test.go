@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWriteUpstreamOverload(t *testing.T) {
+	setConfigForTest(t, func(c *config) { c.defaultRetryAfter = 7 })
+	date := "Wed, 21 Oct 2026 07:28:00 GMT"
+	tests := []struct {
+		name           string
+		status         int
+		retryAfter     string
+		wantHandled    bool
+		wantRetryAfter string
+	}{
+		{"503 with delay", http.StatusServiceUnavailable, "30", true, "30"},
+		{"429 with delay", http.StatusTooManyRequests, "12", true, "12"},
+		{"503 with date", http.StatusServiceUnavailable, date, true, date},
+		{"503 without Retry-After", http.StatusServiceUnavailable, "", true, "7"},
+		{"429 with invalid Retry-After", http.StatusTooManyRequests, "soon", true, "7"},
+		{"500", http.StatusInternalServerError, "30", false, ""},
+		{"400", http.StatusBadRequest, "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				http.Error(w, "busy", tt.status)
+			}))
+			defer upstream.Close()
+
+			_, err := sendToOllama(context.Background(), upstream.Client(), upstream.URL+"/api/generate", []byte(`{}`))
+			if err == nil {
+				t.Fatal("sendToOllama succeeded, want an upstream error")
+			}
+			rec := httptest.NewRecorder()
+			if handled := writeUpstreamOverload(rec, err); handled != tt.wantHandled {
+				t.Fatalf("writeUpstreamOverload = %v, want %v", handled, tt.wantHandled)
+			}
+			if !tt.wantHandled {
+				return
+			}
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want 503", rec.Code)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if !strings.Contains(rec.Body.String(), upstreamOllama) {
+				t.Errorf("body = %q, want it to name %s", rec.Body.String(), upstreamOllama)
+			}
+		})
+	}
+}
+
+func TestWhisperOverloadRetried(t *testing.T) {
+	setConfigForTest(t, func(c *config) {
+		c.retryBackoffMS = 1
+		c.retryMaxBackoffMS = 5
+		c.whisperRetries = 2
+	})
+
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"text": "hello"}`))
+	}))
+	defer upstream.Close()
+
+	ctx := withWhisperURL(context.Background(), upstream.URL)
+	resp, err := transcribeWithWhisperOptions(ctx, "a.wav", strings.NewReader("audio"), whisperOptions{})
+	if err != nil {
+		t.Fatalf("transcribe: %v", err)
+	}
+	if resp.Text != "hello" {
+		t.Errorf("text = %q, want %q", resp.Text, "hello")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Whisper called %d times, want 2", n)
+	}
+}
+
+func TestWhisperOverloadExhaustsRetries(t *testing.T) {
+	setConfigForTest(t, func(c *config) {
+		c.retryBackoffMS = 1
+		c.retryMaxBackoffMS = 5
+		c.whisperRetries = 2
+	})
+
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "20")
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	ctx := withWhisperURL(context.Background(), upstream.URL)
+	_, err := transcribeWithWhisperOptions(ctx, "a.wav", strings.NewReader("audio"), whisperOptions{})
+	if n := calls.Load(); n != 3 {
+		t.Errorf("Whisper called %d times, want 3", n)
+	}
+	rec := httptest.NewRecorder()
+	if !writeUpstreamOverload(rec, err) {
+		t.Fatalf("writeUpstreamOverload didn't handle %v", err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "20" {
+		t.Errorf("got %d with Retry-After %q, want 503 with 20", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	setConfigForTest(t, func(c *config) {
+		c.retryBackoffMS = 100
+		c.retryMaxBackoffMS = 1000
+		c.retryJitter = 0.0
+	})
+	tests := []struct {
+		n          int
+		retryAfter string
+		want       int // milliseconds
+	}{
+		{0, "", 100},
+		{1, "", 200},
+		{3, "", 800},
+		{4, "", 1000},
+		{0, "1", 1000},
+		{0, "60", 1000},
+	}
+	for _, tt := range tests {
+		err := &upstreamError{Service: upstreamWhisper, StatusCode: http.StatusServiceUnavailable, RetryAfter: tt.retryAfter}
+		if got := retryDelay(tt.n, err).Milliseconds(); got != int64(tt.want) {
+			t.Errorf("retryDelay(%d) with Retry-After %q = %dms, want %dms", tt.n, tt.retryAfter, got, tt.want)
+		}
+	}
+}
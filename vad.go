@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// Length of the frames the voice activity detector classifies
+const vadFrameMs = 30
+
+// How far above the noise floor, and at most how far below the loudest
+// frame, speech must be
+const vadMarginDB = 10
+
+// Silence shorter than this is left in place, as cutting it saves little
+const vadMinRemovedSeconds = 1.0
+
+// speechRegion is a stretch of the upload that contains speech
+type speechRegion struct {
+	Start, End float64 // seconds
+}
+
+// speechMap maps times in audio stripped of silence back to the upload's
+type speechMap struct {
+	regions []speechRegion // in the upload's time, in order
+	removed float64        // seconds of silence cut
+}
+
+// uploadTime maps t seconds into the stripped audio to the upload's time,
+// to the millisecond
+func (m *speechMap) uploadTime(t float64) float64 {
+	offset := 0.0
+	for _, region := range m.regions {
+		length := region.End - region.Start
+		if t <= offset+length {
+			return math.Round((region.Start+t-offset)*1000) / 1000
+		}
+		offset += length
+	}
+	return m.regions[len(m.regions)-1].End
+}
+
+// restoreTimings shifts the segment and word times of a transcription of
+// stripped audio to the upload's
+func (m *speechMap) restoreTimings(segments []Segment) {
+	for i := range segments {
+		segment := &segments[i]
+		if !segment.timed() {
+			continue
+		}
+		segment.Start, segment.End = m.uploadTime(segment.Start), m.uploadTime(segment.End)
+		for j := range segment.Words {
+			segment.Words[j].Start = m.uploadTime(segment.Words[j].Start)
+			segment.Words[j].End = m.uploadTime(segment.Words[j].End)
+		}
+	}
+}
+
+// stripSilence runs voice activity detection on the WAV file at path and
+// writes its speech regions to a new WAV file, whose path is returned
+// with the map back to the upload's time. Audio without speech is
+// rejected with 422. Files it can't decode, and files with little silence
+// to cut, are left alone: the path is returned unchanged with a nil map.
+func stripSilence(path string) (string, *speechMap, error) {
+	if !cfg().vadEnabled {
+		return path, nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	info, err := readWAVHeader(file)
+	if err != nil {
+		return path, nil, nil
+	}
+	decode, err := info.sampleDecoder()
+	if err != nil || info.SampleRate == 0 || info.Channels == 0 {
+		return path, nil, nil
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+
+	frameSize := int64(info.Channels * info.BitsPerSample / 8)
+	frames := min(info.DataSize, stat.Size()-info.DataOffset) / frameSize
+	duration := float64(frames) / float64(info.SampleRate)
+	levels := frameLevels(io.NewSectionReader(file, info.DataOffset, frames*frameSize), info, decode)
+	regions := speechRegions(levels, duration)
+	if len(regions) == 0 {
+		return "", nil, newHTTPError(http.StatusUnprocessableEntity,
+			"no speech detected: no part of the audio stays above %g dBFS for %d ms (VAD_THRESHOLD_DBFS, VAD_MIN_SPEECH_MS)", cfg().vadThreshold, cfg().vadMinSpeechMs)
+	}
+
+	speech := &speechMap{regions: regions, removed: duration}
+	for _, region := range regions {
+		speech.removed -= region.End - region.Start
+	}
+	if speech.removed < vadMinRemovedSeconds {
+		return path, nil, nil
+	}
+
+	// Copy the regions, whole frames each
+	out, err := os.CreateTemp("", "speech-*.wav")
+	if err != nil {
+		return "", nil, err
+	}
+	var spans [][2]int64
+	var size int64
+	for _, region := range regions {
+		first := int64(region.Start * float64(info.SampleRate))
+		last := min(int64(math.Ceil(region.End*float64(info.SampleRate))), frames)
+		spans = append(spans, [2]int64{first, last})
+		size += (last - first) * frameSize
+	}
+	w := bufio.NewWriter(out)
+	w.Write(wavHeader(info.Format, info.Channels, info.SampleRate, info.BitsPerSample, size))
+	for _, span := range spans {
+		if _, err = io.Copy(w, io.NewSectionReader(file, info.DataOffset+span[0]*frameSize, (span[1]-span[0])*frameSize)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", nil, fmt.Errorf("failed to write speech: %w", err)
+	}
+	return out.Name(), speech, nil
+}
+
+// frameLevels returns the RMS level in dBFS of each vadFrameMs frame of
+// the samples read from r, over all channels
+func frameLevels(r io.Reader, info *wavInfo, decode func([]byte) float64) []float64 {
+	sampleSize := info.BitsPerSample / 8
+	samplesPerFrame := info.SampleRate * vadFrameMs / 1000 * info.Channels
+	reader := bufio.NewReader(r)
+	sample := make([]byte, sampleSize)
+	var levels []float64
+	for done := false; !done; {
+		var sumSquares float64
+		count := 0
+		for ; count < samplesPerFrame; count++ {
+			if _, err := io.ReadFull(reader, sample); err != nil {
+				done = true
+				break
+			}
+			v := decode(sample)
+			sumSquares += v * v
+		}
+		if count > 0 {
+			levels = append(levels, 20*math.Log10(math.Sqrt(sumSquares/float64(count))))
+		}
+	}
+	return levels
+}
+
+// speechRegions classifies frames as speech and returns the padded
+// regions of at least VAD_MIN_SPEECH_MS. A frame is speech when it is
+// above VAD_THRESHOLD_DBFS and clearly above the noise floor, taken as the
+// 10th percentile of the levels; the margin shrinks for audio that barely
+// varies, which has no quiet frames to measure the floor by.
+func speechRegions(levels []float64, duration float64) []speechRegion {
+	if len(levels) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(levels)
+	slices.Sort(sorted)
+	floor, peak := sorted[len(sorted)/10], sorted[len(sorted)-1]
+	threshold := max(cfg().vadThreshold, min(floor+vadMarginDB, peak-vadMarginDB))
+
+	frame := float64(vadFrameMs) / 1000
+	minSpeech := float64(cfg().vadMinSpeechMs) / 1000
+	padding := float64(cfg().vadPaddingMs) / 1000
+	var regions []speechRegion
+	add := func(start, end int) {
+		if float64(end-start)*frame < minSpeech {
+			return
+		}
+		region := speechRegion{Start: max(0, float64(start)*frame-padding), End: min(duration, float64(end)*frame+padding)}
+		if n := len(regions); n > 0 && region.Start <= regions[n-1].End {
+			regions[n-1].End = region.End
+			return
+		}
+		regions = append(regions, region)
+	}
+	start := -1
+	for i, level := range levels {
+		switch {
+		case level >= threshold && start < 0:
+			start = i
+		case level < threshold && start >= 0:
+			add(start, i)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		add(start, len(levels))
+	}
+	return regions
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Endpoint hot-folder results are recorded for, and the caller they are
+// recorded under
+const resultEndpointWatch = "watch"
+
+// Values of WATCH_OUTPUTS
+const (
+	watchOutputJSON = "json"
+	watchOutputText = "txt"
+	watchOutputSRT  = "srt"
+	watchOutputVTT  = "vtt"
+)
+
+// Extension of the file written in place of the outputs when a file fails
+const watchErrorExt = ".error.txt"
+
+// /process fields WATCH_PARAMS can't set: the outputs are chosen by
+// WATCH_OUTPUTS and the audio is the watched file
+var watchParamsUnsupported = []string{"audio_url", "stream", "raw_stream", "response_format", "download", "session_id", "text", "async"}
+
+// watchFile is a file seen in a watched directory
+type watchFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// folderWatcher processes the audio files dropped in WATCH_DIRS, one at a
+// time. A file is processed once it has kept its size and modification
+// time for a whole interval, so files still being copied are left alone.
+// It counts as done once its first output, or its error file, exists,
+// which also keeps it done across restarts.
+type folderWatcher struct {
+	dirs      []string
+	outputDir string
+	interval  time.Duration
+	seen      map[string]watchFile
+}
+
+func newFolderWatcher() *folderWatcher {
+	return &folderWatcher{
+		dirs:      splitList(cfg().watchDirs),
+		outputDir: cfg().watchOutputDir,
+		interval:  time.Duration(cfg().watchInterval) * time.Second,
+		seen:      make(map[string]watchFile),
+	}
+}
+
+// run scans the directories every interval until ctx is done
+func (fw *folderWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(fw.interval)
+	defer ticker.Stop()
+	for {
+		fw.scan(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan processes the files that haven't changed since the last scan
+func (fw *folderWatcher) scan(ctx context.Context) {
+	seen := make(map[string]watchFile, len(fw.seen))
+	for _, dir := range fw.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.Printf("Failed to read watched directory %s: %v", dir, err)
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || !isAudioFilename(name) {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if fw.done(path) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			file := watchFile{size: info.Size(), modTime: info.ModTime()}
+			seen[path] = file
+			if last, ok := fw.seen[path]; !ok || last != file {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			fw.process(ctx, path)
+			delete(seen, path)
+		}
+	}
+	fw.seen = seen
+}
+
+// done reports whether the file at path was processed, or failed
+func (fw *folderWatcher) done(path string) bool {
+	for _, output := range []string{fw.outputPath(path, "."+cfg().watchOutputs()[0]), fw.outputPath(path, watchErrorExt)} {
+		if _, err := os.Stat(output); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// outputPath returns the path of the output of the file at path with the
+// extension ext, next to the file or in WATCH_OUTPUT_DIR
+func (fw *folderWatcher) outputPath(path, ext string) string {
+	dir := filepath.Dir(path)
+	if fw.outputDir != "" {
+		dir = fw.outputDir
+	}
+	base := filepath.Base(path)
+	return filepath.Join(dir, strings.TrimSuffix(base, filepath.Ext(base))+ext)
+}
+
+// process runs the pipeline on the file at path with WATCH_PARAMS and
+// writes its outputs, or an error file when it fails. A file cut off by
+// shutdown is left to be processed again.
+func (fw *folderWatcher) process(ctx context.Context, path string) {
+	id := newRequestID()
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, requestIDKey, id), time.Duration(cfg().jobTimeout)*time.Second)
+	defer cancel()
+
+	log.Printf("Processing watched file %s request_id=%s", path, id)
+	started := time.Now()
+	result, err := processWatchedFile(ctx, id, path)
+	if err == nil {
+		err = fw.writeOutputs(path, result)
+	}
+	if err != nil {
+		if errors.Is(context.Cause(ctx), context.Canceled) {
+			return
+		}
+		watchFiles.add(1, "failed")
+		log.Printf("Watched file %s failed: %v request_id=%s", path, err, id)
+		if err := writeFileAtomic(fw.outputPath(path, watchErrorExt), []byte(err.Error()+"\n")); err != nil {
+			log.Printf("Failed to write the error file of %s: %v request_id=%s", path, err, id)
+		}
+		return
+	}
+	watchFiles.add(1, "ok")
+	log.Printf("Processed watched file %s in %s request_id=%s", path, time.Since(started).Round(time.Millisecond), id)
+}
+
+// processWatchedFile runs the pipeline on the file at path with the
+// WATCH_PARAMS fields
+func processWatchedFile(ctx context.Context, id, path string) (*pipelineResult, error) {
+	params, err := url.ParseQuery(cfg().watchParams)
+	if err != nil {
+		return nil, fmt.Errorf("WATCH_PARAMS: %w", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	input, err := readUpload(ctx, params, filepath.Base(path), file)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Audio.Close()
+	input.Caller = resultEndpointWatch
+	return processUpload(ctx, resultEndpointWatch, id, input, nil)
+}
+
+// readUpload reads audio as a /process upload named filename with the
+// fields in params, so it gets the same defaults and checks. Without
+// audio the form has only the fields, for audio_url and llm_only requests.
+func readUpload(ctx context.Context, params url.Values, filename string, audio io.Reader) (*processInput, error) {
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		err := writeUploadForm(form, params, filename, audio)
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/process", body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	input, err := readProcessInput(r)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	// The form may be read only up to the audio, so closing the audio
+	// closes the pipe too, which ends the goroutine
+	input.Audio = uploadAudio{ReadCloser: input.Audio, body: body}
+	return input, nil
+}
+
+// uploadAudio is the audio of an upload read by readUpload
+type uploadAudio struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (a uploadAudio) Close() error {
+	a.body.Close()
+	return a.ReadCloser.Close()
+}
+
+// writeUploadForm writes the fields in params and the audio, if any, as a
+// multipart form
+func writeUploadForm(form *multipart.Writer, params url.Values, filename string, audio io.Reader) error {
+	for key, values := range params {
+		for _, value := range values {
+			if err := form.WriteField(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	if audio == nil {
+		return nil
+	}
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, audio)
+	return err
+}
+
+// writeOutputs writes the WATCH_OUTPUTS of the file at path. The first
+// output, which marks the file as done, is written last.
+func (fw *folderWatcher) writeOutputs(path string, result *pipelineResult) error {
+	outputs := cfg().watchOutputs()
+	for i := len(outputs) - 1; i >= 0; i-- {
+		var data []byte
+		switch outputs[i] {
+		case watchOutputJSON:
+			var err error
+			if data, err = json.MarshalIndent(result.Response, "", "  "); err != nil {
+				return err
+			}
+			data = append(data, '\n')
+		case watchOutputText:
+			text := result.Response.Response
+			if result.Response.LLMSkipped {
+				text = result.Response.Transcription
+			}
+			data = []byte(strings.TrimSpace(text) + "\n")
+		case watchOutputSRT:
+			data = []byte(formatSRT(subtitleCues(result.WhisperResp.Segments)))
+		case watchOutputVTT:
+			data = []byte(formatVTT(subtitleCues(result.WhisperResp.Segments)))
+		}
+		if err := writeFileAtomic(fw.outputPath(path, "."+outputs[i]), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it
+// into place, so a half-written output is never seen
+func writeFileAtomic(path string, data []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Chmod(0o644)
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+// watchOutputs returns the outputs in WATCH_OUTPUTS
+func (c *config) watchOutputs() []string {
+	outputs := splitList(strings.ToLower(c.watchOutputFormats))
+	if len(outputs) == 0 {
+		return []string{watchOutputJSON}
+	}
+	return outputs
+}
+
+// checkWatchConfig reports what is wrong with the WATCH_ settings
+func (c *config) checkWatchConfig() error {
+	for _, output := range c.watchOutputs() {
+		switch output {
+		case watchOutputJSON, watchOutputText, watchOutputSRT, watchOutputVTT:
+		default:
+			return fmt.Errorf("WATCH_OUTPUTS must list json, txt, srt or vtt, got %q", output)
+		}
+	}
+	params, err := url.ParseQuery(c.watchParams)
+	if err != nil {
+		return fmt.Errorf("WATCH_PARAMS: %w", err)
+	}
+	for key := range params {
+		if slices.Contains(watchParamsUnsupported, key) || key == "mode" && params.Get(key) == modeLLMOnly {
+			return fmt.Errorf("WATCH_PARAMS can't set %s", key)
+		}
+	}
+	for _, dir := range splitList(c.watchDirs) {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("WATCH_DIRS: %s isn't a directory", dir)
+		}
+	}
+	if info, err := os.Stat(c.watchOutputDir); c.watchOutputDir != "" && (err != nil || !info.IsDir()) {
+		return fmt.Errorf("WATCH_OUTPUT_DIR: %s isn't a directory", c.watchOutputDir)
+	}
+	if c.watchDirs != "" && c.watchInterval < 1 {
+		return fmt.Errorf("WATCH_INTERVAL must be at least 1 second, got %d", c.watchInterval)
+	}
+	return nil
+}
+
+// isAudioFilename reports whether name has the extension of an audio
+// format the bridge knows
+func isAudioFilename(name string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	return slices.Contains(knownAudioFormats, ext) || ext == "opus" || ext == "mp4"
+}
+
+// splitList splits a comma-separated setting, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
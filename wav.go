@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// WAV format codes
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// Largest fmt chunk accepted. WAVE_FORMAT_EXTENSIBLE, the longest
+// standard layout, takes 40 bytes; the size comes from the upload, so it
+// is bounded before anything is allocated for it.
+const maxFmtChunkSize = 64
+
+var errNotWAV = errors.New("not a WAV file")
+
+// wavInfo describes the PCM stream of a WAV file
+type wavInfo struct {
+	Format        uint16
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	DataOffset    int64
+	DataSize      int64
+}
+
+// readWAVHeader parses the RIFF header of r up to the start of the data
+// chunk. It returns errNotWAV when r isn't a RIFF/WAVE stream.
+func readWAVHeader(r io.ReadSeeker) (*wavInfo, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, errNotWAV
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errNotWAV
+	}
+
+	info := &wavInfo{}
+	haveFmt := false
+	offset := int64(12)
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("missing data chunk: %w", err)
+		}
+		id := string(hdr[0:4])
+		size := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		offset += 8
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, fmt.Errorf("fmt chunk too short")
+			}
+			if size > maxFmtChunkSize {
+				return nil, fmt.Errorf("fmt chunk of %d bytes is larger than %d", size, maxFmtChunkSize)
+			}
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, fmt.Errorf("failed to read fmt chunk: %w", err)
+			}
+			info.Format = binary.LittleEndian.Uint16(buf[0:2])
+			info.Channels = int(binary.LittleEndian.Uint16(buf[2:4]))
+			info.SampleRate = int(binary.LittleEndian.Uint32(buf[4:8]))
+			info.BitsPerSample = int(binary.LittleEndian.Uint16(buf[14:16]))
+			if info.Format == wavFormatExtensible && size >= 26 {
+				// The real format is the first two bytes of the sub-format GUID
+				info.Format = binary.LittleEndian.Uint16(buf[24:26])
+			}
+			haveFmt = true
+		case "data":
+			if !haveFmt {
+				return nil, fmt.Errorf("data chunk before fmt chunk")
+			}
+			info.DataOffset = offset
+			info.DataSize = size
+			return info, nil
+		default:
+			// Other chunks are skipped without reading them
+			if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return nil, fmt.Errorf("failed to skip %q chunk: %w", id, err)
+			}
+		}
+
+		// Chunks are padded to an even size
+		if size%2 == 1 {
+			if _, err := r.Seek(1, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			size++
+		}
+		offset += size
+	}
+}
+
+// monoWAVHeader builds a canonical 44-byte header for a mono WAV file
+// with dataSize bytes of samples
+func monoWAVHeader(format uint16, sampleRate, bitsPerSample int, dataSize int64) []byte {
+	return wavHeader(format, 1, sampleRate, bitsPerSample, dataSize)
+}
+
+// wavHeader builds a canonical 44-byte WAV header for dataSize bytes of
+// interleaved samples
+func wavHeader(format uint16, channels, sampleRate, bitsPerSample int, dataSize int64) []byte {
+	blockAlign := channels * bitsPerSample / 8
+	header := make([]byte, 44)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(36+dataSize))
+	copy(header[8:16], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], format)
+	binary.LittleEndian.PutUint16(header[22:24], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:28], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(header[32:34], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:36], uint16(bitsPerSample))
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], uint32(dataSize))
+	return header
+}
+
+// sampleDecoder returns a function decoding one sample to [-1, 1], or an
+// error for sample formats we don't handle.
+func (w *wavInfo) sampleDecoder() (func([]byte) float64, error) {
+	switch {
+	case w.Format == wavFormatPCM && w.BitsPerSample == 8:
+		return func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }, nil
+	case w.Format == wavFormatPCM && w.BitsPerSample == 16:
+		return func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / 32768 }, nil
+	case w.Format == wavFormatPCM && w.BitsPerSample == 24:
+		return func(b []byte) float64 {
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			return float64(v) / 8388608
+		}, nil
+	case w.Format == wavFormatPCM && w.BitsPerSample == 32:
+		return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / 2147483648 }, nil
+	case w.Format == wavFormatFloat && w.BitsPerSample == 32:
+		return func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }, nil
+	default:
+		return nil, fmt.Errorf("unsupported WAV sample format %d with %d bits", w.Format, w.BitsPerSample)
+	}
+}
+
+// wavLoudness computes the RMS level in dBFS over all samples of all
+// channels of the WAV file at path. A digitally silent file returns -Inf.
+func wavLoudness(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := readWAVHeader(file)
+	if err != nil {
+		return 0, err
+	}
+	decode, err := info.sampleDecoder()
+	if err != nil {
+		return 0, err
+	}
+
+	sampleSize := info.BitsPerSample / 8
+	reader := bufio.NewReader(io.LimitReader(file, info.DataSize))
+	sample := make([]byte, sampleSize)
+	var sumSquares float64
+	var count int64
+	for {
+		if _, err := io.ReadFull(reader, sample); err != nil {
+			break
+		}
+		v := decode(sample)
+		sumSquares += v * v
+		count++
+	}
+	if count == 0 {
+		return math.Inf(-1), nil
+	}
+
+	return 20 * math.Log10(math.Sqrt(sumSquares/float64(count))), nil
+}
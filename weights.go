@@ -0,0 +1,158 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// parseWeights parses a comma-separated list of name=weight pairs, e.g.
+// "llama3:70b=4,mixtral=3"
+func parseWeights(value string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, weight, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid entry %q (expected name=weight)", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(weight))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid weight %q for %q (expected a positive integer)", weight, name)
+		}
+		weights[name] = n
+	}
+	return weights, nil
+}
+
+// modelWeight returns the number of Ollama slots a generation with model
+// occupies. An exact match wins over a match on the model name without
+// its tag, so "llama3=2" covers every llama3 tag unless one is listed
+// explicitly. Unlisted models weigh 1.
+func modelWeight(model string) int {
+	if weight, ok := cfg().ollamaModelWeights[model]; ok {
+		return weight
+	}
+	if name, _, ok := strings.Cut(model, ":"); ok {
+		if weight, ok := cfg().ollamaModelWeights[name]; ok {
+			return weight
+		}
+	}
+	return 1
+}
+
+// weightedSemaphore limits the total weight of concurrent holders.
+// Waiters are served in FIFO order so a heavy request can't be starved by
+// a stream of light ones.
+type weightedSemaphore struct {
+	size    int
+	mu      sync.Mutex
+	cur     int
+	waiters list.List
+}
+
+type semaphoreWaiter struct {
+	n     int
+	ready chan struct{}
+}
+
+func newWeightedSemaphore(size int) *weightedSemaphore {
+	return &weightedSemaphore{size: size}
+}
+
+// clamp caps n at the semaphore size so an oversized weight waits for an
+// idle backend instead of blocking forever
+func (s *weightedSemaphore) clamp(n int) int {
+	return min(n, s.size)
+}
+
+// tryAcquire takes n units without blocking
+func (s *weightedSemaphore) tryAcquire(n int) bool {
+	n = s.clamp(n)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur+n <= s.size && s.waiters.Len() == 0 {
+		s.cur += n
+		return true
+	}
+	return false
+}
+
+// acquire takes n units, waiting until they are free or ctx is done
+func (s *weightedSemaphore) acquire(ctx context.Context, n int) error {
+	n = s.clamp(n)
+	s.mu.Lock()
+	if s.cur+n <= s.size && s.waiters.Len() == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(semaphoreWaiter{n: n, ready: ready})
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-ready:
+			// Acquired just as the context ended, hand the units back
+			s.cur -= n
+			s.notifyWaiters()
+		default:
+			isFront := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			// A heavy waiter at the front may have been holding up
+			// lighter ones behind it
+			if isFront && s.size > s.cur {
+				s.notifyWaiters()
+			}
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// release returns n units
+func (s *weightedSemaphore) release(n int) {
+	n = s.clamp(n)
+	s.mu.Lock()
+	s.cur -= n
+	s.notifyWaiters()
+	s.mu.Unlock()
+}
+
+// inUse returns the units currently taken
+func (s *weightedSemaphore) inUse() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+// notifyWaiters wakes waiters in order while their weight fits. Must be
+// called with s.mu held.
+func (s *weightedSemaphore) notifyWaiters() {
+	for {
+		next := s.waiters.Front()
+		if next == nil {
+			return
+		}
+		w := next.Value.(semaphoreWaiter)
+		if s.cur+w.n > s.size {
+			return
+		}
+		s.cur += w.n
+		s.waiters.Remove(next)
+		close(w.ready)
+	}
+}
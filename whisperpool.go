@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// whisperPool spreads transcriptions over the WHISPER_URL servers. Each
+// transcription goes to a backend picked by WHISPER_ROUTING among those
+// that are up, and fails over to the others when the backend can't be
+// reached or answers with a 5xx. A backend that failed is skipped for
+// backendCooldown, or until the keepalive health check reaches it
+// again. With a single URL it only forwards to it.
+type whisperPool struct {
+	mu       sync.Mutex
+	urls     string // WHISPER_URL the backends were made from
+	backends []*poolBackend
+
+	next atomic.Uint64 // round-robin position
+}
+
+// Whisper backends of WHISPER_URL
+var whisperBackends = &whisperPool{}
+
+// list returns the backends of the current WHISPER_URL, keeping the state
+// of those that stayed in it after a reload
+func (p *whisperPool) list() []*poolBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	urls := cfg().whisperURL
+	if p.backends != nil && p.urls == urls {
+		return p.backends
+	}
+	var backends []*poolBackend
+	for _, url := range splitBackendURLs(urls) {
+		i := slices.IndexFunc(p.backends, func(b *poolBackend) bool { return b.url == url })
+		if i >= 0 {
+			backends = append(backends, p.backends[i])
+		} else {
+			backends = append(backends, &poolBackend{kind: "Whisper backend", url: url})
+		}
+	}
+	p.urls, p.backends = urls, backends
+	return backends
+}
+
+// order returns the backends to try, in order: those that are up, starting
+// with the one WHISPER_ROUTING picks, or every backend when none is up
+func (p *whisperPool) order() []*poolBackend {
+	all := p.list()
+	if len(all) < 2 {
+		return all
+	}
+	return routeBackends(all, &p.next, cfg().whisperRouting)
+}
+
+// transcribe sends the transcription to a backend, failing over to the
+// next one when it can't be reached or fails with a 5xx. Failing over
+// needs audio that can be read again; other audio gets one backend.
+func (p *whisperPool) transcribe(ctx context.Context, filename string, r io.Reader, opts whisperOptions) (*WhisperResponse, error) {
+	backends := p.order()
+	if len(backends) < 2 {
+		return cfg().transcriber.transcribe(ctx, filename, r, opts)
+	}
+	audio := replayableAudio(r)
+	var resp *WhisperResponse
+	var err error
+	for i, b := range backends {
+		if i > 0 {
+			if audio == nil || ctx.Err() != nil || !isUpstreamFailure(err) {
+				break
+			}
+			log.Printf("Failing over from Whisper backend %s to %s request_id=%s", backends[i-1].url, b.url, requestIDFromContext(ctx))
+			whisperFailovers.add(1)
+		}
+		input := r
+		if audio != nil {
+			input = audio()
+		}
+		b.inFlight.Add(1)
+		resp, err = cfg().transcriber.transcribe(withWhisperBackend(ctx, b.url), filename, input, opts)
+		b.inFlight.Add(-1)
+		switch {
+		case err == nil:
+			b.markUp()
+			return resp, nil
+		case isUpstreamFailure(err) && ctx.Err() == nil:
+			b.markDown(err)
+		}
+	}
+	return nil, err
+}
+
+// ping checks every backend, marking each up or down, and fails when none
+// answers
+func (p *whisperPool) ping(ctx context.Context) error {
+	backends := p.list()
+	if len(backends) < 2 {
+		return cfg().transcriber.ping(ctx)
+	}
+	errs := make([]error, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = cfg().transcriber.ping(withWhisperBackend(ctx, b.url)); errs[i] != nil {
+				b.markDown(errs[i])
+				errs[i] = fmt.Errorf("%s: %w", b.url, errs[i])
+			} else {
+				b.markUp()
+			}
+		}()
+	}
+	wg.Wait()
+	if slices.Contains(errs, nil) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// writeMetrics writes the state of each backend when there are several
+func (p *whisperPool) writeMetrics(w *bufio.Writer) {
+	backends := p.list()
+	if len(backends) < 2 {
+		return
+	}
+	writeMetricHeader(w, "bridge_whisper_backend_up", "gauge", "Whether a WHISPER_URL backend is routed to (1) or skipped after failing (0)")
+	for _, b := range backends {
+		up := 0.0
+		if b.available() {
+			up = 1
+		}
+		writeSample(w, "bridge_whisper_backend_up", []string{"backend"}, []string{b.url}, "", "", up)
+	}
+	writeMetricHeader(w, "bridge_whisper_backend_in_flight", "gauge", "Transcriptions being sent to each WHISPER_URL backend")
+	for _, b := range backends {
+		writeSample(w, "bridge_whisper_backend_in_flight", []string{"backend"}, []string{b.url}, "", "", float64(b.inFlight.Load()))
+	}
+}
+
+// withWhisperBackend stores the backend URL a transcription goes to in ctx
+func withWhisperBackend(ctx context.Context, url string) context.Context {
+	return context.WithValue(ctx, whisperBackendKey, url)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Largest single WebSocket message and the most compressed audio a
+// session may buffer
+const (
+	wsMaxMessageBytes = 1 << 20
+	wsMaxBufferBytes  = 64 << 20
+)
+
+// Seconds allowed for writing one event to the socket
+const wsWriteTimeout = 10 * time.Second
+
+// Event types sent only on /ws/stream
+const (
+	liveEventPartial    = "partial"
+	liveEventTranscript = "transcript"
+	liveEventToken      = "token"
+	liveEventResponse   = "response"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: checkWSOrigin,
+}
+
+// wsControl is a text message sent by the client
+type wsControl struct {
+	Type string `json:"type"`
+}
+
+// wsStreamHandler runs a live transcription over a WebSocket. The client
+// sends audio as binary messages and a {"type":"end"} text message when
+// it is done; settings are passed in the query string because browsers
+// can't set headers on WebSocket requests:
+//
+//	format       pcm (default), webm or ogg
+//	sample_rate  sample rate of pcm audio, 16000 by default
+//	provider     LLM provider for the answer, LLM_PROVIDER by default
+//	model        model for the answer
+//	prompt       prompt placed before the transcription
+//
+// Raw 16-bit mono PCM is windowed like /live and each window's segments
+// are sent as soon as they are transcribed. Opus in a WebM or Ogg
+// container, as recorded by MediaRecorder, can't be cut at arbitrary
+// points, so the audio received so far is re-transcribed every
+// LIVE_WINDOW_SECONDS and sent as a partial event instead. Once the audio
+// ends the full transcript goes to the LLM and the answer is streamed back
+// as token events, followed by response and done.
+func wsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := strings.ToLower(query.Get("format"))
+	if format == "" {
+		format = "pcm"
+	}
+	if format != "pcm" && format != "webm" && format != "ogg" {
+		http.Error(w, "format must be pcm, webm or ogg", http.StatusBadRequest)
+		return
+	}
+	sampleRate, err := parseSampleRate(query.Get("sample_rate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	llm, err := lookupLLM(query.Get("provider"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	model, _, err := requestModel(r, llm, query.Get("model"))
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	prompt := query.Get("prompt")
+	if prompt == "" {
+		prompt = cfg().defaultPrompt
+	}
+
+	// A session holds one slot for its whole duration
+	release, err := admit(r, priorityNormal)
+	if err != nil {
+		http.Error(w, "Server is at capacity, please try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(withLLM(r.Context(), llm), time.Duration(cfg().liveMaxDuration)*time.Second)
+	defer cancel()
+
+	ctx, err = withURLOverrides(ctx, r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Upgrade writes its own error response
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(wsMaxMessageBytes)
+
+	// The connection is no longer tied to the request, so a client that
+	// goes away must cancel the session itself
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	audio := readWSAudio(ctx, cancel, conn)
+	defer audio.Close()
+
+	emit := func(event LiveEvent) bool {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteJSON(event) == nil
+	}
+	defer func() {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	}()
+
+	var result liveResult
+	if format == "pcm" {
+		result, err = transcribeLive(ctx, audio, sampleRate, emit)
+	} else {
+		result, err = transcribeWSContainer(ctx, audio, format, emit)
+	}
+	if err != nil {
+		if !errors.Is(err, errClientGone) {
+			emit(LiveEvent{Type: liveEventError, Start: result.end, Error: err.Error()})
+		}
+		return
+	}
+	if !emit(LiveEvent{Type: liveEventTranscript, Start: 0, End: result.end, Text: result.text}) {
+		return
+	}
+	if strings.TrimSpace(result.text) != "" {
+		if err := answerWS(ctx, model, prompt, result.text, emit); err != nil {
+			log.Printf("WebSocket LLM step failed: %v request_id=%s", err, requestIDFromContext(ctx))
+			if !emit(LiveEvent{Type: liveEventError, Start: result.end, Error: "Ollama processing failed: " + err.Error()}) {
+				return
+			}
+		}
+	}
+	emit(LiveEvent{Type: liveEventDone, Start: 0, End: result.end, Segments: result.segments})
+}
+
+// readWSAudio reads the client's messages in the background and returns
+// the audio as a stream, which ends at the client's end message. Reads
+// that go UPLOAD_IDLE_TIMEOUT seconds without a message abort the session.
+// Messages are still read after the end, to answer pings and notice a
+// disconnect, which cancels the session. Closing the returned reader
+// unblocks the background reader.
+func readWSAudio(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn) *io.PipeReader {
+	pr, pw := io.Pipe()
+	idle := time.Duration(cfg().uploadIdleTimeout) * time.Second
+
+	go func() {
+		finished := false
+		finish := func(err error) {
+			if !finished {
+				finished = true
+				pw.CloseWithError(err)
+			}
+		}
+		defer func() {
+			finish(errClientGone)
+			cancel()
+		}()
+
+		for {
+			if !finished && idle > 0 {
+				conn.SetReadDeadline(time.Now().Add(idle))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				if isTimeout(err) {
+					finish(errUploadStalled)
+				} else if ctx.Err() == nil && !finished {
+					log.Printf("WebSocket closed before the end of the audio: %v request_id=%s", err, requestIDFromContext(ctx))
+				}
+				return
+			}
+			if finished {
+				continue
+			}
+			switch kind {
+			case websocket.BinaryMessage:
+				// Blocks while the transcription is behind, which stops
+				// reading from the socket until it catches up
+				if _, err := pw.Write(data); err != nil {
+					finish(err)
+				}
+			case websocket.TextMessage:
+				var control wsControl
+				if err := json.Unmarshal(data, &control); err != nil || control.Type != "end" {
+					finish(errors.New(`unexpected text message, only {"type":"end"} is accepted`))
+					continue
+				}
+				finish(nil)
+			}
+		}
+	}()
+	return pr
+}
+
+// transcribeWSContainer buffers compressed audio and re-transcribes all
+// of it every LIVE_WINDOW_SECONDS while more keeps arriving, skipping a
+// round when nothing new came in. The final transcription of the whole
+// stream is returned once the audio ends.
+func transcribeWSContainer(ctx context.Context, audio io.Reader, format string, emit func(LiveEvent) bool) (liveResult, error) {
+	var (
+		mu      sync.Mutex
+		buffer  []byte
+		readErr = make(chan error, 1)
+	)
+	go func() {
+		chunk := make([]byte, 32*1024)
+		for {
+			n, err := audio.Read(chunk)
+			mu.Lock()
+			buffer = append(buffer, chunk[:n]...)
+			size := len(buffer)
+			mu.Unlock()
+			if err == io.EOF {
+				readErr <- nil
+				return
+			}
+			if err == nil && size > wsMaxBufferBytes {
+				err = errors.New("audio stream is too large")
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	transcribe := func() (string, error) {
+		mu.Lock()
+		snapshot := buffer
+		mu.Unlock()
+		resp, err := transcribeStreamWithWhisper(ctx, "live."+format, bytes.NewReader(snapshot))
+		if err != nil {
+			return "", err
+		}
+		if cfg().redactPIIEnabled {
+			redactWhisperResponse(resp)
+		}
+		return strings.TrimSpace(resp.Text), nil
+	}
+
+	ticker := time.NewTicker(time.Duration(cfg().liveWindowSeconds) * time.Second)
+	defer ticker.Stop()
+	transcribed := 0
+	for {
+		select {
+		case err := <-readErr:
+			if err != nil {
+				return liveResult{}, err
+			}
+			text, err := transcribe()
+			if err != nil {
+				return liveResult{}, err
+			}
+			return liveResult{text: text}, nil
+		case <-ticker.C:
+			mu.Lock()
+			size := len(buffer)
+			mu.Unlock()
+			if size == transcribed {
+				continue
+			}
+			transcribed = size
+			// An incomplete stream may not decode yet, later rounds and
+			// the final transcription will catch up
+			text, err := transcribe()
+			if err != nil {
+				log.Printf("Partial transcription failed: %v request_id=%s", err, requestIDFromContext(ctx))
+				continue
+			}
+			if text != "" && !emit(LiveEvent{Type: liveEventPartial, Text: text}) {
+				return liveResult{}, errClientGone
+			}
+		case <-ctx.Done():
+			return liveResult{}, ctx.Err()
+		}
+	}
+}
+
+// answerWS generates the LLM answer for a finished transcript, sending
+// each token as it arrives and the complete answer at the end
+func answerWS(ctx context.Context, model, prompt, transcription string, emit func(LiveEvent) bool) error {
+	if err := llmFromContext(ctx).allow(ctx); err != nil {
+		return err
+	}
+	var chunks int
+	text, err := summarizeLong(ctx, model, transcription, &chunks)
+	if err != nil {
+		return err
+	}
+	resp, err := generateWithLLM(ctx, model, buildPrompt(prompt, text), nil, func(token string) error {
+		if !emit(LiveEvent{Type: liveEventToken, Text: token}) {
+			return errClientGone
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	emit(LiveEvent{Type: liveEventResponse, Response: resp.Response, Model: resp.Model, DoneReason: resp.DoneReason})
+	return nil
+}
+
+// checkWSOrigin accepts clients without an Origin header, which aren't
+// browsers, origins listed in WS_ALLOWED_ORIGINS and the server's own
+// origin
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || cfg().wsAllowedOrigins["*"] || cfg().wsAllowedOrigins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}